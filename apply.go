@@ -0,0 +1,159 @@
+package mfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	gopath "path"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// ErrApplyConflict is returned by `Apply` when a change doesn't match the
+// tree (e.g., the entry it modifies isn't the one it was computed from),
+// or the tree changed while the changes were applied.
+var ErrApplyConflict = errors.New("changes conflict with the tree")
+
+// Apply replays the changes (as returned by `Diff`, in order) onto the
+// tree, in a single update: they're applied to a snapshot of the tree
+// which is swapped in once they all succeeded, so either all or none of
+// them are applied. Each change must match the tree: the entries removed,
+// modified or renamed must be the `Change.Before` ones and the paths
+// added to must be free, or it fails with `ErrApplyConflict`. The nodes
+// of the changes must be in the DAG service. As with `Root.Restore`, the
+// `FSNode`s loaded before stop updating the tree.
+func Apply(rt *Root, changes []Change) error {
+	return CtxApply(rt.GetDirectory().ctx, rt, changes)
+}
+
+// CtxApply is `Apply` with a context for the DAG operations.
+func CtxApply(ctx context.Context, rt *Root, changes []Change) error {
+	snap, err := rt.Snapshot()
+	if err != nil {
+		return err
+	}
+	scratch, err := snap.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer scratch.Close()
+
+	for _, c := range changes {
+		if err := applyChange(ctx, scratch, c); err != nil {
+			return pathError("apply", c.Path, err)
+		}
+	}
+
+	nd, err := scratch.GetDirectory().GetNode()
+	if err != nil {
+		return err
+	}
+	if nd.Cid().Equals(snap.Cid()) {
+		return nil
+	}
+	dir := rt.GetDirectory()
+	swapped, err := dir.swap(ctx, snap.Cid(), nd)
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		return fmt.Errorf("%w: the tree changed while applying", ErrApplyConflict)
+	}
+	if err := rt.updateChildEntry(child{dir.name, nd}); err != nil {
+		return err
+	}
+
+	if rt.watched() {
+		return treeEvents(ctx, dir.dagService, snap.Cid(), nd.Cid(), "/", rt.emit)
+	}
+	return nil
+}
+
+func applyChange(ctx context.Context, rt *Root, c Change) error {
+	switch c.Type {
+	case ChangeAdd:
+		if err := expectEntry(ctx, rt, c.Path, cid.Undef); err != nil {
+			return err
+		}
+		return putEntry(ctx, rt, c.Path, c.After)
+	case ChangeRemove:
+		if err := expectEntry(ctx, rt, c.Path, c.Before); err != nil {
+			return err
+		}
+		return removeEntry(ctx, rt, c.Path)
+	case ChangeModify:
+		if err := expectEntry(ctx, rt, c.Path, c.Before); err != nil {
+			return err
+		}
+		if err := removeEntry(ctx, rt, c.Path); err != nil {
+			return err
+		}
+		return putEntry(ctx, rt, c.Path, c.After)
+	case ChangeRename:
+		if err := expectEntry(ctx, rt, c.OldPath, c.Before); err != nil {
+			return err
+		}
+		if err := expectEntry(ctx, rt, c.Path, cid.Undef); err != nil {
+			return err
+		}
+		if err := CtxMkdir(ctx, rt, gopath.Dir(c.Path), MkdirOpts{Mkparents: true}); err != nil {
+			return err
+		}
+		if err := CtxMv(ctx, rt, c.OldPath, c.Path); err != nil {
+			return err
+		}
+		if c.After.Equals(c.Before) {
+			return nil
+		}
+		if err := removeEntry(ctx, rt, c.Path); err != nil {
+			return err
+		}
+		return putEntry(ctx, rt, c.Path, c.After)
+	default:
+		return fmt.Errorf("unknown change type %s", c.Type)
+	}
+}
+
+// expectEntry checks that the entry at 'pth' is the node 'c' (or that
+// there's none if undefined).
+func expectEntry(ctx context.Context, rt *Root, pth string, c cid.Cid) error {
+	var cur cid.Cid
+	fsn, err := dirLookup(ctx, rt.GetDirectory(), pth)
+	switch {
+	case err == nil:
+		nd, err := fsn.GetNode()
+		if err != nil {
+			return err
+		}
+		cur = nd.Cid()
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	switch {
+	case cur.Equals(c):
+		return nil
+	case !c.Defined():
+		return fmt.Errorf("%w: %s already exists", ErrApplyConflict, pth)
+	case !cur.Defined():
+		return fmt.Errorf("%w: %s doesn't exist", ErrApplyConflict, pth)
+	default:
+		return fmt.Errorf("%w: %s is %s, expected %s", ErrApplyConflict, pth, cur, c)
+	}
+}
+
+func putEntry(ctx context.Context, rt *Root, pth string, c cid.Cid) error {
+	if err := CtxMkdir(ctx, rt, gopath.Dir(pth), MkdirOpts{Mkparents: true}); err != nil {
+		return err
+	}
+	return CtxPutDAG(ctx, rt, pth, c)
+}
+
+func removeEntry(ctx context.Context, rt *Root, pth string) error {
+	pdir, name, err := lookupParent(rt, pth)
+	if err != nil {
+		return err
+	}
+	return pdir.CtxUnlink(ctx, name)
+}
@@ -0,0 +1,435 @@
+package mfs
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	gopath "path"
+
+	dag "github.com/ipfs/go-merkledag"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// ErrInvalidCAR is returned by `ImportCAR` when the CAR file is malformed
+// or not supported.
+var ErrInvalidCAR = errors.New("invalid CAR file")
+
+// maxCARSection bounds the size of the sections of an imported CAR file.
+const maxCARSection = 8 << 20
+
+// ExportCAR flushes the entry at 'pth' and writes its whole DAG to 'w' as
+// a CARv1 file (https://ipld.io/specs/transport/car/carv1/) with the
+// entry as only root, each block once in depth-first order. This is a
+// one-call backup of (a part of) the MFS, see `ImportCAR` to restore it.
+func ExportCAR(ctx context.Context, rt *Root, pth string, w io.Writer) (err error) {
+	defer func() { err = pathError("export", pth, err) }()
+
+	fsn, err := dirLookup(ctx, rt.GetDirectory(), pth)
+	if err != nil {
+		return err
+	}
+	if err := fsn.Flush(); err != nil {
+		return err
+	}
+	nd, err := fsn.GetNode()
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := writeCARHeader(bw, nd.Cid()); err != nil {
+		return err
+	}
+	err = exportBlocks(ctx, rt.GetDirectory().dagService, nd, cid.NewSet(), rt.unsupported, bw)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func exportBlocks(ctx context.Context, dserv ipld.DAGService, nd ipld.Node, seen *cid.Set, policy UnsupportedPolicy, w io.Writer) error {
+	if !seen.Visit(nd.Cid()) {
+		return nil
+	}
+	if err := checkSupported(nd); err != nil && policy != UnsupportedOpaque {
+		// Even with `UnsupportedStrip`: skipping the block would leave
+		// its parent linking to a block missing from the CAR file.
+		return fmt.Errorf("%s: %w", nd.Cid(), err)
+	}
+	if err := writeCARBlock(w, nd.Cid(), nd.RawData()); err != nil {
+		return err
+	}
+	for _, l := range nd.Links() {
+		if seen.Has(l.Cid) {
+			continue
+		}
+		child, err := l.GetNode(ctx, dserv)
+		if err != nil {
+			return err
+		}
+		if err := exportBlocks(ctx, dserv, child, seen, policy, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCARHeader writes the header of a CARv1 file with the single root
+// 'root': the DAG-CBOR map `{"roots": [root], "version": 1}` (encoded by
+// hand, with the keys in canonical order), prefixed by its length.
+func writeCARHeader(w io.Writer, root cid.Cid) error {
+	c := append([]byte{0}, root.Bytes()...) // multibase identity prefix
+
+	var hdr []byte
+	hdr = append(hdr, 0xa2) // map of 2 entries
+	hdr = appendCBORHead(hdr, 3, uint64(len("roots")))
+	hdr = append(hdr, "roots"...)
+	hdr = append(hdr, 0x81)       // array of 1 entry
+	hdr = append(hdr, 0xd8, 0x2a) // tag 42 (CID)
+	hdr = appendCBORHead(hdr, 2, uint64(len(c)))
+	hdr = append(hdr, c...)
+	hdr = appendCBORHead(hdr, 3, uint64(len("version")))
+	hdr = append(hdr, "version"...)
+	hdr = append(hdr, 0x01)
+
+	return writeCARSection(w, hdr)
+}
+
+// appendCBORHead appends the head of a CBOR item of major type 'major'
+// with the argument 'n'.
+func appendCBORHead(b []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= 0xff:
+		return append(b, major|24, byte(n))
+	case n <= 0xffff:
+		return append(b, major|25, byte(n>>8), byte(n))
+	case n <= 0xffffffff:
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], uint32(n))
+		return append(append(b, major|26), buf[:]...)
+	default:
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], n)
+		return append(append(b, major|27), buf[:]...)
+	}
+}
+
+func writeCARBlock(w io.Writer, c cid.Cid, data []byte) error {
+	return writeCARSection(w, c.Bytes(), data)
+}
+
+// writeCARSection writes the parts of a section prefixed by their total
+// length as a varint.
+func writeCARSection(w io.Writer, parts ...[]byte) error {
+	var size int
+	for _, p := range parts {
+		size += len(p)
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(size))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportCAR adds the blocks of the CARv1 file read from 'r' to the DAG
+// service and links its root (the file must have a single one) at 'pth',
+// like `PutDAG`. Only DAG-PB and raw blocks are supported, and each is
+// checked against its CID.
+func ImportCAR(ctx context.Context, rt *Root, pth string, r io.Reader) (err error) {
+	root, err := importCAR(ctx, rt.GetDirectory().dagService, bufio.NewReader(r))
+	if err != nil {
+		return pathError("import", pth, err)
+	}
+	return CtxPutDAG(ctx, rt, pth, root)
+}
+
+func importCAR(ctx context.Context, dserv ipld.DAGService, r *bufio.Reader) (cid.Cid, error) {
+	hdr, err := readCARSection(r)
+	if err != nil {
+		return cid.Undef, err
+	}
+	roots, err := parseCARHeader(hdr)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("%w: %s", ErrInvalidCAR, err)
+	}
+	if len(roots) != 1 {
+		return cid.Undef, fmt.Errorf("%w: %d roots, expected 1", ErrInvalidCAR, len(roots))
+	}
+
+	batch := ipld.NewBatch(ctx, dserv)
+	for {
+		section, err := readCARSection(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return cid.Undef, err
+		}
+		nd, err := decodeCARBlock(section)
+		if err != nil {
+			return cid.Undef, fmt.Errorf("%w: %s", ErrInvalidCAR, err)
+		}
+		if err := batch.Add(ctx, nd); err != nil {
+			return cid.Undef, err
+		}
+	}
+	if err := batch.Commit(); err != nil {
+		return cid.Undef, err
+	}
+	return roots[0], nil
+}
+
+// readCARSection reads a section prefixed by its length, returning
+// `io.EOF` at the end of the file.
+func readCARSection(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCAR, err)
+	}
+	if size > maxCARSection {
+		return nil, fmt.Errorf("%w: section of %d bytes", ErrInvalidCAR, size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCAR, err)
+	}
+	return buf, nil
+}
+
+// decodeCARBlock decodes the block of a section, checking it against its
+// CID.
+func decodeCARBlock(section []byte) (ipld.Node, error) {
+	n, c, err := cid.CidFromBytes(section)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBlock(c, section[n:])
+}
+
+// decodeBlock decodes the block 'c' of 'data', checking it against its
+// CID.
+func decodeBlock(c cid.Cid, data []byte) (ipld.Node, error) {
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !sum.Equals(c) {
+		return nil, fmt.Errorf("block %s doesn't match its data", c)
+	}
+
+	switch c.Type() {
+	case cid.Raw:
+		return dag.NewRawNodeWPrefix(data, c.Prefix())
+	case cid.DagProtobuf:
+		nd, err := dag.DecodeProtobuf(data)
+		if err != nil {
+			return nil, err
+		}
+		nd.SetCidBuilder(c.Prefix())
+		if !nd.Cid().Equals(c) {
+			return nil, fmt.Errorf("block %s isn't canonical DAG-PB", c)
+		}
+		return nd, nil
+	default:
+		return nil, fmt.Errorf("block %s has an unsupported codec", c)
+	}
+}
+
+// parseCARHeader returns the roots of a CARv1 header.
+func parseCARHeader(hdr []byte) ([]cid.Cid, error) {
+	d := &cborDecoder{buf: hdr}
+	major, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if major != 5 {
+		return nil, fmt.Errorf("header isn't a map")
+	}
+
+	var roots []cid.Cid
+	var version uint64
+	for i := uint64(0); i < n; i++ {
+		key, err := d.text()
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "version":
+			major, version, err = d.head()
+			if err == nil && major != 0 {
+				err = fmt.Errorf("version isn't an integer")
+			}
+		case "roots":
+			roots, err = d.cids()
+		default:
+			err = d.skip()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if version != 1 {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+	return roots, nil
+}
+
+// cborDecoder decodes the subset of DAG-CBOR used by CAR headers.
+type cborDecoder struct {
+	buf []byte
+}
+
+// head returns the major type and argument of the next item.
+func (d *cborDecoder) head() (byte, uint64, error) {
+	if len(d.buf) == 0 {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	major, info := d.buf[0]>>5, d.buf[0]&0x1f
+	d.buf = d.buf[1:]
+
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info <= 27:
+		size = 1 << (info - 24)
+	default:
+		return 0, 0, fmt.Errorf("unsupported CBOR item")
+	}
+	if len(d.buf) < size {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	var n uint64
+	for _, b := range d.buf[:size] {
+		n = n<<8 | uint64(b)
+	}
+	d.buf = d.buf[size:]
+	return major, n, nil
+}
+
+// bytes returns the contents of a byte or text string of length 'n'.
+func (d *cborDecoder) bytes(n uint64) ([]byte, error) {
+	if uint64(len(d.buf)) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b, nil
+}
+
+func (d *cborDecoder) text() (string, error) {
+	major, n, err := d.head()
+	if err != nil {
+		return "", err
+	}
+	if major != 3 {
+		return "", fmt.Errorf("expected a string")
+	}
+	b, err := d.bytes(n)
+	return string(b), err
+}
+
+// cids decodes an array of CIDs (tag 42 over the CID bytes prefixed by
+// a zero byte).
+func (d *cborDecoder) cids() ([]cid.Cid, error) {
+	major, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if major != 4 {
+		return nil, fmt.Errorf("expected an array")
+	}
+	var out []cid.Cid
+	for i := uint64(0); i < n; i++ {
+		major, tag, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if major != 6 || tag != 42 {
+			return nil, fmt.Errorf("expected a CID")
+		}
+		major, size, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if major != 2 {
+			return nil, fmt.Errorf("expected a CID")
+		}
+		b, err := d.bytes(size)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) == 0 || b[0] != 0 {
+			return nil, fmt.Errorf("invalid CID")
+		}
+		c, err := cid.Cast(b[1:])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// skip skips the next item.
+func (d *cborDecoder) skip() error {
+	major, n, err := d.head()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case 2, 3:
+		_, err = d.bytes(n)
+		return err
+	case 4:
+		for i := uint64(0); i < n; i++ {
+			if err := d.skip(); err != nil {
+				return err
+			}
+		}
+	case 5:
+		for i := uint64(0); i < 2*n; i++ {
+			if err := d.skip(); err != nil {
+				return err
+			}
+		}
+	case 6:
+		return d.skip()
+	}
+	return nil
+}
+
+// PutDAG links the DAG rooted at 'c', already in the DAG service, at
+// 'pth' (like `PutNode`).
+func PutDAG(rt *Root, pth string, c cid.Cid) error {
+	return CtxPutDAG(rt.GetDirectory().ctx, rt, pth, c)
+}
+
+// CtxPutDAG is `PutDAG` with a context for the DAG operations.
+func CtxPutDAG(ctx context.Context, rt *Root, pth string, c cid.Cid) (err error) {
+	defer rt.recoverPanic(&err)
+
+	nd, err := rt.GetDirectory().dagService.Get(ctx, c)
+	if err != nil {
+		return pathError("put", pth, err)
+	}
+	return CtxPutNode(ctx, rt, gopath.Clean("/"+pth), nd)
+}
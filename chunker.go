@@ -0,0 +1,34 @@
+package mfs
+
+import (
+	"bytes"
+	"io"
+
+	chunker "github.com/ipfs/go-ipfs-chunker"
+)
+
+// splitterGen returns the generator of the splitters described by 'spec'
+// (like "size-262144" or "rabin-16-32-64", see `chunker.FromString`), the
+// default one if empty.
+func splitterGen(spec string) (chunker.SplitterGen, error) {
+	if spec == "" {
+		return chunker.DefaultSplitter, nil
+	}
+	if _, err := chunker.FromString(bytes.NewReader(nil), spec); err != nil {
+		return nil, err
+	}
+	return func(r io.Reader) chunker.Splitter {
+		// Can't fail, the spec was validated above.
+		s, _ := chunker.FromString(r, spec)
+		return s
+	}, nil
+}
+
+// chunkerOf returns the chunker spec of the root of 'p' (empty for the
+// default one, or if 'p' isn't in a `Root`).
+func chunkerOf(p parent) string {
+	if r := rootOf(p); r != nil {
+		return r.chunker
+	}
+	return ""
+}
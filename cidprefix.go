@@ -0,0 +1,38 @@
+package mfs
+
+import (
+	"fmt"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// rootCidPrefix returns the CID prefix of the nodes created by the root,
+// the one of its node with the configured version and hash function
+// (nil if neither is).
+func rootCidPrefix(o *rootOptions, node cid.Cid) (*cid.Prefix, error) {
+	if !o.cidVersionSet && !o.hashFuncSet {
+		return nil, nil
+	}
+	prefix := node.Prefix()
+	if o.cidVersionSet {
+		prefix.Version = o.cidVersion
+	}
+	if o.hashFuncSet {
+		prefix.MhType = o.hashFunc
+		prefix.MhLength = -1
+	}
+	if _, err := prefix.Sum(nil); err != nil {
+		return nil, fmt.Errorf("invalid CID version or hash function: %w", err)
+	}
+	return &prefix, nil
+}
+
+// newCidBuilder returns the CID builder of the nodes created under the
+// directory: the one of the root (see `WithCidVersion`) if configured,
+// its own otherwise.
+func (d *Directory) newCidBuilder() cid.Builder {
+	if r := rootOf(d.parent); r != nil && r.cidPrefix != nil {
+		return *r.cidPrefix
+	}
+	return d.GetCidBuilder()
+}
@@ -0,0 +1,188 @@
+package mfs
+
+import (
+	"context"
+	"fmt"
+
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// CompactReport describes the blocks making up the structure of a
+// directory (its node, or its HAMT shards, not the contents of its
+// entries) before and after compacting it.
+type CompactReport struct {
+	Entries int
+	Sharded bool // whether the compacted directory is a HAMT
+
+	Blocks        int
+	Bytes         uint64
+	CompactBlocks int
+	CompactBytes  uint64
+}
+
+// CompactEstimate reports what `Compact` would do, without modifying
+// the directory nor storing the compacted version.
+func (d *Directory) CompactEstimate(ctx context.Context) (_ CompactReport, err error) {
+	defer rootOf(d.parent).recoverPanic(&err)
+
+	snapshot, err := d.snapshot()
+	if err != nil {
+		return CompactReport{}, err
+	}
+
+	report, _, err := d.compact(ctx, snapshot, newOverlayDAG(d.dagService))
+	return report, err
+}
+
+// Compact rewrites the directory in its optimal representation: a basic
+// directory if its entries fit under the go-unixfs sharding threshold
+// (`uio.HAMTShardingSize`), or a freshly built HAMT otherwise (after mass
+// deletions the existing shards may be left sparse and deep). It fails
+// if the directory is modified while the new version is being built.
+func (d *Directory) Compact(ctx context.Context) (_ CompactReport, err error) {
+	defer rootOf(d.parent).recoverPanic(&err)
+
+	if d.isDetached() {
+		return CompactReport{}, ErrDetached
+	}
+	snapshot, err := d.snapshot()
+	if err != nil {
+		return CompactReport{}, err
+	}
+	oldNd, err := snapshot.GetNode()
+	if err != nil {
+		return CompactReport{}, err
+	}
+
+	report, newNd, err := d.compact(ctx, snapshot, d.dagService)
+	if err != nil {
+		return CompactReport{}, err
+	}
+	if newNd.Cid().Equals(oldNd.Cid()) {
+		return report, nil
+	}
+
+	err = d.swapNode(ctx, oldNd, newNd)
+	if err != nil {
+		return CompactReport{}, err
+	}
+	return report, d.propagate(newNd)
+}
+
+// swapNode replaces the UnixFS directory by the one in 'newNd' if it's
+// still at 'oldNd'.
+func (d *Directory) swapNode(ctx context.Context, oldNd, newNd ipld.Node) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err := d.sync(); err != nil {
+		return err
+	}
+	curNd, err := d.storeNode()
+	if err != nil {
+		return err
+	}
+	if !curNd.Cid().Equals(oldNd.Cid()) {
+		return fmt.Errorf("directory %s changed while compacting", d.name)
+	}
+
+	err = d.dagService.Add(ctx, newNd)
+	if err != nil {
+		return err
+	}
+	db, err := uio.NewDirectoryFromNode(d.dagService, newNd)
+	if err != nil {
+		return err
+	}
+
+	d.setUnixfsDir(db)
+	d.storedNode = newNd
+	d.notifyChange()
+	return nil
+}
+
+// compact builds the compacted version of 'src' in 'dserv'.
+func (d *Directory) compact(ctx context.Context, src uio.Directory, dserv ipld.DAGService) (CompactReport, *dag.ProtoNode, error) {
+	var report CompactReport
+
+	oldNd, err := src.GetNode()
+	if err != nil {
+		return CompactReport{}, nil, err
+	}
+	report.Blocks, report.Bytes, err = dirBlocks(ctx, dserv, oldNd)
+	if err != nil {
+		return CompactReport{}, nil, err
+	}
+
+	// Same estimation go-unixfs uses to decide when to shard.
+	var basicSize int
+	err = src.ForEachLink(ctx, func(l *ipld.Link) error {
+		report.Entries++
+		basicSize += len(l.Name) + len(l.Cid.Bytes())
+		return nil
+	})
+	if err != nil {
+		return CompactReport{}, nil, err
+	}
+
+	var fanout int
+	if uio.HAMTShardingSize > 0 && basicSize >= uio.HAMTShardingSize {
+		d.lock.Lock()
+		fanout = d.shardWidth
+		d.lock.Unlock()
+		if fanout == 0 {
+			fanout = uio.DefaultShardWidth
+		}
+	}
+
+	newNd, err := rebuildDir(ctx, dserv, src, fanout, d.GetCidBuilder(), nil)
+	if err != nil {
+		return CompactReport{}, nil, err
+	}
+
+	report.Sharded = fanout != 0
+	report.CompactBlocks, report.CompactBytes, err = dirBlocks(ctx, dserv, newNd)
+	if err != nil {
+		return CompactReport{}, nil, err
+	}
+	return report, newNd, nil
+}
+
+// dirBlocks counts the blocks of the directory structure in 'nd': the
+// node itself and, for a HAMT, its sub-shards.
+func dirBlocks(ctx context.Context, dserv ipld.DAGService, nd ipld.Node) (int, uint64, error) {
+	blocks, size := 1, uint64(len(nd.RawData()))
+
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return blocks, size, nil
+	}
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	if err != nil || fsn.Type() != ft.THAMTShard {
+		return blocks, size, nil
+	}
+
+	// Sub-shards are the links named only with the (padded) index
+	// in the shard, entries have their name appended to it.
+	padLen := len(fmt.Sprintf("%X", fsn.Fanout()-1))
+	for _, l := range pbnd.Links() {
+		if len(l.Name) != padLen {
+			continue
+		}
+		child, err := l.GetNode(ctx, dserv)
+		if err != nil {
+			return 0, 0, err
+		}
+		b, s, err := dirBlocks(ctx, dserv, child)
+		if err != nil {
+			return 0, 0, err
+		}
+		blocks += b
+		size += s
+	}
+	return blocks, size, nil
+}
@@ -0,0 +1,61 @@
+package mfs
+
+import (
+	"context"
+	"time"
+
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// DescriptorStats are the counters of the writes made through a
+// `FileDescriptor`, to attribute the growth of the DAG and the latency
+// to specific write operations. They stay available once the
+// descriptor is closed, including its final flush.
+type DescriptorStats struct {
+	BytesWritten int64 // by `Write` and `WriteAt`
+
+	// Blocks added to the DAG service (the file's leaves and inner
+	// nodes, including the ones later replaced by another write) and
+	// their size.
+	BlocksAdded int
+	BytesAdded  int64
+
+	// Flushes of the changes (failed ones included) and the total time
+	// they took, propagation to the root included when syncing.
+	Flushes       int
+	FlushDuration time.Duration
+}
+
+// statsDAG counts the blocks added through it in the stats of a
+// descriptor, it's only used with the descriptor's lock taken.
+type statsDAG struct {
+	ipld.DAGService
+	stats *DescriptorStats
+}
+
+func (s *statsDAG) Add(ctx context.Context, nd ipld.Node) error {
+	if err := s.DAGService.Add(ctx, nd); err != nil {
+		return err
+	}
+	s.stats.BlocksAdded++
+	s.stats.BytesAdded += int64(len(nd.RawData()))
+	return nil
+}
+
+func (s *statsDAG) AddMany(ctx context.Context, nds []ipld.Node) error {
+	if err := s.DAGService.AddMany(ctx, nds); err != nil {
+		return err
+	}
+	for _, nd := range nds {
+		s.stats.BlocksAdded++
+		s.stats.BytesAdded += int64(len(nd.RawData()))
+	}
+	return nil
+}
+
+// Stats returns the counters of the writes made through the descriptor.
+func (fi *fileDescriptor) Stats() DescriptorStats {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	return fi.stats
+}
@@ -0,0 +1,224 @@
+package mfs
+
+import (
+	"context"
+	"fmt"
+	gopath "path"
+	"sort"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// ChangeType is the kind of a `Change`.
+type ChangeType int
+
+const (
+	// ChangeAdd: an entry was added at the path.
+	ChangeAdd ChangeType = iota
+	// ChangeRemove: the entry at the path was removed.
+	ChangeRemove
+	// ChangeModify: the contents of the file at the path changed.
+	ChangeModify
+	// ChangeRename: the entry at `Change.OldPath` was moved to the path,
+	// unchanged.
+	ChangeRename
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case ChangeAdd:
+		return "add"
+	case ChangeRemove:
+		return "remove"
+	case ChangeModify:
+		return "modify"
+	case ChangeRename:
+		return "rename"
+	default:
+		return fmt.Sprintf("ChangeType(%d)", int(t))
+	}
+}
+
+// Change is a difference between two trees, see `Diff`.
+type Change struct {
+	Type    ChangeType
+	Path    string
+	OldPath string // of a `ChangeRename`
+
+	// Entry before and after the change (undefined for an added and a
+	// removed entry respectively).
+	Before, After cid.Cid
+}
+
+// Diff returns the changes turning the tree 'oldRoot' into 'newRoot',
+// sorted by path. Subtrees with the same CID on both sides are skipped
+// without being fetched, and an added or removed directory is reported
+// as a single change (not one per entry below it). An entry removed and
+// added elsewhere with the same contents is reported as a rename; an
+// entry replaced by one of another type as a removal and an addition.
+func Diff(ctx context.Context, ds ipld.DAGService, oldRoot, newRoot cid.Cid) ([]Change, error) {
+	return DiffPath(ctx, ds, oldRoot, newRoot, "/")
+}
+
+// DiffPath is `Diff` restricted to the entry at 'pth' in both trees (the
+// paths of the changes are still absolute). The entry may be missing on
+// one side, it's then reported as added or removed.
+func DiffPath(ctx context.Context, ds ipld.DAGService, oldRoot, newRoot cid.Cid, pth string) ([]Change, error) {
+	pth = gopath.Clean("/" + pth)
+	oc, err := resolveCid(ctx, ds, oldRoot, pth)
+	if err != nil {
+		return nil, pathError("diff", pth, err)
+	}
+	nc, err := resolveCid(ctx, ds, newRoot, pth)
+	if err != nil {
+		return nil, pathError("diff", pth, err)
+	}
+
+	var changes []Change
+	emit := func(c Change) {
+		changes = append(changes, c)
+	}
+	switch {
+	case !oc.Defined() && !nc.Defined():
+		return nil, pathError("diff", pth, fmt.Errorf("missing in both trees"))
+	case !oc.Defined():
+		emit(Change{Type: ChangeAdd, Path: pth, After: nc})
+	case !nc.Defined():
+		emit(Change{Type: ChangeRemove, Path: pth, Before: oc})
+	default:
+		if err := diffEntry(ctx, ds, oc, nc, pth, emit); err != nil {
+			return nil, pathError("diff", pth, err)
+		}
+	}
+	return pairRenames(changes), nil
+}
+
+// resolveCid returns the CID of the entry at 'pth' in the tree 'root'
+// (undefined if there's none).
+func resolveCid(ctx context.Context, ds ipld.DAGService, root cid.Cid, pth string) (cid.Cid, error) {
+	c := root
+	for _, name := range splitPath(pth) {
+		nt, err := linkType(ctx, ds, c)
+		if err != nil {
+			return cid.Undef, err
+		}
+		if nt != TDir {
+			return cid.Undef, nil
+		}
+		links, err := entryLinks(ctx, ds, c)
+		if err != nil {
+			return cid.Undef, err
+		}
+		var ok bool
+		if c, ok = links[name]; !ok {
+			return cid.Undef, nil
+		}
+	}
+	return c, nil
+}
+
+// diffEntry emits the changes turning the entry 'oc' at 'pth' into 'nc'.
+func diffEntry(ctx context.Context, ds ipld.DAGService, oc, nc cid.Cid, pth string, emit func(Change)) error {
+	if oc.Equals(nc) {
+		return nil
+	}
+	oldType, err := linkType(ctx, ds, oc)
+	if err != nil {
+		return err
+	}
+	newType, err := linkType(ctx, ds, nc)
+	if err != nil {
+		return err
+	}
+	switch {
+	case oldType == TDir && newType == TDir:
+		return diffDir(ctx, ds, oc, nc, pth, emit)
+	case oldType == newType:
+		emit(Change{Type: ChangeModify, Path: pth, Before: oc, After: nc})
+	default:
+		emit(Change{Type: ChangeRemove, Path: pth, Before: oc})
+		emit(Change{Type: ChangeAdd, Path: pth, After: nc})
+	}
+	return nil
+}
+
+// diffDir emits the changes turning the directory 'oldDir' at 'pth' into
+// 'newDir'.
+func diffDir(ctx context.Context, ds ipld.DAGService, oldDir, newDir cid.Cid, pth string, emit func(Change)) error {
+	oldLinks, err := entryLinks(ctx, ds, oldDir)
+	if err != nil {
+		return err
+	}
+	newLinks, err := entryLinks(ctx, ds, newDir)
+	if err != nil {
+		return err
+	}
+
+	for name, oc := range oldLinks {
+		if _, ok := newLinks[name]; !ok {
+			emit(Change{Type: ChangeRemove, Path: gopath.Join(pth, name), Before: oc})
+		}
+	}
+	for name, nc := range newLinks {
+		epth := gopath.Join(pth, name)
+		oc, ok := oldLinks[name]
+		if !ok {
+			emit(Change{Type: ChangeAdd, Path: epth, After: nc})
+			continue
+		}
+		if err := diffEntry(ctx, ds, oc, nc, epth, emit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pairRenames sorts the changes by path, replacing the removals and
+// additions of the same contents by renames.
+func pairRenames(changes []Change) []Change {
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	// Removed paths by multihash, in path order.
+	removed := make(map[string][]int)
+	for i, c := range changes {
+		if c.Type == ChangeRemove {
+			key := string(c.Before.Hash())
+			removed[key] = append(removed[key], i)
+		}
+	}
+	drop := make(map[int]bool)
+	for i, c := range changes {
+		if c.Type != ChangeAdd {
+			continue
+		}
+		key := string(c.After.Hash())
+		for len(removed[key]) > 0 {
+			ri := removed[key][0]
+			removed[key] = removed[key][1:]
+			// Not a replacement of the same path (type change).
+			if changes[ri].Path == c.Path {
+				continue
+			}
+			changes[i] = Change{
+				Type:    ChangeRename,
+				Path:    c.Path,
+				OldPath: changes[ri].Path,
+				Before:  changes[ri].Before,
+				After:   c.After,
+			}
+			drop[ri] = true
+			break
+		}
+	}
+
+	out := changes[:0]
+	for i, c := range changes {
+		if !drop[i] {
+			out = append(out, c)
+		}
+	}
+	return out
+}
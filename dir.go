@@ -4,9 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	dag "github.com/ipfs/go-merkledag"
@@ -15,6 +18,7 @@ import (
 
 	cid "github.com/ipfs/go-cid"
 	ipld "github.com/ipfs/go-ipld-format"
+	murmur3 "github.com/spaolacci/murmur3"
 )
 
 // Deprecated: use github.com/ipfs/boxo/mfs.ErrNotYetImplemented
@@ -44,10 +48,40 @@ type Directory struct {
 	ctx context.Context
 
 	// UnixFS directory implementation used for creating,
-	// reading and editing directories.
+	// reading and editing directories. It's decoded from `node`, the
+	// one the directory was created from, on first use (see
+	// `loadUnsync`), nil until then.
 	unixfsDir uio.Directory
+	node      ipld.Node
 
-	modTime time.Time
+	// Set (atomically) once `unixfsDir` is loaded.
+	loaded int32
+
+	// Node of `unixfsDir` last stored in the DAG service, nil if it
+	// was modified since. Flushes reuse it instead of re-serializing
+	// (and re-adding) directories that didn't change.
+	storedNode ipld.Node
+
+	// CIDs the cached entries are linked with in `unixfsDir`, entries
+	// whose node didn't change aren't updated when syncing.
+	entryCids map[string]cid.Cid
+
+	// Time of the last change to the directory (as selected by
+	// `modTimePolicy`), only kept in memory.
+	modTime       time.Time
+	modTimePolicy ModTimePolicy
+
+	// Width of the HAMT shards used when the directory gets sharded
+	// (0 for the go-unixfs default), protected by `lock`.
+	shardWidth int
+
+	// Hard limits inherited from the `Root`, and the number of entries
+	// (-1 until counted) checked against them.
+	limits     limits
+	entryCount int
+
+	// Set (atomically) once the directory is unlinked, see `detach`.
+	detached int32
 }
 
 // NewDirectory constructs a new MFS directory.
@@ -57,8 +91,7 @@ type Directory struct {
 //
 // Deprecated: use github.com/ipfs/boxo/mfs.NewDirectory
 func NewDirectory(ctx context.Context, name string, node ipld.Node, parent parent, dserv ipld.DAGService) (*Directory, error) {
-	db, err := uio.NewDirectoryFromNode(dserv, node)
-	if err != nil {
+	if err := checkDirNode(node); err != nil {
 		return nil, err
 	}
 
@@ -68,20 +101,235 @@ func NewDirectory(ctx context.Context, name string, node ipld.Node, parent paren
 			parent:     parent,
 			dagService: dserv,
 		},
-		ctx:          ctx,
-		unixfsDir:    db,
-		entriesCache: make(map[string]FSNode),
-		modTime:      time.Now(),
+		ctx:           ctx,
+		node:          node,
+		entriesCache:  make(map[string]FSNode),
+		entryCids:     make(map[string]cid.Cid),
+		modTime:       time.Now(),
+		modTimePolicy: inheritedModTimePolicy(parent),
+		shardWidth:    inheritedShardWidth(parent),
+		limits:        inheritedLimits(parent),
+		entryCount:    -1,
 	}, nil
 }
 
+// checkDirNode checks that the node is a UnixFS directory, without
+// decoding its structure (a HAMT's) as `uio.NewDirectoryFromNode` does.
+func checkDirNode(nd ipld.Node) error {
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return uio.ErrNotADir
+	}
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	if err != nil {
+		return err
+	}
+	switch fsn.Type() {
+	case ft.TDirectory, ft.THAMTShard:
+		return nil
+	default:
+		return uio.ErrNotADir
+	}
+}
+
+// Loaded reports whether the UnixFS structure of the directory was
+// decoded already. Directories are loaded on first use (like looking up
+// or listing their entries) rather than when created, so that walking
+// down a path doesn't decode the directories along the way; each
+// directory is loaded under its own lock, concurrently with the others.
+func (d *Directory) Loaded() bool {
+	return atomic.LoadInt32(&d.loaded) == 1
+}
+
+// load is `loadUnsync` with locking.
+func (d *Directory) load(ctx context.Context) error {
+	if d.Loaded() {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.loadUnsync(ctx)
+}
+
+// loadUnsync decodes the UnixFS structure of the directory if it wasn't
+// yet. It must be called with the directory's lock taken.
+func (d *Directory) loadUnsync(ctx context.Context) error {
+	if d.Loaded() {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db, err := uio.NewDirectoryFromNode(d.dagService, d.node)
+	if err != nil {
+		return err
+	}
+	d.setUnixfsDir(db)
+	return nil
+}
+
+// setUnixfsDir replaces the UnixFS structure of the directory. It must be
+// called with the directory's lock taken.
+func (d *Directory) setUnixfsDir(db uio.Directory) {
+	d.unixfsDir = db
+	atomic.StoreInt32(&d.loaded, 1)
+}
+
+// inheritedModTimePolicy returns the modification time policy of the
+// parent (it must be called with the parent directory's lock taken).
+func inheritedModTimePolicy(p parent) ModTimePolicy {
+	switch p := p.(type) {
+	case *Directory:
+		return p.modTimePolicy
+	case *Root:
+		return p.modTimePolicy
+	default:
+		return ModTimeOnChange
+	}
+}
+
+// ModTime returns the time of the last change to the directory.
+func (d *Directory) ModTime() time.Time {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.modTime
+}
+
+// touch updates the modification time if the policy applies to the
+// change, 'entries' tells whether entries were added, removed or
+// replaced (or only their contents changed). It must be called with
+// the directory's lock taken.
+func (d *Directory) touch(entries bool) {
+	switch d.modTimePolicy {
+	case ModTimeOnChange:
+	case ModTimeOnEntries:
+		if !entries {
+			return
+		}
+	default:
+		return
+	}
+	d.modTime = time.Now()
+}
+
+// inheritedShardWidth returns the shard width configured in the parent
+// (it must be called with the parent directory's lock taken).
+func inheritedShardWidth(p parent) int {
+	switch p := p.(type) {
+	case *Directory:
+		return p.shardWidth
+	case *Root:
+		return p.shardWidth
+	default:
+		return 0
+	}
+}
+
+// isShard checks whether the node is a UnixFS HAMT directory.
+func isShard(nd ipld.Node) bool {
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return false
+	}
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	return err == nil && fsn.Type() == ft.THAMTShard
+}
+
+// shardedUnsync checks whether the directory currently is a HAMT, which
+// go-unixfs switches to (and back from) on its own as it grows and
+// shrinks. It must be called with the directory's lock taken.
+func (d *Directory) shardedUnsync() bool {
+	if !d.Loaded() {
+		return isShard(d.node)
+	}
+	db := d.unixfsDir
+	if dyn, ok := db.(*uio.DynamicDirectory); ok {
+		db = dyn.Directory
+	}
+	_, ok := db.(*uio.HAMTDirectory)
+	return ok
+}
+
+// validShardWidth checks the width is usable for a HAMT shard.
+func validShardWidth(width int) error {
+	if width < 8 || width&(width-1) != 0 {
+		return fmt.Errorf("invalid HAMT shard width %d: must be a power of two and at least 8", width)
+	}
+	return nil
+}
+
+// SetShardWidth overrides the width of the HAMT shards used if this
+// directory (or a subdirectory created afterwards) gets sharded. It
+// doesn't affect directories that are already sharded, use `Reshard`
+// for those.
+func (d *Directory) SetShardWidth(width int) error {
+	if err := validShardWidth(width); err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.shardWidth = width
+	return nil
+}
+
+// addUnixfsChild adds the entry to the underlying UnixFS directory. If
+// that turned it into a HAMT (go-unixfs shards directories automatically
+// past a size threshold) it's rebuilt with the configured shard width.
+func (d *Directory) addUnixfsChild(ctx context.Context, name string, nd ipld.Node) error {
+	if err := d.loadUnsync(ctx); err != nil {
+		return err
+	}
+	d.storedNode = nil
+	sharded := d.shardedUnsync()
+	err := d.unixfsDir.AddChild(ctx, name, nd)
+	if err != nil {
+		return err
+	}
+
+	if sharded || d.shardWidth == 0 {
+		return nil
+	}
+
+	dirNd, err := d.unixfsDir.GetNode()
+	if err != nil {
+		return err
+	}
+	if !isShard(dirNd) {
+		return nil
+	}
+
+	newNd, err := rebuildDir(ctx, d.dagService, d.unixfsDir, d.shardWidth, d.GetCidBuilder(), nil)
+	if err != nil {
+		return err
+	}
+
+	db, err := uio.NewDirectoryFromNode(d.dagService, newNd)
+	if err != nil {
+		return err
+	}
+	d.setUnixfsDir(db)
+	return nil
+}
+
 // GetCidBuilder gets the CID builder of the root node
 func (d *Directory) GetCidBuilder() cid.Builder {
+	if !d.Loaded() {
+		// The same one the UnixFS directory gets once loaded.
+		return d.node.(*dag.ProtoNode).CidBuilder()
+	}
 	return d.unixfsDir.GetCidBuilder()
 }
 
 // SetCidBuilder sets the CID builder
 func (d *Directory) SetCidBuilder(b cid.Builder) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.loadUnsync(d.ctx); err != nil {
+		log.Errorf("failed to set the CID builder of %s: %s", d.name, err)
+		return
+	}
+	d.storedNode = nil
 	d.unixfsDir.SetCidBuilder(b)
 }
 
@@ -90,7 +338,16 @@ func (d *Directory) SetCidBuilder(b cid.Builder) {
 // the newly created directory node with the updated entry in the DAG
 // service. Then it propagates the update upwards (through this same
 // interface) repeating the whole process in the parent.
+//
+// In bulk-load mode (see `Root.StartBulkLoad`) only the entry is
+// updated, the directory is sealed when the mode ends.
 func (d *Directory) updateChildEntry(c child) error {
+	if r := rootOf(d.parent); r != nil && r.bulkLoading() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		return d.updateChild(c)
+	}
+
 	newDirNode, err := d.localUpdate(c)
 	if err != nil {
 		return err
@@ -98,7 +355,33 @@ func (d *Directory) updateChildEntry(c child) error {
 
 	// Continue to propagate the update process upwards
 	// (all the way up to the root).
-	return d.parent.updateChildEntry(child{d.name, newDirNode})
+	return d.propagate(newDirNode)
+}
+
+// propagate updates the entry of the directory in its parent to 'nd',
+// unless the directory was unlinked: stale references to removed
+// directories can't bring their entries back.
+func (d *Directory) propagate(nd ipld.Node) error {
+	if d.isDetached() {
+		return nil
+	}
+	return d.parent.updateChildEntry(child{d.name, nd})
+}
+
+// detach marks the directory and its cached entries (recursively) as
+// detached from their parents, see `detachEntry`.
+func (d *Directory) detach(unlinked bool) {
+	atomic.StoreInt32(&d.detached, 1)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, entry := range d.entriesCache {
+		detachEntry(entry, unlinked)
+	}
+}
+
+func (d *Directory) isDetached() bool {
+	return atomic.LoadInt32(&d.detached) == 1
 }
 
 // This method implements the part of `updateChildEntry` that needs
@@ -116,7 +399,7 @@ func (d *Directory) localUpdate(c child) (*dag.ProtoNode, error) {
 	// TODO: Clearly define how are we propagating changes to lower layers
 	// like UnixFS.
 
-	nd, err := d.unixfsDir.GetNode()
+	nd, err := d.storeNode()
 	if err != nil {
 		return nil, err
 	}
@@ -126,23 +409,50 @@ func (d *Directory) localUpdate(c child) (*dag.ProtoNode, error) {
 		return nil, dag.ErrNotProtobuf
 	}
 
+	return pbnd.Copy().(*dag.ProtoNode), nil
+	// TODO: Why do we need a copy?
+}
+
+// storeNode adds the node of the UnixFS directory to the DAG service,
+// unless it was already stored and didn't change since. It must be
+// called with the directory's lock taken.
+func (d *Directory) storeNode() (ipld.Node, error) {
+	if d.storedNode != nil {
+		return d.storedNode, nil
+	}
+
+	if err := d.loadUnsync(d.ctx); err != nil {
+		return nil, err
+	}
+	nd, err := d.unixfsDir.GetNode()
+	if err != nil {
+		return nil, err
+	}
+
 	err = d.dagService.Add(d.ctx, nd)
 	if err != nil {
 		return nil, err
 	}
 
-	return pbnd.Copy().(*dag.ProtoNode), nil
-	// TODO: Why do we need a copy?
+	d.storedNode = nd
+	return nd, nil
 }
 
-// Update child entry in the underlying UnixFS directory.
+// Update child entry in the underlying UnixFS directory (if it changed).
 func (d *Directory) updateChild(c child) error {
-	err := d.unixfsDir.AddChild(d.ctx, c.Name, c.Node)
+	if linked, ok := d.entryCids[c.Name]; ok && linked.Equals(c.Node.Cid()) {
+		return nil
+	}
+
+	err := d.addUnixfsChild(d.ctx, c.Name, c.Node)
 	if err != nil {
 		return err
 	}
+	if _, ok := d.entriesCache[c.Name]; ok {
+		d.entryCids[c.Name] = c.Node.Cid()
+	}
 
-	d.modTime = time.Now()
+	d.touch(false)
 
 	return nil
 }
@@ -153,13 +463,20 @@ func (d *Directory) Type() NodeType {
 
 // childNode returns a FSNode under this directory by the given name if it exists.
 // it does *not* check the cached dirs and files
-func (d *Directory) childNode(name string) (FSNode, error) {
-	nd, err := d.childFromDag(name)
+func (d *Directory) childNode(ctx context.Context, name string) (FSNode, error) {
+	nd, err := d.childFromDag(ctx, name)
 	if err != nil {
 		return nil, err
 	}
 
-	return d.cacheNode(name, nd)
+	fsn, err := d.cacheNode(name, nd)
+	if err != nil {
+		return nil, err
+	}
+	if err := spills(d.parent).reload(ctx, path.Join(d.Path(), name), nd.Cid(), fsn); err != nil {
+		log.Warnf("failed to reload the spilled state of %s: %s", name, err)
+	}
+	return fsn, nil
 }
 
 // cacheNode caches a node into d.childDirs or d.files and returns the FSNode.
@@ -178,60 +495,177 @@ func (d *Directory) cacheNode(name string, nd ipld.Node) (FSNode, error) {
 				return nil, err
 			}
 
-			d.entriesCache[name] = ndir
+			d.cacheEntry(name, ndir, nd.Cid())
 			return ndir, nil
 		case ft.TFile, ft.TRaw, ft.TSymlink:
 			nfi, err := NewFile(name, nd, d, d.dagService)
 			if err != nil {
 				return nil, err
 			}
-			d.entriesCache[name] = nfi
+			d.cacheEntry(name, nfi, nd.Cid())
 			return nfi, nil
-		case ft.TMetadata:
-			return nil, ErrNotYetImplemented
 		default:
-			return nil, ErrInvalidChild
+			return d.cacheUnsupported(name, nd)
 		}
 	case *dag.RawNode:
 		nfi, err := NewFile(name, nd, d, d.dagService)
 		if err != nil {
 			return nil, err
 		}
-		d.entriesCache[name] = nfi
+		d.cacheEntry(name, nfi, nd.Cid())
 		return nfi, nil
 	default:
 		return nil, fmt.Errorf("unrecognized node type in cache node")
 	}
 }
 
+// cacheUnsupported is `cacheNode` for the nodes of unsupported types,
+// applying the policy of the root.
+func (d *Directory) cacheUnsupported(name string, nd ipld.Node) (FSNode, error) {
+	err := checkSupported(nd)
+	switch unsupportedPolicy(d.parent) {
+	case UnsupportedOpaque:
+		nfi, err := NewFile(name, nd, d, d.dagService)
+		if err != nil {
+			return nil, err
+		}
+		d.cacheEntry(name, nfi, nd.Cid())
+		return nfi, nil
+	case UnsupportedStrip:
+		return nil, os.ErrNotExist
+	default:
+		return nil, err
+	}
+}
+
 // Child returns the child of this directory by the given name
 func (d *Directory) Child(name string) (FSNode, error) {
+	return d.CtxChild(d.ctx, name)
+}
+
+// CtxChild is `Child` with a context for loading the entry.
+func (d *Directory) CtxChild(ctx context.Context, name string) (_ FSNode, err error) {
+	defer rootOf(d.parent).recoverPanic(&err)
+
 	d.lock.Lock()
 	defer d.lock.Unlock()
-	return d.childUnsync(name)
+	if d.isDetached() {
+		return nil, ErrDetached
+	}
+	return d.childUnsync(ctx, name)
 }
 
+// Uncache drops the loaded entry 'name' from the cache, once its changes
+// are synced into the directory. The dropped `FSNode`s are detached (using
+// them fails with `ErrDetached`) so they can't diverge from the ones loaded
+// afterwards. Entries in use, files with open descriptors or directories
+// holding some, are kept.
 func (d *Directory) Uncache(name string) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	if err := d.uncacheUnsync(name); err != nil {
+		log.Errorf("failed to uncache %s: %s", name, err)
+	}
+}
+
+// uncacheUnsync is `Uncache` without locking.
+func (d *Directory) uncacheUnsync(name string) error {
+	entry, ok := d.entriesCache[name]
+	if !ok || inUse(entry) {
+		return nil
+	}
+
+	nd, err := entry.GetNode()
+	if err != nil {
+		return err
+	}
+	if err := d.updateChild(child{name, nd}); err != nil {
+		return err
+	}
 	delete(d.entriesCache, name)
+	delete(d.entryCids, name)
+	// Still in the tree: only stale, not orphaned.
+	detachEntry(entry, false)
+	d.notifyChange()
+	return nil
+}
+
+// inUse tells whether the loaded entry has open descriptors, its own if
+// it's a file or the ones of its loaded entries (recursively) otherwise.
+// They are its references count: the entries in use can't be uncached.
+func inUse(fsn FSNode) bool {
+	switch fsn := fsn.(type) {
+	case *File:
+		fsn.nodeLock.RLock()
+		defer fsn.nodeLock.RUnlock()
+		return fsn.openDescs > 0
+	case *Directory:
+		fsn.lock.Lock()
+		defer fsn.lock.Unlock()
+		for _, entry := range fsn.entriesCache {
+			if inUse(entry) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// detachEntry detaches the loaded entry from the tree, making the
+// reference stale. The files of entries 'unlinked' from the tree (rather
+// than only dropped from the cache) are reported to the `WithOnOrphan`
+// function.
+func detachEntry(fsn FSNode, unlinked bool) {
+	switch fsn := fsn.(type) {
+	case *File:
+		entries(fsn.parent).forget(fsn)
+		fsn.detach(unlinked)
+	case *Directory:
+		entries(fsn.parent).forget(fsn)
+		fsn.detach(unlinked)
+	}
+}
+
+// notify emits an event for the entry 'name' of this directory to the
+// watchers of the `Root` (if any).
+func (d *Directory) notify(name string, op Op) {
+	if d.isDetached() {
+		return
+	}
+	if r := rootOf(d.parent); r != nil && r.watched() {
+		r.emit(Event{Name: path.Join(d.Path(), name), Op: op})
+	}
+}
+
+// notifyChange signals the `Root` that the structure of the tree changed.
+func (d *Directory) notifyChange() {
+	if d.isDetached() {
+		return
+	}
+	if r := rootOf(d.parent); r != nil {
+		r.changed()
+	}
 }
 
 // childFromDag searches through this directories dag node for a child link
 // with the given name
-func (d *Directory) childFromDag(name string) (ipld.Node, error) {
-	return d.unixfsDir.Find(d.ctx, name)
+func (d *Directory) childFromDag(ctx context.Context, name string) (ipld.Node, error) {
+	if err := d.loadUnsync(ctx); err != nil {
+		return nil, err
+	}
+	return d.unixfsDir.Find(ctx, name)
 }
 
 // childUnsync returns the child under this directory by the given name
 // without locking, useful for operations which already hold a lock
-func (d *Directory) childUnsync(name string) (FSNode, error) {
+func (d *Directory) childUnsync(ctx context.Context, name string) (FSNode, error) {
 	entry, ok := d.entriesCache[name]
 	if ok {
+		entries(d.parent).touch(entry)
 		return entry, nil
 	}
 
-	return d.childNode(name)
+	return d.childNode(ctx, name)
 }
 
 // Deprecated: use github.com/ipfs/boxo/mfs.NodeListing
@@ -240,14 +674,31 @@ type NodeListing struct {
 	Type int
 	Size int64
 	Hash string
+
+	// Err is why the node of the entry couldn't be loaded, only set in
+	// the partial listings (see `ListOpts.Partial`).
+	Err error
+
+	// mode has the type bits of the entry, telling symlinks apart from
+	// the regular files (see `FileInfo`).
+	mode fs.FileMode
 }
 
-func (d *Directory) ListNames(ctx context.Context) ([]string, error) {
+func (d *Directory) ListNames(ctx context.Context) (_ []string, err error) {
+	defer rootOf(d.parent).recoverPanic(&err)
+
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	if d.isDetached() {
+		return nil, ErrDetached
+	}
+
+	if err := d.loadUnsync(ctx); err != nil {
+		return nil, err
+	}
 
 	var out []string
-	err := d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+	err = d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
 		out = append(out, l.Name)
 		return nil
 	})
@@ -258,6 +709,57 @@ func (d *Directory) ListNames(ctx context.Context) ([]string, error) {
 	return out, nil
 }
 
+// errPageFull stops the iteration of `ListNamesPage` once the page is full.
+var errPageFull = errors.New("page full")
+
+// ListNamesPage returns the page of at most 'limit' names (no limit if
+// not positive) of the directory after skipping the first 'offset' ones,
+// counting only the names matching 'pattern' (a pattern of `path.Match`,
+// "" matching all), e.g., "prefix*". The names come in the order of the
+// directory node, so the pages are consistent as long as it doesn't
+// change. A page shorter than 'limit' is the last one.
+func (d *Directory) ListNamesPage(ctx context.Context, offset, limit int, pattern string) (_ []string, err error) {
+	defer rootOf(d.parent).recoverPanic(&err)
+
+	if pattern != "" {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.isDetached() {
+		return nil, ErrDetached
+	}
+	if err := d.loadUnsync(ctx); err != nil {
+		return nil, err
+	}
+
+	var out []string
+	err = d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		if pattern != "" {
+			if ok, _ := path.Match(pattern, l.Name); !ok {
+				return nil
+			}
+		}
+		if offset > 0 {
+			offset--
+			return nil
+		}
+		out = append(out, l.Name)
+		if limit > 0 && len(out) == limit {
+			return errPageFull
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errPageFull) {
+		return nil, err
+	}
+
+	return out, nil
+}
+
 func (d *Directory) List(ctx context.Context) ([]NodeListing, error) {
 	var out []NodeListing
 	err := d.ForEachEntry(ctx, func(nl NodeListing) error {
@@ -267,43 +769,217 @@ func (d *Directory) List(ctx context.Context) ([]NodeListing, error) {
 	return out, err
 }
 
-func (d *Directory) ForEachEntry(ctx context.Context, f func(NodeListing) error) error {
-	d.lock.Lock()
-	defer d.lock.Unlock()
-	return d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
-		c, err := d.childUnsync(l.Name)
-		if err != nil {
+// ForEachEntry calls 'f' for each entry of the directory. It iterates a
+// consistent snapshot taken at call start: concurrent mutations of the
+// directory (including ones made by 'f' itself) aren't observed.
+// Complete listings are cached by the `Root` (see `WithListingCache`).
+// The context is checked between the entries, so an unreachable node
+// doesn't hold the listing past the deadline of 'ctx'.
+func (d *Directory) ForEachEntry(ctx context.Context, f func(NodeListing) error) (err error) {
+	defer rootOf(d.parent).recoverPanic(&err)
+
+	return d.forEachEntry(ctx, ListOpts{}, f)
+}
+
+// forEachEntry is `ForEachEntry` loading the nodes of the entries as
+// told by 'opts'.
+func (d *Directory) forEachEntry(ctx context.Context, opts ListOpts, f func(NodeListing) error) (err error) {
+	defer rootOf(d.parent).recoverPanic(&err)
+
+	if d.isDetached() {
+		return ErrDetached
+	}
+	if err := d.load(ctx); err != nil {
+		return err
+	}
+	nd, err := d.snapshotNode()
+	if err != nil {
+		return err
+	}
+
+	cache := listings(d.parent)
+	if listing, ok := cache.get(nd.Cid()); ok {
+		for _, child := range listing {
+			if err := f(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	snapshot, err := uio.NewDirectoryFromNode(d.dagService, nd)
+	if err != nil {
+		return err
+	}
+
+	policy := unsupportedPolicy(d.parent)
+	var listing []NodeListing
+	complete := true
+	err = snapshot.ForEachLink(ctx, func(l *ipld.Link) error {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
 
-		nd, err := c.GetNode()
+		child, listed, err := d.entryListing(ctx, l, opts.ChildTimeout, policy)
 		if err != nil {
-			return err
+			if !opts.Partial || ctx.Err() != nil {
+				return err
+			}
+			child = NodeListing{Name: l.Name, Hash: l.Cid.String(), Err: err}
+			listed, complete = true, false
+		}
+		if !listed {
+			return nil
+		}
+		if cache != nil {
+			listing = append(listing, child)
 		}
 
-		child := NodeListing{
-			Name: l.Name,
-			Type: int(c.Type()),
-			Hash: nd.Cid().String(),
+		return f(child)
+	})
+	if err != nil {
+		return err
+	}
+
+	if complete {
+		cache.add(nd.Cid(), listing)
+	}
+	return nil
+}
+
+// entryListing loads the node of the link 'l' to describe it, giving up
+// after 'timeout' (if positive) or once 'ctx' is done, even if the DAG
+// service doesn't honor the context.
+func (d *Directory) entryListing(ctx context.Context, l *ipld.Link, timeout time.Duration, policy UnsupportedPolicy) (NodeListing, bool, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	type result struct {
+		child  NodeListing
+		listed bool
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		nd, err := l.GetNode(ctx, d.dagService)
+		if err != nil {
+			done <- result{err: err}
+			return
 		}
+		child, listed, err := policyListing(ctx, d.dagService, l.Name, nd, policy)
+		done <- result{child, listed, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.child, r.listed, r.err
+	case <-ctx.Done():
+		return NodeListing{}, false, fmt.Errorf("%s: %w", l.Name, ctx.Err())
+	}
+}
+
+// snapshot returns a read-only view of the directory as of now: the
+// cached entries are synced and the resulting node is loaded as an
+// independent UnixFS directory, unaffected by later mutations.
+func (d *Directory) snapshot() (uio.Directory, error) {
+	nd, err := d.snapshotNode()
+	if err != nil {
+		return nil, err
+	}
+
+	return uio.NewDirectoryFromNode(d.dagService, nd)
+}
+
+// snapshotNode returns a copy of the node of the directory as of now,
+// see `snapshot`.
+func (d *Directory) snapshotNode() (ipld.Node, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	err := d.sync()
+	if err != nil {
+		return nil, err
+	}
 
-		if c, ok := c.(*File); ok {
-			size, err := c.Size()
+	nd, err := d.storeNode()
+	if err != nil {
+		return nil, err
+	}
+
+	return nd.Copy(), nil
+}
+
+// latestNode returns the node of the directory as last updated, stored.
+// Unlike `GetNode` the cached entries aren't synced first: only the
+// changes already propagated to the directory are included.
+func (d *Directory) latestNode() (ipld.Node, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	nd, err := d.storeNode()
+	if err != nil {
+		return nil, err
+	}
+	return nd.Copy(), nil
+}
+
+// nodeListing describes the entry 'name' pointing to the node 'nd'.
+func nodeListing(ctx context.Context, dserv ipld.DAGService, name string, nd ipld.Node) (NodeListing, error) {
+	child := NodeListing{
+		Name: name,
+		Type: int(TFile),
+		Hash: nd.Cid().String(),
+	}
+
+	switch nd := nd.(type) {
+	case *dag.ProtoNode:
+		fsn, err := ft.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return NodeListing{}, err
+		}
+
+		nt, err := UnixFSNodeType(fsn.Type())
+		if err != nil {
+			return NodeListing{}, err
+		}
+		child.Type = int(nt)
+		child.mode, err = UnixFSFileMode(fsn.Type())
+		if err != nil {
+			return NodeListing{}, err
+		}
+		if nt == TFile {
+			child.Size, err = nodeSize(ctx, dserv, nd)
 			if err != nil {
-				return err
+				return NodeListing{}, err
 			}
-			child.Size = size
 		}
+	case *dag.RawNode:
+		child.Size = int64(len(nd.RawData()))
+	default:
+		return NodeListing{}, fmt.Errorf("unrecognized node type in node listing")
+	}
 
-		return f(child)
-	})
+	return child, nil
 }
 
 func (d *Directory) Mkdir(name string) (*Directory, error) {
+	return d.CtxMkdir(d.ctx, name)
+}
+
+// CtxMkdir is `Mkdir` with a context for the DAG operations.
+func (d *Directory) CtxMkdir(ctx context.Context, name string) (_ *Directory, err error) {
+	defer rootOf(d.parent).recoverPanic(&err)
+
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	if d.isDetached() {
+		return nil, ErrDetached
+	}
 
-	fsn, err := d.childUnsync(name)
+	fsn, err := d.childUnsync(ctx, name)
 	if err == nil {
 		switch fsn := fsn.(type) {
 		case *Directory:
@@ -315,15 +991,19 @@ func (d *Directory) Mkdir(name string) (*Directory, error) {
 		}
 	}
 
+	if err := d.checkEntryLimit(); err != nil {
+		return nil, err
+	}
+
 	ndir := ft.EmptyDirNode()
-	ndir.SetCidBuilder(d.GetCidBuilder())
+	ndir.SetCidBuilder(d.newCidBuilder())
 
-	err = d.dagService.Add(d.ctx, ndir)
+	err = d.dagService.Add(ctx, ndir)
 	if err != nil {
 		return nil, err
 	}
 
-	err = d.unixfsDir.AddChild(d.ctx, name, ndir)
+	err = d.addUnixfsChild(ctx, name, ndir)
 	if err != nil {
 		return nil, err
 	}
@@ -333,49 +1013,313 @@ func (d *Directory) Mkdir(name string) (*Directory, error) {
 		return nil, err
 	}
 
-	d.entriesCache[name] = dirobj
+	d.cacheEntry(name, dirobj, ndir.Cid())
+	d.entryAdded()
+	d.touch(true)
+	d.notifyChange()
+	d.notify(name, Create)
 	return dirobj, nil
 }
 
+// Unlink removes the entry 'name' from the directory. If it's a loaded
+// file its open descriptors keep working against the detached DAG,
+// which is reported to the `WithOnOrphan` function once they are all
+// closed.
 func (d *Directory) Unlink(name string) error {
+	return d.CtxUnlink(d.ctx, name)
+}
+
+// CtxUnlink is `Unlink` with a context for the DAG operations.
+func (d *Directory) CtxUnlink(ctx context.Context, name string) (err error) {
+	defer rootOf(d.parent).recoverPanic(&err)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.isDetached() {
+		return ErrDetached
+	}
+	return d.unlinkUnsync(ctx, name)
+}
+
+// UnlinkAndGet removes the entry 'name' like `Unlink` and returns the CID
+// and type of what it pointed to, read in the same critical section, so
+// callers can unpin, log or relink it without racing with other changes.
+func (d *Directory) UnlinkAndGet(name string) (_ cid.Cid, _ NodeType, err error) {
+	defer rootOf(d.parent).recoverPanic(&err)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.isDetached() {
+		return cid.Undef, 0, ErrDetached
+	}
+
+	var nd ipld.Node
+	if entry, ok := d.entriesCache[name]; ok {
+		nd, err = entry.GetNode()
+	} else {
+		nd, err = d.childFromDag(d.ctx, name)
+	}
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	nt, err := nodeType(nd)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+
+	if err := d.unlinkUnsync(d.ctx, name); err != nil {
+		return cid.Undef, 0, err
+	}
+	return nd.Cid(), nt, nil
+}
+
+// UnlinkMany removes the entries 'names' in a single critical section,
+// all of them or none (if any doesn't exist). In sharded directories the
+// removals are done in HAMT order, so each shard is visited once, and
+// the shards are only rewritten when the directory is next stored
+// rather than once per removal.
+func (d *Directory) UnlinkMany(ctx context.Context, names []string) (err error) {
+	defer rootOf(d.parent).recoverPanic(&err)
+
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	if d.isDetached() {
+		return ErrDetached
+	}
+
+	unique := make([]string, 0, len(names))
+	seen := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			unique = append(unique, name)
+		}
+	}
+	if d.shardedUnsync() {
+		sortByShard(unique)
+	}
+
+	for _, name := range unique {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, ok := d.entriesCache[name]; ok {
+			continue
+		}
+		if _, err := d.childFromDag(ctx, name); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	for _, name := range unique {
+		if err := d.unlinkUnsync(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortByShard sorts the entry names by their hash in a HAMT, which is
+// the order of the shards holding them.
+func sortByShard(names []string) {
+	hashes := make(map[string]uint64, len(names))
+	for _, name := range names {
+		hashes[name] = murmur3.Sum64([]byte(name))
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return hashes[names[i]] < hashes[names[j]]
+	})
+}
+
+func (d *Directory) unlinkUnsync(ctx context.Context, name string) error {
+	return d.removeUnsync(ctx, name, Remove)
+}
 
+// removeUnsync removes the entry 'name' reporting it with the event 'op'
+// (`Remove`, or `Rename` when it's moved elsewhere).
+func (d *Directory) removeUnsync(ctx context.Context, name string, op Op) error {
+	if err := d.loadUnsync(ctx); err != nil {
+		return err
+	}
+	d.recordRemoval(ctx, name)
+	entry := d.entriesCache[name]
 	delete(d.entriesCache, name)
+	delete(d.entryCids, name)
+
+	d.storedNode = nil
+	err := d.unixfsDir.RemoveChild(ctx, name)
+	if err != nil {
+		return err
+	}
+	d.entryRemoved()
+
+	d.touch(true)
+	d.notifyChange()
+	d.notify(name, op)
+
+	detachEntry(entry, true)
+	return nil
+}
+
+// moveOut removes the entry 'name' moved elsewhere.
+func (d *Directory) moveOut(ctx context.Context, name string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.removeUnsync(ctx, name, Rename)
+}
 
-	return d.unixfsDir.RemoveChild(d.ctx, name)
+// entryNode returns the node of the entry 'name', flushing it if it's
+// cached but without loading it otherwise: only the path to the entry in
+// the UnixFS directory is read (a single branch of a HAMT).
+func (d *Directory) entryNode(ctx context.Context, name string) (ipld.Node, error) {
+	d.lock.Lock()
+	entry, ok := d.entriesCache[name]
+	if !ok {
+		defer d.lock.Unlock()
+		return d.childFromDag(ctx, name)
+	}
+	d.lock.Unlock()
+
+	// Flushing the entry updates it in this directory, so not under
+	// the lock.
+	return entry.GetNode()
 }
 
-func (d *Directory) Flush() error {
+// putEntry adds the entry 'name' pointing to 'nd', which must already be
+// in the DAG service. Like `entryNode` it only touches the path to the
+// entry in the UnixFS directory.
+func (d *Directory) putEntry(ctx context.Context, name string, nd ipld.Node) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.entriesCache[name]; ok {
+		return ErrDirExists
+	}
+	_, err := d.childFromDag(ctx, name)
+	switch {
+	case err == nil:
+		return ErrDirExists
+	case err != os.ErrNotExist:
+		return err
+	}
+	if err := d.checkEntryLimit(); err != nil {
+		return err
+	}
+
+	err = d.addUnixfsChild(ctx, name, nd)
+	if err != nil {
+		return err
+	}
+
+	d.entryAdded()
+	d.touch(true)
+	d.notifyChange()
+	d.notify(name, Create)
+	return nil
+}
+
+// setFile sets the entry 'name' to the file 'nd' (replacing a file
+// there) in a single update of the directory.
+func (d *Directory) setFile(name string, nd ipld.Node) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	op := Create
+	dst, err := d.childUnsync(d.ctx, name)
+	switch {
+	case err == nil:
+		if _, ok := dst.(*File); !ok {
+			return fmt.Errorf("cannot replace %s: not a file", name)
+		}
+		op = Write
+	case err != os.ErrNotExist:
+		return err
+	}
+	if op == Create {
+		if err := d.checkEntryLimit(); err != nil {
+			return err
+		}
+	}
+
+	err = d.dagService.Add(d.ctx, nd)
+	if err != nil {
+		return err
+	}
+	err = d.addUnixfsChild(d.ctx, name, nd)
+	if err != nil {
+		return err
+	}
+
+	delete(d.entriesCache, name)
+	delete(d.entryCids, name)
+	if op == Create {
+		d.entryAdded()
+	}
+	d.touch(true)
+	d.notifyChange()
+	d.notify(name, op)
+
+	if fi, ok := dst.(*File); ok {
+		fi.detach(true)
+	}
+	return nil
+}
+
+func (d *Directory) Flush() (err error) {
+	defer rootOf(d.parent).recoverPanic(&err)
+
+	if d.isDetached() {
+		return ErrDetached
+	}
 	nd, err := d.GetNode()
 	if err != nil {
 		return err
 	}
 
-	return d.parent.updateChildEntry(child{d.name, nd})
+	if err := d.propagate(nd); err != nil {
+		return err
+	}
+	d.notify("", Flush)
+	return nil
 }
 
 // AddChild adds the node 'nd' under this directory giving it the name 'name'
 func (d *Directory) AddChild(name string, nd ipld.Node) error {
+	return d.CtxAddChild(d.ctx, name, nd)
+}
+
+// CtxAddChild is `AddChild` with a context for the DAG operations.
+func (d *Directory) CtxAddChild(ctx context.Context, name string, nd ipld.Node) (err error) {
+	defer rootOf(d.parent).recoverPanic(&err)
+
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	if d.isDetached() {
+		return ErrDetached
+	}
 
-	_, err := d.childUnsync(name)
+	_, err = d.childUnsync(ctx, name)
 	if err == nil {
 		return ErrDirExists
 	}
+	if err := d.checkEntryLimit(); err != nil {
+		return err
+	}
 
-	err = d.dagService.Add(d.ctx, nd)
+	err = d.dagService.Add(ctx, nd)
 	if err != nil {
 		return err
 	}
 
-	err = d.unixfsDir.AddChild(d.ctx, name, nd)
+	err = d.addUnixfsChild(ctx, name, nd)
 	if err != nil {
 		return err
 	}
 
-	d.modTime = time.Now()
+	d.entryAdded()
+	d.touch(true)
+	d.notifyChange()
+	d.notify(name, Create)
 	return nil
 }
 
@@ -414,24 +1358,21 @@ func (d *Directory) Path() string {
 	return out
 }
 
-func (d *Directory) GetNode() (ipld.Node, error) {
+func (d *Directory) GetNode() (_ ipld.Node, err error) {
+	defer rootOf(d.parent).recoverPanic(&err)
+
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	err := d.sync()
+	err = d.sync()
 	if err != nil {
 		return nil, err
 	}
 
-	nd, err := d.unixfsDir.GetNode()
-	if err != nil {
-		return nil, err
-	}
-
-	err = d.dagService.Add(d.ctx, nd)
+	nd, err := d.storeNode()
 	if err != nil {
 		return nil, err
 	}
 
-	return nd.Copy(), err
+	return nd.Copy(), nil
 }
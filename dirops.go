@@ -0,0 +1,216 @@
+package mfs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	ft "github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// The directory operations measured by `MeasureDirOps`.
+const (
+	DirOpAddChild = "AddChild"
+	DirOpChild    = "Child"
+	DirOpMv       = "Mv"
+	DirOpUnlink   = "Unlink"
+)
+
+// DirOpsOpts is used by MeasureDirOps
+type DirOpsOpts struct {
+	Sizes  []int // numbers of entries of the directories measured
+	Rounds int   // times each operation is timed (1 if not positive)
+}
+
+// DirOpsResult is the time an operation took on a directory, on average.
+type DirOpsResult struct {
+	Entries int           `json:"entries"`
+	Sharded bool          `json:"sharded"`
+	Op      string        `json:"op"`
+	PerOp   time.Duration `json:"perOp"`
+
+	// Size of the directory estimated as go-unixfs does to decide when
+	// to shard (see `uio.HAMTShardingSize`).
+	Size int `json:"size"`
+}
+
+// MeasureDirOps times the operations (`DirOpAddChild`...) on directories
+// of each of the sizes, in the basic and the HAMT encodings, with the
+// blocks in 'dserv'. The operations leave the size of the directories
+// unchanged: each round adds an entry, looks up an existing one, renames
+// the added one and unlinks it.
+//
+// The automatic sharding of go-unixfs is disabled meanwhile (by setting
+// `uio.HAMTShardingSize` to 0) to keep the encodings, it mustn't be used
+// concurrently in the process: this is a benchmarking tool.
+func MeasureDirOps(ctx context.Context, dserv ipld.DAGService, opts DirOpsOpts) ([]DirOpsResult, error) {
+	rounds := opts.Rounds
+	if rounds <= 0 {
+		rounds = 1
+	}
+
+	oldShardingSize := uio.HAMTShardingSize
+	uio.HAMTShardingSize = 0
+	defer func() { uio.HAMTShardingSize = oldShardingSize }()
+
+	var results []DirOpsResult
+	for _, entries := range opts.Sizes {
+		for _, sharded := range []bool{false, true} {
+			res, err := measureDirOps(ctx, dserv, entries, sharded, rounds)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, res...)
+		}
+	}
+	return results, nil
+}
+
+// measureDirOps is `MeasureDirOps` of one size and encoding.
+func measureDirOps(ctx context.Context, dserv ipld.DAGService, entries int, sharded bool, rounds int) ([]DirOpsResult, error) {
+	file := NewEmptyFileNode(EmptyFileOpts{})
+	if err := dserv.Add(ctx, file); err != nil {
+		return nil, err
+	}
+	rt, err := NewRoot(ctx, dserv, ft.EmptyDirNode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rt.Close()
+
+	if err := CtxMkdir(ctx, rt, "/d", MkdirOpts{}); err != nil {
+		return nil, err
+	}
+	dir, err := ctxLookupDir(ctx, rt, "/d")
+	if err != nil {
+		return nil, err
+	}
+	size := 0
+	for i := 0; i < entries; i++ {
+		name := fmt.Sprintf("entry-%08d", i)
+		if err := dir.AddChild(name, file); err != nil {
+			return nil, err
+		}
+		size += len(name) + len(file.Cid().Bytes())
+	}
+	fanout := 0
+	if sharded {
+		fanout = uio.DefaultShardWidth
+	}
+	if err := Reshard(ctx, rt, "/d", fanout, nil); err != nil {
+		return nil, err
+	}
+	if dir, err = ctxLookupDir(ctx, rt, "/d"); err != nil {
+		return nil, err
+	}
+
+	var elapsed [4]time.Duration
+	timed := func(i int, f func() error) error {
+		start := time.Now()
+		err := f()
+		elapsed[i] += time.Since(start)
+		return err
+	}
+	for r := 0; r < rounds; r++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		added, moved := fmt.Sprintf("added-%d", r), fmt.Sprintf("moved-%d", r)
+		err := timed(0, func() error {
+			return dir.AddChild(added, file)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if entries > 0 {
+			existing := fmt.Sprintf("entry-%08d", r%entries)
+			err = timed(1, func() error {
+				_, err := dir.CtxChild(ctx, existing)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			// Load it from the directory again if looked up in later rounds.
+			dir.Uncache(existing)
+		}
+		err = timed(2, func() error {
+			return CtxMv(ctx, rt, "/d/"+added, "/d/"+moved)
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = timed(3, func() error {
+			return dir.Unlink(moved)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var results []DirOpsResult
+	for i, op := range []string{DirOpAddChild, DirOpChild, DirOpMv, DirOpUnlink} {
+		if op == DirOpChild && entries == 0 {
+			continue
+		}
+		results = append(results, DirOpsResult{
+			Entries: entries,
+			Sharded: sharded,
+			Op:      op,
+			PerOp:   elapsed[i] / time.Duration(rounds),
+			Size:    size,
+		})
+	}
+	return results, nil
+}
+
+// ShardingCrossover returns the smallest directory size measured from
+// which the HAMT encoding is faster than the basic one over all the
+// operations, in entries and as estimated by go-unixfs (the value to
+// set `uio.HAMTShardingSize` to), or false if it never is.
+func ShardingCrossover(results []DirOpsResult) (entries, size int, ok bool) {
+	type total struct {
+		basic, sharded time.Duration
+		size           int
+	}
+	totals := make(map[int]*total)
+	for _, r := range results {
+		t, found := totals[r.Entries]
+		if !found {
+			t = &total{size: r.Size}
+			totals[r.Entries] = t
+		}
+		if r.Sharded {
+			t.sharded += r.PerOp
+		} else {
+			t.basic += r.PerOp
+		}
+	}
+
+	sizes := make([]int, 0, len(totals))
+	for n := range totals {
+		sizes = append(sizes, n)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+	for _, n := range sizes {
+		t := totals[n]
+		if t.sharded >= t.basic {
+			break
+		}
+		entries, size, ok = n, t.size, true
+	}
+	return entries, size, ok
+}
+
+// DefaultShardingSize is the directory size (as estimated by go-unixfs)
+// from which the HAMT encoding was measured faster than the basic one,
+// see `ShardingCrossover` and the results of `MeasureDirOps` kept in
+// testdata/dirops.json (`go test -run TestDefaultShardingSize
+// -update-dirops` measures them again). Embedders can set
+// `uio.HAMTShardingSize` to it (measured over an in-memory blockstore,
+// embedders with slower ones can measure their own crossover).
+const DefaultShardingSize = 24000
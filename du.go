@@ -0,0 +1,170 @@
+package mfs
+
+import (
+	"context"
+	gopath "path"
+	"sort"
+	"sync"
+
+	uio "github.com/ipfs/go-unixfs/io"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// DefaultDiskUsageConcurrency is the number of entries walked in parallel
+// by `DiskUsage` in per-child mode, unless set in `DiskUsageOpts`.
+const DefaultDiskUsageConcurrency = 8
+
+// DiskUsageOpts is used by DiskUsage
+type DiskUsageOpts struct {
+	PerChild    bool // also report the usage of each entry of the directory
+	Concurrency int  // entries walked in parallel in per-child mode
+}
+
+// Usage is the space used by the blocks of a DAG, each counted once.
+type Usage struct {
+	Name   string
+	Blocks int
+	Bytes  uint64
+}
+
+// DiskUsageReport is returned by DiskUsage
+type DiskUsageReport struct {
+	Usage
+
+	// Usage of the entries of the directory, by decreasing size (only
+	// in per-child mode). Blocks shared between entries are counted in
+	// only one of them, so the sizes add up to the total.
+	Children []Usage
+}
+
+// DiskUsage computes the space used by the DAG at 'pth', counting the
+// blocks shared inside it only once. In per-child mode the usage of each
+// entry of the directory is reported as well, walking them concurrently.
+func DiskUsage(ctx context.Context, r *Root, pth string, opts DiskUsageOpts) (DiskUsageReport, error) {
+	fsn, err := Lookup(r, pth)
+	if err != nil {
+		return DiskUsageReport{}, err
+	}
+	nd, err := fsn.GetNode()
+	if err != nil {
+		return DiskUsageReport{}, err
+	}
+	dserv := r.GetDirectory().dagService
+
+	var report DiskUsageReport
+	_, report.Name = gopath.Split(gopath.Clean("/" + pth))
+	seen := &syncCidSet{set: cid.NewSet()}
+
+	if fsn.Type() == TDir && opts.PerChild {
+		report.Children, err = childrenUsage(ctx, dserv, nd, seen, opts.Concurrency)
+		if err != nil {
+			return DiskUsageReport{}, err
+		}
+		for _, u := range report.Children {
+			report.Blocks += u.Blocks
+			report.Bytes += u.Bytes
+		}
+	}
+
+	// Only the blocks not in any entry (the directory structure) remain
+	// to be counted in per-child mode.
+	rest, err := usage(ctx, dserv, nd.Cid(), seen)
+	if err != nil {
+		return DiskUsageReport{}, err
+	}
+	report.Blocks += rest.Blocks
+	report.Bytes += rest.Bytes
+	return report, nil
+}
+
+// childrenUsage walks the entries of the directory in 'nd' concurrently.
+func childrenUsage(ctx context.Context, dserv ipld.DAGService, nd ipld.Node, seen *syncCidSet, concurrency int) ([]Usage, error) {
+	dir, err := uio.NewDirectoryFromNode(dserv, nd)
+	if err != nil {
+		return nil, err
+	}
+	links, err := dir.Links(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if concurrency <= 0 {
+		concurrency = DefaultDiskUsageConcurrency
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	out := make([]Usage, len(links))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var walkErr error
+	for i, l := range links {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, l *ipld.Link) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			u, err := usage(ctx, dserv, l.Cid, seen)
+			if err != nil {
+				errOnce.Do(func() {
+					walkErr = err
+					cancel()
+				})
+				return
+			}
+			u.Name = l.Name
+			out[i] = u
+		}(i, l)
+	}
+	wg.Wait()
+	if walkErr != nil {
+		return nil, walkErr
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Bytes > out[j].Bytes
+	})
+	return out, nil
+}
+
+// usage adds up the blocks reachable from 'c' not yet in 'seen'.
+func usage(ctx context.Context, dserv ipld.DAGService, c cid.Cid, seen *syncCidSet) (Usage, error) {
+	var u Usage
+	var walk func(cid.Cid) error
+	walk = func(c cid.Cid) error {
+		if !seen.visit(c) {
+			return nil
+		}
+		nd, err := dserv.Get(ctx, c)
+		if err != nil {
+			return err
+		}
+		u.Blocks++
+		u.Bytes += uint64(len(nd.RawData()))
+		for _, l := range nd.Links() {
+			if err := walk(l.Cid); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return u, walk(c)
+}
+
+// syncCidSet is a `cid.Set` safe for concurrent use.
+type syncCidSet struct {
+	lock sync.Mutex
+	set  *cid.Set
+}
+
+func (s *syncCidSet) visit(c cid.Cid) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.set.Visit(c)
+}
@@ -0,0 +1,187 @@
+package mfs
+
+import (
+	"container/list"
+	"context"
+	"path"
+	"sync"
+	"sync/atomic"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// entryCache bounds the number of entries loaded in the directories of a
+// `Root` (see `WithEntryCacheLimit`). It tracks them in LRU order and,
+// once over the limit, evicts the least recently used ones that are
+// flushed: files without open descriptors and directories without loaded
+// entries (evicting the entries of a directory makes it evictable in
+// turn). Evicted entries are detached like uncached ones.
+type entryCache struct {
+	lock    sync.Mutex
+	max     int
+	lru     *list.List
+	entries map[FSNode]*list.Element
+
+	// Set (atomically) while an eviction is running.
+	evicting int32
+
+	// Runs the evictions.
+	life *lifecycle
+}
+
+type cachedEntry struct {
+	dir  *Directory
+	name string
+	fsn  FSNode
+}
+
+func newEntryCache(max int, life *lifecycle) *entryCache {
+	return &entryCache{
+		life:    life,
+		max:     max,
+		lru:     list.New(),
+		entries: make(map[FSNode]*list.Element),
+	}
+}
+
+// add registers the entry 'name' loaded in 'dir', starting an eviction
+// in the background if that goes over the limit (the directory locks
+// can't be taken by the caller, which holds the one of 'dir'). The cache
+// may be nil (unbounded).
+func (c *entryCache) add(dir *Directory, name string, fsn FSNode) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	c.entries[fsn] = c.lru.PushFront(&cachedEntry{dir: dir, name: name, fsn: fsn})
+	over := c.lru.Len() > c.max
+	c.lock.Unlock()
+
+	if over && atomic.CompareAndSwapInt32(&c.evicting, 0, 1) {
+		started := c.life.Go("eviction", func(context.Context) error {
+			defer atomic.StoreInt32(&c.evicting, 0)
+			c.evict()
+			return nil
+		})
+		if !started {
+			atomic.StoreInt32(&c.evicting, 0)
+		}
+	}
+}
+
+// touch records a use of the entry.
+func (c *entryCache) touch(fsn FSNode) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.entries[fsn]; ok {
+		c.lru.MoveToFront(e)
+	}
+}
+
+// forget unregisters the entry, no longer loaded.
+func (c *entryCache) forget(fsn FSNode) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.entries[fsn]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, fsn)
+	}
+}
+
+// oldest returns the least recently used entry if over the limit, moving
+// it to the front so the entries that can't be evicted are skipped.
+func (c *entryCache) oldest() *cachedEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.lru.Len() <= c.max {
+		return nil
+	}
+	e := c.lru.Back()
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedEntry)
+}
+
+func (c *entryCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+// evict evicts the least recently used entries while over the limit,
+// trying each entry at most once.
+func (c *entryCache) evict() {
+	for tries := c.len(); tries > 0; tries-- {
+		ce := c.oldest()
+		if ce == nil {
+			return
+		}
+		ce.dir.evict(ce.name, ce.fsn)
+	}
+}
+
+// evict uncaches the entry 'name' if it's still 'fsn' and flushed.
+func (d *Directory) evict(name string, fsn FSNode) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.entriesCache[name] != fsn {
+		// Replaced or removed without being detached.
+		entries(d.parent).forget(fsn)
+		return
+	}
+	if dir, ok := fsn.(*Directory); ok && dir.hasCachedEntries() {
+		return
+	}
+
+	spill := spills(d.parent)
+	var nd ipld.Node
+	var state spilledEntry
+	if spill != nil {
+		var err error
+		nd, state, err = spillState(fsn)
+		if err != nil {
+			log.Errorf("failed to evict %s: %s", name, err)
+			return
+		}
+	}
+	if err := d.uncacheUnsync(name); err != nil {
+		log.Errorf("failed to evict %s: %s", name, err)
+		return
+	}
+	if _, ok := d.entriesCache[name]; ok || spill == nil {
+		// In use, or nothing to spill.
+		return
+	}
+	if err := spill.spill(d.ctx, path.Join(d.Path(), name), nd, state); err != nil {
+		log.Errorf("failed to spill %s: %s", name, err)
+	}
+}
+
+func (d *Directory) hasCachedEntries() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.entriesCache) > 0
+}
+
+// cacheEntry caches the entry 'name' loaded from the node 'c'.
+func (d *Directory) cacheEntry(name string, fsn FSNode, c cid.Cid) {
+	d.entriesCache[name] = fsn
+	d.entryCids[name] = c
+	entries(d.parent).add(d, name, fsn)
+}
+
+// entries returns the entry cache of the root of 'p' (nil if unbounded
+// or detached from a root).
+func entries(p parent) *entryCache {
+	if r := rootOf(p); r != nil {
+		return r.entries
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package mfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	gopath "path"
+
+	uio "github.com/ipfs/go-unixfs/io"
+
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// ErrNotDir is returned (wrapped) when a path goes through an entry that
+// isn't a directory.
+var ErrNotDir = errors.New("not a directory")
+
+// ErrDetached is returned by the operations on a `Directory` or `File`
+// whose entry was unlinked or moved (or dropped from the cache, see
+// `Directory.Uncache`) since it was loaded: the reference is stale, the
+// entry must be looked up again.
+var ErrDetached = errors.New("stale reference to an entry no longer in the tree")
+
+// ErrIntoItself is returned (wrapped) when moving or copying a directory
+// onto itself or into one of its descendants.
+var ErrIntoItself = errors.New("cannot move or copy a directory into itself")
+
+// PathError records the error of an MFS operation along with the path it
+// concerns, like `os.PathError`. Its message reads like the ones of the
+// command line tools, e.g., "mv: /photos/2021: not a directory".
+type PathError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	if e.Op == "" {
+		return e.Path + ": " + e.Err.Error()
+	}
+	return e.Op + ": " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
+// pathError wraps 'err' (if not nil) in a `*PathError` of the operation
+// 'op' on 'pth'. Errors already attached to a (more precise) path keep
+// it, only taking the operation if they had none.
+func pathError(op, pth string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if pe, ok := err.(*PathError); ok {
+		if pe.Op == "" {
+			pe.Op = op
+		}
+		return pe
+	}
+	return &PathError{Op: op, Path: gopath.Clean("/" + pth), Err: err}
+}
+
+// ErrReadOnly is returned (wrapped) when writing through a descriptor
+// opened for reading only.
+var ErrReadOnly = errors.New("read-only")
+
+// ErrNotEmpty is not returned by MFS, whose removals are recursive, but
+// is classified as `CodeNotEmpty` for the embedders refusing to remove
+// non-empty directories on their own.
+var ErrNotEmpty = errors.New("directory not empty")
+
+// ErrorCode classifies the errors of MFS for the embedders translating
+// them to their own codes (like HTTP statuses), see `Code`. The values
+// are stable, new codes are only ever appended.
+type ErrorCode int
+
+const (
+	// CodeUnknown is any other error (invalid argument, malformed DAG,
+	// internal failure...).
+	CodeUnknown ErrorCode = 0
+	// CodeNotExist is a missing entry (or root, or upload session).
+	CodeNotExist ErrorCode = 1
+	// CodeExist is an entry in the way of one being created.
+	CodeExist ErrorCode = 2
+	// CodeNotDir is a path going through an entry that isn't a
+	// directory.
+	CodeNotDir ErrorCode = 3
+	// CodeIsDir is a file operation on a directory.
+	CodeIsDir ErrorCode = 4
+	// CodeNotEmpty is the removal of a non-empty directory refused.
+	CodeNotEmpty ErrorCode = 5
+	// CodeReadOnly is a write refused, like through a read-only
+	// descriptor.
+	CodeReadOnly ErrorCode = 6
+	// CodeQuota is a limit of the root exceeded (file size, directory
+	// entries).
+	CodeQuota ErrorCode = 7
+	// CodeStale is a stale reference to an entry, descriptor or state
+	// of the tree: look it up again (or retry the changes).
+	CodeStale ErrorCode = 8
+	// CodeClosed is a closed file, descriptor or root.
+	CodeClosed ErrorCode = 9
+	// CodeOffline is a block that couldn't be fetched.
+	CodeOffline ErrorCode = 10
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	CodeUnknown:  "Unknown",
+	CodeNotExist: "NotExist",
+	CodeExist:    "Exist",
+	CodeNotDir:   "NotDir",
+	CodeIsDir:    "IsDir",
+	CodeNotEmpty: "NotEmpty",
+	CodeReadOnly: "ReadOnly",
+	CodeQuota:    "Quota",
+	CodeStale:    "Stale",
+	CodeClosed:   "Closed",
+	CodeOffline:  "Offline",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("ErrorCode(%d)", int(c))
+}
+
+// errorCodes maps the errors MFS returns (wrapped) to their codes.
+var errorCodes = []struct {
+	err  error
+	code ErrorCode
+}{
+	{fs.ErrNotExist, CodeNotExist},
+	{ErrNotExist, CodeNotExist},
+	{ErrNoUpload, CodeNotExist},
+	{fs.ErrExist, CodeExist},
+	{ErrDirExists, CodeExist},
+	{ErrNotDir, CodeNotDir},
+	{uio.ErrNotADir, CodeNotDir},
+	{ErrIsDirectory, CodeIsDir},
+	{ErrNotEmpty, CodeNotEmpty},
+	{ErrReadOnly, CodeReadOnly},
+	{fs.ErrPermission, CodeReadOnly},
+	{ErrFileTooLarge, CodeQuota},
+	{ErrTooManyEntries, CodeQuota},
+	{ErrDetached, CodeStale},
+	{ErrRevoked, CodeStale},
+	{ErrApplyConflict, CodeStale},
+	{ErrClosed, CodeClosed},
+	{ErrClosedIdle, CodeClosed},
+	{ErrBadFd, CodeClosed},
+	{ErrRootClosed, CodeClosed},
+	{fs.ErrClosed, CodeClosed},
+	{ipld.ErrNotFound, CodeOffline},
+}
+
+// Code returns the code classifying 'err' (`CodeUnknown` for nil).
+func Code(err error) ErrorCode {
+	if err == nil {
+		return CodeUnknown
+	}
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code
+		}
+	}
+	return CodeUnknown
+}
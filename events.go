@@ -0,0 +1,120 @@
+package mfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Op describes a set of MFS mutations affecting a path. Its bits have the
+// same values and meaning as the ones of `fsnotify.Op` so integrations
+// (FUSE mounts, sync daemons) can convert events with a plain cast.
+type Op uint32
+
+const (
+	// Create: a new entry was added at the path.
+	Create Op = 1 << iota
+	// Write: the contents at the path were modified.
+	Write
+	// Remove: the entry at the path was removed.
+	Remove
+	// Rename: the entry at the path was moved elsewhere.
+	Rename
+	// Chmod: the metadata of the entry at the path changed.
+	Chmod
+
+	// Overflow: events were dropped because the consumer was too slow
+	// (it has no fsnotify counterpart and its `Event.Name` is empty).
+	Overflow
+	// Flush: the entry at the path was flushed, its node is stored and
+	// propagated up to the root (it has no fsnotify counterpart).
+	Flush
+)
+
+var opNames = []struct {
+	op   Op
+	name string
+}{
+	{Create, "CREATE"},
+	{Write, "WRITE"},
+	{Remove, "REMOVE"},
+	{Rename, "RENAME"},
+	{Chmod, "CHMOD"},
+	{Overflow, "OVERFLOW"},
+	{Flush, "FLUSH"},
+}
+
+// Has reports whether 'op' includes all the bits of 'h'.
+func (op Op) Has(h Op) bool {
+	return op&h == h
+}
+
+func (op Op) String() string {
+	var names []string
+	for _, on := range opNames {
+		if op.Has(on.op) {
+			names = append(names, on.name)
+		}
+	}
+	if len(names) == 0 {
+		return "[no events]"
+	}
+	return strings.Join(names, "|")
+}
+
+// Event reports a mutation in the MFS, laid out like `fsnotify.Event`.
+type Event struct {
+	// Name is the absolute MFS path of the affected entry.
+	Name string
+	Op   Op
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("%q: %s", e.Name, e.Op)
+}
+
+// CoalesceEvents reduces a batch of events (in the order they happened)
+// following the fsnotify conventions, so consumers see the minimal set
+// of changes:
+//   - A Write, Chmod or Flush following an event for the same path (other
+//     than a Remove or Rename) is merged into it.
+//   - A Remove following a Create of the same path cancels both, the entry
+//     was never observable.
+//   - A Remove following only Write/Chmod/Flush events of the same path
+//     replaces them, the modifications are moot.
+//
+// The relative order of the remaining events is preserved.
+func CoalesceEvents(events []Event) []Event {
+	out := make([]Event, 0, len(events))
+	// Index in `out` of the latest event of each path.
+	last := make(map[string]int)
+
+	for _, e := range events {
+		idx, ok := last[e.Name]
+		if ok && out[idx].Op&(Remove|Rename) == 0 {
+			prev := &out[idx]
+			switch {
+			case e.Op&^(Write|Chmod|Flush) == 0:
+				prev.Op |= e.Op
+				continue
+			case e.Op == Remove && prev.Op.Has(Create):
+				prev.Op = 0
+				delete(last, e.Name)
+				continue
+			case e.Op == Remove:
+				prev.Op = 0
+			}
+		}
+
+		last[e.Name] = len(out)
+		out = append(out, e)
+	}
+
+	// Filter the events dropped above.
+	res := out[:0]
+	for _, e := range out {
+		if e.Op != 0 {
+			res = append(res, e)
+		}
+	}
+	return res
+}
@@ -0,0 +1,180 @@
+package mfs
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCoalesceEvents(t *testing.T) {
+	events := []Event{
+		{"/a", Create},
+		{"/a", Write},
+		{"/b", Write},
+		{"/b", Write},
+		{"/b", Chmod},
+		{"/tmp", Create},
+		{"/tmp", Write},
+		{"/tmp", Remove},
+		{"/c", Write},
+		{"/c", Remove},
+		{"/d", Remove},
+		{"/d", Create},
+		{"/e", Rename},
+		{"/e", Write},
+	}
+
+	expected := []Event{
+		{"/a", Create | Write},
+		{"/b", Write | Chmod},
+		{"/c", Remove},
+		{"/d", Remove},
+		{"/d", Create},
+		{"/e", Rename},
+		{"/e", Write},
+	}
+
+	out := CoalesceEvents(events)
+	if len(out) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, out)
+	}
+	for i := range out {
+		if out[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, out)
+		}
+	}
+}
+
+func TestOpString(t *testing.T) {
+	if s := (Create | Write).String(); s != "CREATE|WRITE" {
+		t.Fatalf("unexpected op string %q", s)
+	}
+	if s := Op(0).String(); s != "[no events]" {
+		t.Fatalf("unexpected op string %q", s)
+	}
+}
+
+func TestWatchOverflowDropOldest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	w := rt.Watch(WatchOpts{BufferSize: 2, Overflow: OverflowDropOldest})
+	defer w.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := dir.Mkdir(fmt.Sprintf("d%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var received []Event
+	for {
+		select {
+		case e := <-w.Events():
+			received = append(received, e)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for events, got %v", received)
+		}
+		if received[len(received)-1].Name == "/d4" {
+			break
+		}
+	}
+
+	var overflowed bool
+	for _, e := range received {
+		if e.Op == Overflow {
+			overflowed = true
+		}
+	}
+	if !overflowed || len(received) >= 6 {
+		t.Fatalf("expected events to be dropped with an overflow marker, got %v", received)
+	}
+}
+
+func TestWatchOverflowBlock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	w := rt.Watch(WatchOpts{BufferSize: 1, Overflow: OverflowBlock})
+	defer w.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		for i := 0; i < 4; i++ {
+			if _, err := dir.Mkdir(fmt.Sprintf("d%d", i)); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+
+	select {
+	case <-errs:
+		t.Fatal("mutations should have blocked on the full watcher")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	for i := 0; i < 4; i++ {
+		select {
+		case e := <-w.Events():
+			if e.Name != fmt.Sprintf("/d%d", i) || e.Op != Create {
+				t.Fatalf("unexpected event %s", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for events")
+		}
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchPath(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	a := mkdirP(t, rt.GetDirectory(), "a")
+
+	w := rt.Watch(WatchOpts{Path: "a", BufferSize: 100})
+	defer w.Close()
+
+	if err := a.AddChild("x", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.GetDirectory().AddChild("ab", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mv(rt, "/a/x", "/a/y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Event{
+		{"/a/x", Create},
+		{"/a/y", Create},
+		{"/a/x", Rename},
+		{"/a", Flush},
+	}
+	for _, exp := range expected {
+		select {
+		case e := <-w.Events():
+			if e != exp {
+				t.Fatalf("expected %s, got %s", exp, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s", exp)
+		}
+	}
+}
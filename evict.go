@@ -0,0 +1,76 @@
+package mfs
+
+import (
+	"errors"
+	gopath "path"
+)
+
+// ErrInUse is returned by `Root.Evict` for an entry with open
+// descriptors, its own if it's a file or ones of the entries below it.
+var ErrInUse = errors.New("entry in use")
+
+// Evict flushes the entry at 'pth' and drops it from the cache of its
+// directory (see `Directory.Uncache`), so the memory held by the subtree
+// can be garbage collected while the rest of the tree stays loaded. It
+// refuses with `ErrInUse` to evict an entry with open descriptors.
+// Evicting the root evicts all of its entries, refusing if any is in
+// use. The references to the evicted entries become stale, failing with
+// `ErrDetached`.
+func (kr *Root) Evict(pth string) (err error) {
+	defer kr.recoverPanic(&err)
+
+	pth = gopath.Clean("/" + pth)
+	if pth == "/" {
+		return pathError("evict", pth, kr.evictAll())
+	}
+
+	fsn, err := Lookup(kr, pth)
+	if err != nil {
+		return pathError("evict", pth, err)
+	}
+	if inUse(fsn) {
+		return pathError("evict", pth, ErrInUse)
+	}
+	if err := fsn.Flush(); err != nil {
+		return pathError("evict", pth, err)
+	}
+
+	pdir, name, err := lookupParent(kr, pth)
+	if err != nil {
+		return pathError("evict", pth, err)
+	}
+	pdir.lock.Lock()
+	defer pdir.lock.Unlock()
+	if pdir.entriesCache[name] != fsn {
+		// Replaced (or already evicted) meanwhile.
+		return nil
+	}
+	// Opened meanwhile.
+	if inUse(fsn) {
+		return pathError("evict", pth, ErrInUse)
+	}
+	return pathError("evict", pth, pdir.uncacheUnsync(name))
+}
+
+// evictAll is `Evict` of the root directory.
+func (kr *Root) evictAll() error {
+	dir := kr.GetDirectory()
+	if err := dir.Flush(); err != nil {
+		return err
+	}
+
+	dir.lock.Lock()
+	defer dir.lock.Unlock()
+
+	for _, entry := range dir.entriesCache {
+		if inUse(entry) {
+			return ErrInUse
+		}
+	}
+	for name := range dir.entriesCache {
+		if err := dir.uncacheUnsync(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,8 +1,11 @@
 package mfs
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
 	mod "github.com/ipfs/go-unixfs/mod"
 
@@ -11,6 +14,11 @@ import (
 	ipld "github.com/ipfs/go-ipld-format"
 )
 
+// ErrClosedIdle is returned by operations on a `FileDescriptor` that was
+// automatically flushed and closed after staying unused for longer than
+// the `File`'s `IdleTimeout`.
+var ErrClosedIdle = errors.New("file closed after idle timeout")
+
 type state uint8
 
 const (
@@ -41,6 +49,38 @@ type FileDescriptor interface {
 	Truncate(int64) error
 	Size() (int64, error)
 	Flush() error
+
+	// Context-aware variants of `Flush` and `Close`, if the context is
+	// canceled the file is left at its last synced state and a
+	// `*FlushError` is returned.
+	CtxFlush(context.Context) error
+	CtxClose(context.Context) error
+
+	// Abort closes the descriptor discarding the modifications not
+	// flushed yet, the file is left at its last flushed state.
+	Abort() error
+
+	// Stats returns the counters of the writes made through the
+	// descriptor, available after it's closed as well.
+	Stats() DescriptorStats
+}
+
+var _ FileDescriptor = (*fileDescriptor)(nil)
+
+// FlushError is returned when a flush is interrupted by its context
+// being canceled: the file is left at its last synced state, holding
+// `Persisted` bytes.
+type FlushError struct {
+	Persisted int64
+	Err       error
+}
+
+func (e *FlushError) Error() string {
+	return fmt.Sprintf("flush interrupted with %d bytes persisted: %s", e.Persisted, e.Err)
+}
+
+func (e *FlushError) Unwrap() error {
+	return e.Err
 }
 
 type fileDescriptor struct {
@@ -48,22 +88,90 @@ type fileDescriptor struct {
 	mod   *mod.DagModifier
 	flags Flags
 
+	// Maximum size of the file (0 for no limit), see `WithMaxFileSize`.
+	maxSize int64
+
 	state state
+
+	// Write counters, `dserv` counts the blocks added through it.
+	stats DescriptorStats
+	dserv ipld.DAGService
+
+	// Lock around the descriptor, necessary because the idle timer
+	// may close it concurrently with the owner using it.
+	lock sync.Mutex
+
+	// Idle auto-close support, `idleTimer` is nil if the `File` had
+	// no `IdleTimeout` set when this descriptor was opened.
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	lastUse     time.Time
+	closedIdle  bool
+}
+
+// closedErr returns the error reported when using a closed descriptor.
+func (fi *fileDescriptor) closedErr() error {
+	if fi.closedIdle {
+		return ErrClosedIdle
+	}
+	return ErrClosed
+}
+
+// touch records a use of the descriptor, postponing the idle auto-close.
+func (fi *fileDescriptor) touch() {
+	if fi.idleTimer != nil {
+		fi.lastUse = time.Now()
+	}
+}
+
+// startIdleTimer arms the idle auto-close timer if a timeout was given.
+func (fi *fileDescriptor) startIdleTimer(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	// The timer may fire before it's even stored.
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.idleTimeout = timeout
+	fi.lastUse = time.Now()
+	fi.idleTimer = time.AfterFunc(timeout, fi.closeIdle)
+}
+
+// closeIdle is called by the idle timer. If the descriptor was used
+// since the timer was armed it is re-armed for the remaining time,
+// otherwise the descriptor is flushed and closed so it no longer
+// holds the `File`'s descriptor lock.
+func (fi *fileDescriptor) closeIdle() {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+
+	if fi.state == stateClosed {
+		return
+	}
+	if idle := time.Since(fi.lastUse); idle < fi.idleTimeout {
+		fi.idleTimer.Reset(fi.idleTimeout - idle)
+		return
+	}
+
+	if err := fi.closeUnsync(context.TODO()); err != nil {
+		log.Errorf("failed to flush idle file descriptor of %s: %s", fi.inode.name, err)
+	}
+	fi.closedIdle = true
 }
 
 func (fi *fileDescriptor) checkWrite() error {
 	if fi.state == stateClosed {
-		return ErrClosed
+		return fi.closedErr()
 	}
 	if !fi.flags.Write {
-		return fmt.Errorf("file is read-only")
+		return fmt.Errorf("file is %w", ErrReadOnly)
 	}
 	return nil
 }
 
 func (fi *fileDescriptor) checkRead() error {
 	if fi.state == stateClosed {
-		return ErrClosed
+		return fi.closedErr()
 	}
 	if !fi.flags.Read {
 		return fmt.Errorf("file is write-only")
@@ -72,40 +180,81 @@ func (fi *fileDescriptor) checkRead() error {
 }
 
 // Size returns the size of the file referred to by this descriptor
-func (fi *fileDescriptor) Size() (int64, error) {
+func (fi *fileDescriptor) Size() (_ int64, err error) {
+	defer fi.inode.root().recoverPanic(&err)
+
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
 	return fi.mod.Size()
 }
 
 // Truncate truncates the file to size
-func (fi *fileDescriptor) Truncate(size int64) error {
+func (fi *fileDescriptor) Truncate(size int64) (err error) {
+	defer fi.inode.root().recoverPanic(&err)
+
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.touch()
+
 	if err := fi.checkWrite(); err != nil {
-		return fmt.Errorf("truncate failed: %s", err)
+		return fmt.Errorf("truncate failed: %w", err)
+	}
+	if err := fi.checkFileSize(size, 0); err != nil {
+		return fmt.Errorf("truncate failed: %w", err)
 	}
 	fi.state = stateDirty
 	return fi.mod.Truncate(size)
 }
 
 // Write writes the given data to the file at its current offset
-func (fi *fileDescriptor) Write(b []byte) (int, error) {
+func (fi *fileDescriptor) Write(b []byte) (n int, err error) {
+	defer fi.inode.root().recoverPanic(&err)
+
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.touch()
+
 	if err := fi.checkWrite(); err != nil {
-		return 0, fmt.Errorf("write failed: %s", err)
+		return 0, fmt.Errorf("write failed: %w", err)
+	}
+	if fi.flags.Append {
+		if _, err := fi.mod.Seek(0, io.SeekEnd); err != nil {
+			return 0, fmt.Errorf("write failed: %w", err)
+		}
+	}
+	if err := fi.checkFileSize(-1, len(b)); err != nil {
+		return 0, fmt.Errorf("write failed: %w", err)
 	}
 	fi.state = stateDirty
-	return fi.mod.Write(b)
+	n, err = fi.mod.Write(b)
+	fi.stats.BytesWritten += int64(n)
+	return n, err
 }
 
 // Read reads into the given buffer from the current offset
-func (fi *fileDescriptor) Read(b []byte) (int, error) {
+func (fi *fileDescriptor) Read(b []byte) (_ int, err error) {
+	defer fi.inode.root().recoverPanic(&err)
+
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.touch()
+
 	if err := fi.checkRead(); err != nil {
-		return 0, fmt.Errorf("read failed: %s", err)
+		return 0, fmt.Errorf("read failed: %w", err)
 	}
 	return fi.mod.Read(b)
 }
 
 // Read reads into the given buffer from the current offset
-func (fi *fileDescriptor) CtxReadFull(ctx context.Context, b []byte) (int, error) {
+func (fi *fileDescriptor) CtxReadFull(ctx context.Context, b []byte) (_ int, err error) {
+	defer fi.inode.root().recoverPanic(&err)
+
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.touch()
+
 	if err := fi.checkRead(); err != nil {
-		return 0, fmt.Errorf("read failed: %s", err)
+		return 0, fmt.Errorf("read failed: %w", err)
 	}
 	return fi.mod.CtxReadFull(ctx, b)
 }
@@ -113,17 +262,56 @@ func (fi *fileDescriptor) CtxReadFull(ctx context.Context, b []byte) (int, error
 // Close flushes, then propogates the modified dag node up the directory structure
 // and signals a republish to occur
 func (fi *fileDescriptor) Close() error {
+	return fi.CtxClose(context.TODO())
+}
+
+// CtxClose is `Close` honoring the context while flushing, the
+// descriptor is closed even if the flush is interrupted.
+func (fi *fileDescriptor) CtxClose(ctx context.Context) (err error) {
+	defer fi.inode.root().recoverPanic(&err)
+
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	return fi.closeUnsync(ctx)
+}
+
+// Abort implements `FileDescriptor.Abort`.
+func (fi *fileDescriptor) Abort() error {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
 	if fi.state == stateClosed {
-		return ErrClosed
+		return fi.closedErr()
+	}
+	fi.release()
+	return nil
+}
+
+// closeUnsync closes the descriptor without taking its lock.
+func (fi *fileDescriptor) closeUnsync(ctx context.Context) error {
+	if fi.state == stateClosed {
+		return fi.closedErr()
+	}
+	err := fi.flushUp(ctx, fi.flags.Sync)
+	fi.release()
+	return err
+}
+
+// release marks the descriptor closed and releases its hold on the
+// `File`, it must be called with the descriptor's lock taken.
+func (fi *fileDescriptor) release() {
+	if fi.idleTimer != nil {
+		fi.idleTimer.Stop()
 	}
 	if fi.flags.Write {
 		defer fi.inode.desclock.Unlock()
 	} else if fi.flags.Read {
 		defer fi.inode.desclock.RUnlock()
 	}
-	err := fi.flushUp(fi.flags.Sync)
 	fi.state = stateClosed
-	return err
+	fi.inode.releaseDescriptor()
+	if r := rootOf(fi.inode.parent); r != nil {
+		r.untrackDescriptor(fi)
+	}
 }
 
 // Flush generates a new version of the node of the underlying
@@ -131,24 +319,51 @@ func (fi *fileDescriptor) Close() error {
 // the entry in the parent directory (setting `fullSync` to
 // propagate the update all the way to the root).
 func (fi *fileDescriptor) Flush() error {
-	return fi.flushUp(true)
+	return fi.CtxFlush(context.TODO())
+}
+
+// CtxFlush is `Flush` honoring the context.
+func (fi *fileDescriptor) CtxFlush(ctx context.Context) (err error) {
+	defer fi.inode.root().recoverPanic(&err)
+
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	if fi.state == stateClosed {
+		return fi.closedErr()
+	}
+	fi.touch()
+	return fi.flushUp(ctx, true)
 }
 
 // flushUp syncs the file and adds it to the dagservice
 // it *must* be called with the File's lock taken
 // If `fullSync` is set the changes are propagated upwards
 // (the `Up` part of `flushUp`).
-func (fi *fileDescriptor) flushUp(fullSync bool) error {
+// If the context is canceled before the new node is stored the
+// `File` keeps its previous node (and the descriptor stays dirty).
+func (fi *fileDescriptor) flushUp(ctx context.Context, fullSync bool) error {
 	var nd ipld.Node
 	switch fi.state {
 	case stateCreated, stateDirty:
+		if err := ctx.Err(); err != nil {
+			return fi.flushError(err)
+		}
+		start := time.Now()
+		defer func() {
+			fi.stats.Flushes++
+			fi.stats.FlushDuration += time.Since(start)
+		}()
+
 		var err error
 		nd, err = fi.mod.GetNode()
 		if err != nil {
 			return err
 		}
-		err = fi.inode.dagService.Add(context.TODO(), nd)
+		err = fi.dserv.Add(ctx, nd)
 		if err != nil {
+			if ctx.Err() != nil {
+				return fi.flushError(ctx.Err())
+			}
 			return err
 		}
 
@@ -163,15 +378,21 @@ func (fi *fileDescriptor) flushUp(fullSync bool) error {
 		// Save the members to be used for subsequent calls
 		parent := fi.inode.parent
 		name := fi.inode.name
+		detached := fi.inode.detached
 		fi.inode.nodeLock.Unlock()
 
-		// Bubble up the update's to the parent, only if fullSync is set to true.
-		if fullSync {
+		// Bubble up the update's to the parent, only if fullSync is set to true
+		// (and the file wasn't unlinked, in which case there's no entry to update).
+		if fullSync && !detached {
 			if err := parent.updateChildEntry(child{name, nd}); err != nil {
 				return err
 			}
 		}
 
+		if dir, ok := parent.(*Directory); ok && fi.state == stateDirty && !detached {
+			dir.notify(name, Write)
+		}
+
 		fi.state = stateFlushed
 		return nil
 	case stateFlushed:
@@ -181,19 +402,48 @@ func (fi *fileDescriptor) flushUp(fullSync bool) error {
 	}
 }
 
+// flushError reports a flush interrupted by 'err'.
+func (fi *fileDescriptor) flushError(err error) error {
+	persisted, serr := fi.inode.Size()
+	if serr != nil {
+		return err
+	}
+	return &FlushError{Persisted: persisted, Err: err}
+}
+
 // Seek implements io.Seeker
-func (fi *fileDescriptor) Seek(offset int64, whence int) (int64, error) {
+func (fi *fileDescriptor) Seek(offset int64, whence int) (_ int64, err error) {
+	defer fi.inode.root().recoverPanic(&err)
+
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.touch()
+
 	if fi.state == stateClosed {
-		return 0, fmt.Errorf("seek failed: %s", ErrClosed)
+		return 0, fmt.Errorf("seek failed: %w", fi.closedErr())
 	}
 	return fi.mod.Seek(offset, whence)
 }
 
 // Write At writes the given bytes at the offset 'at'
-func (fi *fileDescriptor) WriteAt(b []byte, at int64) (int, error) {
+func (fi *fileDescriptor) WriteAt(b []byte, at int64) (n int, err error) {
+	defer fi.inode.root().recoverPanic(&err)
+
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.touch()
+
 	if err := fi.checkWrite(); err != nil {
-		return 0, fmt.Errorf("write-at failed: %s", err)
+		return 0, fmt.Errorf("write-at failed: %w", err)
+	}
+	if fi.flags.Append {
+		return 0, fmt.Errorf("write-at failed: file opened for appending")
+	}
+	if err := fi.checkFileSize(at, len(b)); err != nil {
+		return 0, fmt.Errorf("write-at failed: %w", err)
 	}
 	fi.state = stateDirty
-	return fi.mod.WriteAt(b, at)
+	n, err = fi.mod.WriteAt(b, at)
+	fi.stats.BytesWritten += int64(n)
+	return n, err
 }
@@ -0,0 +1,167 @@
+package mfs
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrBadFd is returned by the descriptor table operations of the `Root`
+// given a number that isn't an open descriptor.
+var ErrBadFd = errors.New("bad file descriptor")
+
+// ErrRevoked is returned when using a descriptor number whose file was
+// unlinked (or moved) since it was opened. The number stays allocated
+// until it's closed with `Root.CloseFd`.
+var ErrRevoked = errors.New("file descriptor revoked")
+
+// fdTable maps the descriptor numbers handed out by `Root.OpenFd` to
+// the open descriptors. Unlike `*File` references they can't go stale:
+// the descriptor of an unlinked file is revoked on next use.
+type fdTable struct {
+	lock sync.Mutex
+	fds  map[int]*tableEntry
+}
+
+type tableEntry struct {
+	file    *File
+	desc    FileDescriptor
+	revoked bool
+}
+
+// add registers a descriptor under the lowest free number.
+func (t *fdTable) add(fi *File, desc FileDescriptor) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.fds == nil {
+		t.fds = make(map[int]*tableEntry)
+	}
+	fd := 0
+	for t.fds[fd] != nil {
+		fd++
+	}
+	t.fds[fd] = &tableEntry{file: fi, desc: desc}
+	return fd
+}
+
+// get returns the descriptor numbered 'fd', revoking it (discarding its
+// unflushed changes) if its file was unlinked.
+func (t *fdTable) get(fd int) (FileDescriptor, error) {
+	t.lock.Lock()
+	e, ok := t.fds[fd]
+	if !ok {
+		t.lock.Unlock()
+		return nil, ErrBadFd
+	}
+	if e.revoked {
+		t.lock.Unlock()
+		return nil, ErrRevoked
+	}
+	if !e.file.isDetached() {
+		t.lock.Unlock()
+		return e.desc, nil
+	}
+	e.revoked = true
+	t.lock.Unlock()
+
+	_ = e.desc.Abort()
+	return nil, ErrRevoked
+}
+
+// remove unregisters the descriptor numbered 'fd', returning it unless
+// it was revoked (and so already released).
+func (t *fdTable) remove(fd int) (FileDescriptor, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	e, ok := t.fds[fd]
+	if !ok {
+		return nil, ErrBadFd
+	}
+	delete(t.fds, fd)
+	if e.revoked {
+		return nil, nil
+	}
+	return e.desc, nil
+}
+
+// open returns the numbers of the open descriptors.
+func (t *fdTable) open() []int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	fds := make([]int, 0, len(t.fds))
+	for fd := range t.fds {
+		fds = append(fds, fd)
+	}
+	return fds
+}
+
+// OpenFd opens the file at 'pth' returning the number of its descriptor
+// in the table of the root, to be used with `ReadFd`, `WriteFd`, `SeekFd`
+// and `CloseFd`. If the file is unlinked (or moved) the descriptor is
+// revoked: its unflushed changes are discarded and the operations on it
+// fail with `ErrRevoked`.
+func (kr *Root) OpenFd(pth string, flags Flags) (int, error) {
+	fsn, err := Lookup(kr, pth)
+	if err != nil {
+		return -1, pathError("open", pth, err)
+	}
+	fi, ok := fsn.(*File)
+	if !ok {
+		return -1, pathError("open", pth, ErrIsDirectory)
+	}
+	desc, err := fi.Open(flags)
+	if err != nil {
+		return -1, pathError("open", pth, err)
+	}
+	return kr.fds.add(fi, desc), nil
+}
+
+// ReadFd reads from the descriptor 'fd' at its current offset.
+func (kr *Root) ReadFd(fd int, b []byte) (int, error) {
+	desc, err := kr.fds.get(fd)
+	if err != nil {
+		return 0, err
+	}
+	return desc.Read(b)
+}
+
+// WriteFd writes to the descriptor 'fd' at its current offset.
+func (kr *Root) WriteFd(fd int, b []byte) (int, error) {
+	desc, err := kr.fds.get(fd)
+	if err != nil {
+		return 0, err
+	}
+	return desc.Write(b)
+}
+
+// SeekFd sets the offset of the descriptor 'fd', see `io.Seeker`.
+func (kr *Root) SeekFd(fd int, offset int64, whence int) (int64, error) {
+	desc, err := kr.fds.get(fd)
+	if err != nil {
+		return 0, err
+	}
+	return desc.Seek(offset, whence)
+}
+
+// CloseFd closes the descriptor 'fd' (flushing it) and frees its number.
+// Closing a revoked descriptor succeeds.
+func (kr *Root) CloseFd(fd int) error {
+	desc, err := kr.fds.remove(fd)
+	if err != nil || desc == nil {
+		return err
+	}
+	return desc.Close()
+}
+
+// closeFds closes the descriptors left open in the table.
+func (kr *Root) closeFds() error {
+	var firstErr error
+	for _, fd := range kr.fds.open() {
+		if err := kr.CloseFd(fd); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -3,13 +3,16 @@ package mfs
 import (
 	"context"
 	"fmt"
+	"io"
+	"os"
 	"sync"
+	"time"
 
 	dag "github.com/ipfs/go-merkledag"
 	ft "github.com/ipfs/go-unixfs"
 	mod "github.com/ipfs/go-unixfs/mod"
 
-	chunker "github.com/ipfs/go-ipfs-chunker"
+	cid "github.com/ipfs/go-cid"
 	ipld "github.com/ipfs/go-ipld-format"
 )
 
@@ -34,7 +37,24 @@ type File struct {
 	// there may be many `FileDescriptor`s operating on this `File`.
 	nodeLock sync.RWMutex
 
+	// Set when the file is unlinked from its parent directory: open
+	// descriptors keep working against the detached DAG but their
+	// flushes are no longer propagated to the parent. Protected by
+	// `nodeLock`, as is `openDescs` (the number of open descriptors).
+	detached  bool
+	openDescs int
+	// Set along with `detached` when the file was unlinked, rather than
+	// only dropped from the cache: its DAG is then reported to
+	// the `WithOnOrphan` function once its descriptors are closed.
+	unlinked bool
+
 	RawLeaves bool
+
+	// IdleTimeout, if set, is the time after which an unused open
+	// `FileDescriptor` is flushed and closed automatically (its owner
+	// getting `ErrClosedIdle` on next use), so an abandoned writer
+	// can't block `Sync` (and `Root.Close`) forever.
+	IdleTimeout time.Duration
 }
 
 // NewFile returns a NewFile object with the given parameters.  If the
@@ -56,7 +76,35 @@ func NewFile(name string, node ipld.Node, parent parent, dserv ipld.DAGService)
 	return fi, nil
 }
 
+// EmptyFileOpts is used by NewEmptyFileNode
+type EmptyFileOpts struct {
+	CidBuilder cid.Builder // nil for the CIDv0 default
+}
+
+// NewEmptyFileNode returns the canonical node of an empty file. It's a
+// UnixFS protobuf node even with a CIDv1 builder (an empty raw node
+// can't be appended to), data written to it later gets raw leaves in
+// that case as with any CIDv1 file (see `NewFile`).
+func NewEmptyFileNode(opts EmptyFileOpts) *dag.ProtoNode {
+	nd := dag.NodeWithData(ft.FilePBData(nil, 0))
+	nd.SetCidBuilder(opts.CidBuilder)
+	return nd
+}
+
 func (fi *File) Open(flags Flags) (_ FileDescriptor, _retErr error) {
+	return fi.CtxOpen(context.TODO(), flags)
+}
+
+// CtxOpen is `Open` with a context for the DAG operations of the
+// descriptor: reads and writes through it fail once it's canceled.
+func (fi *File) CtxOpen(ctx context.Context, flags Flags) (_ FileDescriptor, _retErr error) {
+	if (flags.Append || flags.Truncate) && !flags.Write {
+		return nil, fmt.Errorf("file opened for appending or truncating but not writing")
+	}
+	if flags.Create && flags.Exclusive {
+		return nil, os.ErrExist
+	}
+
 	if flags.Write {
 		fi.desclock.Lock()
 		defer func() {
@@ -76,8 +124,11 @@ func (fi *File) Open(flags Flags) (_ FileDescriptor, _retErr error) {
 	}
 
 	fi.nodeLock.RLock()
-	node := fi.node
+	node, detached := fi.node, fi.detached
 	fi.nodeLock.RUnlock()
+	if detached {
+		return nil, ErrDetached
+	}
 
 	// TODO: Move this `switch` logic outside (maybe even
 	// to another package, this seems like a job of UnixFS),
@@ -92,9 +143,9 @@ func (fi *File) Open(flags Flags) (_ FileDescriptor, _retErr error) {
 
 		switch fsn.Type() {
 		default:
-			return nil, fmt.Errorf("unsupported fsnode type for 'file'")
+			return nil, fmt.Errorf("unsupported fsnode type for 'file': %w", ErrUnsupportedType)
 		case ft.TSymlink:
-			return nil, fmt.Errorf("symlinks not yet supported")
+			return nil, fmt.Errorf("cannot open symlink %s, see Readlink", fi.name)
 		case ft.TFile, ft.TRaw:
 			// OK case
 		}
@@ -102,20 +153,65 @@ func (fi *File) Open(flags Flags) (_ FileDescriptor, _retErr error) {
 		// Ok as well.
 	}
 
-	dmod, err := mod.NewDagModifier(context.TODO(), node, fi.dagService, chunker.DefaultSplitter)
-	// TODO: Remove the use of the `chunker` package here, add a new `NewDagModifier` in
-	// `go-unixfs` with the `DefaultSplitter` already included.
+	spec := flags.Chunker
+	if spec == "" {
+		spec = chunkerOf(fi.parent)
+	}
+	splitter, err := splitterGen(spec)
 	if err != nil {
 		return nil, err
 	}
-	dmod.RawLeaves = fi.RawLeaves
 
-	return &fileDescriptor{
+	fd := &fileDescriptor{
 		inode: fi,
 		flags: flags,
-		mod:   dmod,
 		state: stateCreated,
-	}, nil
+	}
+	fd.dserv = &statsDAG{DAGService: fi.dagService, stats: &fd.stats}
+
+	dmod, err := mod.NewDagModifier(ctx, node, fd.dserv, splitter)
+	if err != nil {
+		return nil, err
+	}
+	dmod.RawLeaves = fi.RawLeaves
+	if r := rootOf(fi.parent); r != nil && r.cidPrefix != nil {
+		dmod.Prefix = *r.cidPrefix
+		dmod.RawLeaves = fi.RawLeaves || r.cidPrefix.Version > 0
+	}
+	fd.mod = dmod
+	if dir, ok := fi.parent.(*Directory); ok {
+		fd.maxSize = dir.limits.maxFileSize
+	}
+	if flags.Truncate {
+		if err := dmod.Truncate(0); err != nil {
+			return nil, err
+		}
+		fd.state = stateDirty
+	}
+	if flags.Append {
+		if _, err := dmod.Seek(0, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+	// Checked again along with the count `detach` looks at, so the file
+	// can't be unlinked in between without being reported as orphaned
+	// once this descriptor is closed.
+	fi.nodeLock.Lock()
+	if fi.detached {
+		fi.nodeLock.Unlock()
+		return nil, ErrDetached
+	}
+	fi.openDescs++
+	r := rootOf(fi.parent)
+	fi.nodeLock.Unlock()
+
+	if r != nil {
+		r.trackDescriptor(fd)
+	}
+	// Only once counted and tracked, which closing it on idle undoes.
+	fd.startIdleTimer(fi.IdleTimeout)
+
+	return fd, nil
 }
 
 // Size returns the size of this file
@@ -124,16 +220,69 @@ func (fi *File) Open(flags Flags) (_ FileDescriptor, _retErr error) {
 // through the `DagModifier`'s `fileSize` function is doing
 // pretty much the same thing as here, we should at least call
 // that function and wrap the `ErrNotUnixfs` with an MFS text.
-func (fi *File) Size() (int64, error) {
+func (fi *File) Size() (_ int64, err error) {
+	defer fi.root().recoverPanic(&err)
+
 	fi.nodeLock.RLock()
-	defer fi.nodeLock.RUnlock()
-	switch nd := fi.node.(type) {
+	nd := fi.node
+	fi.nodeLock.RUnlock()
+
+	return nodeSize(context.TODO(), fi.dagService, nd)
+}
+
+// nodeSize returns the size of the file content in 'nd'. If its UnixFS
+// metadata is inconsistent (block sizes not matching its links, or not
+// adding up to its filesize, as produced by some other implementations)
+// a warning is logged and the size is computed by traversing the DAG
+// instead.
+func nodeSize(ctx context.Context, dserv ipld.DAGService, nd ipld.Node) (int64, error) {
+	switch nd := nd.(type) {
 	case *dag.ProtoNode:
 		fsn, err := ft.FSNodeFromBytes(nd.Data())
 		if err != nil {
 			return 0, err
 		}
-		return int64(fsn.FileSize()), nil
+		sum := uint64(len(fsn.Data()))
+		for _, bs := range fsn.BlockSizes() {
+			sum += bs
+		}
+		if fsn.NumChildren() == len(nd.Links()) && sum == fsn.FileSize() {
+			return int64(fsn.FileSize()), nil
+		}
+
+		log.Warnf("inconsistent unixfs metadata in %s (%d block sizes for %d links, %d bytes for a filesize of %d), computing size by traversal",
+			nd.Cid(), fsn.NumChildren(), len(nd.Links()), sum, fsn.FileSize())
+		return traverseSize(ctx, dserv, nd)
+	case *dag.RawNode:
+		return int64(len(nd.RawData())), nil
+	default:
+		return 0, fmt.Errorf("unrecognized node type in mfs/file.Size()")
+	}
+}
+
+// traverseSize computes the size of the file content in 'nd' adding up
+// the data of all the nodes in its DAG.
+func traverseSize(ctx context.Context, dserv ipld.DAGService, nd ipld.Node) (int64, error) {
+	switch nd := nd.(type) {
+	case *dag.ProtoNode:
+		var size int64
+		if fsn, err := ft.FSNodeFromBytes(nd.Data()); err == nil {
+			size = int64(len(fsn.Data()))
+		}
+
+		for _, l := range nd.Links() {
+			child, err := l.GetNode(ctx, dserv)
+			if err != nil {
+				return 0, err
+			}
+
+			childSize, err := traverseSize(ctx, dserv, child)
+			if err != nil {
+				return 0, err
+			}
+			size += childSize
+		}
+		return size, nil
 	case *dag.RawNode:
 		return int64(len(nd.RawData())), nil
 	default:
@@ -141,6 +290,97 @@ func (fi *File) Size() (int64, error) {
 	}
 }
 
+// FileLayout identifies how the nodes of a file DAG are arranged.
+type FileLayout string
+
+const (
+	// LayoutSingle is a file stored in a single node.
+	LayoutSingle FileLayout = "single"
+	// LayoutFlat is a root linking directly to all the leaves (the
+	// balanced and trickle layouts can't be told apart at this size).
+	LayoutFlat FileLayout = "flat"
+	// LayoutBalanced is a DAG with all the leaves at the same depth.
+	LayoutBalanced FileLayout = "balanced"
+	// LayoutTrickle is a DAG with leaves and subtrees under the root.
+	LayoutTrickle FileLayout = "trickle"
+)
+
+// FileAttributes describes how the DAG of an existing file was built,
+// so tooling can display (and preserve) it when copying files.
+type FileAttributes struct {
+	// RawLeaves is set if the leaves of the DAG are raw nodes.
+	RawLeaves bool
+	// CidVersion of the root node of the file.
+	CidVersion uint64
+	// ChunkSize is the approximate size of the chunks the file was split
+	// into (the size of its first leaf).
+	ChunkSize int64
+	Layout    FileLayout
+}
+
+// Attributes detects the attributes of the file's DAG. Only the first
+// and last branches are inspected so the cost doesn't depend on the
+// file size.
+func (fi *File) Attributes() (_ FileAttributes, err error) {
+	defer fi.root().recoverPanic(&err)
+
+	ctx := context.TODO()
+
+	nd, err := fi.GetNode()
+	if err != nil {
+		return FileAttributes{}, err
+	}
+
+	attrs := FileAttributes{
+		CidVersion: nd.Cid().Prefix().Version,
+		Layout:     LayoutSingle,
+	}
+
+	links := nd.Links()
+	if len(links) > 0 {
+		first, err := links[0].GetNode(ctx, fi.dagService)
+		if err != nil {
+			return FileAttributes{}, err
+		}
+		last, err := links[len(links)-1].GetNode(ctx, fi.dagService)
+		if err != nil {
+			return FileAttributes{}, err
+		}
+
+		switch {
+		case len(first.Links()) == 0 && len(last.Links()) == 0:
+			attrs.Layout = LayoutFlat
+		case len(first.Links()) == 0:
+			attrs.Layout = LayoutTrickle
+		default:
+			attrs.Layout = LayoutBalanced
+		}
+
+		// Descend through the first links to reach the first leaf.
+		for len(first.Links()) > 0 {
+			first, err = first.Links()[0].GetNode(ctx, fi.dagService)
+			if err != nil {
+				return FileAttributes{}, err
+			}
+		}
+		nd = first
+	}
+
+	switch leaf := nd.(type) {
+	case *dag.RawNode:
+		attrs.RawLeaves = true
+		attrs.ChunkSize = int64(len(leaf.RawData()))
+	case *dag.ProtoNode:
+		fsn, err := ft.FSNodeFromBytes(leaf.Data())
+		if err != nil {
+			return FileAttributes{}, err
+		}
+		attrs.ChunkSize = int64(len(fsn.Data()))
+	}
+
+	return attrs, nil
+}
+
 // GetNode returns the dag node associated with this file
 // TODO: Use this method and do not access the `nodeLock` directly anywhere else.
 func (fi *File) GetNode() (ipld.Node, error) {
@@ -149,6 +389,58 @@ func (fi *File) GetNode() (ipld.Node, error) {
 	return fi.node, nil
 }
 
+// SetNode replaces the contents of the file with the file DAG 'nd'. As
+// for a writer it waits for the open descriptors to be closed, then the
+// new node is stored and propagated to the parent directory.
+func (fi *File) SetNode(ctx context.Context, nd ipld.Node) (err error) {
+	defer fi.root().recoverPanic(&err)
+
+	nt, err := nodeType(nd)
+	if err != nil {
+		return err
+	}
+	if nt != TFile {
+		return fmt.Errorf("cannot set the node of %s: not a file", fi.name)
+	}
+	// Don't wait for the descriptors of a file no longer in the tree.
+	if fi.isDetached() {
+		return ErrDetached
+	}
+	fi.nodeLock.RLock()
+	dir, _ := fi.parent.(*Directory)
+	fname := fi.name
+	fi.nodeLock.RUnlock()
+	if dir != nil {
+		if err := dir.checkNodeSize(ctx, fname, nd); err != nil {
+			return err
+		}
+	}
+
+	fi.desclock.Lock()
+	defer fi.desclock.Unlock()
+
+	if err := fi.dagService.Add(ctx, nd); err != nil {
+		return err
+	}
+
+	fi.nodeLock.Lock()
+	if fi.detached {
+		fi.nodeLock.Unlock()
+		return ErrDetached
+	}
+	fi.node = nd
+	parent, name := fi.parent, fi.name
+	fi.nodeLock.Unlock()
+
+	if err := parent.updateChildEntry(child{name, nd}); err != nil {
+		return err
+	}
+	if dir, ok := parent.(*Directory); ok {
+		dir.notify(name, Write)
+	}
+	return nil
+}
+
 // TODO: Tight coupling with the `FileDescriptor`, at the
 // very least this should be an independent function that
 // takes a `File` argument and automates the open/flush/close
@@ -166,7 +458,70 @@ func (fi *File) Flush() error {
 
 	defer fd.Close()
 
-	return fd.Flush()
+	if err := fd.Flush(); err != nil {
+		return err
+	}
+
+	fi.nodeLock.RLock()
+	parent, name, detached := fi.parent, fi.name, fi.detached
+	fi.nodeLock.RUnlock()
+	if dir, ok := parent.(*Directory); ok && !detached {
+		dir.notify(name, Flush)
+	}
+	return nil
+}
+
+// detach marks the file as detached from its parent directory, either
+// 'unlinked' or only dropped from the cache (the entry is still in the
+// tree). If unlinked and no descriptors are open the file is reported as
+// orphaned right away, otherwise that's deferred until the last one is
+// closed.
+func (fi *File) detach(unlinked bool) {
+	fi.nodeLock.Lock()
+	fi.detached = true
+	fi.unlinked = fi.unlinked || unlinked
+	orphaned := fi.unlinked && fi.openDescs == 0
+	nd := fi.node
+	fi.nodeLock.Unlock()
+
+	if orphaned {
+		fi.reportOrphan(nd)
+	}
+}
+
+// root returns the `Root` of the tree holding the file (nil if none).
+func (fi *File) root() *Root {
+	fi.nodeLock.RLock()
+	defer fi.nodeLock.RUnlock()
+	return rootOf(fi.parent)
+}
+
+// isDetached tells whether the file was unlinked from its parent.
+func (fi *File) isDetached() bool {
+	fi.nodeLock.RLock()
+	defer fi.nodeLock.RUnlock()
+	return fi.detached
+}
+
+// releaseDescriptor is called when one of the file's descriptors is
+// closed, reporting the file as orphaned if it was the last one of
+// an already unlinked file.
+func (fi *File) releaseDescriptor() {
+	fi.nodeLock.Lock()
+	fi.openDescs--
+	orphaned := fi.unlinked && fi.openDescs == 0
+	nd := fi.node
+	fi.nodeLock.Unlock()
+
+	if orphaned {
+		fi.reportOrphan(nd)
+	}
+}
+
+func (fi *File) reportOrphan(nd ipld.Node) {
+	if r := fi.root(); r != nil && r.onOrphan != nil {
+		r.onOrphan(nd)
+	}
 }
 
 func (fi *File) Sync() error {
@@ -0,0 +1,192 @@
+package mfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	gopath "path"
+	"sync"
+)
+
+// FileHandle is an open MFS file with the methods of `*os.File` that make
+// sense for it, so it can be handed to code written against the standard
+// library (`io.ReadWriteSeeker`, `io.ReaderAt`, `io.WriterAt`, `Stat`,
+// `Truncate`...). It wraps a `FileDescriptor`, safe for concurrent use.
+type FileHandle struct {
+	name string // path it was opened at
+	file *File
+
+	lock sync.Mutex
+	desc FileDescriptor
+}
+
+var (
+	_ io.ReadWriteSeeker = (*FileHandle)(nil)
+	_ io.ReaderAt        = (*FileHandle)(nil)
+	_ io.WriterAt        = (*FileHandle)(nil)
+	_ io.Closer          = (*FileHandle)(nil)
+)
+
+// Open opens the file at 'pth' as a `FileHandle`.
+func Open(r *Root, pth string, flags Flags) (*FileHandle, error) {
+	return CtxOpen(r.GetDirectory().ctx, r, pth, flags)
+}
+
+// CtxOpen is `Open` with a context for the DAG operations of the handle
+// (see `File.CtxOpen`).
+func CtxOpen(ctx context.Context, r *Root, pth string, flags Flags) (*FileHandle, error) {
+	fsn, err := dirLookup(ctx, r.GetDirectory(), pth)
+	if err != nil {
+		return nil, pathError("open", pth, err)
+	}
+	fi, ok := fsn.(*File)
+	if !ok {
+		return nil, pathError("open", pth, ErrIsDirectory)
+	}
+	desc, err := fi.CtxOpen(ctx, flags)
+	if err != nil {
+		return nil, pathError("open", pth, err)
+	}
+	return &FileHandle{name: gopath.Clean("/" + pth), file: fi, desc: desc}, nil
+}
+
+// Name returns the path the file was opened at.
+func (h *FileHandle) Name() string {
+	return h.name
+}
+
+func (h *FileHandle) Read(b []byte) (int, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.desc.Read(b)
+}
+
+// ReadAt reads len(b) bytes at the offset 'off', without moving the
+// offset of the handle. As required by `io.ReaderAt` it fails (with
+// `io.EOF` at the end of the file) if fewer bytes are read.
+func (h *FileHandle) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, h.pathError("read", fmt.Errorf("negative offset"))
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	size, err := h.desc.Size()
+	if err != nil {
+		return 0, err
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+	short := int64(len(b)) > size-off
+	if short {
+		b = b[:size-off]
+	}
+
+	cur, err := h.desc.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := h.desc.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(h.desc, b)
+	if err == io.ErrUnexpectedEOF || (err == nil && short) {
+		err = io.EOF
+	}
+	if _, serr := h.desc.Seek(cur, io.SeekStart); serr != nil && err == nil {
+		err = serr
+	}
+	return n, err
+}
+
+func (h *FileHandle) Write(b []byte) (int, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.desc.Write(b)
+}
+
+// WriteAt writes 'b' at the offset 'off', without moving the offset of
+// the handle.
+func (h *FileHandle) WriteAt(b []byte, off int64) (int, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	cur, err := h.desc.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	// The descriptor moves its offset by the bytes written from where it
+	// was, not from 'off' (which could take it past the end of the file).
+	n, err := h.desc.WriteAt(b, off)
+	if _, serr := h.desc.Seek(cur, io.SeekStart); serr != nil && err == nil {
+		err = serr
+	}
+	return n, err
+}
+
+// WriteString is `Write` with the contents of a string.
+func (h *FileHandle) WriteString(s string) (int, error) {
+	return h.Write([]byte(s))
+}
+
+func (h *FileHandle) Seek(offset int64, whence int) (int64, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.desc.Seek(offset, whence)
+}
+
+// Truncate changes the size of the file.
+func (h *FileHandle) Truncate(size int64) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.pathError("truncate", h.desc.Truncate(size))
+}
+
+// Sync flushes the changes made through the handle to the tree.
+func (h *FileHandle) Sync() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.pathError("sync", h.desc.Flush())
+}
+
+// Stat describes the file, its size including the changes made through
+// the handle that aren't flushed yet.
+func (h *FileHandle) Stat() (fs.FileInfo, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	size, err := h.desc.Size()
+	if err != nil {
+		return nil, h.pathError("stat", err)
+	}
+	nd, err := h.file.GetNode()
+	if err != nil {
+		return nil, h.pathError("stat", err)
+	}
+	_, name := gopath.Split(h.name)
+	return NodeListing{
+		Name: name,
+		Type: int(TFile),
+		Size: size,
+		Hash: nd.Cid().String(),
+	}.FileInfo(), nil
+}
+
+// Stats returns the counters of the writes made through the handle.
+func (h *FileHandle) Stats() DescriptorStats {
+	return h.desc.Stats()
+}
+
+// Close flushes the changes made through the handle and closes it.
+func (h *FileHandle) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.pathError("close", h.desc.Close())
+}
+
+func (h *FileHandle) pathError(op string, err error) error {
+	return pathError(op, h.name, err)
+}
@@ -0,0 +1,186 @@
+package mfs
+
+import (
+	"context"
+	"io/fs"
+	gopath "path"
+	"sort"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// Permission bits reported by `FileInfo.Mode`: UnixFS 1.0 nodes don't
+// record any, so MFS entries look like the ones of a regular user-owned
+// tree.
+const (
+	DefaultDirPerm     fs.FileMode = 0o755
+	DefaultFilePerm    fs.FileMode = 0o644
+	DefaultSymlinkPerm fs.FileMode = 0o777
+)
+
+// FileInfo describes an MFS entry. It implements both `fs.FileInfo` and
+// `fs.DirEntry`, so the results of `Root.Lstat` and `Directory.ReadDir`
+// can be handed to any code expecting the standard filesystem metadata.
+type FileInfo struct {
+	listing NodeListing
+}
+
+var (
+	_ fs.FileInfo = (*FileInfo)(nil)
+	_ fs.DirEntry = (*FileInfo)(nil)
+)
+
+// FileInfo returns the `FileInfo` of the listed entry.
+func (nl NodeListing) FileInfo() *FileInfo {
+	return &FileInfo{listing: nl}
+}
+
+// Name returns the name of the entry (empty for the root).
+func (fi *FileInfo) Name() string {
+	return fi.listing.Name
+}
+
+// Size returns the size of the file contents (0 for directories).
+func (fi *FileInfo) Size() int64 {
+	return fi.listing.Size
+}
+
+// Mode returns the type bits of the entry along with the default
+// permissions of its type.
+func (fi *FileInfo) Mode() fs.FileMode {
+	switch t := fi.Type(); t {
+	case fs.ModeDir:
+		return t | DefaultDirPerm
+	case fs.ModeSymlink:
+		return t | DefaultSymlinkPerm
+	default:
+		return t | DefaultFilePerm
+	}
+}
+
+// ModTime returns the zero time, UnixFS 1.0 nodes don't record it.
+func (fi *FileInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+// IsDir tells whether the entry is a directory.
+func (fi *FileInfo) IsDir() bool {
+	return fi.listing.Type == int(TDir)
+}
+
+// Sys returns the `NodeListing` of the entry.
+func (fi *FileInfo) Sys() any {
+	return fi.listing
+}
+
+// Type returns the type bits of the entry.
+func (fi *FileInfo) Type() fs.FileMode {
+	if fi.listing.mode.Type() != 0 {
+		return fi.listing.mode.Type()
+	}
+	return NodeType(fi.listing.Type).FileMode()
+}
+
+// Info returns the entry itself, it's already fully described.
+func (fi *FileInfo) Info() (fs.FileInfo, error) {
+	return fi, nil
+}
+
+// Listing returns the `NodeListing` of the entry.
+func (fi *FileInfo) Listing() NodeListing {
+	return fi.listing
+}
+
+// Lstat is `StatPath` returning an `fs.FileInfo`. Symlinks aren't
+// followed.
+func (kr *Root) Lstat(ctx context.Context, pth string) (*FileInfo, error) {
+	nl, err := kr.StatPath(ctx, pth)
+	if err != nil {
+		return nil, err
+	}
+	return nl.FileInfo(), nil
+}
+
+// ReadDir lists the entries of the directory as `fs.DirEntry`s, sorted by
+// name like `fs.ReadDir` does.
+func (d *Directory) ReadDir(ctx context.Context) ([]fs.DirEntry, error) {
+	var out []fs.DirEntry
+	err := d.ForEachEntry(ctx, func(nl NodeListing) error {
+		out = append(out, nl.FileInfo())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name() < out[j].Name()
+	})
+	return out, nil
+}
+
+// NodeInfo describes the entry at a path, see `Stat`.
+type NodeInfo struct {
+	Name string
+	Type NodeType
+	// Mode has the type bits of the entry (telling symlinks apart) along
+	// with the default permissions of its type.
+	Mode fs.FileMode
+	// ModTime is only known for the directories loaded in memory (see
+	// `Directory.ModTime`), UnixFS 1.0 nodes don't record it.
+	ModTime time.Time
+	Cid     cid.Cid
+	// Size is the size of the file contents (0 for directories).
+	Size int64
+	// CumulativeSize is the size of the whole DAG of the entry,
+	// including the UnixFS metadata.
+	CumulativeSize uint64
+	// Blocks is the number of blocks directly linked by the node.
+	Blocks int
+}
+
+// Stat describes the entry at 'pth', without following symlinks.
+func Stat(rt *Root, pth string) (*NodeInfo, error) {
+	return CtxStat(rt.GetDirectory().ctx, rt, pth)
+}
+
+// CtxStat is `Stat` with a context for the DAG operations.
+func CtxStat(ctx context.Context, rt *Root, pth string) (*NodeInfo, error) {
+	info, err := stat(ctx, rt, pth)
+	return info, pathError("stat", pth, err)
+}
+
+func stat(ctx context.Context, rt *Root, pth string) (*NodeInfo, error) {
+	fsn, err := dirLookup(ctx, rt.GetDirectory(), pth)
+	if err != nil {
+		return nil, err
+	}
+	nd, err := fsn.GetNode()
+	if err != nil {
+		return nil, err
+	}
+
+	_, name := gopath.Split(gopath.Clean("/" + pth))
+	nl, _, err := policyListing(ctx, rt.GetDirectory().dagService, name, nd, rt.unsupported)
+	if err != nil {
+		return nil, err
+	}
+	cumulative, err := nd.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &NodeInfo{
+		Name:           name,
+		Type:           NodeType(nl.Type),
+		Mode:           nl.FileInfo().Mode(),
+		Cid:            nd.Cid(),
+		Size:           nl.Size,
+		CumulativeSize: cumulative,
+		Blocks:         len(nd.Links()),
+	}
+	if dir, ok := fsn.(*Directory); ok {
+		info.ModTime = dir.ModTime()
+	}
+	return info, nil
+}
@@ -0,0 +1,156 @@
+package mfs
+
+import (
+	"context"
+	"fmt"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// PersistHook is called with a new root once its whole DAG is stored in
+// the DAG service and before it's published, embedders can record it
+// durably as the recovery point of the MFS. If it fails the root isn't
+// published. It must not modify the MFS.
+type PersistHook func(context.Context, cid.Cid) error
+
+// FlushPhase is the step a flush of the root is in.
+type FlushPhase int
+
+const (
+	// FlushIdle means no flush is in progress.
+	FlushIdle FlushPhase = iota
+	// FlushChildren means the changed nodes below the root are being
+	// stored.
+	FlushChildren
+	// FlushRoot means all the nodes below the root are stored and the
+	// root node is being stored (and passed to the `PersistHook`).
+	FlushRoot
+)
+
+func (p FlushPhase) String() string {
+	switch p {
+	case FlushIdle:
+		return "idle"
+	case FlushChildren:
+		return "children"
+	case FlushRoot:
+		return "root"
+	default:
+		return fmt.Sprintf("FlushPhase(%d)", int(p))
+	}
+}
+
+// FlushState is returned by `Root.FlushState`.
+type FlushState struct {
+	Phase FlushPhase
+	// Root being stored in the `FlushRoot` phase, the last persisted
+	// one otherwise.
+	Root cid.Cid
+	// Error the last flush failed with (nil if it succeeded).
+	Err error
+}
+
+// FlushState reports the progress of the flushes of the root. A flush
+// is done in two phases: first every changed node below the root is
+// stored, then the root node is stored and (only then) swapped in as the
+// persisted root and handed to the republisher, so a published root
+// never references nodes missing from the DAG service.
+func (kr *Root) FlushState() FlushState {
+	kr.flushLock.Lock()
+	defer kr.flushLock.Unlock()
+	return kr.flushState
+}
+
+// PersistedRoot returns the last root whose whole DAG was stored (and
+// accepted by the `PersistHook`, if any).
+func (kr *Root) PersistedRoot() cid.Cid {
+	kr.flushLock.Lock()
+	defer kr.flushLock.Unlock()
+	return kr.persisted
+}
+
+func (kr *Root) setFlushPhase(phase FlushPhase, c cid.Cid) {
+	kr.flushLock.Lock()
+	defer kr.flushLock.Unlock()
+	kr.flushState.Phase = phase
+	if c.Defined() {
+		kr.flushState.Root = c
+	}
+}
+
+// flushFailed records the error a flush failed with and returns it.
+func (kr *Root) flushFailed(err error) error {
+	kr.flushLock.Lock()
+	defer kr.flushLock.Unlock()
+	kr.flushState = FlushState{Phase: FlushIdle, Root: kr.persisted, Err: err}
+	return err
+}
+
+// persistRoot runs the second phase of a flush: the nodes below 'nd'
+// must already be stored.
+//
+// The flushes below the root only take the locks of the directories they
+// go through, so the ones of disjoint subtrees run in parallel until here
+// and may reach it out of order: the latest node of the root directory,
+// which includes 'nd', is persisted rather than 'nd' itself (that could
+// be older than the last one persisted). A flush whose root was already
+// persisted (by a later one, or because nothing changed) is done without
+// storing nor publishing it again. It returns the root persisted.
+func (kr *Root) persistRoot(ctx context.Context, nd ipld.Node) (cid.Cid, error) {
+	kr.persistLock.Lock()
+	defer kr.persistLock.Unlock()
+
+	latest, err := kr.GetDirectory().latestNode()
+	if err != nil {
+		return cid.Undef, kr.flushFailed(err)
+	}
+	if c := latest.Cid(); c.Equals(kr.PersistedRoot()) {
+		kr.flushLock.Lock()
+		kr.flushState = FlushState{Phase: FlushIdle, Root: c}
+		kr.flushLock.Unlock()
+		return c, nil
+	}
+	nd = latest
+
+	kr.setFlushPhase(FlushRoot, nd.Cid())
+	err = kr.GetDirectory().dagService.Add(ctx, nd)
+	if err != nil {
+		return cid.Undef, kr.flushFailed(err)
+	}
+
+	if kr.overlay != nil {
+		// Only stored in memory, `Commit` persists it.
+		kr.flushLock.Lock()
+		kr.flushState = FlushState{Phase: FlushIdle, Root: kr.persisted}
+		kr.flushLock.Unlock()
+		return nd.Cid(), nil
+	}
+	if err := kr.rootPersisted(ctx, nd.Cid()); err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+// rootPersisted swaps in 'c' as the persisted root once its whole DAG
+// is stored, and publishes it.
+func (kr *Root) rootPersisted(ctx context.Context, c cid.Cid) error {
+	if err := kr.checkLock(ctx); err != nil {
+		return kr.flushFailed(err)
+	}
+	if kr.persistHook != nil {
+		if err := kr.persistHook(ctx, c); err != nil {
+			return kr.flushFailed(fmt.Errorf("persist hook: %w", err))
+		}
+	}
+
+	kr.flushLock.Lock()
+	kr.persisted = c
+	kr.flushState = FlushState{Phase: FlushIdle, Root: c}
+	kr.flushLock.Unlock()
+
+	if kr.repub != nil {
+		kr.repub.Update(c)
+	}
+	return nil
+}
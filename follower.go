@@ -0,0 +1,183 @@
+package mfs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	dag "github.com/ipfs/go-merkledag"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// ResolveFunc returns the latest root of a published MFS (e.g., by
+// resolving its IPNS name).
+type ResolveFunc func(context.Context) (cid.Cid, error)
+
+// Follower is a read-only mirror of an MFS published elsewhere, the read
+// side of the replication between nodes: it periodically resolves the
+// latest root and atomically swaps in a `Root` loaded from it, notifying
+// its watchers of the entries that changed.
+type Follower struct {
+	dserv   ipld.DAGService
+	resolve ResolveFunc
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// Serializes the refreshes.
+	refreshLock sync.Mutex
+
+	lock    sync.RWMutex
+	root    *Root
+	current cid.Cid
+	lastErr error
+
+	watchers watchers
+}
+
+// NewFollowerRoot resolves the latest root and loads it, then keeps
+// following it, re-resolving every 'interval'.
+func NewFollowerRoot(ctx context.Context, ds ipld.DAGService, resolve ResolveFunc, interval time.Duration) (*Follower, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	f := &Follower{
+		dserv:   ds,
+		resolve: resolve,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	if err := f.Refresh(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go f.run(interval)
+	return f, nil
+}
+
+func (f *Follower) run(interval time.Duration) {
+	defer close(f.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.Refresh(f.ctx); err != nil && f.ctx.Err() == nil {
+				log.Warnf("failed to follow root: %s", err)
+			}
+		case <-f.ctx.Done():
+			return
+		}
+	}
+}
+
+// Root returns the `Root` of the latest tree. It must only be read: it's
+// replaced (not updated) when a new tree is followed, so references
+// obtained from it keep showing the tree they were obtained from.
+func (f *Follower) Root() *Root {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.root
+}
+
+// Current returns the CID of the latest tree.
+func (f *Follower) Current() cid.Cid {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.current
+}
+
+// Err returns the error of the last refresh (nil if it succeeded).
+func (f *Follower) Err() error {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.lastErr
+}
+
+// Watch registers a new `Watcher` for the changes between the followed
+// trees.
+func (f *Follower) Watch(opts WatchOpts) *Watcher {
+	return f.watchers.watch(opts, nil)
+}
+
+// Refresh resolves the latest root now, and swaps it in if it changed.
+func (f *Follower) Refresh(ctx context.Context) error {
+	f.refreshLock.Lock()
+	defer f.refreshLock.Unlock()
+
+	err := f.refresh(ctx)
+	f.lock.Lock()
+	f.lastErr = err
+	f.lock.Unlock()
+	return err
+}
+
+func (f *Follower) refresh(ctx context.Context) error {
+	c, err := f.resolve(ctx)
+	if err != nil {
+		return fmt.Errorf("resolve: %w", err)
+	}
+	old := f.Current()
+	if old.Equals(c) {
+		return nil
+	}
+
+	nd, err := f.dserv.Get(ctx, c)
+	if err != nil {
+		return err
+	}
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return fmt.Errorf("%s: %w", c, ErrNotDir)
+	}
+	root, err := NewRoot(f.ctx, f.dserv, pbnd, nil)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	f.root = root
+	f.current = c
+	f.lock.Unlock()
+
+	if old.Defined() && f.watchers.watched() {
+		return treeEvents(ctx, f.dserv, old, c, "/", f.watchers.emit)
+	}
+	return nil
+}
+
+// Close stops following the root and closes the watchers.
+func (f *Follower) Close() error {
+	f.cancel()
+	<-f.done
+	f.watchers.closeAll()
+	return nil
+}
+
+// treeEvents emits the events turning the directory 'oldDir' at 'pth'
+// into 'newDir' (see `Diff`, without renames).
+func treeEvents(ctx context.Context, dserv ipld.DAGService, oldDir, newDir cid.Cid, pth string, emit func(Event)) error {
+	return diffDir(ctx, dserv, oldDir, newDir, pth, func(c Change) {
+		switch c.Type {
+		case ChangeAdd:
+			emit(Event{Name: c.Path, Op: Create})
+		case ChangeRemove:
+			emit(Event{Name: c.Path, Op: Remove})
+		case ChangeModify:
+			emit(Event{Name: c.Path, Op: Write})
+		}
+	})
+}
+
+// linkType returns the `NodeType` of the node 'c'.
+func linkType(ctx context.Context, dserv ipld.DAGService, c cid.Cid) (NodeType, error) {
+	nd, err := dserv.Get(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	return nodeType(nd)
+}
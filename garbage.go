@@ -0,0 +1,66 @@
+package mfs
+
+import (
+	"context"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// GarbageReport describes the blocks reachable only from an old root.
+type GarbageReport struct {
+	Blocks int
+	Bytes  uint64
+}
+
+// GarbageEstimate computes the blocks reachable from 'oldRoot' but not
+// from 'newRoot', that is, how much space a garbage collection would
+// reclaim after the MFS moved from the old root to the new one (as long
+// as nothing else references them).
+func GarbageEstimate(ctx context.Context, ds ipld.DAGService, oldRoot, newRoot cid.Cid) (GarbageReport, error) {
+	live := cid.NewSet()
+	err := walkDAG(ctx, ds, newRoot, live, nil, nil)
+	if err != nil {
+		return GarbageReport{}, err
+	}
+
+	var report GarbageReport
+	// The DAGs of live nodes are live as well, no need to descend.
+	err = walkDAG(ctx, ds, oldRoot, cid.NewSet(), live, func(nd ipld.Node) {
+		report.Blocks++
+		report.Bytes += uint64(len(nd.RawData()))
+	})
+	if err != nil {
+		return GarbageReport{}, err
+	}
+
+	return report, nil
+}
+
+// walkDAG visits every node reachable from 'c' once, recording them in
+// 'visited' and calling 'visit' (if set) for each. The DAGs rooted at
+// the CIDs in 'prune' (if set) are skipped without being fetched.
+func walkDAG(ctx context.Context, ds ipld.DAGService, c cid.Cid, visited, prune *cid.Set, visit func(ipld.Node)) error {
+	if prune != nil && prune.Has(c) {
+		return nil
+	}
+	if !visited.Visit(c) {
+		return nil
+	}
+
+	nd, err := ds.Get(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	if visit != nil {
+		visit(nd)
+	}
+
+	for _, l := range nd.Links() {
+		if err := walkDAG(ctx, ds, l.Cid, visited, prune, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
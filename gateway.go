@@ -0,0 +1,61 @@
+package mfs
+
+import (
+	"context"
+	"fmt"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// GatewayFetcher retrieves single blocks through a trustless gateway
+// (like `GET /ipfs/<cid>?format=raw`, see the IPFS Trustless Gateway
+// specification), or any other untrusted source: every block is checked
+// against its CID before being used.
+type GatewayFetcher interface {
+	FetchBlock(ctx context.Context, c cid.Cid) ([]byte, error)
+}
+
+// NewRootFromGateway is `NewRootFromCid` over the directory 'c' retrieved
+// with 'f': its whole DAG is fetched and verified block by block, added to
+// 'ds', and then the root is opened from there. It lets nodes without
+// connectivity to the providers of the content (through 'ds') start from
+// it.
+func NewRootFromGateway(parent context.Context, ds ipld.DAGService, f GatewayFetcher, c cid.Cid, pf PubFunc, opts ...RootOption) (*Root, error) {
+	if err := fetchDAG(parent, ds, f, c); err != nil {
+		return nil, err
+	}
+	return NewRootFromCid(parent, ds, c, pf, opts...)
+}
+
+// fetchDAG adds the DAG 'c' retrieved with 'f' to the DAG service.
+func fetchDAG(ctx context.Context, dserv ipld.DAGService, f GatewayFetcher, c cid.Cid) error {
+	seen := cid.NewSet()
+	seen.Add(c)
+	queue := []cid.Cid{c}
+
+	batch := ipld.NewBatch(ctx, dserv)
+	for len(queue) > 0 {
+		c, queue = queue[0], queue[1:]
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, err := f.FetchBlock(ctx, c)
+		if err != nil {
+			return fmt.Errorf("fetch %s: %w", c, err)
+		}
+		nd, err := decodeBlock(c, data)
+		if err != nil {
+			return fmt.Errorf("fetch %s: %w", c, err)
+		}
+		if err := batch.Add(ctx, nd); err != nil {
+			return err
+		}
+		for _, l := range nd.Links() {
+			if seen.Visit(l.Cid) {
+				queue = append(queue, l.Cid)
+			}
+		}
+	}
+	return batch.Commit()
+}
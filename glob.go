@@ -0,0 +1,147 @@
+package mfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	gopath "path"
+	"sort"
+	"strings"
+
+	uio "github.com/ipfs/go-unixfs/io"
+
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// Glob returns the paths of the tree matching 'pattern', sorted. The
+// pattern is matched segment by segment with the syntax of `path.Match`
+// (`*`, `?`, `[...]`), where a `**` segment matches any number of
+// segments (including none): `/docs/**/*.md` matches the `.md` files
+// anywhere below `/docs`. Only the subtrees that can match are walked,
+// out of a snapshot of the tree taken at call start.
+func Glob(r *Root, pattern string) ([]string, error) {
+	return CtxGlob(r.GetDirectory().ctx, r, pattern)
+}
+
+// CtxGlob is `Glob` with a context for the DAG operations.
+func CtxGlob(ctx context.Context, r *Root, pattern string) (_ []string, err error) {
+	defer func() { err = pathError("glob", pattern, err) }()
+	defer r.recoverPanic(&err)
+
+	segs := splitPattern(pattern)
+	for _, seg := range segs {
+		if _, err := gopath.Match(seg, ""); err != nil {
+			return nil, fmt.Errorf("invalid path pattern: %w", err)
+		}
+	}
+
+	// Start from the deepest directory without wildcards.
+	var base []string
+	for len(segs) > 0 && !hasMeta(segs[0]) {
+		base, segs = append(base, segs[0]), segs[1:]
+	}
+	basePath := "/" + strings.Join(base, "/")
+	fsn, err := dirLookup(ctx, r.GetDirectory(), basePath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	nd, err := fsn.GetNode()
+	if err != nil {
+		return nil, err
+	}
+
+	g := &globWalk{
+		dserv:   r.GetDirectory().dagService,
+		policy:  r.unsupported,
+		matched: make(map[string]struct{}),
+	}
+	if err := g.walk(ctx, basePath, nd, segs); err != nil {
+		return nil, err
+	}
+
+	out := make([]string, 0, len(g.matched))
+	for pth := range g.matched {
+		out = append(out, pth)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// hasMeta reports whether the pattern segment has wildcards.
+func hasMeta(seg string) bool {
+	return strings.ContainsAny(seg, `*?[\`)
+}
+
+type globWalk struct {
+	dserv   ipld.DAGService
+	policy  UnsupportedPolicy
+	matched map[string]struct{} // a path can match several ways with `**`
+}
+
+// walk matches the entries below 'nd', at 'pth', against the remaining
+// segments of the pattern.
+func (g *globWalk) walk(ctx context.Context, pth string, nd ipld.Node, segs []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(segs) == 0 {
+		g.matched[pth] = struct{}{}
+		return nil
+	}
+	if segs[0] == "**" {
+		if err := g.walk(ctx, pth, nd, segs[1:]); err != nil {
+			return err
+		}
+	}
+
+	dir, err := uio.NewDirectoryFromNode(g.dserv, nd)
+	switch err {
+	case nil:
+	case uio.ErrNotADir:
+		return nil
+	default:
+		return err
+	}
+
+	var children []*ipld.Link
+	err = dir.ForEachLink(ctx, func(l *ipld.Link) error {
+		if segs[0] != "**" {
+			if ok, _ := gopath.Match(segs[0], l.Name); !ok {
+				return nil
+			}
+		}
+		children = append(children, l)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, l := range children {
+		child, err := l.GetNode(ctx, g.dserv)
+		if err != nil {
+			return err
+		}
+		if err := checkSupported(child); err != nil {
+			switch g.policy {
+			case UnsupportedReject:
+				return fmt.Errorf("%s: %w", gopath.Join(pth, l.Name), err)
+			case UnsupportedStrip:
+				continue
+			}
+		}
+
+		rest := segs[1:]
+		if segs[0] == "**" {
+			rest = segs
+		}
+		if err := g.walk(ctx, gopath.Join(pth, l.Name), child, rest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
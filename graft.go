@@ -0,0 +1,135 @@
+package mfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// ErrInvalidGraft is returned (wrapped) when a DAG grafted into the MFS
+// from outside fails the validation enabled with `WithGraftValidation`.
+var ErrInvalidGraft = errors.New("invalid grafted DAG")
+
+// GraftLimits bound the DAGs grafted into the MFS from outside (by
+// `PutNode` and `SyncFromCid`). Zero values mean no limit.
+type GraftLimits struct {
+	MaxDepth int    // levels of nodes below the grafted one
+	MaxWidth int    // links of a single node
+	MaxSize  uint64 // total size of the (distinct) blocks
+}
+
+// graftValidator checks a grafted DAG is well-formed UnixFS within the
+// limits, so untrusted content can't plant structures that later break
+// listing or flushing.
+type graftValidator struct {
+	limits GraftLimits
+	policy UnsupportedPolicy
+	dserv  ipld.DAGService
+	seen   *cid.Set
+	size   uint64
+}
+
+// validateGraft validates the DAG of 'nd' before it's linked into the
+// tree, if enabled.
+func (kr *Root) validateGraft(ctx context.Context, nd ipld.Node) error {
+	if kr.graftLimits == nil {
+		return nil
+	}
+	v := &graftValidator{
+		limits: *kr.graftLimits,
+		policy: kr.unsupported,
+		dserv:  kr.GetDirectory().dagService,
+		seen:   cid.NewSet(),
+	}
+	if err := v.validate(ctx, nd, 0, false); err != nil {
+		return fmt.Errorf("%w %s: %s", ErrInvalidGraft, nd.Cid(), err)
+	}
+	return nil
+}
+
+// validate checks 'nd' at 'depth' below the grafted node and its DAG,
+// 'fileData' is set for the nodes below a file (which must be file
+// nodes as well).
+func (v *graftValidator) validate(ctx context.Context, nd ipld.Node, depth int, fileData bool) error {
+	if !v.seen.Visit(nd.Cid()) {
+		return nil
+	}
+	if v.limits.MaxDepth > 0 && depth > v.limits.MaxDepth {
+		return fmt.Errorf("deeper than %d levels", v.limits.MaxDepth)
+	}
+	links := nd.Links()
+	if v.limits.MaxWidth > 0 && len(links) > v.limits.MaxWidth {
+		return fmt.Errorf("%s has %d links, more than %d", nd.Cid(), len(links), v.limits.MaxWidth)
+	}
+	v.size += uint64(len(nd.RawData()))
+	if v.limits.MaxSize > 0 && v.size > v.limits.MaxSize {
+		return fmt.Errorf("larger than %d bytes", v.limits.MaxSize)
+	}
+
+	var childFileData bool
+	switch nd := nd.(type) {
+	case *dag.RawNode:
+		return nil
+	case *dag.ProtoNode:
+		fsn, err := ft.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return fmt.Errorf("%s: %s", nd.Cid(), err)
+		}
+		switch t := fsn.Type(); {
+		case t == ft.TFile || t == ft.TRaw:
+			if len(links) != len(fsn.BlockSizes()) {
+				return fmt.Errorf("%s has %d links but %d block sizes", nd.Cid(), len(links), len(fsn.BlockSizes()))
+			}
+			childFileData = true
+		case fileData:
+			return fmt.Errorf("%s: unexpected %s node in a file", nd.Cid(), t)
+		case t == ft.TDirectory:
+			names := make(map[string]struct{}, len(links))
+			for _, l := range links {
+				if l.Name == "" || l.Name == "." || l.Name == ".." || strings.Contains(l.Name, "/") {
+					return fmt.Errorf("%s: invalid entry name %q", nd.Cid(), l.Name)
+				}
+				if _, ok := names[l.Name]; ok {
+					return fmt.Errorf("%s: duplicate entry %q", nd.Cid(), l.Name)
+				}
+				names[l.Name] = struct{}{}
+			}
+		case t == ft.THAMTShard:
+			if err := validShardWidth(int(fsn.Fanout())); err != nil {
+				return fmt.Errorf("%s: %s", nd.Cid(), err)
+			}
+		case t == ft.TSymlink:
+			if len(links) != 0 {
+				return fmt.Errorf("%s: symlink with links", nd.Cid())
+			}
+		case v.policy != UnsupportedReject && checkSupported(nd) != nil:
+			// Passed through (or stripped) as is.
+			return nil
+		default:
+			return fmt.Errorf("%s: unsupported %s node", nd.Cid(), t)
+		}
+	default:
+		return fmt.Errorf("%s: not a UnixFS node", nd.Cid())
+	}
+
+	for _, l := range links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		child, err := v.dserv.Get(ctx, l.Cid)
+		if err != nil {
+			return err
+		}
+		if err := v.validate(ctx, child, depth+1, childFileData); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package mfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// DefaultDescriptorHoldThreshold is the time a `FileDescriptor` can stay
+// open before `Root.HealthCheck` reports it as stuck, unless changed
+// with `WithDescriptorHoldThreshold`.
+const DefaultDescriptorHoldThreshold = 10 * time.Minute
+
+// HealthCheck verifies the DAG service responds (fetching the last
+// persisted root), the republisher (if any) is running and no
+// `FileDescriptor` has been held open longer than the configured
+// threshold. It is meant for readiness/liveness probes of services
+// embedding the MFS: it's read-only, the pending changes aren't stored,
+// and honors the context deadline even if a lock is stuck.
+func (kr *Root) HealthCheck(ctx context.Context) (err error) {
+	defer kr.recoverPanic(&err)
+
+	if rp, ok := kr.repub.(*Republisher); ok && rp.hasStopped() {
+		return fmt.Errorf("health check: republisher has stopped")
+	}
+
+	if err := kr.checkDescriptors(); err != nil {
+		return fmt.Errorf("health check: %w", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		dir := kr.GetDirectory()
+		// Not having it (e.g., the node the root was created over
+		// wasn't stored) is still an answer.
+		_, err := dir.dagService.Get(ctx, kr.PersistedRoot())
+		if err != nil && !errors.Is(err, ipld.ErrNotFound) {
+			errCh <- fmt.Errorf("dag service: %w", err)
+			return
+		}
+		errCh <- nil
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return fmt.Errorf("health check: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("health check: %w", ctx.Err())
+	}
+}
+
+// checkDescriptors reports the open descriptors held for longer than
+// the threshold.
+func (kr *Root) checkDescriptors() error {
+	threshold := kr.descHoldThreshold
+	if threshold <= 0 {
+		threshold = DefaultDescriptorHoldThreshold
+	}
+
+	kr.descLock.Lock()
+	defer kr.descLock.Unlock()
+	for fd, opened := range kr.openDescs {
+		if held := time.Since(opened); held > threshold {
+			return fmt.Errorf("descriptor of %s held open for %s", fd.inode.name, held)
+		}
+	}
+	return nil
+}
+
+// trackDescriptor registers a newly opened descriptor.
+func (kr *Root) trackDescriptor(fd *fileDescriptor) {
+	kr.descLock.Lock()
+	defer kr.descLock.Unlock()
+	if kr.openDescs == nil {
+		kr.openDescs = make(map[*fileDescriptor]time.Time)
+	}
+	kr.openDescs[fd] = time.Now()
+}
+
+// untrackDescriptor unregisters a closed descriptor.
+func (kr *Root) untrackDescriptor(fd *fileDescriptor) {
+	kr.descLock.Lock()
+	defer kr.descLock.Unlock()
+	delete(kr.openDescs, fd)
+}
@@ -0,0 +1,72 @@
+package mfs
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// HiddenFunc tells whether the entry 'name' is hidden, see
+// `WithHiddenFunc`.
+type HiddenFunc func(name string) bool
+
+// IsHidden is the default `HiddenFunc`: the dotfiles are hidden (like
+// the staging and tombstone directories).
+func IsHidden(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// hiddenFunc returns the `HiddenFunc` of the root of 'p' (the default one
+// if detached from a root).
+func hiddenFunc(p parent) HiddenFunc {
+	if r := rootOf(p); r != nil && r.hidden != nil {
+		return r.hidden
+	}
+	return IsHidden
+}
+
+// ListOpts is used by ListEntries and ListEntryNames
+type ListOpts struct {
+	IncludeHidden bool // also list the hidden entries
+
+	// Partial lists the entries whose node can't be loaded with the
+	// error in `NodeListing.Err`, instead of failing the listing. It
+	// still stops once the context is done.
+	Partial bool
+	// ChildTimeout bounds the loading of the node of each entry (no
+	// bound but the context if zero), so a single unreachable node
+	// doesn't take the whole deadline.
+	ChildTimeout time.Duration
+}
+
+// ListEntries is `List` skipping the hidden entries, unless
+// `ListOpts.IncludeHidden` is set. The entries listed before an error
+// are returned with it.
+func (d *Directory) ListEntries(ctx context.Context, opts ListOpts) ([]NodeListing, error) {
+	hidden := hiddenFunc(d.parent)
+	var out []NodeListing
+	err := d.forEachEntry(ctx, opts, func(nl NodeListing) error {
+		if opts.IncludeHidden || !hidden(nl.Name) {
+			out = append(out, nl)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// ListEntryNames is `ListNames` skipping the hidden entries, unless
+// `ListOpts.IncludeHidden` is set.
+func (d *Directory) ListEntryNames(ctx context.Context, opts ListOpts) ([]string, error) {
+	names, err := d.ListNames(ctx)
+	if err != nil || opts.IncludeHidden {
+		return names, err
+	}
+	hidden := hiddenFunc(d.parent)
+	out := names[:0]
+	for _, name := range names {
+		if !hidden(name) {
+			out = append(out, name)
+		}
+	}
+	return out, nil
+}
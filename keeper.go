@@ -0,0 +1,124 @@
+package mfs
+
+import (
+	"context"
+	"time"
+
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// DefaultKeepInterval is how often a `RootKeeper` saves the root unless
+// set with `RootKeeper.Interval`.
+const DefaultKeepInterval = 10 * time.Second
+
+// RootKeeper saves the root of a `Root` under a key of a datastore, so
+// the MFS can be resumed from it after a restart (or a crash, losing at
+// most the changes of the last `Interval`), see `RootKeeper.Resume`.
+// Only the roots persisted (whose whole DAG is stored, see `FlushState`)
+// are saved.
+type RootKeeper struct {
+	ds  ds.Datastore
+	key ds.Key
+
+	// Interval between the saves of the root (`DefaultKeepInterval` if
+	// zero), the root is saved once more when closed.
+	Interval time.Duration
+}
+
+// NewRootKeeper returns a `RootKeeper` saving the root under 'key'.
+func NewRootKeeper(d ds.Datastore, key string) *RootKeeper {
+	return &RootKeeper{ds: d, key: ds.NewKey(key)}
+}
+
+// Load returns the root saved, `cid.Undef` if none.
+func (k *RootKeeper) Load(ctx context.Context) (cid.Cid, error) {
+	val, err := k.ds.Get(ctx, k.key)
+	switch err {
+	case nil:
+		return cid.Cast(val)
+	case ds.ErrNotFound:
+		return cid.Undef, nil
+	default:
+		return cid.Undef, err
+	}
+}
+
+// Save saves the root 'c'.
+func (k *RootKeeper) Save(ctx context.Context, c cid.Cid) error {
+	return k.ds.Put(ctx, k.key, c.Bytes())
+}
+
+// Resume opens the `Root` saved (see `NewRootFromCid`), or a new one over
+// 'node' (an empty directory if nil) if none was, and keeps it.
+func (k *RootKeeper) Resume(ctx context.Context, dserv ipld.DAGService, node *dag.ProtoNode, pf PubFunc, opts ...RootOption) (*Root, error) {
+	c, err := k.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var r *Root
+	switch {
+	case c.Defined():
+		r, err = NewRootFromCid(ctx, dserv, c, pf, opts...)
+	case node != nil:
+		r, err = NewRoot(ctx, dserv, node, pf, opts...)
+	default:
+		r, err = NewRoot(ctx, dserv, ft.EmptyDirNode(), pf, opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := k.Keep(r); err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Keep saves the root of 'r' every `Interval` while open (if it changed),
+// and once more when closed. It fails with `ErrRootClosed` if 'r' is
+// closed already.
+func (k *RootKeeper) Keep(r *Root) error {
+	interval := k.Interval
+	if interval <= 0 {
+		interval = DefaultKeepInterval
+	}
+
+	var last cid.Cid
+	save := func(ctx context.Context) {
+		c := r.PersistedRoot()
+		if c.Equals(last) {
+			return
+		}
+		if err := k.Save(ctx, c); err != nil {
+			log.Errorf("failed to save root %s: %s", c, err)
+			return
+		}
+		last = c
+	}
+
+	started := r.life.Go("root keeper", func(ctx context.Context) error {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				save(ctx)
+			case <-ctx.Done():
+				// When closed by `Root.Close`, it was flushed already.
+				save(context.Background())
+				return nil
+			}
+		}
+	})
+	if !started {
+		return ErrRootClosed
+	}
+	return nil
+}
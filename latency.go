@@ -0,0 +1,143 @@
+package mfs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// NetworkConditions are the conditions simulated by `NewLatencyDAG`.
+type NetworkConditions struct {
+	// Latency added to each block request (once per batch for
+	// `GetMany`, as the requests are pipelined).
+	Latency time.Duration
+	// Bandwidth in bytes per second the blocks are transferred at,
+	// shared by the concurrent transfers (0 for unlimited).
+	Bandwidth int64
+	// Writes applies the conditions to the blocks added too, not only
+	// to the ones fetched.
+	Writes bool
+}
+
+// latencyDAG is a DAG service delaying the transfers of the blocks of the
+// underlying one as if they went through a network.
+type latencyDAG struct {
+	ipld.DAGService
+	conds NetworkConditions
+
+	// Time the simulated link is busy until.
+	lock     sync.Mutex
+	busyTill time.Time
+}
+
+var _ ipld.DAGService = (*latencyDAG)(nil)
+
+// NewLatencyDAG wraps the DAG service 'ds' so its blocks are transferred
+// with the given latency and bandwidth, to evaluate performance work
+// (listing, flushing, reading ahead) under realistic network conditions
+// rather than only against in-memory stores.
+func NewLatencyDAG(ds ipld.DAGService, conds NetworkConditions) ipld.DAGService {
+	return &latencyDAG{DAGService: ds, conds: conds}
+}
+
+// sleepCtx sleeps until the context is done or for 'd'.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// transfer waits for 'size' bytes to go through the link, after the
+// transfers already queued.
+func (l *latencyDAG) transfer(ctx context.Context, size int) error {
+	if l.conds.Bandwidth <= 0 {
+		return ctx.Err()
+	}
+	d := time.Duration(int64(size) * int64(time.Second) / l.conds.Bandwidth)
+
+	l.lock.Lock()
+	now := time.Now()
+	if l.busyTill.Before(now) {
+		l.busyTill = now
+	}
+	l.busyTill = l.busyTill.Add(d)
+	done := l.busyTill
+	l.lock.Unlock()
+
+	return sleepCtx(ctx, time.Until(done))
+}
+
+func (l *latencyDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	if err := sleepCtx(ctx, l.conds.Latency); err != nil {
+		return nil, err
+	}
+	nd, err := l.DAGService.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.transfer(ctx, len(nd.RawData())); err != nil {
+		return nil, err
+	}
+	return nd, nil
+}
+
+func (l *latencyDAG) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	go func() {
+		defer close(out)
+		if err := sleepCtx(ctx, l.conds.Latency); err != nil {
+			out <- &ipld.NodeOption{Err: err}
+			return
+		}
+		for opt := range l.DAGService.GetMany(ctx, cids) {
+			if opt.Err == nil {
+				if err := l.transfer(ctx, len(opt.Node.RawData())); err != nil {
+					opt = &ipld.NodeOption{Err: err}
+				}
+			}
+			select {
+			case out <- opt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (l *latencyDAG) Add(ctx context.Context, nd ipld.Node) error {
+	if l.conds.Writes {
+		if err := sleepCtx(ctx, l.conds.Latency); err != nil {
+			return err
+		}
+		if err := l.transfer(ctx, len(nd.RawData())); err != nil {
+			return err
+		}
+	}
+	return l.DAGService.Add(ctx, nd)
+}
+
+func (l *latencyDAG) AddMany(ctx context.Context, nds []ipld.Node) error {
+	if l.conds.Writes {
+		if err := sleepCtx(ctx, l.conds.Latency); err != nil {
+			return err
+		}
+		for _, nd := range nds {
+			if err := l.transfer(ctx, len(nd.RawData())); err != nil {
+				return err
+			}
+		}
+	}
+	return l.DAGService.AddMany(ctx, nds)
+}
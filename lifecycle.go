@@ -0,0 +1,110 @@
+package mfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// ErrRootClosed is returned by `Root.Err` once the root is closed.
+var ErrRootClosed = errors.New("mfs root closed")
+
+// lifecycle owns the background goroutines of a `Root` (republisher,
+// watchers, evictions...): they run under a context canceled when the
+// root is closed, which waits for them to return, and the first error
+// they fail with is reported by `Root.Err`. A failed goroutine doesn't
+// stop the others.
+type lifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// Whether the panics of the goroutines are recovered (as errors).
+	recoverPanics bool
+
+	lock    sync.Mutex
+	err     error // first failure
+	stopped bool
+}
+
+func newLifecycle(parent context.Context, recoverPanics bool) *lifecycle {
+	ctx, cancel := context.WithCancel(parent)
+	return &lifecycle{ctx: ctx, cancel: cancel, recoverPanics: recoverPanics}
+}
+
+// Go runs 'f' in a background goroutine named 'name' (for the errors),
+// unless the lifecycle is stopped: it then returns false. 'f' must return
+// once its context is canceled. Without a lifecycle (nil) the goroutine
+// is just started.
+func (l *lifecycle) Go(name string, f func(context.Context) error) bool {
+	if l == nil {
+		go func() { _ = f(context.Background()) }()
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.stopped {
+		return false
+	}
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		if l.recoverPanics {
+			defer func() {
+				if v := recover(); v != nil {
+					l.fail(name, &PanicError{Value: v, Stack: debug.Stack()})
+				}
+			}()
+		}
+		if err := f(l.ctx); err != nil && l.ctx.Err() == nil {
+			l.fail(name, err)
+		}
+	}()
+	return true
+}
+
+// fail records the failure of the goroutine 'name'.
+func (l *lifecycle) fail(name string, err error) {
+	err = fmt.Errorf("%s: %w", name, err)
+	log.Errorf("background task failed: %s", err)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.err == nil {
+		l.err = err
+	}
+}
+
+// Err returns the first failure, or why the lifecycle ended.
+func (l *lifecycle) Err() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	switch {
+	case l.err != nil:
+		return l.err
+	case l.stopped:
+		return ErrRootClosed
+	default:
+		return l.ctx.Err()
+	}
+}
+
+// stop cancels the goroutines and waits for them to return.
+func (l *lifecycle) stop() {
+	l.lock.Lock()
+	l.stopped = true
+	l.lock.Unlock()
+
+	l.cancel()
+	l.wg.Wait()
+}
+
+// Err reports the state of the root: nil while open, the first error a
+// background goroutine (like the republisher, or a `Watcher` delivering
+// events) failed with, the error of the context given to `NewRoot` once
+// canceled, or `ErrRootClosed` once closed.
+func (kr *Root) Err() error {
+	return kr.life.Err()
+}
@@ -0,0 +1,156 @@
+package mfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// ErrFileTooLarge is returned (wrapped) by the writes that would grow a
+// file past the limit set with `WithMaxFileSize`.
+var ErrFileTooLarge = errors.New("file too large")
+
+// ErrTooManyEntries is returned (wrapped) when adding an entry to a
+// directory already holding the maximum set with `WithMaxDirEntries`.
+var ErrTooManyEntries = errors.New("too many directory entries")
+
+// limits are the hard limits of a `Root`, inherited by its directories
+// (0 means no limit).
+type limits struct {
+	maxFileSize   int64
+	maxDirEntries int
+}
+
+// inheritedLimits returns the limits of the parent.
+func inheritedLimits(p parent) limits {
+	switch p := p.(type) {
+	case *Directory:
+		return p.limits
+	case *Root:
+		return p.limits
+	default:
+		return limits{}
+	}
+}
+
+// checkEntryLimit fails if the directory already holds the maximum
+// number of entries, it's called (with the lock taken) before adding a
+// new one. The entries are only counted once, the count is then kept up
+// to date by `entryAdded` and `entryRemoved`.
+func (d *Directory) checkEntryLimit() error {
+	if d.limits.maxDirEntries <= 0 {
+		return nil
+	}
+	if d.entryCount < 0 {
+		if err := d.loadUnsync(d.ctx); err != nil {
+			return err
+		}
+		count := 0
+		err := d.unixfsDir.ForEachLink(d.ctx, func(*ipld.Link) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		d.entryCount = count
+	}
+	if d.entryCount >= d.limits.maxDirEntries {
+		return fmt.Errorf("%w: %s holds %d", ErrTooManyEntries, d.Path(), d.entryCount)
+	}
+	return nil
+}
+
+func (d *Directory) entryAdded() {
+	if d.entryCount >= 0 {
+		d.entryCount++
+	}
+}
+
+func (d *Directory) entryRemoved() {
+	if d.entryCount > 0 {
+		d.entryCount--
+	}
+}
+
+// checkFileSize fails if writing 'n' bytes at 'at' (at the current
+// offset if negative) would grow the file past the limit.
+func (fi *fileDescriptor) checkFileSize(at int64, n int) error {
+	if fi.maxSize <= 0 {
+		return nil
+	}
+	if at < 0 {
+		// The offset can't be past the end, so this bound spares
+		// getting it (which syncs the buffered writes) far from
+		// the limit.
+		size, err := fi.mod.Size()
+		if err != nil {
+			return err
+		}
+		if size+int64(n) <= fi.maxSize {
+			return nil
+		}
+		at, err = fi.mod.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+	}
+	return checkSize(fi.inode.name, at+int64(n), fi.maxSize)
+}
+
+// checkSize fails if the file 'name' of 'size' bytes is over the limit
+// 'max' (none if not positive).
+func checkSize(name string, size, max int64) error {
+	if max > 0 && size > max {
+		return fmt.Errorf("%w: %s would exceed %d bytes", ErrFileTooLarge, name, max)
+	}
+	return nil
+}
+
+// checkNodeSize fails if 'nd', about to be linked as the entry 'name'
+// of the directory, is a file over the size limit or a directory holding
+// one (recursively). It's the check of the content created outside of
+// the descriptors: grafted, imported or uploaded.
+func (d *Directory) checkNodeSize(ctx context.Context, name string, nd ipld.Node) error {
+	if d.limits.maxFileSize <= 0 {
+		return nil
+	}
+	return checkDAGFileSizes(ctx, d.dagService, name, nd, d.limits.maxFileSize, cid.NewSet())
+}
+
+func checkDAGFileSizes(ctx context.Context, dserv ipld.DAGService, name string, nd ipld.Node, max int64, seen *cid.Set) error {
+	if !seen.Visit(nd.Cid()) {
+		return nil
+	}
+	nt, err := nodeType(nd)
+	if err != nil {
+		// Malformed or unsupported nodes are left to the callers.
+		return nil
+	}
+	if nt == TFile {
+		size, err := nodeSize(ctx, dserv, nd)
+		if err != nil {
+			return err
+		}
+		return checkSize(name, size, max)
+	}
+
+	links, err := entryLinks(ctx, dserv, nd.Cid())
+	if err != nil {
+		return err
+	}
+	for entry, c := range links {
+		child, err := dserv.Get(ctx, c)
+		if err != nil {
+			return err
+		}
+		if err := checkDAGFileSizes(ctx, dserv, name+"/"+entry, child, max, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package mfs
+
+import (
+	"container/list"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// DefaultListingCacheSize is the number of directory listings cached by
+// a `Root` unless set with `WithListingCache`.
+const DefaultListingCacheSize = 256
+
+// listingCache keeps the listings of the most recently listed directory
+// nodes by CID, so listing an unchanged directory again doesn't decode
+// its entries. As nodes are immutable a cached listing never goes stale,
+// it's just evicted when not used.
+type listingCache struct {
+	lock    sync.Mutex
+	max     int
+	entries map[cid.Cid]*list.Element
+	lru     *list.List
+}
+
+type listingEntry struct {
+	c       cid.Cid
+	listing []NodeListing
+}
+
+func newListingCache(max int) *listingCache {
+	return &listingCache{
+		max:     max,
+		entries: make(map[cid.Cid]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the listing of the directory 'c' if cached. It must not be
+// modified. The cache may be nil (disabled).
+func (lc *listingCache) get(c cid.Cid) ([]NodeListing, bool) {
+	if lc == nil {
+		return nil, false
+	}
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+
+	e, ok := lc.entries[c]
+	if !ok {
+		return nil, false
+	}
+	lc.lru.MoveToFront(e)
+	return e.Value.(*listingEntry).listing, true
+}
+
+// add caches the complete listing of the directory 'c'.
+func (lc *listingCache) add(c cid.Cid, listing []NodeListing) {
+	if lc == nil {
+		return
+	}
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+
+	if _, ok := lc.entries[c]; ok {
+		return
+	}
+	lc.entries[c] = lc.lru.PushFront(&listingEntry{c: c, listing: listing})
+
+	for lc.lru.Len() > lc.max {
+		oldest := lc.lru.Back()
+		lc.lru.Remove(oldest)
+		delete(lc.entries, oldest.Value.(*listingEntry).c)
+	}
+}
+
+// listings returns the listing cache of the root of 'p' (nil if disabled
+// or detached from a root).
+func listings(p parent) *listingCache {
+	if r := rootOf(p); r != nil {
+		return r.listings
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package mfs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ErrRootLocked is returned when the lock of the MFS (see `WithLock`) is
+// held by another owner.
+var ErrRootLocked = errors.New("mfs root is locked by another owner")
+
+// Locker is an advisory lock shared by the processes (or `Root`s) that
+// may open the same MFS, so they don't unknowingly mutate and publish it
+// concurrently.
+type Locker interface {
+	// Acquire takes the lock 'key' for 'owner'. It fails with
+	// `ErrRootLocked` if another owner holds it, unless 'takeover' is
+	// set, in which case the lock is taken away from that owner.
+	Acquire(ctx context.Context, key, owner string, takeover bool) error
+	// Release frees the lock if 'owner' holds it.
+	Release(ctx context.Context, key, owner string) error
+	// Holds checks whether 'owner' still holds the lock.
+	Holds(ctx context.Context, key, owner string) (bool, error)
+}
+
+// rootLock is the lock held by a `Root`.
+type rootLock struct {
+	locker Locker
+	key    string
+	owner  string
+}
+
+func newOwnerID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// checkLock verifies the root still holds its lock (if any), it may
+// have been taken over by another owner.
+func (kr *Root) checkLock(ctx context.Context) error {
+	if kr.lock == nil {
+		return nil
+	}
+	held, err := kr.lock.locker.Holds(ctx, kr.lock.key, kr.lock.owner)
+	if err != nil {
+		return err
+	}
+	if !held {
+		return ErrRootLocked
+	}
+	return nil
+}
+
+// releaseLock frees the lock of the root (if any).
+func (kr *Root) releaseLock(ctx context.Context) error {
+	if kr.lock == nil {
+		return nil
+	}
+	return kr.lock.locker.Release(ctx, kr.lock.key, kr.lock.owner)
+}
+
+// DatastoreLocker is a `Locker` storing the owner of each lock under its
+// key in a datastore. The check and update aren't atomic across
+// processes: it's advisory, meant to catch mistakes rather than races
+// between simultaneous starts.
+type DatastoreLocker struct {
+	lock sync.Mutex
+	ds   ds.Datastore
+}
+
+var _ Locker = (*DatastoreLocker)(nil)
+
+// NewDatastoreLocker returns a `Locker` backed by the datastore.
+func NewDatastoreLocker(d ds.Datastore) *DatastoreLocker {
+	return &DatastoreLocker{ds: d}
+}
+
+func (l *DatastoreLocker) owner(ctx context.Context, key string) (string, error) {
+	val, err := l.ds.Get(ctx, ds.NewKey(key))
+	switch err {
+	case nil:
+		return string(val), nil
+	case ds.ErrNotFound:
+		return "", nil
+	default:
+		return "", err
+	}
+}
+
+func (l *DatastoreLocker) Acquire(ctx context.Context, key, owner string, takeover bool) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	cur, err := l.owner(ctx, key)
+	if err != nil {
+		return err
+	}
+	if cur != "" && cur != owner {
+		if !takeover {
+			return fmt.Errorf("%w (%s held by %s)", ErrRootLocked, key, cur)
+		}
+		log.Warnf("taking over lock %s from %s", key, cur)
+	}
+	return l.ds.Put(ctx, ds.NewKey(key), []byte(owner))
+}
+
+func (l *DatastoreLocker) Release(ctx context.Context, key, owner string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	cur, err := l.owner(ctx, key)
+	if err != nil {
+		return err
+	}
+	if cur != owner {
+		return nil
+	}
+	return l.ds.Delete(ctx, ds.NewKey(key))
+}
+
+func (l *DatastoreLocker) Holds(ctx context.Context, key, owner string) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	cur, err := l.owner(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	return cur == owner, nil
+}
@@ -1,16 +1,24 @@
 package mfs
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"math/rand"
 	"os"
+	gopath "path"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -21,9 +29,11 @@ import (
 	ft "github.com/ipfs/go-unixfs"
 	importer "github.com/ipfs/go-unixfs/importer"
 	uio "github.com/ipfs/go-unixfs/io"
+	pb "github.com/ipfs/go-unixfs/pb"
 
 	cid "github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
 	dssync "github.com/ipfs/go-datastore/sync"
 	bstore "github.com/ipfs/go-ipfs-blockstore"
 	chunker "github.com/ipfs/go-ipfs-chunker"
@@ -36,7 +46,7 @@ func emptyDirNode() *dag.ProtoNode {
 	return dag.NodeWithData(ft.FolderPBData())
 }
 
-func getDagserv(t *testing.T) ipld.DAGService {
+func getDagserv(t testing.TB) ipld.DAGService {
 	db := dssync.MutexWrap(ds.NewMapDatastore())
 	bs := bstore.NewBlockstore(db)
 	blockserv := bserv.New(bs, offline.Exchange(bs))
@@ -56,7 +66,7 @@ func fileNodeFromReader(t *testing.T, ds ipld.DAGService, r io.Reader) ipld.Node
 	return nd
 }
 
-func mkdirP(t *testing.T, root *Directory, pth string) *Directory {
+func mkdirP(t testing.TB, root *Directory, pth string) *Directory {
 	dirs := path.SplitList(pth)
 	cur := root
 	for _, d := range dirs {
@@ -174,6 +184,7 @@ func assertFileAtPath(ds ipld.DAGService, root *Directory, expn ipld.Node, pth s
 	if err != nil {
 		return err
 	}
+	defer rfd.Close()
 
 	out, err := io.ReadAll(rfd)
 	if err != nil {
@@ -1321,6 +1332,5912 @@ func TestFileDescriptors(t *testing.T) {
 	}
 }
 
+func TestFileDescriptorIdleTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	nd := dag.NodeWithData(ft.FilePBData(nil, 0))
+	fi, err := NewFile("test", nd, dir, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi.IdleTimeout = time.Millisecond * 50
+
+	wfd, err := fi.Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := wfd.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fi.Sync()
+	}()
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("idle descriptor was not closed")
+	case <-done:
+	}
+
+	_, err = wfd.Write([]byte("world"))
+	if !errors.Is(err, ErrClosedIdle) {
+		t.Fatalf("expected ErrClosedIdle, got: %v", err)
+	}
+	if err := wfd.Close(); err != ErrClosedIdle {
+		t.Fatalf("expected ErrClosedIdle, got: %v", err)
+	}
+
+	size, err := fi.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 5 {
+		t.Fatalf("expected idle close to flush the write, got size %d", size)
+	}
+
+	// Closed on idle right away, once counted and tracked.
+	fi.IdleTimeout = time.Nanosecond
+	for i := 0; i < 100; i++ {
+		if _, err := fi.Open(Flags{Read: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		fi.nodeLock.RLock()
+		descs := fi.openDescs
+		fi.nodeLock.RUnlock()
+		rt.descLock.Lock()
+		tracked := len(rt.openDescs)
+		rt.descLock.Unlock()
+		if descs == 0 && tracked == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the idle descriptors to be released, %d counted and %d tracked", descs, tracked)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUnlinkOpenFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var orphans []ipld.Node
+	ds := getDagserv(t)
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithOnOrphan(func(nd ipld.Node) {
+		orphans = append(orphans, nd)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := rt.GetDirectory()
+
+	err = dir.AddChild("file", dag.NodeWithData(ft.FilePBData(nil, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsn, err := dir.Child("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := fsn.(*File)
+
+	wfd, err := fi.Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dir.Unlink("file"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := wfd.Write([]byte("detached")); err != nil {
+		t.Fatal(err)
+	}
+	if err := wfd.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The flush must not bring back the unlinked entry.
+	if _, err := dir.Child("file"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected unlinked file to stay removed, got: %v", err)
+	}
+	if len(orphans) != 0 {
+		t.Fatal("file reported as orphan while still open")
+	}
+
+	if err := wfd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(orphans) != 1 {
+		t.Fatalf("expected 1 orphan, got %d", len(orphans))
+	}
+	data, err := catNode(ds, orphans[0].(*dag.ProtoNode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "detached" {
+		t.Fatalf("unexpected orphan contents: %q", data)
+	}
+}
+
+func TestEvictNoOrphans(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var orphans int
+	ds := getDagserv(t)
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithOnOrphan(func(ipld.Node) {
+		orphans++
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := mkdirP(t, rt.GetDirectory(), "a/b")
+	for _, name := range []string{"f1", "f2"} {
+		if err := dir.AddChild(name, getRandFile(t, ds, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load := func() {
+		for _, pth := range []string{"/a/b/f1", "/a/b/f2"} {
+			fsn, err := Lookup(rt, pth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fd, err := fsn.(*File).Open(Flags{Read: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fd.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The evicted files are still in the tree: they're stale, not orphans.
+	load()
+	if err := rt.Evict("/a"); err != nil {
+		t.Fatal(err)
+	}
+	load()
+	rt.GetDirectory().Uncache("a")
+	load()
+	if err := rt.FlushMemFree(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if orphans != 0 {
+		t.Fatalf("expected no orphans, got %d", orphans)
+	}
+
+	load()
+	if err := rt.GetDirectory().Unlink("a"); err != nil {
+		t.Fatal(err)
+	}
+	if orphans != 2 {
+		t.Fatalf("expected the 2 unlinked files to be reported, got %d", orphans)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	mkdirP(t, dir, "a/b")
+
+	res := NewResolver(rt, ResolverOpts{MaxEntries: 2, CacheMisses: true})
+
+	b1, err := res.Lookup("/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := res.Lookup("a/b/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b1 != b2 {
+		t.Fatal("expected the same node for equivalent paths")
+	}
+
+	if _, err := res.Lookup("/a/c"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got: %v", err)
+	}
+
+	// Creating the missing entry must invalidate the cached miss.
+	mkdirP(t, dir, "a/c")
+	if _, err := res.Lookup("/a/c"); err != nil {
+		t.Fatal(err)
+	}
+
+	// And removing an entry must invalidate the cached hit.
+	a, err := res.Lookup("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.(*Directory).Unlink("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := res.Lookup("/a/b"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got: %v", err)
+	}
+
+	res.lock.Lock()
+	n := res.lru.Len()
+	res.lock.Unlock()
+	if n > 2 {
+		t.Fatalf("cache exceeded its bound: %d entries", n)
+	}
+}
+
+func TestDirListSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	for _, name := range []string{"a", "b", "c"} {
+		if err := dir.AddChild(name, getRandFile(t, ds, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var listed []string
+	err := dir.ForEachEntry(ctx, func(nl NodeListing) error {
+		listed = append(listed, nl.Name)
+		if nl.Size != 100 {
+			return fmt.Errorf("unexpected size %d for %s", nl.Size, nl.Name)
+		}
+
+		// Mutations during the listing must not be observed by it.
+		if err := dir.Unlink("c"); err != nil && err != os.ErrNotExist {
+			return err
+		}
+		_, err := dir.Mkdir("d" + nl.Name)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(listed)
+	if !compStrArrs(listed, []string{"a", "b", "c"}) {
+		t.Fatalf("listing didnt match the snapshot at call start: %v", listed)
+	}
+}
+
+func TestMissingPaths(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	d := mkdirP(t, dir, "a/b")
+	same := getRandFile(t, ds, 100)
+	if err := d.AddChild("same", same); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddChild("changed", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	other := getRandFile(t, ds, 200)
+	manifest := []PathCid{
+		{Path: "/a/b/same", Cid: same.Cid()},
+		{Path: "/a/b/changed", Cid: other.Cid()},
+		{Path: "/a/b/absent", Cid: other.Cid()},
+		{Path: "/a/b/same/under-file", Cid: other.Cid()},
+		{Path: "/x/y", Cid: other.Cid()},
+	}
+
+	missing, err := MissingPaths(ctx, rt, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, m := range missing {
+		paths = append(paths, m.Path)
+		if m.Path == "/a/b/changed" && !m.Actual.Defined() {
+			t.Fatal("expected the actual CID of a changed path")
+		}
+		if m.Path != "/a/b/changed" && m.Actual.Defined() {
+			t.Fatalf("expected %s to be reported as absent", m.Path)
+		}
+	}
+	expected := []string{"/a/b/changed", "/a/b/absent", "/a/b/same/under-file", "/x/y"}
+	if !compStrArrs(paths, expected) {
+		t.Fatalf("expected %v to be reported, got %v", expected, paths)
+	}
+}
+
+func TestFlushCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	nd := dag.NodeWithData(ft.FilePBData(nil, 0))
+	fi, err := NewFile("test", nd, dir, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wfd, err := fi.Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := wfd.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := wfd.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wfd.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+
+	cctx, ccancel := context.WithCancel(ctx)
+	ccancel()
+
+	err = wfd.CtxFlush(cctx)
+	var ferr *FlushError
+	if !errors.As(err, &ferr) {
+		t.Fatalf("expected a FlushError, got: %v", err)
+	}
+	if ferr.Persisted != 5 || !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected flush error: %s", err)
+	}
+
+	// The file must be left at its last synced state.
+	size, err := fi.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 5 {
+		t.Fatalf("expected file to keep its last synced size, got %d", size)
+	}
+
+	if err := wfd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	size, err = fi.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 11 {
+		t.Fatalf("expected close to flush the pending write, got size %d", size)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := getDagserv(t)
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), func(ctx context.Context, c cid.Cid) error {
+		return nil
+	}, WithDescriptorHoldThreshold(time.Millisecond*20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rt.HealthCheck(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := rt.GetDirectory()
+	if err := dir.AddChild("file", dag.NodeWithData(ft.FilePBData(nil, 0))); err != nil {
+		t.Fatal(err)
+	}
+	// The pending change isn't stored by the probe.
+	if err := rt.HealthCheck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	dir.lock.Lock()
+	stored := dir.storedNode
+	dir.lock.Unlock()
+	if stored != nil {
+		t.Fatal("expected the health check not to store the root")
+	}
+
+	fsn, err := dir.Child("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fsn.(*File).Open(Flags{Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	if err := rt.HealthCheck(ctx); err == nil {
+		t.Fatal("expected the stuck descriptor to be reported")
+	}
+
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.HealthCheck(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSizeWithInconsistentMetadata(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	// A file node linking to its leaves without recording their block
+	// sizes, as produced by some other implementations.
+	nd := dag.NodeWithData(ft.FilePBData(nil, 0))
+	for _, data := range []string{"hello", " world"} {
+		leaf := dag.NodeWithData(ft.FilePBData([]byte(data), uint64(len(data))))
+		if err := ds.Add(ctx, leaf); err != nil {
+			t.Fatal(err)
+		}
+		if err := nd.AddNodeLink("", leaf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := dir.AddChild("file", nd); err != nil {
+		t.Fatal(err)
+	}
+
+	fsn, err := dir.Child("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := fsn.(*File).Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 11 {
+		t.Fatalf("expected size 11, got %d", size)
+	}
+
+	list, err := dir.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Size != 11 {
+		t.Fatalf("unexpected listing: %v", list)
+	}
+
+	// The block sizes recorded but not the filesize.
+	nd = dag.NodeWithData(ft.FilePBData(nil, 0))
+	fsnode := ft.NewFSNode(ft.TFile)
+	for _, data := range []string{"hello", " world"} {
+		leaf := dag.NodeWithData(ft.FilePBData([]byte(data), uint64(len(data))))
+		if err := ds.Add(ctx, leaf); err != nil {
+			t.Fatal(err)
+		}
+		if err := nd.AddNodeLink("", leaf); err != nil {
+			t.Fatal(err)
+		}
+		fsnode.AddBlockSize(uint64(len(data)))
+	}
+	fsnode.UpdateFilesize(-int64(fsnode.FileSize()))
+	data, err := fsnode.GetBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd.SetData(data)
+	if err := dir.AddChild("nosize", nd); err != nil {
+		t.Fatal(err)
+	}
+
+	fsn, err = dir.Child("nosize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, err := fsn.(*File).Size(); err != nil || size != 11 {
+		t.Fatalf("expected size 11, got %d (%v)", size, err)
+	}
+}
+
+func TestFileAttributes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	// The default splitter cuts 256KiB chunks.
+	nd := getRandFile(t, ds, 1024*1024)
+	if err := dir.AddChild("file", nd); err != nil {
+		t.Fatal(err)
+	}
+
+	fsn, err := dir.Child("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := fsn.(*File).Attributes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := FileAttributes{
+		RawLeaves:  false,
+		CidVersion: 0,
+		ChunkSize:  256 * 1024,
+		Layout:     LayoutFlat,
+	}
+	if attrs != expected {
+		t.Fatalf("expected %+v, got %+v", expected, attrs)
+	}
+}
+
+func TestEmptyFileNode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	v0 := NewEmptyFileNode(EmptyFileOpts{})
+	if v0.Cid().Prefix().Version != 0 {
+		t.Fatal("expected a CIDv0 node by default")
+	}
+
+	dir.SetCidBuilder(dag.V1CidPrefix())
+	if err := WriteFile(rt, "/file", bytes.NewReader([]byte("data")), WriteFileOpts{Create: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	fsn, err := dir.Child("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := fsn.(*File)
+	nd, err := fi.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nd.Cid().Prefix().Version != 1 || !fi.RawLeaves {
+		t.Fatal("expected a CIDv1 file with raw leaves")
+	}
+}
+
+func TestReshard(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	dir := mkdirP(t, rt.GetDirectory(), "big")
+
+	var names []string
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("file%d", i)
+		names = append(names, name)
+		if err := dir.AddChild(name, getRandFile(t, ds, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(names)
+
+	checkDir := func(sharded bool) {
+		nd, err := FlushPath(ctx, rt, "/big")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsn, err := ft.FSNodeFromBytes(nd.(*dag.ProtoNode).Data())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (fsn.Type() == ft.THAMTShard) != sharded {
+			t.Fatalf("unexpected directory type %s", fsn.Type())
+		}
+		if err := assertDirAtPath(rt.GetDirectory(), "/big", names); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var copied int
+	err := Reshard(ctx, rt, "/big", 16, func(n int) { copied = n })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != len(names) {
+		t.Fatalf("expected progress to reach %d entries, got %d", len(names), copied)
+	}
+	checkDir(true)
+
+	if err := Reshard(ctx, rt, "/big", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkDir(false)
+
+	if err := Reshard(ctx, rt, "/big", 12, nil); err == nil {
+		t.Fatal("expected invalid fanout to be rejected")
+	}
+
+	// All the shards are built with the builder of the directory.
+	mkdirP(t, rt.GetDirectory(), "big").SetCidBuilder(sha512Prefix)
+	if err := Reshard(ctx, rt, "/big", 8, nil); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := FlushPath(ctx, rt, "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shards := assertShardPrefix(ctx, t, ds, nd, sha512Prefix); shards < 2 {
+		t.Fatalf("expected sub-shards, got %d shards", shards)
+	}
+
+	// Writes on open descriptors below it would be lost.
+	fsn, err := Lookup(rt, "/big/file0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fsn.(*File).Open(Flags{Read: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Reshard(ctx, rt, "/big", 0, nil); !errors.Is(err, ErrInUse) {
+		t.Fatalf("expected ErrInUse, got %v", err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reshard(ctx, rt, "/big", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sha512Prefix builds CIDv1 with sha2-512.
+var sha512Prefix = cid.Prefix{Version: 1, Codec: cid.DagProtobuf, MhType: 0x13, MhLength: -1}
+
+// assertShardPrefix checks that the HAMT shards of the DAG of 'nd' (which
+// must be one) have the CID prefix 'prefix', and returns their number.
+func assertShardPrefix(ctx context.Context, t *testing.T, ds ipld.DAGService, nd ipld.Node, prefix cid.Prefix) int {
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok || !isShard(pbnd) {
+		return 0
+	}
+	if p := nd.Cid().Prefix(); p.Version != prefix.Version || p.MhType != prefix.MhType {
+		t.Fatalf("expected shard %s to have the prefix %v", nd.Cid(), prefix)
+	}
+	shards := 1
+	for _, l := range nd.Links() {
+		child, err := ds.Get(ctx, l.Cid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards += assertShardPrefix(ctx, t, ds, child, prefix)
+	}
+	return shards
+}
+
+func TestCompact(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	dir := mkdirP(t, rt.GetDirectory(), "small")
+
+	var names []string
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("file%d", i)
+		names = append(names, name)
+		if err := dir.AddChild(name, getRandFile(t, ds, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A HAMT way below the sharding threshold.
+	if err := Reshard(ctx, rt, "/small", 8, nil); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := lookupDir(rt, "/small")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	estimate, err := dir.CompactEstimate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimate.Entries != len(names) || estimate.Sharded || estimate.Blocks <= 1 || estimate.CompactBlocks != 1 {
+		t.Fatalf("unexpected estimate %+v", estimate)
+	}
+
+	report, err := dir.Compact(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report != estimate {
+		t.Fatalf("expected %+v, got %+v", estimate, report)
+	}
+
+	nd, err := FlushPath(ctx, rt, "/small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isShard(nd) {
+		t.Fatal("expected the directory to be unsharded")
+	}
+	if err := assertDirAtPath(rt.GetDirectory(), "/small", names); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactKeepsPrefix(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	dir := mkdirP(t, rt.GetDirectory(), "big")
+	dir.SetCidBuilder(sha512Prefix)
+	if err := dir.SetShardWidth(8); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := dir.AddChild(fmt.Sprintf("file%d", i), getRandFile(t, ds, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Over the sharding threshold: compacted into a HAMT.
+	defer func(size int) { uio.HAMTShardingSize = size }(uio.HAMTShardingSize)
+	uio.HAMTShardingSize = 100
+	report, err := dir.Compact(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Sharded {
+		t.Fatalf("expected the directory to be sharded, got %+v", report)
+	}
+
+	nd, err := FlushPath(ctx, rt, "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shards := assertShardPrefix(ctx, t, ds, nd, sha512Prefix); shards < 2 {
+		t.Fatalf("expected sub-shards, got %d shards", shards)
+	}
+}
+
+func TestShardWidthOption(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := getDagserv(t)
+	if _, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithShardWidth(100)); err == nil {
+		t.Fatal("expected invalid shard width to be rejected")
+	}
+
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithShardWidth(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := rt.GetDirectory().Mkdir("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.shardWidth != 64 {
+		t.Fatalf("expected the root shard width to be inherited, got %d", a.shardWidth)
+	}
+
+	if err := a.SetShardWidth(7); err == nil {
+		t.Fatal("expected invalid shard width to be rejected")
+	}
+	if err := a.SetShardWidth(32); err != nil {
+		t.Fatal(err)
+	}
+	b, err := a.Mkdir("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.shardWidth != 32 {
+		t.Fatalf("expected the overridden shard width to be inherited, got %d", b.shardWidth)
+	}
+}
+
+func TestOverlayCommit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := getDagserv(t)
+	root := emptyDirNode()
+	if err := ds.Add(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+
+	rt, err := NewRoot(ctx, ds, root, nil, WithOverlay())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := mkdirP(t, rt.GetDirectory(), "a")
+	scratch := dag.NodeWithData(ft.FilePBData([]byte("scratch"), 7))
+	if err := a.AddChild("scratch", scratch); err != nil {
+		t.Fatal(err)
+	}
+	kept := dag.NodeWithData(ft.FilePBData([]byte("kept"), 4))
+	if err := a.AddChild("kept", kept); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Unlink("scratch"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ds.Get(ctx, kept.Cid()); err == nil {
+		t.Fatal("uncommitted node shouldnt be in the DAG service")
+	}
+
+	c, err := rt.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []cid.Cid{c, kept.Cid()} {
+		if _, err := ds.Get(ctx, expected); err != nil {
+			t.Fatalf("committed node %s missing: %s", expected, err)
+		}
+	}
+	if _, err := ds.Get(ctx, scratch.Cid()); err == nil {
+		t.Fatal("abandoned node shouldnt have been committed")
+	}
+
+	if err := assertDirAtPath(rt.GetDirectory(), "/a", []string{"kept"}); err != nil {
+		t.Fatal(err)
+	}
+	// The abandoned nodes are dropped as well.
+	if n := len(rt.overlay.cids()); n != 0 {
+		t.Fatalf("expected no nodes left in memory, got %d", n)
+	}
+}
+
+func TestGarbageEstimate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	dir := rt.GetDirectory()
+
+	kept := dag.NodeWithData(ft.FilePBData([]byte("kept"), 4))
+	if err := dir.AddChild("kept", kept); err != nil {
+		t.Fatal(err)
+	}
+	removed := dag.NodeWithData(ft.FilePBData([]byte("removed"), 7))
+	if err := dir.AddChild("removed", removed); err != nil {
+		t.Fatal(err)
+	}
+
+	oldRoot, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dir.Unlink("removed"); err != nil {
+		t.Fatal(err)
+	}
+	newRoot, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := GarbageEstimate(ctx, ds, oldRoot.Cid(), newRoot.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The old root directory node and the removed file.
+	expected := GarbageReport{
+		Blocks: 2,
+		Bytes:  uint64(len(oldRoot.RawData()) + len(removed.RawData())),
+	}
+	if report != expected {
+		t.Fatalf("expected %+v, got %+v", expected, report)
+	}
+}
+
+// failingReader returns an error after reading 'n' bytes of 'r'.
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *failingReader) Read(b []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, errors.New("connection reset")
+	}
+	if len(b) > f.n {
+		b = b[:f.n]
+	}
+	n, err := f.r.Read(b)
+	f.n -= n
+	return n, err
+}
+
+func TestWriteFileIdempotent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, rt := setupRoot(ctx, t)
+	data := []byte("hello idempotent world")
+	opts := WriteFileOpts{Create: true, IdempotencyKey: "upload-1"}
+
+	err := WriteFile(rt, "/file", &failingReader{r: bytes.NewReader(data), n: 5}, opts)
+	if err == nil {
+		t.Fatal("expected the interrupted write to fail")
+	}
+
+	// The retry resends all the data and resumes after what was written.
+	if err := WriteFile(rt, "/file", bytes.NewReader(data), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once complete, a retry is a no-op.
+	if err := WriteFile(rt, "/file", bytes.NewReader([]byte("other")), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFile(rt, "/other", bytes.NewReader(data), opts); err == nil {
+		t.Fatal("expected reusing the key for another path to fail")
+	}
+
+	buf := make([]byte, len(data))
+	if err := readFile(rt, "/file", 0, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatalf("unexpected contents %q", buf)
+	}
+	fsn, err := Lookup(rt, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := fsn.(*File).Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) {
+		t.Fatalf("expected size %d, got %d", len(data), size)
+	}
+}
+
+func TestUploadSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, rt := setupRoot(ctx, t)
+	mkdirP(t, rt.GetDirectory(), "uploads")
+
+	id, err := StartUpload(rt, "/uploads/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendChunk(ctx, rt, id, []byte("hello ")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is linked until the upload is committed.
+	if _, err := Lookup(rt, "/uploads/big"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got: %v", err)
+	}
+
+	// Simulate an interruption: resume from the reported state.
+	partial, size, err := UploadState(rt, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 6 {
+		t.Fatalf("expected 6 bytes uploaded, got %d", size)
+	}
+	if err := AbortUpload(rt, id); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err = ResumeUpload(ctx, rt, "/uploads/big", partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendChunk(ctx, rt, id, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed commit keeps the session to be retried.
+	mkdirP(t, rt.GetDirectory(), "uploads/big")
+	if err := CommitUpload(rt, id); !errors.Is(err, ErrIsDirectory) {
+		t.Fatalf("expected ErrIsDirectory, got: %v", err)
+	}
+	if _, size, err := UploadState(rt, id); err != nil || size != 11 {
+		t.Fatalf("expected the session to be kept, got %d bytes (%v)", size, err)
+	}
+	if err := RemoveAll(rt, "/uploads/big"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CommitUpload(rt, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := CommitUpload(rt, id); err != ErrNoUpload {
+		t.Fatalf("expected ErrNoUpload, got: %v", err)
+	}
+
+	buf := make([]byte, 11)
+	if err := readFile(rt, "/uploads/big", 0, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello world" {
+		t.Fatalf("unexpected contents %q", buf)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, rt := setupRoot(ctx, t)
+	mkdirP(t, rt.GetDirectory(), "a")
+
+	for _, data := range []string{"first version", "second"} {
+		if err := WriteFileAtomic(ctx, rt, "/a/file", bytes.NewReader([]byte(data))); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, len(data))
+		if err := readFile(rt, "/a/file", 0, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != data {
+			t.Fatalf("unexpected contents %q", buf)
+		}
+	}
+
+	// No temporary entries are left behind.
+	if err := assertDirAtPath(rt.GetDirectory(), "/a", []string{"file"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := WriteFileAtomic(ctx, rt, "/a/failed", &failingReader{r: bytes.NewReader([]byte("data")), n: 2})
+	if err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	if err := assertDirAtPath(rt.GetDirectory(), "/a", []string{"file"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStagingDirCleanup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+
+	id, err := StartUpload(rt, "/partial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendChunk(ctx, rt, id, []byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	partial, _, err := UploadState(rt, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging, err := rt.StagingDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := staging.AddChild("file.tmp-abandoned", NewEmptyFileNode(EmptyFileOpts{})); err != nil {
+		t.Fatal(err)
+	}
+	names, err := staging.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("expected the partial upload and the temporary file to be staged, got %v", names)
+	}
+
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tree is left as is unless asked to.
+	rt2, err := NewRoot(ctx, ds, nd.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertDirAtPath(rt2.GetDirectory(), DefaultStagingDir, names); err != nil {
+		t.Fatal(err)
+	}
+
+	// Abandoned entries are removed when the tree is opened again, the
+	// partial uploads are kept to be resumed.
+	rt2, err = NewRoot(ctx, ds, nd.(*dag.ProtoNode), nil, WithStagingCleanup())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertDirAtPath(rt2.GetDirectory(), DefaultStagingDir, []string{"upload-" + string(id)}); err != nil {
+		t.Fatal(err)
+	}
+	id2, err := ResumeUpload(ctx, rt2, "/partial", partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertDirAtPath(rt2.GetDirectory(), DefaultStagingDir, []string{"upload-" + string(id2)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A custom staging path is created on demand.
+	rt3, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithStagingDir("var/staging"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(ctx, rt3, "/file", bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertDirAtPath(rt3.GetDirectory(), "/var/staging", []string{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithStagingDir("/")); err == nil {
+		t.Fatal("expected the root to be rejected as staging directory")
+	}
+}
+
+func TestTree(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	dir := mkdirP(t, rt.GetDirectory(), "a/b/c")
+	if err := dir.AddChild("file", getRandFile(t, ds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.GetDirectory().AddChild("top", getRandFile(t, ds, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := Tree(ctx, rt, "/", TreeOpts{IncludeSizes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Children) != 2 || tree.Children[0].Name != "a" || tree.Children[1].Name != "top" {
+		t.Fatalf("unexpected root entries %v", tree.Children)
+	}
+	if tree.Children[1].Size != 10 {
+		t.Fatalf("expected size 10, got %d", tree.Children[1].Size)
+	}
+	c := tree.Children[0].Children[0].Children[0]
+	if c.Name != "c" || c.Type != int(TDir) || len(c.Children) != 1 || c.Children[0].Size != 1000 {
+		t.Fatal("unexpected subtree")
+	}
+
+	tree, err = Tree(ctx, rt, "/a", TreeOpts{MaxDepth: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := tree.Children[0]
+	if tree.Name != "a" || b.Name != "b" || !b.Truncated || b.Children != nil {
+		t.Fatal("expected the tree to stop at depth 1")
+	}
+}
+
+func TestModTimePolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := getDagserv(t)
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithModTimePolicy(ModTimeOnEntries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := mkdirP(t, rt.GetDirectory(), "a")
+	if err := dir.AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := dir.ModTime()
+	time.Sleep(time.Millisecond * 10)
+
+	// Changing the contents of an entry doesn't update it.
+	fsn, err := dir.Child("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fsn.(*File).Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !dir.ModTime().Equal(mtime) {
+		t.Fatal("modification time changed on a content update")
+	}
+
+	// Removing one does.
+	if err := dir.Unlink("file"); err != nil {
+		t.Fatal(err)
+	}
+	if !dir.ModTime().After(mtime) {
+		t.Fatal("modification time wasn't updated on unlink")
+	}
+}
+
+func TestTypeMapping(t *testing.T) {
+	for _, tc := range []struct {
+		ut   pb.Data_DataType
+		nt   NodeType
+		mode fs.FileMode
+	}{
+		{ft.TDirectory, TDir, fs.ModeDir},
+		{ft.THAMTShard, TDir, fs.ModeDir},
+		{ft.TFile, TFile, 0},
+		{ft.TRaw, TFile, 0},
+		{ft.TSymlink, TFile, fs.ModeSymlink},
+	} {
+		nt, err := UnixFSNodeType(tc.ut)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mode, err := UnixFSFileMode(tc.ut)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nt != tc.nt || mode != tc.mode {
+			t.Fatalf("%s: expected %d/%s, got %d/%s", tc.ut, tc.nt, tc.mode, nt, mode)
+		}
+
+		back, err := NodeTypeFromFileMode(mode | 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if back != nt {
+			t.Fatalf("%s: mode %s mapped back to %d", tc.ut, mode, back)
+		}
+	}
+
+	if _, err := UnixFSNodeType(ft.TMetadata); err != ErrNotYetImplemented {
+		t.Fatalf("expected ErrNotYetImplemented, got %v", err)
+	}
+	if _, err := NodeTypeFromFileMode(fs.ModeNamedPipe); err == nil {
+		t.Fatal("expected named pipes to be rejected")
+	}
+}
+
+// countingDAG counts the nodes added to (and read from) the DAG service.
+type countingDAG struct {
+	ipld.DAGService
+	adds int64
+	gets int64
+}
+
+func (c *countingDAG) Get(ctx context.Context, k cid.Cid) (ipld.Node, error) {
+	atomic.AddInt64(&c.gets, 1)
+	return c.DAGService.Get(ctx, k)
+}
+
+func (c *countingDAG) Add(ctx context.Context, nd ipld.Node) error {
+	atomic.AddInt64(&c.adds, 1)
+	return c.DAGService.Add(ctx, nd)
+}
+
+func (c *countingDAG) AddMany(ctx context.Context, nds []ipld.Node) error {
+	atomic.AddInt64(&c.adds, int64(len(nds)))
+	return c.DAGService.AddMany(ctx, nds)
+}
+
+func TestBulkLoad(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const files = 10
+	load := func(opts ...RootOption) (*Root, int64) {
+		dserv := &countingDAG{DAGService: getDagserv(t)}
+		rt, err := NewRoot(ctx, dserv, emptyDirNode(), nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mkdirP(t, rt.GetDirectory(), "a/b/c")
+		for i := 0; i < files; i++ {
+			pth := fmt.Sprintf("/a/b/c/file%d", i)
+			err := WriteFile(rt, pth, bytes.NewReader([]byte(pth)), WriteFileOpts{Create: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rt, atomic.LoadInt64(&dserv.adds)
+	}
+
+	_, normal := load()
+	rt, bulk := load(WithBulkLoad())
+	if bulk+3*files > normal {
+		t.Fatalf("expected the ancestors not to be rewritten on every write (%d adds, %d without bulk load)", bulk, normal)
+	}
+
+	if err := rt.EndBulkLoad(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("/a/b/c/file3"))
+	if err := readFile(rt, "/a/b/c/file3", 0, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "/a/b/c/file3" {
+		t.Fatalf("unexpected contents %q", buf)
+	}
+}
+
+func TestFlushSkipsUnchanged(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dserv := &countingDAG{DAGService: getDagserv(t)}
+	rt, err := NewRoot(ctx, dserv, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const dirs = 20
+	for i := 0; i < dirs; i++ {
+		dir := mkdirP(t, rt.GetDirectory(), fmt.Sprintf("d%d", i))
+		if err := dir.AddChild("file", getRandFile(t, dserv, 100)); err != nil {
+			t.Fatal(err)
+		}
+		// Load the entry so the directory has it cached.
+		if _, err := dir.Child("file"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt64(&dserv.adds, 0)
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if adds := atomic.LoadInt64(&dserv.adds); adds != 0 {
+		t.Fatalf("flushing an unchanged tree added %d nodes", adds)
+	}
+
+	if err := WriteFile(rt, "/d3/file", bytes.NewReader([]byte("changed")), WriteFileOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if adds := atomic.LoadInt64(&dserv.adds); adds >= dirs {
+		t.Fatalf("updating a single file added %d nodes", adds)
+	}
+
+	atomic.StoreInt64(&dserv.adds, 0)
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if adds := atomic.LoadInt64(&dserv.adds); adds != 0 {
+		t.Fatalf("flushing an unchanged tree added %d nodes", adds)
+	}
+
+	buf := make([]byte, len("changed"))
+	if err := readFile(rt, "/d3/file", 0, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "changed" {
+		t.Fatalf("unexpected contents %q", buf)
+	}
+}
+
+func TestPublishStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	dir := mkdirP(t, rt.GetDirectory(), "a")
+	if err := dir.AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	fsn, err := dir.Child("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fsn.(*File).Open(Flags{Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte("dirty")); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := rt.PublishStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Republisher.Running || status.UpToDate {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if len(status.DirtyPaths) != 1 || status.DirtyPaths[0] != "/a/file" {
+		t.Fatalf("unexpected dirty paths %v", status.DirtyPaths)
+	}
+
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.repub.WaitPub(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err = rt.PublishStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.UpToDate || len(status.DirtyPaths) != 0 || status.Republisher.PublishedAt.IsZero() {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+// droppingDAG silently drops the nodes added to it.
+type droppingDAG struct {
+	ipld.DAGService
+}
+
+func (droppingDAG) Add(context.Context, ipld.Node) error {
+	return nil
+}
+
+func TestWriteVerification(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rt, err := NewRoot(ctx, getDagserv(t), emptyDirNode(), nil, WithWriteVerification())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(rt, "/file", bytes.NewReader([]byte("data")), WriteFileOpts{Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := rt.VerifyStats(); stats.Verified == 0 || stats.Failed != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	rt, err = NewRoot(ctx, droppingDAG{getDagserv(t)}, emptyDirNode(), nil, WithWriteVerification())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rt.GetDirectory().Mkdir("dir")
+	if !errors.Is(err, ErrVerifyFailed) {
+		t.Fatalf("expected a verification failure, got %v", err)
+	}
+	if stats := rt.VerifyStats(); stats.Failed != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	dir := mkdirP(t, rt.GetDirectory(), "a")
+	big := getRandFile(t, ds, 5000)
+	for name, nd := range map[string]ipld.Node{
+		"small": getRandFile(t, ds, 200),
+		"big":   big,
+		"copy":  big,
+	} {
+		if err := dir.AddChild(name, nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sub := mkdirP(t, dir, "sub")
+	if err := sub.AddChild("file", getRandFile(t, ds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	total, err := DiskUsage(ctx, rt, "/a", DiskUsageOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := DiskUsage(ctx, rt, "/a", DiskUsageOpts{PerChild: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Usage != total.Usage || report.Name != "a" {
+		t.Fatalf("expected %+v, got %+v", total.Usage, report.Usage)
+	}
+
+	// The shared file is only counted once.
+	if len(report.Children) != 4 || report.Children[0].Bytes < 5000 || report.Children[3].Bytes != 0 {
+		t.Fatalf("unexpected breakdown %+v", report.Children)
+	}
+	if report.Children[1].Name != "sub" || report.Children[2].Name != "small" {
+		t.Fatalf("unexpected order %+v", report.Children)
+	}
+}
+
+func TestFileDescriptorAbort(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, rt := setupRoot(ctx, t)
+	if err := WriteFile(rt, "/file", bytes.NewReader([]byte("original")), WriteFileOpts{Create: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	fsn, err := Lookup(rt, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := fsn.(*File)
+	fd, err := fi.Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte("modified")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Abort(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	buf := make([]byte, len("original"))
+	if err := readFile(rt, "/file", 0, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "original" {
+		t.Fatalf("unexpected contents %q", buf)
+	}
+
+	// The write lock was released.
+	fd, err = fi.Open(Flags{Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPersistHook(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := getDagserv(t)
+	hookErr := errors.New("recovery point not recorded")
+	var failing bool
+	var persisted []cid.Cid
+	hook := func(ctx context.Context, c cid.Cid) error {
+		if failing {
+			return hookErr
+		}
+		// The whole DAG must be stored by now.
+		if err := walkDAG(ctx, ds, c, cid.NewSet(), nil, nil); err != nil {
+			t.Errorf("root %s persisted with missing nodes: %s", c, err)
+		}
+		persisted = append(persisted, c)
+		return nil
+	}
+
+	var published []cid.Cid
+	pf := func(ctx context.Context, c cid.Cid) error {
+		published = append(published, c)
+		return nil
+	}
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), pf, WithPersistHook(hook))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := mkdirP(t, rt.GetDirectory(), "a/b")
+	if err := dir.AddChild("file", getRandFile(t, ds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	state := rt.FlushState()
+	if state.Phase != FlushIdle || state.Err != nil || len(persisted) == 0 || !state.Root.Equals(persisted[len(persisted)-1]) {
+		t.Fatalf("unexpected flush state %+v", state)
+	}
+	if !rt.PersistedRoot().Equals(state.Root) {
+		t.Fatal("expected the flushed root to be the persisted one")
+	}
+
+	failing = true
+	if err := dir.AddChild("other", getRandFile(t, ds, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); !errors.Is(err, hookErr) {
+		t.Fatalf("expected the hook error, got %v", err)
+	}
+	if state := rt.FlushState(); !errors.Is(state.Err, hookErr) || !state.Root.Equals(persisted[len(persisted)-1]) {
+		t.Fatalf("unexpected flush state %+v", state)
+	}
+
+	if err := rt.repub.WaitPub(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) == 0 || !published[len(published)-1].Equals(persisted[len(persisted)-1]) {
+		t.Fatal("expected the last persisted root to be published")
+	}
+}
+
+func TestRootLock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dserv := getDagserv(t)
+	locker := NewDatastoreLocker(dssync.MutexWrap(ds.NewMapDatastore()))
+	open := func(opts ...RootOption) (*Root, error) {
+		opts = append(opts, WithLock(locker, "/mfs/root"))
+		return NewRoot(ctx, dserv, emptyDirNode(), nil, opts...)
+	}
+
+	rt1, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := open(); !errors.Is(err, ErrRootLocked) {
+		t.Fatalf("expected ErrRootLocked, got %v", err)
+	}
+
+	rt2, err := open(WithLockTakeover())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkdirP(t, rt1.GetDirectory(), "a")
+	if err := rt1.Flush(); !errors.Is(err, ErrRootLocked) {
+		t.Fatalf("expected the taken over root not to flush, got %v", err)
+	}
+
+	if err := rt2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rt3, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing releases the lock even if the last flush fails.
+	hookErr := errors.New("hook failed")
+	rt3.persistHook = func(context.Context, cid.Cid) error { return hookErr }
+	mkdirP(t, rt3.GetDirectory(), "b")
+	if err := rt3.Close(); !errors.Is(err, hookErr) {
+		t.Fatalf("expected the flush error, got %v", err)
+	}
+	if err := rt3.Err(); err != ErrRootClosed {
+		t.Fatalf("expected the root to be closed, got %v", err)
+	}
+	if _, err := open(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type recordingPublisher struct {
+	lk      sync.Mutex
+	updates []cid.Cid
+	closed  bool
+}
+
+func (p *recordingPublisher) Update(c cid.Cid) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.updates = append(p.updates, c)
+}
+
+func (p *recordingPublisher) WaitPub(context.Context) error { return nil }
+
+func (p *recordingPublisher) Close() error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.closed = true
+	return nil
+}
+
+func TestCustomPublisher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pub := &recordingPublisher{}
+	rt, err := NewRoot(ctx, getDagserv(t), emptyDirNode(), nil, WithPublisher(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mkdirP(t, rt.GetDirectory(), "a")
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pub.lk.Lock()
+	defer pub.lk.Unlock()
+	if len(pub.updates) == 0 || !pub.updates[len(pub.updates)-1].Equals(nd.Cid()) {
+		t.Fatalf("expected %s to be the last published value, got %v", nd.Cid(), pub.updates)
+	}
+	if !pub.closed {
+		t.Fatal("expected the publisher to be closed with the root")
+	}
+
+	pf := func(context.Context, cid.Cid) error { return nil }
+	if _, err := NewRoot(ctx, getDagserv(t), emptyDirNode(), pf, WithPublisher(pub)); err == nil {
+		t.Fatal("expected giving both a PubFunc and a Publisher to fail")
+	}
+}
+
+func TestMvBetweenSameNamedDirs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	a := mkdirP(t, rt.GetDirectory(), "a")
+	mkdirP(t, rt.GetDirectory(), "b/a")
+	if err := a.AddChild("x", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Mv(rt, "/a/x", "/b/a/x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt, "/a/x"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the source to be removed, got %v", err)
+	}
+	if _, err := Lookup(rt, "/b/a/x"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Moving an entry onto itself is a no-op.
+	if err := Mv(rt, "/b/a/x", "/b/a/x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt, "/b/a/x"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkMvSharded(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rt, err := NewRoot(ctx, getDagserv(b), emptyDirNode(), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, name := range []string{"src", "dst"} {
+		dir := mkdirP(b, rt.GetDirectory(), name)
+		for i := 0; i < 5000; i++ {
+			nd := dag.NodeWithData(ft.FilePBData([]byte(fmt.Sprint(i)), uint64(len(fmt.Sprint(i)))))
+			if err := dir.AddChild(fmt.Sprintf("file%d", i), nd); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := Reshard(ctx, rt, "/"+name, 256, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("rename", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := Mv(rt, "/src/file0", "/src/moved"); err != nil {
+				b.Fatal(err)
+			}
+			if err := Mv(rt, "/src/moved", "/src/file0"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("between", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := Mv(rt, "/src/file1", "/dst/moved"); err != nil {
+				b.Fatal(err)
+			}
+			if err := Mv(rt, "/dst/moved", "/src/file1"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestUnlinkAndGet(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	root := rt.GetDirectory()
+	fnd := getRandFile(t, ds, 1000)
+	if err := root.AddChild("file", fnd); err != nil {
+		t.Fatal(err)
+	}
+	sub := mkdirP(t, root, "dir")
+	if err := sub.AddChild("x", getRandFile(t, ds, 10)); err != nil {
+		t.Fatal(err)
+	}
+	subNd, err := sub.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, nt, err := root.UnlinkAndGet("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Equals(fnd.Cid()) || nt != TFile {
+		t.Fatalf("expected file %s, got %s (type %d)", fnd.Cid(), c, nt)
+	}
+
+	c, nt, err = root.UnlinkAndGet("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Equals(subNd.Cid()) || nt != TDir {
+		t.Fatalf("expected directory %s, got %s (type %d)", subNd.Cid(), c, nt)
+	}
+
+	if _, err := root.Child("file"); err != os.ErrNotExist {
+		t.Fatalf("expected the entry to be removed, got %v", err)
+	}
+	if _, _, err := root.UnlinkAndGet("file"); err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestPathAPI(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, rt := setupRoot(ctx, t)
+	mkdirP(t, rt.GetDirectory(), "a")
+
+	data := []byte("path based")
+	if err := rt.WritePath("/a/file", bytes.NewReader(data), WriteFileOpts{Create: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := rt.StatPath(ctx, "/a/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Name != "file" || st.Type != int(TFile) || st.Size != int64(len(data)) {
+		t.Fatalf("unexpected stat %+v", st)
+	}
+
+	fd, err := rt.OpenPath("/a/file", Flags{Read: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := io.ReadAll(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatalf("unexpected contents %q", buf)
+	}
+	if _, err := rt.OpenPath("/a", Flags{Read: true}); err == nil {
+		t.Fatal("expected opening a directory to fail")
+	}
+
+	list, err := rt.ListPath(ctx, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "file" {
+		t.Fatalf("unexpected listing %+v", list)
+	}
+
+	if err := rt.RemovePath("/a/file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.StatPath(ctx, "/a/file"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	a := mkdirP(t, rt.GetDirectory(), "a/b")
+	fnd := getRandFile(t, ds, 100)
+	if err := a.AddChild("file", fnd); err != nil {
+		t.Fatal(err)
+	}
+
+	links := map[string]string{
+		"/abs":      "/a/b/file",
+		"/a/rel":    "b/file",
+		"/a/b/up":   "../b",
+		"/a/dirlnk": "/a/b",
+		"/loop1":    "/loop2",
+		"/loop2":    "loop1",
+	}
+	for pth, target := range links {
+		if err := Symlink(rt, target, pth); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for pth, target := range links {
+		got, err := Readlink(rt, pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != target {
+			t.Fatalf("expected %s to point to %s, got %s", pth, target, got)
+		}
+	}
+	if _, err := Readlink(rt, "/a/b/file"); !errors.Is(err, ErrNotSymlink) {
+		t.Fatalf("expected ErrNotSymlink, got %v", err)
+	}
+
+	for _, pth := range []string{"/abs", "/a/rel", "/a/b/up/file", "/a/dirlnk/up/up/file", "/a/dirlnk/../b/file"} {
+		fsn, err := LookupWithOpts(rt, pth, LookupOpts{FollowSymlinks: true})
+		if err != nil {
+			t.Fatalf("%s: %s", pth, err)
+		}
+		nd, err := fsn.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !nd.Cid().Equals(fnd.Cid()) {
+			t.Fatalf("%s didn't resolve to the file", pth)
+		}
+	}
+
+	// Not followed by default.
+	fsn, err := Lookup(rt, "/abs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsn.(*File).Open(Flags{Read: true}); err == nil {
+		t.Fatal("expected opening a symlink to fail")
+	}
+	if _, err := LookupWithOpts(rt, "/loop1", LookupOpts{FollowSymlinks: true}); !errors.Is(err, ErrTooManyLinks) {
+		t.Fatalf("expected ErrTooManyLinks, got %v", err)
+	}
+	if _, err := LookupWithOpts(rt, "/abs/x", LookupOpts{FollowSymlinks: true}); err == nil {
+		t.Fatal("expected a path through a file to fail")
+	}
+}
+
+func TestSyncFromCid(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	keep := getRandFile(t, ds, 100)
+	build := func(rt *Root, files map[[2]string]ipld.Node) {
+		for pth, nd := range files {
+			dir := rt.GetDirectory()
+			if pth[0] != "" {
+				dir = mkdirP(t, dir, pth[0])
+			}
+			if err := dir.AddChild(pth[1], nd); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	build(rt, map[[2]string]ipld.Node{
+		{"a", "file"}: getRandFile(t, ds, 100),
+		{"a", "keep"}: keep,
+		{"b", "x"}:    getRandFile(t, ds, 100),
+		{"", "old"}:   getRandFile(t, ds, 100),
+	})
+
+	other, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	build(other, map[[2]string]ipld.Node{
+		{"a", "file"}:   getRandFile(t, ds, 100),
+		{"a", "keep"}:   keep,
+		{"", "b"}:       getRandFile(t, ds, 100),
+		{"new", "file"}: getRandFile(t, ds, 100),
+	})
+	target, err := other.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := rt.Watch(WatchOpts{BufferSize: 100})
+	defer w.Close()
+
+	report, err := SyncFromCid(ctx, rt, target.Cid(), SyncOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report != (SyncReport{Added: 2, Removed: 2, Modified: 1}) {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd.Cid().Equals(target.Cid()) {
+		t.Fatalf("expected the root to be %s, got %s", target.Cid(), nd.Cid())
+	}
+
+	expected := fmt.Sprint(map[string]Op{
+		"/old":    Remove,
+		"/a/file": Write,
+		"/b":      Remove | Create,
+		"/new":    Create,
+	})
+	events := map[string]Op{}
+	timeout := time.After(time.Second)
+	for fmt.Sprint(events) != expected {
+		select {
+		case e := <-w.Events():
+			events[e.Name] |= e.Op
+		case <-timeout:
+			t.Fatalf("expected events %s, got %v", expected, events)
+		}
+	}
+}
+
+func TestGraftValidation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := getDagserv(t)
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithGraftValidation(GraftLimits{
+		MaxDepth: 3,
+		MaxWidth: 10,
+		MaxSize:  1 << 20,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf := dag.NewRawNode([]byte("leaf"))
+	if err := ds.Add(ctx, leaf); err != nil {
+		t.Fatal(err)
+	}
+	dirWith := func(names ...string) ipld.Node {
+		nd := emptyDirNode()
+		for _, name := range names {
+			if err := nd.AddRawLink(name, &ipld.Link{Cid: leaf.Cid(), Size: 4}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nd
+	}
+
+	if err := PutNode(rt, "/valid", getRandFile(t, ds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/dir", dirWith("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	badFile := dag.NodeWithData(ft.FilePBData(nil, 4))
+	if err := badFile.AddNodeLink("", leaf); err != nil {
+		t.Fatal(err)
+	}
+	wide := make([]string, 11)
+	for i := range wide {
+		wide[i] = fmt.Sprint(i)
+	}
+	for name, nd := range map[string]ipld.Node{
+		"garbage":   dag.NodeWithData([]byte("not unixfs")),
+		"badfile":   badFile,
+		"wide":      dirWith(wide...),
+		"duplicate": dirWith("a", "a"),
+		"slash":     dirWith("a/b"),
+		"large":     getRandFile(t, ds, 2<<20),
+	} {
+		if err := PutNode(rt, "/"+name, nd); !errors.Is(err, ErrInvalidGraft) {
+			t.Fatalf("%s: expected ErrInvalidGraft, got %v", name, err)
+		}
+	}
+	if err := assertDirAtPath(rt.GetDirectory(), "/", []string{"dir", "valid"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := getDagserv(t)
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithMaxFileSize(100), WithMaxDirEntries(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := rt.GetDirectory()
+
+	a := mkdirP(t, root, "a")
+	mkdirP(t, root, "b")
+	if err := root.AddChild("c", getRandFile(t, ds, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.AddChild("d", getRandFile(t, ds, 10)); !errors.Is(err, ErrTooManyEntries) {
+		t.Fatalf("expected ErrTooManyEntries, got %v", err)
+	}
+	if _, err := root.Mkdir("d"); !errors.Is(err, ErrTooManyEntries) {
+		t.Fatalf("expected ErrTooManyEntries, got %v", err)
+	}
+	if err := root.Unlink("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.AddChild("d", getRandFile(t, ds, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loaded directories are counted before adding to them.
+	nd, err := root.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt2, err := NewRoot(ctx, ds, nd.(*dag.ProtoNode), nil, WithMaxDirEntries(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt2.GetDirectory().Mkdir("e"); !errors.Is(err, ErrTooManyEntries) {
+		t.Fatalf("expected ErrTooManyEntries, got %v", err)
+	}
+
+	if err := WriteFile(rt, "/a/file", bytes.NewReader(make([]byte, 50)), WriteFileOpts{Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := a.Child("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fsn.(*File).Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	if _, err := fd.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write(make([]byte, 1)); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("expected ErrFileTooLarge, got %v", err)
+	}
+	if _, err := fd.WriteAt(make([]byte, 60), 50); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("expected ErrFileTooLarge, got %v", err)
+	}
+	if err := fd.Truncate(101); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("expected ErrFileTooLarge, got %v", err)
+	}
+	if size, err := fd.Size(); err != nil || size != 100 {
+		t.Fatalf("expected the file to stay at 100 bytes, got %d (%v)", size, err)
+	}
+
+	// Content created outside of the descriptors is checked too.
+	big := getRandFile(t, ds, 200)
+	if err := PutNode(rt, "/b/big", big); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("expected ErrFileTooLarge, got %v", err)
+	}
+	holder := ft.EmptyDirNode()
+	if err := holder.AddNodeLink("big", big); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Add(ctx, holder); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/b/holder", holder); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("expected ErrFileTooLarge, got %v", err)
+	}
+	if err := fsn.(*File).SetNode(ctx, big); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("expected ErrFileTooLarge, got %v", err)
+	}
+
+	// Room for the staging directory.
+	if err := root.Unlink("b"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := StartUpload(rt, "/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendChunk(ctx, rt, id, make([]byte, 60)); err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendChunk(ctx, rt, id, make([]byte, 60)); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("expected ErrFileTooLarge, got %v", err)
+	}
+	// Replacing a file of a full directory doesn't add an entry.
+	if err := CommitUpload(rt, id); err != nil {
+		t.Fatal(err)
+	}
+	fsn, err = root.Child("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, err := fsn.(*File).Size(); err != nil || size != 60 {
+		t.Fatalf("expected the upload to replace d, got %d bytes (%v)", size, err)
+	}
+}
+
+// ctxDAG fails the fetches with canceled contexts, even of local blocks.
+type ctxDAG struct {
+	ipld.DAGService
+}
+
+func (d ctxDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.DAGService.Get(ctx, c)
+}
+
+func TestContextOps(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	canceled, cancelOps := context.WithCancel(ctx)
+	cancelOps()
+
+	ds, rt := setupRoot(ctx, t)
+	a := mkdirP(t, rt.GetDirectory(), "a")
+	if err := a.AddChild("f", getRandFile(t, ds, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is loaded in a new root.
+	rt, err = NewRoot(ctx, ctxDAG{ds}, nd.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CtxLookup(canceled, rt, "/a/f"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the lookup to be canceled, got %v", err)
+	}
+	if err := CtxMkdir(canceled, rt, "/a/b", MkdirOpts{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected mkdir to be canceled, got %v", err)
+	}
+	if err := CtxPutNode(canceled, rt, "/a/g", getRandFile(t, ds, 10)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected put to be canceled, got %v", err)
+	}
+	if err := CtxMv(canceled, rt, "/a/f", "/f"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected mv to be canceled, got %v", err)
+	}
+
+	if err := CtxMv(ctx, rt, "/a/f", "/f"); err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := CtxLookup(ctx, rt, "/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fsn.(*File).CtxOpen(canceled, Flags{Read: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if _, err := fd.Read(make([]byte, 10)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the read to be canceled, got %v", err)
+	}
+}
+
+func TestFollower(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	if err := rt.GetDirectory().AddChild("old", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.GetDirectory().AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	resolve := func(ctx context.Context) (cid.Cid, error) {
+		nd, err := rt.GetDirectory().GetNode()
+		if err != nil {
+			return cid.Undef, err
+		}
+		return nd.Cid(), nil
+	}
+
+	f, err := NewFollowerRoot(ctx, ds, resolve, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	first := f.Root()
+	if _, err := Lookup(first, "/old"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := f.Watch(WatchOpts{BufferSize: 100})
+	defer w.Close()
+
+	if err := rt.GetDirectory().Unlink("old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.GetDirectory().Unlink("file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.GetDirectory().AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	mkdirP(t, rt.GetDirectory(), "new/dir")
+
+	if err := f.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := resolve(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Current().Equals(expected) {
+		t.Fatalf("expected to follow %s, got %s", expected, f.Current())
+	}
+	if f.Root() == first {
+		t.Fatal("expected the root to be swapped")
+	}
+	if _, err := Lookup(f.Root(), "/new/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(f.Root(), "/old"); err == nil {
+		t.Fatal("expected /old to be gone")
+	}
+	// The previous root still shows the previous tree.
+	if _, err := Lookup(first, "/old"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedEvents := fmt.Sprint(map[string]Op{
+		"/old":  Remove,
+		"/file": Write,
+		"/new":  Create,
+	})
+	events := map[string]Op{}
+	timeout := time.After(time.Second)
+	for fmt.Sprint(events) != expectedEvents {
+		select {
+		case e := <-w.Events():
+			events[e.Name] |= e.Op
+		case <-timeout:
+			t.Fatalf("expected events %s, got %v", expectedEvents, events)
+		}
+	}
+}
+
+func TestCp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	dir := mkdirP(t, rt.GetDirectory(), "src/sub")
+	fnd := getRandFile(t, ds, 1000)
+	if err := dir.AddChild("file", fnd); err != nil {
+		t.Fatal(err)
+	}
+	other := getRandFile(t, ds, 100)
+	if err := rt.GetDirectory().AddChild("other", other); err != nil {
+		t.Fatal(err)
+	}
+
+	cidAt := func(pth string) cid.Cid {
+		t.Helper()
+		fsn, err := Lookup(rt, pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd, err := fsn.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd.Cid()
+	}
+
+	// Directories are copied recursively.
+	if err := Cp(ctx, rt, "/src", "/dst", CpOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if !cidAt("/dst/sub/file").Equals(fnd.Cid()) {
+		t.Fatal("copied file differs from the source")
+	}
+	if !cidAt("/dst").Equals(cidAt("/src")) {
+		t.Fatal("copied directory differs from the source")
+	}
+
+	// The copies are independent.
+	if err := Mv(rt, "/dst/sub/file", "/dst/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if !cidAt("/src/sub/file").Equals(fnd.Cid()) {
+		t.Fatal("source changed with the copy")
+	}
+
+	// Files aren't replaced without Overwrite.
+	err := Cp(ctx, rt, "/other", "/dst/moved", CpOpts{})
+	if !errors.Is(err, ErrDirExists) {
+		t.Fatalf("expected ErrDirExists, got %v", err)
+	}
+	err = Cp(ctx, rt, "/other", "/dst/moved", CpOpts{Overwrite: true, Deep: true, Flush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cidAt("/dst/moved").Equals(other.Cid()) {
+		t.Fatal("expected the file to be overwritten")
+	}
+
+	// Existing directories receive the copy.
+	if err := Cp(ctx, rt, "/other", "/src", CpOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if !cidAt("/src/other").Equals(other.Cid()) {
+		t.Fatal("expected the file to be copied inside the directory")
+	}
+}
+
+func TestCpIntoItself(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, rt := setupRoot(ctx, t)
+	mkdirP(t, rt.GetDirectory(), "a/b")
+
+	for _, dst := range []string{"/a", "/a/", "/a/b", "/a/b/c"} {
+		if err := Cp(ctx, rt, "/a", dst, CpOpts{}); !errors.Is(err, ErrIntoItself) {
+			t.Fatalf("cp to %s: expected ErrIntoItself, got %v", dst, err)
+		}
+	}
+	for _, dst := range []string{"/a/", "/a/b", "/a/b/c"} {
+		if err := Mv(rt, "/a", dst); !errors.Is(err, ErrIntoItself) {
+			t.Fatalf("mv to %s: expected ErrIntoItself, got %v", dst, err)
+		}
+	}
+	names, err := rt.GetDirectory().ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "a" {
+		t.Fatalf("expected the tree to be left as is, got %v", names)
+	}
+	if _, err := Lookup(rt, "/a/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Next to itself is fine.
+	if err := Cp(ctx, rt, "/a", "/a2", CpOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Cp(ctx, rt, "/a/b", "/a", CpOpts{}); !errors.Is(err, ErrDirExists) {
+		t.Fatalf("expected ErrDirExists, got %v", err)
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	stale := mkdirP(t, rt.GetDirectory(), "a/b")
+	if err := stale.AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := Lookup(rt, "/a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleFile := fsn.(*File)
+
+	if err := RemoveAll(rt, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt, "/a"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected /a to be removed, got %v", err)
+	}
+	if err := RemoveAll(rt, "/a/b"); err != nil {
+		t.Fatalf("expected removing a missing path to succeed, got %v", err)
+	}
+	if err := RemoveAll(rt, "/"); err == nil {
+		t.Fatal("expected removing the root to fail")
+	}
+
+	// Stale references fail instead of resurrecting the removed entries.
+	if err := stale.AddChild("other", getRandFile(t, ds, 100)); err != ErrDetached {
+		t.Fatalf("expected ErrDetached, got %v", err)
+	}
+	if err := stale.Flush(); err != ErrDetached {
+		t.Fatalf("expected ErrDetached, got %v", err)
+	}
+	if _, err := staleFile.Open(Flags{Write: true, Sync: true}); err != ErrDetached {
+		t.Fatalf("expected ErrDetached, got %v", err)
+	}
+
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd.Cid().Equals(emptyDirNode().Cid()) {
+		t.Fatal("expected the root to be empty")
+	}
+}
+
+func TestListingCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, cached := range []bool{true, false} {
+		dserv := &countingDAG{DAGService: getDagserv(t)}
+		var opts []RootOption
+		if !cached {
+			opts = append(opts, WithListingCache(0))
+		}
+		rt, err := NewRoot(ctx, dserv, emptyDirNode(), nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := mkdirP(t, rt.GetDirectory(), "dir")
+		for i := 0; i < 5; i++ {
+			if err := dir.AddChild(fmt.Sprintf("file%d", i), getRandFile(t, dserv, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		first, err := dir.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gets := atomic.LoadInt64(&dserv.gets)
+		second, err := dir.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(first) != fmt.Sprint(second) {
+			t.Fatalf("expected the same listing, got %v and %v", first, second)
+		}
+		if decoded := atomic.LoadInt64(&dserv.gets) - gets; cached && decoded != 0 {
+			t.Fatalf("expected the listing to be cached, %d nodes read", decoded)
+		} else if !cached && decoded == 0 {
+			t.Fatal("expected the listing not to be cached")
+		}
+
+		// Changes to the directory are listed.
+		if err := dir.Unlink("file0"); err != nil {
+			t.Fatal(err)
+		}
+		third, err := dir.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(third) != 4 {
+			t.Fatalf("expected 4 entries, got %v", third)
+		}
+	}
+}
+
+func TestUnlinkMany(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, rt := setupRoot(ctx, t)
+	dir := mkdirP(t, rt.GetDirectory(), "dir")
+	for i := 0; i < 100; i++ {
+		nd := dag.NodeWithData(ft.FilePBData([]byte(fmt.Sprint(i)), uint64(len(fmt.Sprint(i)))))
+		if err := dir.AddChild(fmt.Sprintf("file%d", i), nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Reshard(ctx, rt, "/dir", 16, nil); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := lookupDir(rt, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for i := 0; i < 60; i++ {
+		names = append(names, fmt.Sprintf("file%d", i))
+	}
+	err = dir.UnlinkMany(ctx, append(names, "missing"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	left, err := dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 100 {
+		t.Fatalf("expected nothing to be removed, %d entries left", len(left))
+	}
+
+	if err := dir.UnlinkMany(ctx, append(names, names[0])); err != nil {
+		t.Fatal(err)
+	}
+	left, err = dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 40 {
+		t.Fatalf("expected 40 entries left, got %d", len(left))
+	}
+	if _, err := dir.Child("file0"); err != os.ErrNotExist {
+		t.Fatalf("expected file0 to be removed, got %v", err)
+	}
+	if _, err := dir.Child("file60"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnlinkManyAutoSharded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defer func(size int) { uio.HAMTShardingSize = size }(uio.HAMTShardingSize)
+	uio.HAMTShardingSize = 100
+
+	_, rt := setupRoot(ctx, t)
+	dir := mkdirP(t, rt.GetDirectory(), "dir")
+	sharded := func() bool {
+		dir.lock.Lock()
+		defer dir.lock.Unlock()
+		return dir.shardedUnsync()
+	}
+	for i := 0; i < 100; i++ {
+		nd := dag.NodeWithData(ft.FilePBData([]byte(fmt.Sprint(i)), uint64(len(fmt.Sprint(i)))))
+		if err := dir.AddChild(fmt.Sprintf("file%d", i), nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !sharded() {
+		t.Fatal("expected the directory to be sharded by go-unixfs")
+	}
+
+	var names []string
+	for i := 0; i < 60; i++ {
+		names = append(names, fmt.Sprintf("file%d", i))
+	}
+	if err := dir.UnlinkMany(ctx, names); err != nil {
+		t.Fatal(err)
+	}
+	left, err := dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 40 {
+		t.Fatalf("expected 40 entries left, got %d", len(left))
+	}
+	if _, err := dir.Child("file0"); err != os.ErrNotExist {
+		t.Fatalf("expected file0 to be removed, got %v", err)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	a := mkdirP(t, rt.GetDirectory(), "a")
+	if err := a.AddChild("keep", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := rt.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Unlink("keep"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.GetDirectory().AddChild("new", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot isn't affected by the changes.
+	view, err := snap.Open(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(view, "/a/keep"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := rt.Watch(WatchOpts{BufferSize: 100})
+	defer w.Close()
+
+	if err := rt.Restore(ctx, snap); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd.Cid().Equals(snap.Cid()) {
+		t.Fatalf("expected the root to be restored to %s, got %s", snap.Cid(), nd.Cid())
+	}
+	if _, err := Lookup(rt, "/new"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected /new to be gone, got %v", err)
+	}
+
+	// Stale references can't bring back the discarded changes.
+	if err := a.AddChild("stale", getRandFile(t, ds, 100)); err != ErrDetached {
+		t.Fatalf("expected ErrDetached, got %v", err)
+	}
+	if _, err := Lookup(rt, "/a/stale"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the stale change to be discarded, got %v", err)
+	}
+
+	expected := fmt.Sprint(map[string]Op{
+		"/a/keep": Create,
+		"/new":    Remove,
+	})
+	events := map[string]Op{}
+	timeout := time.After(time.Second)
+	for fmt.Sprint(events) != expected {
+		select {
+		case e := <-w.Events():
+			events[e.Name] |= e.Op
+		case <-timeout:
+			t.Fatalf("expected events %s, got %v", expected, events)
+		}
+	}
+}
+
+func TestPathError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	mkdirP(t, rt.GetDirectory(), "a")
+	if err := rt.GetDirectory().AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		err      error
+		expected string
+		is       error
+	}{
+		{Mv(rt, "/a", "/file/a"), "mv: /file: not a directory", ErrNotDir},
+		{Mv(rt, "/missing", "/b"), "mv: /missing: file does not exist", os.ErrNotExist},
+		{Mkdir(rt, "/file/b/c", MkdirOpts{Mkparents: true}), "mkdir: /file: not a directory", ErrNotDir},
+		{func() error { _, err := Lookup(rt, "/a/x/y"); return err }(), "lookup: /a/x/y: file does not exist", os.ErrNotExist},
+		{func() error { _, err := Lookup(rt, "/file/y"); return err }(), "lookup: /file: not a directory", ErrNotDir},
+		{Cp(ctx, rt, "/file", "/a/", CpOpts{}), "", nil},
+		{Cp(ctx, rt, "/file", "/a/file", CpOpts{}), "cp: /a/file: " + ErrDirExists.Error(), ErrDirExists},
+		{func() error { _, err := rt.OpenPath("/a", Flags{Read: true}); return err }(), "open: /a: " + ErrIsDirectory.Error(), ErrIsDirectory},
+		{func() error { _, err := rt.StatPath(ctx, "/missing"); return err }(), "stat: /missing: file does not exist", os.ErrNotExist},
+		{func() error { _, err := rt.ListPath(ctx, "/file"); return err }(), "ls: /file: not a directory", ErrNotDir},
+		{rt.RemovePath("/missing/x"), "rm: /missing/x: file does not exist", os.ErrNotExist},
+		{Symlink(rt, "file", "/file/link"), "symlink: /file: not a directory", ErrNotDir},
+		{func() error { _, err := Readlink(rt, "/file"); return err }(), "readlink: /file: not a symlink", ErrNotSymlink},
+		{func() error { _, err := SyncFromCid(ctx, rt, rt.PersistedRoot(), SyncOpts{Path: "/file"}); return err }(), "sync: /file: not a directory", ErrNotDir},
+	} {
+		if tc.is == nil {
+			if tc.err != nil {
+				t.Fatal(tc.err)
+			}
+			continue
+		}
+		var pe *PathError
+		if !errors.As(tc.err, &pe) {
+			t.Fatalf("expected a *PathError, got %v", tc.err)
+		}
+		if tc.err.Error() != tc.expected {
+			t.Fatalf("expected %q, got %q", tc.expected, tc.err)
+		}
+		if !errors.Is(tc.err, tc.is) {
+			t.Fatalf("expected %q to wrap %q", tc.err, tc.is)
+		}
+	}
+}
+
+func TestFileInfo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	mkdirP(t, rt.GetDirectory(), "a/sub")
+	a := mkdirP(t, rt.GetDirectory(), "a")
+	if err := a.AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(rt, "file", "/a/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	var fi fs.FileInfo
+	fi, err := rt.Lstat(ctx, "/a/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Name() != "file" || fi.Size() != 100 || fi.IsDir() || fi.Mode() != DefaultFilePerm {
+		t.Fatalf("unexpected file info: %s %d %v %s", fi.Name(), fi.Size(), fi.IsDir(), fi.Mode())
+	}
+	if nl, ok := fi.Sys().(NodeListing); !ok || nl.Name != "file" {
+		t.Fatalf("expected the listing as Sys, got %v", fi.Sys())
+	}
+	fi, err = rt.Lstat(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.IsDir() || fi.Mode() != fs.ModeDir|DefaultDirPerm {
+		t.Fatalf("expected the root to be a directory, got %s", fi.Mode())
+	}
+
+	entries, err := a.ReadDir(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		name string
+		typ  fs.FileMode
+	}{
+		{"file", 0},
+		{"link", fs.ModeSymlink},
+		{"sub", fs.ModeDir},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(entries))
+	}
+	for i, e := range entries {
+		if e.Name() != expected[i].name || e.Type() != expected[i].typ {
+			t.Fatalf("entry %d: expected %s (%s), got %s (%s)", i, expected[i].name, expected[i].typ, e.Name(), e.Type())
+		}
+		info, err := e.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Type() != e.Type() || info.IsDir() != e.IsDir() {
+			t.Fatalf("%s: inconsistent info mode %s", e.Name(), info.Mode())
+		}
+	}
+	// Listings served from the cache still tell the symlinks apart.
+	entries, err = a.ReadDir(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[1].Type() != fs.ModeSymlink {
+		t.Fatalf("expected a symlink, got %s", entries[1].Type())
+	}
+}
+
+func TestFileSetNode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	dir := mkdirP(t, rt.GetDirectory(), "a")
+	if err := dir.AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := Lookup(rt, "/a/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := fsn.(*File)
+
+	if err := fi.SetNode(ctx, emptyDirNode()); err == nil {
+		t.Fatal("expected an error setting a directory node")
+	}
+
+	fd, err := fi.Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nnd := getRandFile(t, ds, 200)
+	done := make(chan error, 1)
+	go func() {
+		done <- fi.SetNode(ctx, nnd)
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected SetNode to wait for the open descriptor")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := assertFileAtPath(ds, rt.GetDirectory(), nnd, "a/file"); err != nil {
+		t.Fatal(err)
+	}
+	size, err := fi.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 200 {
+		t.Fatalf("expected size 200, got %d", size)
+	}
+
+	// Unlinked files can't be updated.
+	if err := dir.Unlink("file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fi.SetNode(ctx, getRandFile(t, ds, 50)); err != ErrDetached {
+		t.Fatalf("expected ErrDetached, got %v", err)
+	}
+	if _, err := dir.Child("file"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the file to stay unlinked, got %v", err)
+	}
+}
+
+func TestStat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	dir := mkdirP(t, rt.GetDirectory(), "a")
+	fnd := fileNodeFromReader(t, ds, bytes.NewReader(make([]byte, 1024*1024)))
+	if err := dir.AddChild("file", fnd); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(rt, "file", "/a/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := Stat(rt, "/a/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cumulative, err := fnd.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "file" || info.Type != TFile || info.Mode != DefaultFilePerm ||
+		!info.Cid.Equals(fnd.Cid()) || info.Size != 1024*1024 ||
+		info.CumulativeSize != cumulative || info.Blocks != len(fnd.Links()) || !info.ModTime.IsZero() {
+		t.Fatalf("unexpected file info: %+v", info)
+	}
+	if info.Blocks < 2 {
+		t.Fatalf("expected a multi-block file, got %d blocks", info.Blocks)
+	}
+
+	info, err = Stat(rt, "/a/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != TFile || info.Mode != fs.ModeSymlink|DefaultSymlinkPerm {
+		t.Fatalf("expected a symlink, got %+v", info)
+	}
+
+	info, err = Stat(rt, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != TDir || !info.Mode.IsDir() || info.Size != 0 || info.Blocks != 2 || info.ModTime.IsZero() {
+		t.Fatalf("unexpected directory info: %+v", info)
+	}
+
+	_, err = Stat(rt, "/a/missing")
+	var pe *PathError
+	if !errors.As(err, &pe) || pe.Op != "stat" || !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a stat PathError, got %v", err)
+	}
+}
+
+func TestFdTable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, rt := setupRoot(ctx, t)
+	mkdirP(t, rt.GetDirectory(), "a")
+	err := WriteFile(rt, "/a/file", bytes.NewReader([]byte("hello")), WriteFileOpts{Create: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rt.OpenFd("/a", Flags{Read: true}); !errors.Is(err, ErrIsDirectory) {
+		t.Fatalf("expected ErrIsDirectory, got %v", err)
+	}
+	if _, err := rt.ReadFd(3, make([]byte, 1)); err != ErrBadFd {
+		t.Fatalf("expected ErrBadFd, got %v", err)
+	}
+
+	wfd, err := rt.OpenFd("/a/file", Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wfd != 0 {
+		t.Fatalf("expected the first descriptor to be 0, got %d", wfd)
+	}
+	if _, err := rt.SeekFd(wfd, 0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.WriteFd(wfd, []byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.CloseFd(wfd); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.CloseFd(wfd); err != ErrBadFd {
+		t.Fatalf("expected ErrBadFd closing twice, got %v", err)
+	}
+
+	rfd, err := rt.OpenFd("/a/file", Flags{Read: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rfd != wfd {
+		t.Fatalf("expected the closed number %d to be reused, got %d", wfd, rfd)
+	}
+	buf := make([]byte, 32)
+	n, err := rt.ReadFd(rfd, buf)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello world" {
+		t.Fatalf("expected %q, got %q", "hello world", buf[:n])
+	}
+
+	// Unlinking the file revokes its descriptors.
+	if err := rt.RemovePath("/a/file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.ReadFd(rfd, buf); err != ErrRevoked {
+		t.Fatalf("expected ErrRevoked, got %v", err)
+	}
+	if _, err := rt.SeekFd(rfd, 0, io.SeekStart); err != ErrRevoked {
+		t.Fatalf("expected ErrRevoked, got %v", err)
+	}
+	if err := rt.CloseFd(rfd); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the root closes the descriptors left open.
+	err = WriteFile(rt, "/b", bytes.NewReader(nil), WriteFileOpts{Create: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := rt.OpenFd("/b", Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.WriteFd(fd, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.WriteFd(fd, nil); err != ErrBadFd {
+		t.Fatalf("expected ErrBadFd after closing the root, got %v", err)
+	}
+	info, err := Stat(rt, "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 4 {
+		t.Fatalf("expected the open descriptor to be flushed, got size %d", info.Size)
+	}
+}
+
+func TestTreeStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dserv := &countingDAG{DAGService: getDagserv(t)}
+	rt, err := NewRoot(ctx, dserv, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := rt.TreeStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (TreeStats{LargestDir: "/"}) {
+		t.Fatalf("unexpected stats of an empty tree: %+v", stats)
+	}
+
+	a := mkdirP(t, rt.GetDirectory(), "a/b/c")
+	for i := 0; i < 3; i++ {
+		if err := a.AddChild(fmt.Sprintf("f%d", i), getRandFile(t, dserv, int64(10*(i+1)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rt.GetDirectory().AddChild("big", getRandFile(t, dserv, 500)); err != nil {
+		t.Fatal(err)
+	}
+	mkdirP(t, rt.GetDirectory(), "x")
+
+	// The root ties with /a/b/c, both having 3 entries.
+	expected := TreeStats{
+		Files:             4,
+		Directories:       4,
+		MaxDepth:          4,
+		LargestDir:        "/",
+		LargestDirEntries: 3,
+		LargestFile:       "/big",
+		LargestFileSize:   500,
+	}
+	stats, err = rt.TreeStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+
+	// Unchanged directories aren't walked again.
+	gets := atomic.LoadInt64(&dserv.gets)
+	if _, err := rt.TreeStats(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&dserv.gets) - gets; n != 0 {
+		t.Fatalf("expected the stats to be cached, got %d reads", n)
+	}
+
+	x := mkdirP(t, rt.GetDirectory(), "x")
+	if err := x.AddChild("huge", getRandFile(t, dserv, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddChild("f3", getRandFile(t, dserv, 40)); err != nil {
+		t.Fatal(err)
+	}
+	expected.Files += 2
+	expected.LargestDir, expected.LargestDirEntries = "/a/b/c", 4
+	expected.LargestFile, expected.LargestFileSize = "/x/huge", 1000
+	stats, err = rt.TreeStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestPathsForCid(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := getDagserv(t)
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithReverseIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPaths := func(c cid.Cid, expected ...string) {
+		t.Helper()
+		paths, err := PathsForCid(ctx, rt, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !compStrArrs(paths, expected) {
+			t.Fatalf("expected the paths %v for %s, got %v", expected, c, paths)
+		}
+	}
+
+	fnd := getRandFile(t, ds, 100)
+	a := mkdirP(t, rt.GetDirectory(), "a/b")
+	if err := a.AddChild("f", fnd); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.GetDirectory().AddChild("g", fnd); err != nil {
+		t.Fatal(err)
+	}
+	expectPaths(fnd.Cid(), "/a/b/f", "/g")
+
+	// CIDv1 matches the CIDv0 entries.
+	expectPaths(cid.NewCidV1(cid.DagProtobuf, fnd.Cid().Hash()), "/a/b/f", "/g")
+
+	// Moves and removals are reflected.
+	if err := Mv(rt, "/a", "/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.GetDirectory().Unlink("g"); err != nil {
+		t.Fatal(err)
+	}
+	expectPaths(fnd.Cid(), "/c/b/f")
+
+	dnd, err := Lookup(rt, "/c/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := dnd.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPaths(nd.Cid(), "/c/b")
+
+	// Replacing the directory by a file drops the entries below it.
+	if err := rt.GetDirectory().Unlink("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.GetDirectory().AddChild("c", fnd); err != nil {
+		t.Fatal(err)
+	}
+	expectPaths(nd.Cid())
+	expectPaths(fnd.Cid(), "/c")
+
+	_, plain := setupRoot(ctx, t)
+	if _, err := PathsForCid(ctx, plain, fnd.Cid()); err != ErrNoReverseIndex {
+		t.Fatalf("expected ErrNoReverseIndex, got %v", err)
+	}
+}
+
+func TestUncache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	a := mkdirP(t, rt.GetDirectory(), "a")
+	// Unflushed changes of the uncached entries are kept.
+	b := mkdirP(t, a, "b")
+	if err := b.AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	busy := mkdirP(t, rt.GetDirectory(), "open")
+	if err := busy.AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := busy.Child("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fsn.(*File).Open(Flags{Read: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.Uncache("b")
+	if _, err := b.Mkdir("c"); err != ErrDetached {
+		t.Fatalf("expected ErrDetached using an uncached directory, got %v", err)
+	}
+	if _, err := Lookup(rt, "/a/b/file"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rt.FlushMemFree(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.List(ctx); err != ErrDetached {
+		t.Fatalf("expected ErrDetached using an uncached directory, got %v", err)
+	}
+	// The directory holding an open descriptor stays cached.
+	if _, err := busy.Mkdir("sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pth := range []string{"/a/b/file", "/open/file", "/open/sub"} {
+		if _, err := Lookup(rt, pth); err != nil {
+			t.Fatalf("%s: %s", pth, err)
+		}
+	}
+}
+
+func TestEntryCacheLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := getDagserv(t)
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithEntryCacheLimit(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]ipld.Node)
+	for i := 0; i < 10; i++ {
+		dir := mkdirP(t, rt.GetDirectory(), fmt.Sprintf("d%d", i))
+		nd := getRandFile(t, ds, 100)
+		if err := dir.AddChild("file", nd); err != nil {
+			t.Fatal(err)
+		}
+		files[fmt.Sprintf("/d%d/file", i)] = nd
+	}
+
+	// A file with an open descriptor is never evicted.
+	fsn, err := Lookup(rt, "/d0/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fsn.(*File).Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pth := range files {
+		if _, err := Lookup(rt, pth); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		rt.entries.evict()
+	}
+	// Wait for the evictions started in the background.
+	for atomic.LoadInt32(&rt.entries.evicting) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if n := rt.entries.len(); n > 4 {
+		t.Fatalf("expected at most 4 loaded entries, got %d", n)
+	}
+
+	if _, err := fd.Write([]byte("written")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := Stat(rt, "/d0/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Cid.Equals(files["/d0/file"].Cid()) {
+		t.Fatal("expected the write to be kept")
+	}
+	delete(files, "/d0/file")
+	for pth, nd := range files {
+		info, err := Stat(rt, pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.Cid.Equals(nd.Cid()) {
+			t.Fatalf("%s: expected %s, got %s", pth, nd.Cid(), info.Cid)
+		}
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := getDagserv(t)
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithTombstones())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mkdirP(t, rt.GetDirectory(), "a")
+	removed := getRandFile(t, ds, 100)
+	if err := a.AddChild("removed", removed); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddChild("moved", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	if err := a.Unlink("removed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Unlink("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	if err := Mv(rt, "/a/moved", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt, DefaultTombstoneDir); err != nil {
+		t.Fatalf("expected the records to be written on flush: %s", err)
+	}
+
+	records, err := Tombstones(ctx, rt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Path != "/a/moved" || records[1].Path != "/a/removed" {
+		t.Fatalf("unexpected tombstones %+v", records)
+	}
+	if !records[1].Cid.Equals(removed.Cid()) || records[1].Time.Before(before) {
+		t.Fatalf("unexpected tombstone %+v", records[1])
+	}
+
+	// Removing the records doesn't record their removal.
+	n, err := PruneTombstones(ctx, rt, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 pruned records, got %d", n)
+	}
+	records, err = Tombstones(ctx, rt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("expected no tombstones left, got %+v", records)
+	}
+
+	_, plain := setupRoot(ctx, t)
+	if _, err := Tombstones(ctx, plain); err != ErrNoTombstones {
+		t.Fatalf("expected ErrNoTombstones, got %v", err)
+	}
+}
+
+func TestLatencyDAG(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	base := getDagserv(t)
+	nd := dag.NodeWithData(make([]byte, 1000))
+	if err := base.Add(ctx, nd); err != nil {
+		t.Fatal(err)
+	}
+
+	slow := NewLatencyDAG(base, NetworkConditions{
+		Latency:   20 * time.Millisecond,
+		Bandwidth: 1000 * 20, // 50ms for the node
+	})
+	start := time.Now()
+	if _, err := slow.Get(ctx, nd.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < 70*time.Millisecond {
+		t.Fatalf("expected the get to take at least 70ms, took %s", took)
+	}
+
+	// Writes aren't delayed unless asked to.
+	start = time.Now()
+	if err := slow.Add(ctx, dag.NodeWithData([]byte("other"))); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took >= 20*time.Millisecond {
+		t.Fatalf("expected the add not to be delayed, took %s", took)
+	}
+
+	canceled, cancelGet := context.WithCancel(ctx)
+	cancelGet()
+	if _, err := slow.Get(canceled, nd.Cid()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+// benchConditions are the network conditions of the benchmarks over
+// `NewLatencyDAG`: a fast link to a nearby node.
+var benchConditions = NetworkConditions{
+	Latency:   200 * time.Microsecond,
+	Bandwidth: 100 << 20,
+	Writes:    true,
+}
+
+func BenchmarkSlowDAGList(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	base := getDagserv(b)
+	rt, err := NewRoot(ctx, base, emptyDirNode(), nil, WithListingCache(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	dir := mkdirP(b, rt.GetDirectory(), "dir")
+	for i := 0; i < 100; i++ {
+		nd := dag.NodeWithData(ft.FilePBData([]byte(fmt.Sprint(i)), uint64(len(fmt.Sprint(i)))))
+		if err := dir.AddChild(fmt.Sprintf("file%d", i), nd); err != nil {
+			b.Fatal(err)
+		}
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	slow, err := NewRoot(ctx, NewLatencyDAG(base, benchConditions), nd.(*dag.ProtoNode), nil, WithListingCache(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := slow.ListPath(ctx, "/dir"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSlowDAGFlush(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rt, err := NewRoot(ctx, NewLatencyDAG(getDagserv(b), benchConditions), emptyDirNode(), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	dir := mkdirP(b, rt.GetDirectory(), "a/b/c")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nd := dag.NodeWithData(ft.FilePBData([]byte(fmt.Sprint(i)), uint64(len(fmt.Sprint(i)))))
+		if err := dir.AddChild(fmt.Sprintf("file%d", i), nd); err != nil {
+			b.Fatal(err)
+		}
+		if err := rt.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSlowDAGRead(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	base := getDagserv(b)
+	data := make([]byte, 4<<20)
+	nd, err := importer.BuildDagFromReader(base, chunker.DefaultSplitter(bytes.NewReader(data)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	rt, err := NewRoot(ctx, NewLatencyDAG(base, benchConditions), emptyDirNode(), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := rt.GetDirectory().AddChild("file", nd); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fd, err := rt.OpenPath("/file", Flags{Read: true})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, fd); err != nil {
+			b.Fatal(err)
+		}
+		if err := fd.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestUnpublishedPaths(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	rules, err := newPathRules([]string{"/.cache/**", "/*/tmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pth, hidden := range map[string]bool{
+		"/":              false,
+		"/.cache":        true,
+		"/.cache/a/b":    true,
+		"/.cachex":       false,
+		"/a/tmp":         true,
+		"/a/tmp/file":    true,
+		"/a/b/tmp":       false,
+		"/a/.cache/file": false,
+	} {
+		if rules.match(pth) != hidden {
+			t.Errorf("expected %s to match: %t", pth, hidden)
+		}
+	}
+	if _, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithUnpublishedPaths("/a/[")); err == nil {
+		t.Fatal("expected an invalid pattern to fail")
+	}
+
+	var lock sync.Mutex
+	var published []cid.Cid
+	pf := func(ctx context.Context, c cid.Cid) error {
+		lock.Lock()
+		defer lock.Unlock()
+		published = append(published, c)
+		return nil
+	}
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), pf, WithUnpublishedPaths("/.cache/**"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flushed := func() int {
+		if err := rt.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := rt.repub.WaitPub(ctx); err != nil {
+			t.Fatal(err)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		return len(published)
+	}
+
+	dir := mkdirP(t, rt.GetDirectory(), "a")
+	if n := flushed(); n != 1 {
+		t.Fatalf("expected the change to be published, got %d publishes", n)
+	}
+
+	cache := mkdirP(t, rt.GetDirectory(), ".cache/x")
+	for i := 0; i < 3; i++ {
+		if err := cache.AddChild(fmt.Sprintf("file%d", i), getRandFile(t, ds, 100)); err != nil {
+			t.Fatal(err)
+		}
+		if n := flushed(); n != 1 {
+			t.Fatalf("expected the cache changes not to be published, got %d publishes", n)
+		}
+	}
+
+	if err := dir.AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if n := flushed(); n != 2 {
+		t.Fatalf("expected the change to be published, got %d publishes", n)
+	}
+	lock.Lock()
+	last := published[len(published)-1]
+	lock.Unlock()
+	if !last.Equals(rt.PersistedRoot()) {
+		t.Fatal("expected the whole tree to be published")
+	}
+}
+
+func TestHiddenEntries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	for _, c := range []struct {
+		opts   []RootOption
+		hidden []string
+		tree   int // entries of the tree without the hidden ones
+	}{
+		{nil, []string{".config"}, 4},
+		{[]RootOption{WithHiddenFunc(func(name string) bool {
+			return strings.HasSuffix(name, "~")
+		})}, []string{"b~"}, 6},
+	} {
+		rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, c.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mkdirP(t, rt.GetDirectory(), ".config/x")
+		mkdirP(t, rt.GetDirectory(), "a/.config")
+		for _, name := range []string{"b", "b~"} {
+			if err := rt.GetDirectory().AddChild(name, getRandFile(t, ds, 10)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		all, err := rt.GetDirectory().ListEntryNames(ctx, ListOpts{IncludeHidden: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 4 {
+			t.Fatalf("expected all the entries, got %v", all)
+		}
+		entries, err := rt.GetDirectory().ListEntries(ctx, ListOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, err := rt.GetDirectory().ListEntryNames(ctx, ListOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 3 || len(names) != 3 {
+			t.Fatalf("expected 3 visible entries, got %v and %v", entries, names)
+		}
+		for _, name := range names {
+			for _, h := range c.hidden {
+				if name == h {
+					t.Fatalf("hidden entry %s listed", name)
+				}
+			}
+		}
+
+		tree, err := Tree(ctx, rt, "/", TreeOpts{SkipHidden: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var count func(*TreeEntry) int
+		count = func(e *TreeEntry) int {
+			n := 1
+			for _, ch := range e.Children {
+				n += count(ch)
+			}
+			return n
+		}
+		full, err := Tree(ctx, rt, "/", TreeOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count(full) != 7 || count(tree) != c.tree {
+			t.Fatalf("unexpected tree sizes %d and %d", count(full), count(tree))
+		}
+	}
+}
+
+// readCARBlocks parses a CARv1 file, returning its header and blocks.
+func readCARBlocks(t *testing.T, data []byte) ([]byte, []cid.Cid) {
+	r := bytes.NewReader(data)
+	section := func() []byte {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+
+	hdr := section()
+	var cids []cid.Cid
+	for r.Len() > 0 {
+		blk := section()
+		n, c, err := cid.CidFromBytes(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum, err := c.Prefix().Sum(blk[n:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sum.Equals(c) {
+			t.Fatalf("block %s doesn't match its data", c)
+		}
+		cids = append(cids, c)
+	}
+	return hdr, cids
+}
+
+func TestExportCAR(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := mkdirP(t, rt.GetDirectory(), "a/b")
+	file := getRandFile(t, ds, 1<<20)
+	for _, name := range []string{"file", "copy"} {
+		if err := dir.AddChild(name, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rt.GetDirectory().AddChild("other", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := ExportCAR(ctx, rt, "/a", &buf); err != nil {
+		t.Fatal(err)
+	}
+	hdr, cids := readCARBlocks(t, buf.Bytes())
+
+	nd, err := dirLookup(ctx, rt.GetDirectory(), "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := nd.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(hdr, root.Cid().Bytes()) || !bytes.Contains(hdr, []byte("version")) {
+		t.Fatalf("unexpected header %x", hdr)
+	}
+	if !cids[0].Equals(root.Cid()) {
+		t.Fatal("expected the root block first")
+	}
+	usage, err := DiskUsage(ctx, rt, "/a", DiskUsageOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cids) != usage.Blocks {
+		t.Fatalf("expected %d blocks, got %d", usage.Blocks, len(cids))
+	}
+
+	if err := ExportCAR(ctx, rt, "/missing", &buf); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a missing path to fail, got %v", err)
+	}
+}
+
+func TestImportCAR(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := mkdirP(t, rt.GetDirectory(), "a/b")
+	if err := dir.AddChild("file", getRandFile(t, ds, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	raw := dag.NewRawNode([]byte("raw"))
+	if err := ds.Add(ctx, raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("raw", raw); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := ExportCAR(ctx, rt, "/a", &buf); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := FlushPath(ctx, rt, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds2 := getDagserv(t)
+	rt2, err := NewRoot(ctx, ds2, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkdirP(t, rt2.GetDirectory(), "backups")
+	if err := ImportCAR(ctx, rt2, "/backups/a", bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := Lookup(rt2, "/backups/a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsn.(*File).Size(); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := dirLookup(ctx, rt2.GetDirectory(), "/backups/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := imported.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd.Cid().Equals(exported.Cid()) {
+		t.Fatal("imported DAG differs from the exported one")
+	}
+
+	// The blocks are in the DAG service now, they can be linked again.
+	if err := PutDAG(rt2, "/copy", exported.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt2, "/copy/b/raw"); err != nil {
+		t.Fatal(err)
+	}
+
+	car := buf.Bytes()
+	corrupted := append([]byte(nil), car...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	for name, data := range map[string][]byte{
+		"garbage":   []byte("not a CAR file"),
+		"truncated": car[:len(car)-10],
+		"corrupted": corrupted,
+	} {
+		err := ImportCAR(ctx, rt2, "/"+name, bytes.NewReader(data))
+		if !errors.Is(err, ErrInvalidCAR) {
+			t.Errorf("%s: expected ErrInvalidCAR, got %v", name, err)
+		}
+	}
+}
+
+func TestFileHandle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	mkdirP(t, rt.GetDirectory(), "a")
+	if err := rt.GetDirectory().AddChild("dir", emptyDirNode()); err != nil {
+		t.Fatal(err)
+	}
+	nd := dag.NodeWithData(ft.FilePBData(nil, 0))
+	nd.SetCidBuilder(rt.GetDirectory().GetCidBuilder())
+	if err := ds.Add(ctx, nd); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/a/file", nd); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(rt, "/dir", Flags{Read: true}); !errors.Is(err, ErrIsDirectory) {
+		t.Fatalf("expected ErrIsDirectory, got %v", err)
+	}
+	if _, err := Open(rt, "/a/missing", Flags{Read: true}); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+
+	h, err := Open(rt, "a/file", Flags{Read: true, Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Name() != "/a/file" {
+		t.Fatalf("unexpected name %s", h.Name())
+	}
+	if _, err := h.WriteString("hello world"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.WriteAt([]byte("W"), 6); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 5)
+	if n, err := h.ReadAt(buf, 6); err != nil || string(buf[:n]) != "World" {
+		t.Fatalf("unexpected read-at %q: %v", buf[:n], err)
+	}
+	if n, err := h.ReadAt(buf, 8); err != io.EOF || string(buf[:n]) != "rld" {
+		t.Fatalf("expected a short read-at with io.EOF, got %q: %v", buf[:n], err)
+	}
+	// The offset of the handle didn't move.
+	if off, err := h.Seek(0, io.SeekCurrent); err != nil || off != 11 {
+		t.Fatalf("unexpected offset %d: %v", off, err)
+	}
+
+	if err := h.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+	info, err := h.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name() != "file" || info.Size() != 5 || !info.Mode().IsRegular() {
+		t.Fatalf("unexpected file info %s %d %s", info.Name(), info.Size(), info.Mode())
+	}
+	if _, err := h.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(h)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected contents %q: %v", data, err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = Open(rt, "/a/file", Flags{Read: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	data, err = io.ReadAll(h)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected flushed contents %q: %v", data, err)
+	}
+}
+
+func TestDescriptorStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	nd := dag.NodeWithData(ft.FilePBData(nil, 0))
+	if err := PutNode(rt, "/file", nd); err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := Lookup(rt, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fsn.(*File).Open(Flags{Read: true, Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := fd.Stats(); stats != (DescriptorStats{}) {
+		t.Fatalf("expected no writes yet, got %+v", stats)
+	}
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	if _, err := fd.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.WriteAt([]byte("abc"), 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	stats := fd.Stats()
+	if stats.BytesWritten != 1<<20+3 || stats.Flushes != 1 || stats.FlushDuration <= 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	// At least the chunks of the file and its root.
+	if stats.BlocksAdded < 5 || stats.BytesAdded < 1<<20 {
+		t.Fatalf("unexpected added blocks %+v", stats)
+	}
+
+	if _, err := fd.Write([]byte("more")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	final := fd.Stats()
+	if final.BytesWritten != stats.BytesWritten+4 || final.Flushes != 2 || final.BlocksAdded <= stats.BlocksAdded {
+		t.Fatalf("unexpected stats after close %+v", final)
+	}
+}
+
+func TestTar(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := mkdirP(t, rt.GetDirectory(), "a/b/c")
+	mkdirP(t, rt.GetDirectory(), "a/empty")
+	if err := dir.AddChild("file", getRandFile(t, ds, 300000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(rt, "c/file", "/a/b/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteTar(ctx, rt, "/a", &buf); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	expected := []string{"b/", "b/c/", "b/c/file", "b/link", "empty/"}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Fatalf("expected the entries %v, got %v", expected, names)
+	}
+
+	if err := ReadTar(ctx, rt, "/restored", bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	for _, pth := range []string{"/a", "/restored"} {
+		if _, err := FlushPath(ctx, rt, pth); err != nil {
+			t.Fatal(err)
+		}
+	}
+	orig, err := dirLookup(ctx, rt.GetDirectory(), "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := dirLookup(ctx, rt.GetDirectory(), "/restored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ond, _ := orig.GetNode()
+	rnd, _ := restored.GetNode()
+	if !ond.Cid().Equals(rnd.Cid()) {
+		t.Fatal("expected the tree to round-trip through tar")
+	}
+	if target, err := Readlink(rt, "/restored/b/link"); err != nil || target != "c/file" {
+		t.Fatalf("unexpected symlink target %q: %v", target, err)
+	}
+
+	// Extracting again replaces the files.
+	if err := ReadTar(ctx, rt, "/restored", bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	var evil bytes.Buffer
+	tw := tar.NewWriter(&evil)
+	if err := tw.WriteHeader(&tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0o644}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReadTar(ctx, rt, "/evil", &evil); err == nil {
+		t.Fatal("expected a path escaping the directory to fail")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	rootCid := func() cid.Cid {
+		nd, err := rt.GetDirectory().GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd.Cid()
+	}
+
+	dir := mkdirP(t, rt.GetDirectory(), "a/b")
+	mkdirP(t, rt.GetDirectory(), "gone/sub")
+	moved := getRandFile(t, ds, 1000)
+	for name, nd := range map[string]ipld.Node{
+		"moved":    moved,
+		"modified": getRandFile(t, ds, 1000),
+		"retyped":  getRandFile(t, ds, 10),
+		"same":     getRandFile(t, ds, 10),
+	} {
+		if err := dir.AddChild(name, nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := rootCid()
+
+	if err := Mv(rt, "/a/b/moved", "/a/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Unlink("modified"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("modified", getRandFile(t, ds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Unlink("retyped"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.Mkdir("retyped"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.GetDirectory().Unlink("gone"); err != nil {
+		t.Fatal(err)
+	}
+	mkdirP(t, rt.GetDirectory(), "new/other")
+	after := rootCid()
+
+	changes, err := Diff(ctx, ds, before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range changes {
+		s := c.Type.String() + " " + c.Path
+		if c.Type == ChangeRename {
+			s += " from " + c.OldPath
+			if !c.Before.Equals(moved.Cid()) || !c.After.Equals(moved.Cid()) {
+				t.Fatalf("unexpected rename CIDs %+v", c)
+			}
+		}
+		got = append(got, s)
+	}
+	expected := []string{
+		"modify /a/b/modified",
+		"remove /a/b/retyped",
+		"add /a/b/retyped",
+		"rename /a/moved from /a/b/moved",
+		"remove /gone",
+		"add /new",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected the changes\n%v\ngot\n%v", expected, got)
+	}
+
+	// Path-scoped, with the entry missing on one side.
+	changes, err = DiffPath(ctx, ds, before, after, "/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 4 || changes[1].Type != ChangeRemove || changes[1].Path != "/a/b/moved" {
+		t.Fatalf("unexpected path-scoped changes %+v", changes)
+	}
+	changes, err = DiffPath(ctx, ds, before, after, "/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Type != ChangeAdd || changes[0].Path != "/new" {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+	if _, err := DiffPath(ctx, ds, before, after, "/missing"); err == nil {
+		t.Fatal("expected a path missing in both trees to fail")
+	}
+	if changes, err := Diff(ctx, ds, after, after); err != nil || len(changes) != 0 {
+		t.Fatalf("expected no changes, got %v: %v", changes, err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	rootCid := func() cid.Cid {
+		nd, err := rt.GetDirectory().GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd.Cid()
+	}
+
+	dir := mkdirP(t, rt.GetDirectory(), "a/b")
+	mkdirP(t, rt.GetDirectory(), "gone/sub")
+	for name, nd := range map[string]ipld.Node{
+		"moved":    getRandFile(t, ds, 1000),
+		"modified": getRandFile(t, ds, 1000),
+		"retyped":  getRandFile(t, ds, 10),
+	} {
+		if err := dir.AddChild(name, nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap, err := rt.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Mv(rt, "/a/b/moved", "/a/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Unlink("modified"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("modified", getRandFile(t, ds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Unlink("retyped"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.Mkdir("retyped"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.GetDirectory().Unlink("gone"); err != nil {
+		t.Fatal(err)
+	}
+	mkdirP(t, rt.GetDirectory(), "new/other")
+	after := rootCid()
+
+	changes, err := Diff(ctx, ds, snap.Cid(), after)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replayed on the old tree, the changes give the new one.
+	if err := rt.Restore(ctx, snap); err != nil {
+		t.Fatal(err)
+	}
+	if err := Apply(rt, changes); err != nil {
+		t.Fatal(err)
+	}
+	if c := rootCid(); !c.Equals(after) {
+		t.Fatalf("expected the root %s after applying the changes, got %s", after, c)
+	}
+
+	// Applied again, they conflict and the tree is left unchanged.
+	err = Apply(rt, changes)
+	if !errors.Is(err, ErrApplyConflict) {
+		t.Fatalf("expected a conflict applying the changes twice, got %v", err)
+	}
+	if c := rootCid(); !c.Equals(after) {
+		t.Fatal("the tree changed on a failed apply")
+	}
+
+	// On a tree diverging from the old one, none of them is applied.
+	if err := rt.Restore(ctx, snap); err != nil {
+		t.Fatal(err)
+	}
+	dir, err = ctxLookupDir(ctx, rt, "/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Unlink("modified"); err != nil {
+		t.Fatal(err)
+	}
+	diverged := rootCid()
+	err = Apply(rt, changes)
+	if !errors.Is(err, ErrApplyConflict) {
+		t.Fatalf("expected a conflict on a diverged tree, got %v", err)
+	}
+	if c := rootCid(); !c.Equals(diverged) {
+		t.Fatal("the tree changed on a failed apply")
+	}
+	if _, err := Lookup(rt, "/a/moved"); err == nil {
+		t.Fatal("a change was applied before the conflict")
+	}
+}
+
+type ed25519Signer ed25519.PrivateKey
+
+func (s ed25519Signer) Sign(data []byte) ([]byte, error) {
+	return ed25519.Sign(ed25519.PrivateKey(s), data), nil
+}
+
+type ed25519Verifier ed25519.PublicKey
+
+func (v ed25519Verifier) Verify(data, sig []byte) (bool, error) {
+	return ed25519.Verify(ed25519.PublicKey(v), data, sig), nil
+}
+
+func TestRootRecord(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	var records []RootRecord
+	emit := func(ctx context.Context, rec RootRecord) error {
+		lock.Lock()
+		defer lock.Unlock()
+		records = append(records, rec)
+		return nil
+	}
+	lastRecord := func(rt *Root) RootRecord {
+		if err := rt.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := rt.repub.WaitPub(ctx); err != nil {
+			t.Fatal(err)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if len(records) == 0 {
+			t.Fatal("no record emitted")
+		}
+		return records[len(records)-1]
+	}
+	pf := func(ctx context.Context, c cid.Cid) error { return nil }
+
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), pf, WithRootSigner(ed25519Signer(priv), 0, emit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkdirP(t, rt.GetDirectory(), "a")
+	rec := lastRecord(rt)
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Seq != 1 || !rec.Root.Equals(nd.Cid()) {
+		t.Fatalf("expected the record 1 of %s, got %d of %s", nd.Cid(), rec.Seq, rec.Root)
+	}
+	mkdirP(t, rt.GetDirectory(), "b")
+	rec = lastRecord(rt)
+	if rec.Seq != 2 {
+		t.Fatalf("expected the record 2, got %d", rec.Seq)
+	}
+	if err := rec.Verify(ed25519Verifier(pub)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Verify(ed25519Verifier(otherPub)); !errors.Is(err, ErrInvalidRootRecord) {
+		t.Fatalf("expected the record not to verify with another key, got %v", err)
+	}
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := rec.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded RootRecord
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Root.Equals(rec.Root) || decoded.Seq != rec.Seq || !bytes.Equal(decoded.Signature, rec.Signature) {
+		t.Fatalf("expected %+v after a round-trip, got %+v", rec, decoded)
+	}
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); !errors.Is(err, ErrInvalidRootRecord) {
+		t.Fatalf("expected a truncated record to fail, got %v", err)
+	}
+
+	// The root is authenticated on creation.
+	getNode := func(c cid.Cid) *dag.ProtoNode {
+		nd, err := ds.Get(ctx, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd.(*dag.ProtoNode)
+	}
+	tampered := rec
+	tampered.Signature = append([]byte(nil), rec.Signature...)
+	tampered.Signature[0] ^= 1
+	for name, opt := range map[string]RootOption{
+		"tampered":  WithRootRecord(tampered, ed25519Verifier(pub)),
+		"other key": WithRootRecord(rec, ed25519Verifier(otherPub)),
+	} {
+		if _, err := NewRoot(ctx, ds, getNode(rec.Root), nil, opt); !errors.Is(err, ErrInvalidRootRecord) {
+			t.Fatalf("%s: expected the record to fail, got %v", name, err)
+		}
+	}
+	if _, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithRootRecord(rec, ed25519Verifier(pub))); !errors.Is(err, ErrInvalidRootRecord) {
+		t.Fatalf("expected the record of another root to fail, got %v", err)
+	}
+
+	// Resumed from the record, the sequence numbers follow it.
+	rt, err = NewRoot(ctx, ds, getNode(rec.Root), pf,
+		WithRootRecord(rec, ed25519Verifier(pub)),
+		WithRootSigner(ed25519Signer(priv), 0, emit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+	mkdirP(t, rt.GetDirectory(), "c")
+	if rec = lastRecord(rt); rec.Seq != 3 {
+		t.Fatalf("expected the record 3, got %d", rec.Seq)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, rt := setupRoot(ctx, t)
+	a := mkdirP(t, rt.GetDirectory(), "a")
+	b := mkdirP(t, a, "b")
+	if err := b.AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	other := mkdirP(t, rt.GetDirectory(), "other")
+	busy := mkdirP(t, rt.GetDirectory(), "open")
+	if err := busy.AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := busy.Child("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fsn.(*File).Open(Flags{Read: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the subtree is evicted, its unflushed changes are kept.
+	if err := rt.Evict("/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Mkdir("c"); err != ErrDetached {
+		t.Fatalf("expected ErrDetached using an evicted directory, got %v", err)
+	}
+	if _, err := a.Mkdir("c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Mkdir("c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt, "/a/b/file"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries in use are refused, as is the root holding one.
+	for _, pth := range []string{"/open/file", "/open", "/"} {
+		if err := rt.Evict(pth); !errors.Is(err, ErrInUse) {
+			t.Fatalf("%s: expected ErrInUse, got %v", pth, err)
+		}
+	}
+	if _, err := busy.Mkdir("sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Evict("/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a missing entry to fail, got %v", err)
+	}
+
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Evict("/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := busy.Mkdir("sub2"); err != ErrDetached {
+		t.Fatalf("expected ErrDetached using an evicted directory, got %v", err)
+	}
+	for _, pth := range []string{"/a/b/file", "/a/c", "/other/c", "/open/file", "/open/sub"} {
+		if _, err := Lookup(rt, pth); err != nil {
+			t.Fatalf("%s: %s", pth, err)
+		}
+	}
+}
+
+func TestChunker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	if _, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithChunker("size-x")); err == nil {
+		t.Fatal("expected an invalid chunker to fail")
+	}
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithChunker("size-1000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 5000)
+	rand.Read(data)
+	leaves := func(name string, flags Flags) (int, error) {
+		if err := rt.GetDirectory().AddChild(name, NewEmptyFileNode(EmptyFileOpts{})); err != nil {
+			t.Fatal(err)
+		}
+		flags.Write = true
+		h, err := Open(rt, "/"+name, flags)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := h.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Close(); err != nil {
+			t.Fatal(err)
+		}
+		fsn, err := Lookup(rt, "/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd, err := fsn.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(nd.Links()), nil
+	}
+
+	for name, tc := range map[string]struct {
+		spec   string
+		leaves int
+	}{
+		"root":     {"", 5},
+		"override": {"size-2500", 2},
+	} {
+		n, err := leaves(name, Flags{Chunker: tc.spec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tc.leaves {
+			t.Fatalf("%s: expected %d leaves, got %d", name, tc.leaves, n)
+		}
+	}
+	if _, err := leaves("invalid", Flags{Chunker: "bogus"}); err == nil {
+		t.Fatal("expected an invalid chunker to fail")
+	}
+}
+
+// panickingDAG panics getting the nodes (only 'bad' if defined), like a
+// dependency would on a malformed DAG.
+type panickingDAG struct {
+	ipld.DAGService
+	bad cid.Cid
+}
+
+func (p *panickingDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	if p.bad.Defined() && !c.Equals(p.bad) {
+		return p.DAGService.Get(ctx, c)
+	}
+	panic("malformed node")
+}
+
+func TestPanicRecovery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	mkdirP(t, rt.GetDirectory(), "a/b")
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pds := &panickingDAG{DAGService: ds}
+
+	rt, err = NewRoot(ctx, pds, nd.(*dag.ProtoNode), nil, WithPanicRecovery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Lookup(rt, "/a/b")
+	var pe *PanicError
+	if !errors.As(err, &pe) || !errors.Is(err, ErrPanic) {
+		t.Fatalf("expected a recovered panic, got %v", err)
+	}
+	if pe.Value != "malformed node" || !bytes.Contains(pe.Stack, []byte("panickingDAG")) {
+		t.Fatalf("unexpected panic error %v\n%s", pe.Value, pe.Stack)
+	}
+	// The lock of the directory was released.
+	if _, err := rt.GetDirectory().Mkdir("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveAll(rt, "/a/b"); !errors.Is(err, ErrPanic) {
+		t.Fatalf("expected a recovered panic, got %v", err)
+	}
+
+	// The leaves of a file are fetched by the descriptors (the reads get
+	// them in goroutines of go-ipld-format though).
+	leaf := dag.NodeWithData(ft.FilePBData([]byte("hello"), 5))
+	if err := ds.Add(ctx, leaf); err != nil {
+		t.Fatal(err)
+	}
+	fnd := dag.NodeWithData(ft.FilePBData(nil, 0))
+	if err := fnd.AddNodeLink("", leaf); err != nil {
+		t.Fatal(err)
+	}
+	fsnode := ft.NewFSNode(ft.TFile)
+	fsnode.AddBlockSize(5)
+	data, err := fsnode.GetBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fnd.SetData(data)
+	frt, err := NewRoot(ctx, &panickingDAG{DAGService: ds, bad: leaf.Cid()}, emptyDirNode(), nil, WithPanicRecovery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := frt.GetDirectory().AddChild("file", fnd); err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := Lookup(frt, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := fsn.(*File).Open(Flags{Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Truncate(2); !errors.Is(err, ErrPanic) {
+		t.Fatalf("expected a recovered panic, got %v", err)
+	}
+	if err := fd.Abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	rt, err = NewRoot(ctx, pds, nd.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected the panic not to be recovered by default")
+		}
+	}()
+	_, _ = Lookup(rt, "/a/b")
+}
+
+func TestCidPrefix(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	const sha2_512 = 0x13
+	if _, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithHashFunction(sha2_512)); err == nil {
+		t.Fatal("expected CIDv0 with SHA2-512 to fail")
+	}
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil, WithCidVersion(1), WithHashFunction(sha2_512))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mkdirP(t, rt.GetDirectory(), "a/b")
+	data := make([]byte, 1000)
+	rand.Read(data)
+	if err := WriteFile(rt, "/a/file", bytes.NewReader(data), WriteFileOpts{Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(rt, "file", "/a/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pth := range []string{"/", "/a", "/a/b", "/a/file", "/a/link"} {
+		fsn, err := Lookup(rt, pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd, err := fsn.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefix := nd.Cid().Prefix()
+		if prefix.Version != 1 || prefix.MhType != sha2_512 {
+			t.Fatalf("%s: expected a CIDv1 with SHA2-512, got %s", pth, nd.Cid())
+		}
+		if pth != "/a/file" {
+			continue
+		}
+		for _, l := range nd.Links() {
+			if l.Cid.Prefix().Codec != cid.Raw || l.Cid.Prefix().MhType != sha2_512 {
+				t.Fatalf("expected raw leaves with SHA2-512, got %s", l.Cid)
+			}
+		}
+	}
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRootLifecycle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+	pf := func(ctx context.Context, c cid.Cid) error { return nil }
+
+	waitErr := func(rt *Root) error {
+		for i := 0; i < 100; i++ {
+			if err := rt.Err(); err != nil {
+				return err
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("no error reported")
+		return nil
+	}
+
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), pf, WithPanicRecovery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Err(); err != nil {
+		t.Fatal(err)
+	}
+	w := rt.Watch(WatchOpts{})
+	rt.life.Go("failing", func(context.Context) error {
+		return errors.New("boom")
+	})
+	if err := waitErr(rt); err.Error() != "failing: boom" {
+		t.Fatalf("expected the failure of the task, got %v", err)
+	}
+
+	// Closing stops the goroutines, the first failure stays reported.
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range w.Events() {
+	}
+	if err := rt.Err(); err.Error() != "failing: boom" {
+		t.Fatalf("expected the failure of the task, got %v", err)
+	}
+	if rp := rt.repub.(*Republisher); !rp.hasStopped() {
+		t.Fatal("the republisher is still running")
+	}
+	for range rt.Watch(WatchOpts{}).Events() {
+	}
+
+	rt, err = NewRoot(ctx, ds, emptyDirNode(), pf, WithPanicRecovery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.life.Go("panicking", func(context.Context) error {
+		panic("crash")
+	})
+	if err := waitErr(rt); !errors.Is(err, ErrPanic) {
+		t.Fatalf("expected a recovered panic, got %v", err)
+	}
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rt, err = NewRoot(ctx, ds, emptyDirNode(), pf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Err(); err != ErrRootClosed {
+		t.Fatalf("expected ErrRootClosed, got %v", err)
+	}
+
+	// Canceling the context of the root stops it too.
+	pctx, pcancel := context.WithCancel(ctx)
+	rt, err = NewRoot(pctx, ds, emptyDirNode(), pf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = rt.Watch(WatchOpts{})
+	pcancel()
+	for range w.Events() {
+	}
+	if err := rt.Err(); err != context.Canceled {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+}
+
+func TestUnsupportedPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	metaData, err := ft.NewFSNode(ft.TMetadata).GetBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := dag.NodeWithData(metaData)
+	file := dag.NodeWithData(ft.FilePBData([]byte("data"), 4))
+	dir := emptyDirNode()
+	for name, nd := range map[string]*dag.ProtoNode{"meta": meta, "file": file} {
+		if err := ds.Add(ctx, nd); err != nil {
+			t.Fatal(err)
+		}
+		if err := dir.AddNodeLink(name, nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := emptyDirNode()
+	if err := root.AddNodeLink("a", dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, nd := range []ipld.Node{dir, root} {
+		if err := ds.Add(ctx, nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tarNames := func(rt *Root) ([]string, error) {
+		var buf bytes.Buffer
+		if err := WriteTar(ctx, rt, "/a", &buf); err != nil {
+			return nil, err
+		}
+		var names []string
+		tr := tar.NewReader(&buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return names, nil
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, hdr.Name)
+		}
+	}
+
+	// Reject (the default)
+	rt, err := NewRoot(ctx, ds, root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt, "/a/meta"); !errors.Is(err, ErrUnsupportedType) || !errors.Is(err, ErrNotYetImplemented) {
+		t.Fatalf("expected ErrUnsupportedType, got %v", err)
+	}
+	if _, err := Lookup(rt, "/a/file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mkdirP(t, rt.GetDirectory(), "a").List(ctx); !errors.Is(err, ErrUnsupportedType) {
+		t.Fatalf("expected ErrUnsupportedType, got %v", err)
+	}
+	if err := Cp(ctx, rt, "/a/meta", "/copy", CpOpts{}); !errors.Is(err, ErrUnsupportedType) {
+		t.Fatalf("expected ErrUnsupportedType, got %v", err)
+	}
+	if _, err := tarNames(rt); !errors.Is(err, ErrUnsupportedType) {
+		t.Fatalf("expected ErrUnsupportedType, got %v", err)
+	}
+	if err := ExportCAR(ctx, rt, "/a", io.Discard); !errors.Is(err, ErrUnsupportedType) {
+		t.Fatalf("expected ErrUnsupportedType, got %v", err)
+	}
+
+	// Opaque
+	rt, err = NewRoot(ctx, ds, root, nil, WithUnsupportedPolicy(UnsupportedOpaque))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := Lookup(rt, "/a/meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, ok := fsn.(*File)
+	if !ok {
+		t.Fatal("expected the metadata node to be looked up as a file")
+	}
+	if _, err := fi.Open(Flags{Read: true}); !errors.Is(err, ErrUnsupportedType) {
+		t.Fatalf("expected ErrUnsupportedType, got %v", err)
+	}
+	listing, err := mkdirP(t, rt.GetDirectory(), "a").List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing) != 2 {
+		t.Fatalf("expected 2 entries, got %v", listing)
+	}
+	if err := Cp(ctx, rt, "/a/meta", "/copy", CpOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := Lookup(rt, "/copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := cp.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd.Cid().Equals(meta.Cid()) {
+		t.Fatal("expected the metadata node to be copied as is")
+	}
+	if names, err := tarNames(rt); err != nil || fmt.Sprint(names) != "[file]" {
+		t.Fatalf("expected only the file in the tar archive, got %v (%v)", names, err)
+	}
+	if err := ExportCAR(ctx, rt, "/a", io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// Strip
+	rt, err = NewRoot(ctx, ds, root, nil, WithUnsupportedPolicy(UnsupportedStrip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt, "/a/meta"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	listing, err = mkdirP(t, rt.GetDirectory(), "a").List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing) != 1 || listing[0].Name != "file" {
+		t.Fatalf("expected only the file to be listed, got %v", listing)
+	}
+	if err := Cp(ctx, rt, "/a/meta", "/copy", CpOpts{}); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	if names, err := tarNames(rt); err != nil || fmt.Sprint(names) != "[file]" {
+		t.Fatalf("expected only the file in the tar archive, got %v (%v)", names, err)
+	}
+	// The directory still links to the metadata node.
+	if err := ExportCAR(ctx, rt, "/a", io.Discard); !errors.Is(err, ErrUnsupportedType) {
+		t.Fatalf("expected ErrUnsupportedType, got %v", err)
+	}
+	if err := ExportCAR(ctx, rt, "/a/file", io.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPreload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := mkdirP(t, rt.GetDirectory(), "a/b/c")
+	mkdirP(t, rt.GetDirectory(), "d")
+	if err := dir.AddChild("file", getRandFile(t, ds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached := func(d *Directory, name string) bool {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		_, ok := d.entriesCache[name]
+		return ok
+	}
+	load := func(paths []string, depth int) *Root {
+		rt, err := NewRoot(ctx, ds, nd.(*dag.ProtoNode), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rt.Preload(ctx, paths, depth); err != nil {
+			t.Fatal(err)
+		}
+		return rt
+	}
+
+	rt = load([]string{"/a"}, 1)
+	root := rt.GetDirectory()
+	if !cached(root, "a") || cached(root, "d") {
+		t.Fatal("expected only /a to be cached in the root")
+	}
+	a := mkdirP(t, root, "a")
+	b := mkdirP(t, root, "a/b")
+	if !cached(a, "b") || cached(b, "c") {
+		t.Fatal("expected /a/b to be cached, but not /a/b/c")
+	}
+
+	rt = load([]string{"/a", "/d"}, -1)
+	root = rt.GetDirectory()
+	if !cached(root, "a") || !cached(root, "d") {
+		t.Fatal("expected /a and /d to be cached in the root")
+	}
+	if !cached(mkdirP(t, root, "a/b/c"), "file") {
+		t.Fatal("expected /a/b/c/file to be cached")
+	}
+
+	if err := rt.Preload(ctx, []string{"/missing"}, 0); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestListNamesPage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	dir := mkdirP(t, rt.GetDirectory(), "a")
+	for i := 0; i < 10; i++ {
+		mkdirP(t, dir, fmt.Sprintf("f%d", i))
+	}
+	for i := 0; i < 3; i++ {
+		mkdirP(t, dir, fmt.Sprintf("g%d", i))
+	}
+	all, err := dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pattern := range []string{"", "f*", "g?"} {
+		var expected []string
+		for _, name := range all {
+			if ok, _ := gopath.Match(pattern, name); ok || pattern == "" {
+				expected = append(expected, name)
+			}
+		}
+
+		var names []string
+		for offset := 0; ; offset += 4 {
+			page, err := dir.ListNamesPage(ctx, offset, 4, pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) > 4 {
+				t.Fatalf("expected at most 4 names, got %v", page)
+			}
+			names = append(names, page...)
+			if len(page) < 4 {
+				break
+			}
+		}
+		if fmt.Sprint(names) != fmt.Sprint(expected) {
+			t.Fatalf("%q: expected %v, got %v", pattern, expected, names)
+		}
+
+		unlimited, err := dir.ListNamesPage(ctx, 0, 0, pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(unlimited) != fmt.Sprint(expected) {
+			t.Fatalf("%q: expected %v, got %v", pattern, expected, unlimited)
+		}
+	}
+
+	if _, err := dir.ListNamesPage(ctx, 0, 1, "["); err == nil {
+		t.Fatal("expected an invalid pattern to fail")
+	}
+}
+
+func BenchmarkDirOps(b *testing.B) {
+	for _, size := range []int{10, 100, 1000, 10000} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			results, err := MeasureDirOps(context.Background(), getDagserv(b), DirOpsOpts{Sizes: []int{size}, Rounds: b.N})
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, r := range results {
+				encoding := "basic"
+				if r.Sharded {
+					encoding = "hamt"
+				}
+				b.ReportMetric(float64(r.PerOp.Nanoseconds()), fmt.Sprintf("ns/%s-%s", r.Op, encoding))
+			}
+		})
+	}
+}
+
+var updateDirOps = flag.Bool("update-dirops", false, "measure the directory operations again into "+dirOpsResults)
+
+// dirOpsResults are the measures of `MeasureDirOps` that
+// `DefaultShardingSize` is set from.
+const dirOpsResults = "testdata/dirops.json"
+
+func TestDefaultShardingSize(t *testing.T) {
+	if *updateDirOps {
+		results, err := MeasureDirOps(context.Background(), getDagserv(t), DirOpsOpts{
+			Sizes:  []int{10, 100, 250, 500, 1000, 2500, 5000, 10000},
+			Rounds: 1000,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.MarshalIndent(results, "", "\t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dirOpsResults, append(data, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(dirOpsResults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []DirOpsResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		t.Fatal(err)
+	}
+	entries, size, ok := ShardingCrossover(results)
+	if !ok {
+		t.Fatalf("expected a crossover in %s", dirOpsResults)
+	}
+	if size != DefaultShardingSize {
+		t.Fatalf("expected DefaultShardingSize to be the crossover measured in %s: %d bytes (%d entries), got %d", dirOpsResults, size, entries, DefaultShardingSize)
+	}
+}
+
+func TestShardingCrossover(t *testing.T) {
+	results, err := MeasureDirOps(context.Background(), getDagserv(t), DirOpsOpts{Sizes: []int{0, 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2*3+2*4 {
+		t.Fatalf("expected 14 results, got %d", len(results))
+	}
+	if results[len(results)-1].Size == 0 {
+		t.Fatal("expected the size of the directory to be estimated")
+	}
+
+	result := func(entries int, sharded bool, perOp time.Duration) DirOpsResult {
+		return DirOpsResult{Entries: entries, Sharded: sharded, PerOp: perOp, Size: entries * 10}
+	}
+	results = []DirOpsResult{
+		result(10, false, 1), result(10, true, 2),
+		result(100, false, 3), result(100, true, 2),
+		result(1000, false, 5), result(1000, true, 6),
+		result(10000, false, 9), result(10000, true, 7),
+		result(100000, false, 9), result(100000, true, 8),
+	}
+	entries, size, ok := ShardingCrossover(results)
+	if !ok || entries != 10000 || size != 100000 {
+		t.Fatalf("expected a crossover at 10000 entries, got %d (%d bytes, %t)", entries, size, ok)
+	}
+	if _, _, ok := ShardingCrossover(results[:6]); ok {
+		t.Fatal("expected no crossover")
+	}
+}
+
+func TestGlob(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	for _, pth := range []string{"/docs/a.md", "/docs/b.txt", "/docs/sub/c.md", "/docs/sub/deep/d.md", "/src/e.go"} {
+		if err := CtxMkdir(ctx, rt, gopath.Dir(pth), MkdirOpts{Mkparents: true}); err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteFile(rt, pth, strings.NewReader(pth), WriteFileOpts{Create: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for pattern, expected := range map[string][]string{
+		"/docs/*.md":    {"/docs/a.md"},
+		"/docs/?.*":     {"/docs/a.md", "/docs/b.txt"},
+		"/docs/**/*.md": {"/docs/a.md", "/docs/sub/c.md", "/docs/sub/deep/d.md"},
+		"/**/*.go":      {"/src/e.go"},
+		"/*":            {"/docs", "/src"},
+		"/docs/sub/**":  {"/docs/sub", "/docs/sub/c.md", "/docs/sub/deep", "/docs/sub/deep/d.md"},
+		"/docs/a.md":    {"/docs/a.md"},
+		"/missing/*":    {},
+		"/**/*.c":       {},
+	} {
+		matches, err := Glob(rt, pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(matches) != fmt.Sprint(expected) {
+			t.Fatalf("%s: expected %v, got %v", pattern, expected, matches)
+		}
+	}
+
+	if _, err := Glob(rt, "/docs/["); err == nil {
+		t.Fatal("expected an invalid pattern to fail")
+	}
+}
+
+func TestLazyDirectoryLoad(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	for i := 0; i < 8; i++ {
+		mkdirP(t, rt.GetDirectory(), fmt.Sprintf("a/d%d/sub", i))
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err = NewRoot(ctx, ds, nd.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsn, err := Lookup(rt, "/a/d0/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := fsn.(*Directory)
+	if sub.Loaded() {
+		t.Fatal("expected the directory not to be loaded by looking it up")
+	}
+	if !mkdirP(t, rt.GetDirectory(), "a").Loaded() {
+		t.Fatal("expected the directories looked up in to be loaded")
+	}
+	if _, err := sub.ListNames(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !sub.Loaded() {
+		t.Fatal("expected the directory to be loaded by listing it")
+	}
+
+	canceled, cancelLoad := context.WithCancel(ctx)
+	cancelLoad()
+	fsn, err = Lookup(rt, "/a/d1/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsn.(*Directory).CtxChild(canceled, "x"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the load to be canceled, got %v", err)
+	}
+
+	// Load the directories concurrently, several times each.
+	var wg sync.WaitGroup
+	errs := make(chan error, 32)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fsn, err := Lookup(rt, fmt.Sprintf("/a/d%d", i%8))
+			if err != nil {
+				errs <- err
+				return
+			}
+			listing, err := fsn.(*Directory).List(ctx)
+			if err == nil && (len(listing) != 1 || listing[0].Name != "sub") {
+				err = fmt.Errorf("unexpected listing %v", listing)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	mkdirP(t, rt.GetDirectory(), "dir")
+	if err := WriteFile(rt, "/file", bytes.NewReader([]byte("data")), WriteFileOpts{Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	_, errNotExist := Lookup(rt, "/missing")
+	errExist := CtxMkdir(ctx, rt, "/dir", MkdirOpts{})
+	_, errNotDir := Lookup(rt, "/file/x")
+	_, errIsDir := rt.OpenPath("/dir", Flags{Read: true})
+	fd, err := rt.OpenPath("/file", Flags{Read: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, errReadOnly := fd.Write([]byte("x"))
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, errClosed := fd.Read(make([]byte, 1))
+
+	for _, c := range []struct {
+		err  error
+		code ErrorCode
+	}{
+		{nil, CodeUnknown},
+		{errors.New("other"), CodeUnknown},
+		{errNotExist, CodeNotExist},
+		{errExist, CodeExist},
+		{errNotDir, CodeNotDir},
+		{errIsDir, CodeIsDir},
+		{fmt.Errorf("rm: %w", ErrNotEmpty), CodeNotEmpty},
+		{errReadOnly, CodeReadOnly},
+		{pathError("write", "/file", ErrFileTooLarge), CodeQuota},
+		{ErrDetached, CodeStale},
+		{errClosed, CodeClosed},
+		{pathError("read", "/file", ipld.ErrNotFound), CodeOffline},
+	} {
+		if code := Code(c.err); code != c.code {
+			t.Fatalf("%v: expected the code %s, got %s", c.err, c.code, code)
+		}
+	}
+	if CodeOffline.String() != "Offline" || ErrorCode(99).String() != "ErrorCode(99)" {
+		t.Fatal("unexpected names of the codes")
+	}
+}
+
+func TestOpenFlags(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	write := func(pth string, flags Flags, data string) {
+		t.Helper()
+		fd, err := rt.OpenPath(pth, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data != "" {
+			if _, err := fd.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fd.Write([]byte(data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := fd.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := func(pth string) string {
+		t.Helper()
+		fd, err := rt.OpenPath(pth, Flags{Read: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fd.Close()
+		data, err := io.ReadAll(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	if _, err := rt.OpenPath("/file", Flags{Write: true}); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist without Create, got %v", err)
+	}
+	write("/file", Flags{Write: true, Create: true, Exclusive: true}, "abc")
+	if _, err := rt.OpenPath("/file", Flags{Write: true, Create: true, Exclusive: true}); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected os.ErrExist, got %v", err)
+	}
+	write("/file", Flags{Write: true, Create: true}, "")
+	if c := content("/file"); c != "abc" {
+		t.Fatalf("expected Create to keep the existing file, got %q", c)
+	}
+
+	// Appended even after seeking to the start.
+	write("/file", Flags{Write: true, Append: true}, "def")
+	if c := content("/file"); c != "abcdef" {
+		t.Fatalf("expected the data to be appended, got %q", c)
+	}
+	fd, err := rt.OpenPath("/file", Flags{Write: true, Append: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.WriteAt([]byte("x"), 0); err == nil {
+		t.Fatal("expected WriteAt to fail in append mode")
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	write("/file", Flags{Write: true, Truncate: true}, "")
+	if c := content("/file"); c != "" {
+		t.Fatalf("expected the file to be truncated, got %q", c)
+	}
+
+	for _, flags := range []Flags{{Read: true, Append: true}, {Read: true, Truncate: true}} {
+		if _, err := rt.OpenPath("/file", flags); err == nil {
+			t.Fatalf("expected %+v to fail without Write", flags)
+		}
+	}
+}
+
+func TestConcurrentFlushPath(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	const users, files = 8, 10
+	for u := 0; u < users; u++ {
+		mkdirP(t, rt.GetDirectory(), fmt.Sprintf("users/u%d", u))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, users)
+	for u := 0; u < users; u++ {
+		wg.Add(1)
+		go func(u int) {
+			defer wg.Done()
+			dir := fmt.Sprintf("/users/u%d", u)
+			for i := 0; i < files; i++ {
+				pth := fmt.Sprintf("%s/f%d", dir, i)
+				if err := WriteFile(rt, pth, strings.NewReader(pth), WriteFileOpts{Create: true}); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := FlushPath(ctx, rt, dir); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(u)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The last persisted root has the changes of every flush, whatever
+	// order they reached the root in.
+	nd, err := ds.Get(ctx, rt.PersistedRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	persisted, err := NewRoot(ctx, ds, nd.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for u := 0; u < users; u++ {
+		for i := 0; i < files; i++ {
+			if _, err := Lookup(persisted, fmt.Sprintf("/users/u%d/f%d", u, i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// blockingAddDAG blocks adding the directory nodes with an entry named
+// 'name' once armed, until 'release' is closed.
+type blockingAddDAG struct {
+	ipld.DAGService
+	name    string
+	armed   *int32
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (d blockingAddDAG) Add(ctx context.Context, nd ipld.Node) error {
+	if pbnd, ok := nd.(*dag.ProtoNode); ok && atomic.LoadInt32(d.armed) == 1 {
+		for _, l := range pbnd.Links() {
+			if l.Name == d.name {
+				if atomic.CompareAndSwapInt32(d.armed, 1, 0) {
+					close(d.blocked)
+				}
+				<-d.release
+				break
+			}
+		}
+	}
+	return d.DAGService.Add(ctx, nd)
+}
+
+func TestFlushPathDisjointParallel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bds := blockingAddDAG{
+		DAGService: getDagserv(t),
+		name:       "blocking",
+		armed:      new(int32),
+		blocked:    make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	rt, err := NewRoot(ctx, bds, emptyDirNode(), func(context.Context, cid.Cid) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+
+	for _, pth := range []string{"/users/a/blocking", "/users/b/file"} {
+		mkdirP(t, rt.GetDirectory(), gopath.Dir(pth)[1:])
+		if err := WriteFile(rt, pth, strings.NewReader(pth), WriteFileOpts{Create: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := FlushPath(ctx, rt, "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Storing /users/a hangs from now on, while its flush holds its lock.
+	atomic.StoreInt32(bds.armed, 1)
+	mkdirP(t, rt.GetDirectory(), "users/a/sub")
+	mkdirP(t, rt.GetDirectory(), "users/b/sub")
+	aDone := make(chan error, 1)
+	go func() {
+		_, err := FlushPath(ctx, rt, "/users/a")
+		aDone <- err
+	}()
+	select {
+	case <-bds.blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the flush of /users/a didn't store it")
+	}
+
+	// The flush of the disjoint /users/b isn't held up by it.
+	bDone := make(chan error, 1)
+	go func() {
+		_, err := FlushPath(ctx, rt, "/users/b")
+		bDone <- err
+	}()
+	select {
+	case err := <-bDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the flush of /users/b waited for the one of /users/a")
+	}
+	select {
+	case <-aDone:
+		t.Fatal("the flush of /users/a returned while blocked")
+	default:
+	}
+
+	close(bds.release)
+	if err := <-aDone; err != nil {
+		t.Fatal(err)
+	}
+
+	// Both flushes reached the root.
+	nd, err := bds.Get(ctx, rt.PersistedRoot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	persisted, err := NewRoot(ctx, bds, nd.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pth := range []string{"/users/a/sub", "/users/b/sub"} {
+		if _, err := Lookup(persisted, pth); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFlushAndGetCid(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	if err := WriteFile(rt, "/a", strings.NewReader("hello"), WriteFileOpts{Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := rt.FlushAndGetCid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Equals(rt.PersistedRoot()) {
+		t.Fatalf("flushed %s, persisted %s", c, rt.PersistedRoot())
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Equals(nd.Cid()) {
+		t.Fatalf("flushed %s, root is %s", c, nd.Cid())
+	}
+
+	// Nothing changed, the same root is returned.
+	again, err := rt.FlushAndGetCid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Equals(c) {
+		t.Fatalf("flushed %s again, got %s", c, again)
+	}
+}
+
+// hangingDAG never returns the node 'hang', ignoring the context, until
+// 'release' is closed.
+type hangingDAG struct {
+	ipld.DAGService
+	hang    cid.Cid
+	release chan struct{}
+}
+
+func (d hangingDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	if c.Equals(d.hang) {
+		<-d.release
+		return nil, ipld.ErrNotFound
+	}
+	return d.DAGService.Get(ctx, c)
+}
+
+func TestListChildDeadline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	for _, name := range []string{"a", "b", "c"} {
+		if err := WriteFile(rt, "/"+name, strings.NewReader(name), WriteFileOpts{Create: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := Lookup(rt, "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bnd, err := b.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hanging := hangingDAG{ds, bnd.Cid(), make(chan struct{})}
+	defer close(hanging.release)
+	rt, err = NewRoot(ctx, hanging, nd.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The deadline of the listing is honored despite the hanging node.
+	lctx, lcancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer lcancel()
+	start := time.Now()
+	_, err = rt.GetDirectory().List(lctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("listing took %s", d)
+	}
+
+	entries, err := rt.GetDirectory().ListEntries(ctx, ListOpts{
+		Partial:      true,
+		ChildTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for _, e := range entries {
+		switch {
+		case e.Name == "b" && !errors.Is(e.Err, context.DeadlineExceeded):
+			t.Fatalf("expected b to time out, got %v", e.Err)
+		case e.Name != "b" && (e.Err != nil || e.Size != 1):
+			t.Fatalf("unexpected entry %+v", e)
+		}
+	}
+}
+
+func TestNewRootFromCid(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	mkdirP(t, rt.GetDirectory(), "d")
+	for i := 0; i < 10; i++ {
+		pth := fmt.Sprintf("/d/f%d", i)
+		if err := WriteFile(rt, pth, strings.NewReader(pth), WriteFileOpts{Create: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Reshard(ctx, rt, "/d", 8, nil); err != nil {
+		t.Fatal(err)
+	}
+	d, err := Lookup(rt, "/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := d.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := Lookup(rt, "/d/f0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fnd, err := f.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sharded, err := NewRootFromCid(ctx, ds, nd.Cid(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sharded.Close()
+	names, err := sharded.GetDirectory().ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 10 {
+		t.Fatalf("expected 10 entries, got %v", names)
+	}
+
+	if _, err := NewRootFromCid(ctx, ds, fnd.Cid(), nil); !errors.Is(err, ErrNotDir) {
+		t.Fatalf("expected ErrNotDir for a file, got %v", err)
+	}
+}
+
+func TestEntrySpill(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	spill := dssync.MutexWrap(ds.NewMapDatastore())
+	dserv := &countingDAG{DAGService: getDagserv(t)}
+	rt, err := NewRoot(ctx, dserv, emptyDirNode(), nil, WithEntryCacheLimit(1), WithEntrySpill(spill))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := mkdirP(t, rt.GetDirectory(), "a")
+	modTime := a.ModTime()
+	time.Sleep(10 * time.Millisecond)
+	mkdirP(t, rt.GetDirectory(), "b")
+	mkdirP(t, rt.GetDirectory(), "c")
+
+	// Wait for the evictions started in the background.
+	for atomic.LoadInt32(&rt.entries.evicting) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	rt.entries.evict()
+	if !a.isDetached() {
+		t.Fatal("expected a to be evicted")
+	}
+	if ok, err := spill.Has(ctx, ds.NewKey("/entries/a")); err != nil || !ok {
+		t.Fatalf("expected a to be spilled (%v)", err)
+	}
+
+	// Loading it again restores its state, without the DAG service.
+	gets := atomic.LoadInt64(&dserv.gets)
+	fsn, err := Lookup(rt, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&dserv.gets); n != gets {
+		t.Fatalf("expected the node to be read from the spill, %d gets", n-gets)
+	}
+	if mt := fsn.(*Directory).ModTime(); !mt.Equal(modTime) {
+		t.Fatalf("expected the mod time %s, got %s", modTime, mt)
+	}
+	if ok, _ := spill.Has(ctx, ds.NewKey("/entries/a")); ok {
+		t.Fatal("expected the spilled state to be dropped once reloaded")
+	}
+
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := spill.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left, _ := keys.Rest(); len(left) != 0 {
+		t.Fatalf("expected the spill to be emptied, %d keys left", len(left))
+	}
+}
+
+func TestRootKeeper(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dserv := getDagserv(t)
+	keeper := NewRootKeeper(dssync.MutexWrap(ds.NewMapDatastore()), "/mfs/root")
+	keeper.Interval = 10 * time.Millisecond
+
+	rt, err := keeper.Resume(ctx, dserv, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(rt, "/a", strings.NewReader("a"), WriteFileOpts{Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	flushed, err := rt.FlushAndGetCid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Saved periodically while open.
+	for {
+		c, err := keeper.Load(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Equals(flushed) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// And once more when closed.
+	if err := WriteFile(rt, "/b", strings.NewReader("b"), WriteFileOpts{Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := keeper.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.Equals(rt.PersistedRoot()) {
+		t.Fatalf("expected the last root %s to be saved, got %s", rt.PersistedRoot(), saved)
+	}
+
+	rt, err = keeper.Resume(ctx, dserv, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+	for _, pth := range []string{"/a", "/b"} {
+		if _, err := Lookup(rt, pth); err != nil {
+			t.Fatalf("%s not resumed: %s", pth, err)
+		}
+	}
+}
+
+// dagFetcher serves the blocks of a DAG service, corrupting the ones in
+// 'corrupt'.
+type dagFetcher struct {
+	dserv   ipld.DAGService
+	corrupt map[cid.Cid]bool
+}
+
+func (f dagFetcher) FetchBlock(ctx context.Context, c cid.Cid) ([]byte, error) {
+	nd, err := f.dserv.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	data := append([]byte(nil), nd.RawData()...)
+	if f.corrupt[c] {
+		data[len(data)-1] ^= 0xff
+	}
+	return data, nil
+}
+
+func TestNewRootFromGateway(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	src, rt := setupRoot(ctx, t)
+
+	mkdirP(t, rt.GetDirectory(), "d")
+	file := getRandFile(t, src, 1<<20)
+	if err := rt.GetDirectory().AddChild("file", file); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gw, err := NewRootFromGateway(ctx, getDagserv(t), dagFetcher{dserv: src}, nd.Cid(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+	if _, err := Lookup(gw, "/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertFileAtPath(gw.GetDirectory().dagService, gw.GetDirectory(), file, "file"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A block not matching its CID is rejected.
+	corrupt := dagFetcher{dserv: src, corrupt: map[cid.Cid]bool{file.Links()[0].Cid: true}}
+	if _, err := NewRootFromGateway(ctx, getDagserv(t), corrupt, nd.Cid(), nil); err == nil {
+		t.Fatal("expected the corrupted block to be rejected")
+	}
+}
+
 func TestTruncateAtSize(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
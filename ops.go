@@ -2,12 +2,22 @@ package mfs
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	gopath "path"
+	"sort"
 	"strings"
+	"sync"
 
+	dag "github.com/ipfs/go-merkledag"
 	path "github.com/ipfs/go-path"
+	ft "github.com/ipfs/go-unixfs"
+	hamt "github.com/ipfs/go-unixfs/hamt"
+	uio "github.com/ipfs/go-unixfs/io"
 
 	cid "github.com/ipfs/go-cid"
 	ipld "github.com/ipfs/go-ipld-format"
@@ -23,6 +33,14 @@ import (
 //
 // Deprecated: use github.com/ipfs/boxo/mfs.Mv
 func Mv(r *Root, src, dst string) error {
+	return CtxMv(r.GetDirectory().ctx, r, src, dst)
+}
+
+// CtxMv is `Mv` with a context for the DAG operations.
+func CtxMv(ctx context.Context, r *Root, src, dst string) (err error) {
+	defer func() { err = pathError("mv", src, err) }()
+	defer r.recoverPanic(&err)
+
 	srcDirName, srcFname := gopath.Split(src)
 
 	var dstDirName string
@@ -35,31 +53,175 @@ func Mv(r *Root, src, dst string) error {
 	}
 
 	// get parent directories of both src and dest first
-	dstDir, err := lookupDir(r, dstDirName)
+	dstDir, err := ctxLookupDir(ctx, r, dstDirName)
 	if err != nil {
-		return err
+		return pathError("mv", dstDirName, err)
+	}
+
+	srcDir, err := ctxLookupDir(ctx, r, srcDirName)
+	if err != nil {
+		return pathError("mv", srcDirName, err)
 	}
 
-	srcDir, err := lookupDir(r, srcDirName)
+	// The moved entry isn't loaded (nor the directories enumerated):
+	// only the paths to it in the UnixFS directories are touched, a
+	// single branch for HAMTs.
+	nd, err := srcDir.entryNode(ctx, srcFname)
 	if err != nil {
 		return err
 	}
+	if srcDir == dstDir && srcFname == dstFname {
+		return nil
+	}
+	if err := checkNotInto(nd, srcDir, srcFname, dstDir, dstFname); err != nil {
+		return err
+	}
 
-	srcObj, err := srcDir.Child(srcFname)
+	// A file at 'dst' is replaced in a single update, so it isn't lost if
+	// linking the moved entry fails.
+	var replaced ipld.Node
+	fsn, err := dstDir.CtxChild(ctx, dstFname)
+	if err == nil {
+		switch n := fsn.(type) {
+		case *File:
+			replaced, err = n.GetNode()
+			if err != nil {
+				return pathError("mv", dst, err)
+			}
+		case *Directory:
+			dstDir = n
+			dstFname = srcFname
+		default:
+			return fmt.Errorf("unexpected type at path: %s", dst)
+		}
+	} else if err != os.ErrNotExist {
+		return err
+	}
+
+	if replaced != nil {
+		err = dstDir.setFile(dstFname, nd)
+	} else {
+		err = dstDir.putEntry(ctx, dstFname, nd)
+	}
+	if err != nil {
+		return pathError("mv", dst, err)
+	}
+
+	err = srcDir.moveOut(ctx, srcFname)
 	if err != nil {
+		// Rolled back so the entry isn't left at both paths.
+		if rerr := undoMove(ctx, dstDir, dstFname, replaced); rerr != nil {
+			log.Errorf("mv: failed to roll back %s: %s", dst, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// checkNotInto fails with `ErrIntoItself` if 'nd', the entry 'srcName'
+// of 'srcDir', is a directory to be put (as the entry 'dstName' of
+// 'dstDir', or in it if it's a directory) at its own path or below it.
+func checkNotInto(nd ipld.Node, srcDir *Directory, srcName string, dstDir *Directory, dstName string) error {
+	if nt, err := nodeType(nd); err != nil || nt != TDir {
+		return nil
+	}
+	src := gopath.Join(srcDir.Path(), srcName)
+	dst := gopath.Join(dstDir.Path(), dstName)
+	if dst == src || strings.HasPrefix(dst, src+"/") {
+		return fmt.Errorf("%s into %s: %w", src, dst, ErrIntoItself)
+	}
+	return nil
+}
+
+// undoMove removes the entry 'name' moved into 'dir', putting back the
+// file it replaced (if not nil).
+func undoMove(ctx context.Context, dir *Directory, name string, replaced ipld.Node) error {
+	if err := dir.CtxUnlink(ctx, name); err != nil {
 		return err
 	}
+	if replaced == nil {
+		return nil
+	}
+	return dir.putEntry(ctx, name, replaced)
+}
+
+// CpOpts is used by Cp
+type CpOpts struct {
+	// Overwrite replaces a file at 'dst' (directories are never
+	// replaced, the copy goes inside them).
+	Overwrite bool
+	// Deep fetches and re-adds every block of the copied DAG instead of
+	// only linking its root, so the copy doesn't depend on blocks that
+	// are only reachable remotely.
+	Deep bool
+	// Flush flushes the copy (and its parents) once it's linked.
+	Flush bool
+}
+
+// Cp copies the file or directory at 'src' to 'dst', resolving 'dst' like
+// `Mv` does. As nodes are content-addressed the copy (recursive for
+// directories) is a new link to the same DAG, see `CpOpts.Deep`.
+func Cp(ctx context.Context, r *Root, src, dst string, opts CpOpts) (err error) {
+	defer func() { err = pathError("cp", src, err) }()
+	defer r.recoverPanic(&err)
+
+	srcDirName, srcFname := gopath.Split(src)
+
+	var dstDirName string
+	var dstFname string
+	if dst[len(dst)-1] == '/' {
+		dstDirName = dst
+		dstFname = srcFname
+	} else {
+		dstDirName, dstFname = gopath.Split(dst)
+	}
 
-	nd, err := srcObj.GetNode()
+	dstDir, err := ctxLookupDir(ctx, r, dstDirName)
 	if err != nil {
+		return pathError("cp", dstDirName, err)
+	}
+
+	srcDir, err := ctxLookupDir(ctx, r, srcDirName)
+	if err != nil {
+		return pathError("cp", srcDirName, err)
+	}
+
+	nd, err := srcDir.entryNode(ctx, srcFname)
+	if err != nil {
+		return err
+	}
+	if err := checkSupported(nd); err != nil {
+		switch r.unsupported {
+		case UnsupportedStrip:
+			return os.ErrNotExist
+		case UnsupportedReject:
+			return err
+		}
+	}
+	if err := checkNotInto(nd, srcDir, srcFname, dstDir, dstFname); err != nil {
 		return err
 	}
+	if opts.Deep {
+		err = readdDAG(ctx, dstDir.dagService, nd, cid.NewSet())
+		if err != nil {
+			return err
+		}
+	}
 
-	fsn, err := dstDir.Child(dstFname)
+	fsn, err := dstDir.CtxChild(ctx, dstFname)
 	if err == nil {
 		switch n := fsn.(type) {
 		case *File:
-			_ = dstDir.Unlink(dstFname)
+			if !opts.Overwrite {
+				return pathError("cp", dst, ErrDirExists)
+			}
+			if srcDir == dstDir && srcFname == dstFname {
+				return nil
+			}
+			err = dstDir.CtxUnlink(ctx, dstFname)
+			if err != nil {
+				return err
+			}
 		case *Directory:
 			dstDir = n
 			dstFname = srcFname
@@ -70,32 +232,164 @@ func Mv(r *Root, src, dst string) error {
 		return err
 	}
 
-	err = dstDir.AddChild(dstFname, nd)
+	err = dstDir.putEntry(ctx, dstFname, nd)
 	if err != nil {
+		return pathError("cp", dst, err)
+	}
+
+	if opts.Flush {
+		copied, err := dstDir.CtxChild(ctx, dstFname)
+		if err != nil {
+			return err
+		}
+		return copied.Flush()
+	}
+	return nil
+}
+
+// RemoveAll removes the entry at 'pth' and, if it's a directory, all of
+// its contents (like `os.RemoveAll` it's not an error if 'pth' doesn't
+// exist). The `FSNode`s of the removed entries stop updating the tree,
+// so stale references can't bring them back.
+func RemoveAll(r *Root, pth string) (err error) {
+	defer func() { err = pathError("rm", pth, err) }()
+	defer r.recoverPanic(&err)
+
+	pdir, name, err := lookupParent(r, pth)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil
+	case err != nil:
 		return err
 	}
 
-	if srcDir.name == dstDir.name && srcFname == dstFname {
+	err = pdir.Unlink(name)
+	if errors.Is(err, os.ErrNotExist) {
 		return nil
 	}
+	return err
+}
 
-	return srcDir.Unlink(srcFname)
+// readdDAG fetches every block of the DAG of 'nd' and adds it again.
+func readdDAG(ctx context.Context, dserv ipld.DAGService, nd ipld.Node, seen *cid.Set) error {
+	if !seen.Visit(nd.Cid()) {
+		return nil
+	}
+	for _, l := range nd.Links() {
+		child, err := l.GetNode(ctx, dserv)
+		if err != nil {
+			return err
+		}
+		err = readdDAG(ctx, dserv, child, seen)
+		if err != nil {
+			return err
+		}
+	}
+	return dserv.Add(ctx, nd)
 }
 
 func lookupDir(r *Root, path string) (*Directory, error) {
-	di, err := Lookup(r, path)
+	return ctxLookupDir(r.GetDirectory().ctx, r, path)
+}
+
+func ctxLookupDir(ctx context.Context, r *Root, path string) (*Directory, error) {
+	di, err := dirLookup(ctx, r.GetDirectory(), path)
 	if err != nil {
 		return nil, err
 	}
 
 	d, ok := di.(*Directory)
 	if !ok {
-		return nil, fmt.Errorf("%s is not a directory", path)
+		return nil, &PathError{Path: gopath.Clean("/" + path), Err: ErrNotDir}
 	}
 
 	return d, nil
 }
 
+// lookupParent returns the parent directory of 'pth' and the name of
+// the entry in it.
+func lookupParent(r *Root, pth string) (*Directory, string, error) {
+	dirp, name := gopath.Split(gopath.Clean("/" + pth))
+	if name == "" {
+		return nil, "", fmt.Errorf("%s has no parent directory", pth)
+	}
+
+	pdir, err := lookupDir(r, dirp)
+	if err != nil {
+		return nil, "", err
+	}
+	return pdir, name, nil
+}
+
+// WriteFileAtomic writes 'data' into a temporary entry of the staging
+// directory (see `Root.StagingDir`) and then moves it into place in a
+// single update of the target directory, so readers never observe a
+// partially written file at the target path.
+func WriteFileAtomic(ctx context.Context, r *Root, pth string, data io.Reader) (err error) {
+	defer func() { err = pathError("write", pth, err) }()
+	defer r.recoverPanic(&err)
+
+	pdir, name, err := lookupParent(r, pth)
+	if err != nil {
+		return err
+	}
+
+	staging, err := r.StagingDir()
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmpName := fmt.Sprintf("%s.tmp-%s", name, hex.EncodeToString(suffix))
+
+	nd := NewEmptyFileNode(EmptyFileOpts{CidBuilder: pdir.newCidBuilder()})
+	if err := staging.AddChild(tmpName, nd); err != nil {
+		return err
+	}
+	defer func() {
+		if err := staging.Unlink(tmpName); err != nil {
+			log.Errorf("failed to remove staging entry %s: %s", tmpName, err)
+		}
+	}()
+
+	written, err := writeTemp(ctx, staging, tmpName, data)
+	if err != nil {
+		return err
+	}
+	return pdir.setFile(name, written)
+}
+
+// writeTemp writes the data to the temporary file 'name' of the directory,
+// without propagating the update to the directory, and returns its node.
+func writeTemp(ctx context.Context, dir *Directory, name string, data io.Reader) (ipld.Node, error) {
+	fsn, err := dir.Child(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, ok := fsn.(*File)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a file: %w", name, ErrIsDirectory)
+	}
+
+	fd, err := fi.Open(Flags{Write: true})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.Copy(fd, data)
+	cerr := fd.CtxClose(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cerr != nil {
+		return nil, cerr
+	}
+	return fi.GetNode()
+}
+
 // PutNode inserts 'nd' at 'path' in the given mfs
 // TODO: Rename or clearly document that this is not about nodes but actually
 // MFS files/directories (that in the underlying representation can be
@@ -109,17 +403,169 @@ func lookupDir(r *Root, path string) (*Directory, error) {
 //
 // Deprecated: use github.com/ipfs/boxo/mfs.PutNode
 func PutNode(r *Root, path string, nd ipld.Node) error {
+	return CtxPutNode(r.GetDirectory().ctx, r, path, nd)
+}
+
+// CtxPutNode is `PutNode` with a context for the DAG operations.
+func CtxPutNode(ctx context.Context, r *Root, path string, nd ipld.Node) (err error) {
+	defer func() { err = pathError("put", path, err) }()
+	defer r.recoverPanic(&err)
+
 	dirp, filename := gopath.Split(path)
 	if filename == "" {
 		return fmt.Errorf("cannot create file with empty name")
 	}
 
+	pdir, err := ctxLookupDir(ctx, r, dirp)
+	if err != nil {
+		return err
+	}
+
+	if err := r.validateGraft(ctx, nd); err != nil {
+		return err
+	}
+	if err := pdir.checkNodeSize(ctx, filename, nd); err != nil {
+		return err
+	}
+	return pdir.CtxAddChild(ctx, filename, nd)
+}
+
+// WriteFileOpts is used by WriteFile
+type WriteFileOpts struct {
+	// Create the file if it doesn't exist.
+	Create bool
+	// IdempotencyKey, if set, identifies the write: retrying it with the
+	// same key and path after a completed write is a no-op, and after an
+	// interrupted one resumes where it stopped (skipping the bytes of
+	// the data that were already written).
+	IdempotencyKey string
+}
+
+// maxWriteRecords bounds the number of idempotency keys remembered by
+// a `Root`, the oldest ones are forgotten first.
+const maxWriteRecords = 1024
+
+// writeRecord tracks the progress of a `WriteFile` by idempotency key.
+type writeRecord struct {
+	// Held for the duration of the write, serializing the retries.
+	lock sync.Mutex
+
+	path    string
+	written int64
+	done    bool
+}
+
+// writeRecord returns the record of the write with the given key,
+// creating it if needed.
+func (kr *Root) writeRecord(key, pth string) (*writeRecord, error) {
+	kr.writesLock.Lock()
+	defer kr.writesLock.Unlock()
+
+	if rec, ok := kr.writes[key]; ok {
+		if rec.path != pth {
+			return nil, fmt.Errorf("idempotency key %q already used to write %s", key, rec.path)
+		}
+		return rec, nil
+	}
+
+	if kr.writes == nil {
+		kr.writes = make(map[string]*writeRecord)
+	}
+	if len(kr.writesOrder) >= maxWriteRecords {
+		delete(kr.writes, kr.writesOrder[0])
+		kr.writesOrder = kr.writesOrder[1:]
+	}
+	rec := &writeRecord{path: pth}
+	kr.writes[key] = rec
+	kr.writesOrder = append(kr.writesOrder, key)
+	return rec, nil
+}
+
+// WriteFile replaces the contents of the file at 'pth' with 'data'. See
+// `WriteFileOpts.IdempotencyKey` to safely retry interrupted writes.
+func WriteFile(r *Root, pth string, data io.Reader, opts WriteFileOpts) (err error) {
+	defer func() { err = pathError("write", pth, err) }()
+	defer r.recoverPanic(&err)
+
+	pth = gopath.Clean("/" + pth)
+	dirp, filename := gopath.Split(pth)
+	if filename == "" {
+		return fmt.Errorf("cannot write file with empty name")
+	}
+
+	var rec *writeRecord
+	if opts.IdempotencyKey != "" {
+		rec, err = r.writeRecord(opts.IdempotencyKey, pth)
+		if err != nil {
+			return err
+		}
+		rec.lock.Lock()
+		defer rec.lock.Unlock()
+
+		if rec.done {
+			return nil
+		}
+	}
+
 	pdir, err := lookupDir(r, dirp)
 	if err != nil {
 		return err
 	}
 
-	return pdir.AddChild(filename, nd)
+	fsn, err := pdir.Child(filename)
+	if err == os.ErrNotExist && opts.Create {
+		nd := NewEmptyFileNode(EmptyFileOpts{CidBuilder: pdir.newCidBuilder()})
+		err = pdir.AddChild(filename, nd)
+		if err != nil && err != ErrDirExists {
+			return err
+		}
+		fsn, err = pdir.Child(filename)
+	}
+	if err != nil {
+		return err
+	}
+
+	fi, ok := fsn.(*File)
+	if !ok {
+		return fmt.Errorf("not a file: %w", ErrIsDirectory)
+	}
+
+	fd, err := fi.Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		return err
+	}
+
+	var skip int64
+	if rec != nil {
+		skip = rec.written
+	}
+	if skip > 0 {
+		// Resume an interrupted write: the data is sent again from
+		// the start but the first part is already in the file.
+		_, err = io.CopyN(io.Discard, data, skip)
+		if err == nil {
+			_, err = fd.Seek(skip, io.SeekStart)
+		}
+	} else {
+		err = fd.Truncate(0)
+	}
+	if err != nil {
+		fd.Close()
+		return err
+	}
+
+	n, err := io.Copy(fd, data)
+	// Closing flushes whatever was written, even if the copy failed,
+	// so a retry can resume from there.
+	cerr := fd.Close()
+	if rec != nil && cerr == nil {
+		rec.written = skip + n
+		rec.done = err == nil
+	}
+	if err != nil {
+		return err
+	}
+	return cerr
 }
 
 // MkdirOpts is used by Mkdir
@@ -136,6 +582,14 @@ type MkdirOpts struct {
 //
 // Deprecated: use github.com/ipfs/boxo/mfs.Mkdir
 func Mkdir(r *Root, pth string, opts MkdirOpts) error {
+	return CtxMkdir(r.GetDirectory().ctx, r, pth, opts)
+}
+
+// CtxMkdir is `Mkdir` with a context for the DAG operations.
+func CtxMkdir(ctx context.Context, r *Root, pth string, opts MkdirOpts) (err error) {
+	defer func() { err = pathError("mkdir", pth, err) }()
+	defer r.recoverPanic(&err)
+
 	if pth == "" {
 		return fmt.Errorf("no path given to Mkdir")
 	}
@@ -154,14 +608,14 @@ func Mkdir(r *Root, pth string, opts MkdirOpts) error {
 		if opts.Mkparents {
 			return nil
 		}
-		return fmt.Errorf("cannot create directory '/': Already exists")
+		return fmt.Errorf("cannot create directory '/': %w", os.ErrExist)
 	}
 
 	cur := r.GetDirectory()
 	for i, d := range parts[:len(parts)-1] {
-		fsn, err := cur.Child(d)
+		fsn, err := cur.CtxChild(ctx, d)
 		if err == os.ErrNotExist && opts.Mkparents {
-			mkd, err := cur.Mkdir(d)
+			mkd, err := cur.CtxMkdir(ctx, d)
 			if err != nil {
 				return err
 			}
@@ -175,12 +629,12 @@ func Mkdir(r *Root, pth string, opts MkdirOpts) error {
 
 		next, ok := fsn.(*Directory)
 		if !ok {
-			return fmt.Errorf("%s was not a directory", path.Join(parts[:i]))
+			return &PathError{Path: "/" + path.Join(parts[:i+1]), Err: ErrNotDir}
 		}
 		cur = next
 	}
 
-	final, err := cur.Mkdir(parts[len(parts)-1])
+	final, err := cur.CtxMkdir(ctx, parts[len(parts)-1])
 	if err != nil {
 		if !opts.Mkparents || err != os.ErrExist || final == nil {
 			return err
@@ -211,11 +665,34 @@ func Lookup(r *Root, path string) (FSNode, error) {
 	return DirLookup(dir, path)
 }
 
+// CtxLookup is `Lookup` with a context for loading the directories.
+func CtxLookup(ctx context.Context, r *Root, path string) (FSNode, error) {
+	return CtxDirLookup(ctx, r.GetDirectory(), path)
+}
+
 // DirLookup will look up a file or directory at the given path
 // under the directory 'd'
 //
 // Deprecated: use github.com/ipfs/boxo/mfs.DirLookup
 func DirLookup(d *Directory, pth string) (FSNode, error) {
+	return CtxDirLookup(d.ctx, d, pth)
+}
+
+// CtxDirLookup is `DirLookup` with a context for loading the
+// directories.
+func CtxDirLookup(ctx context.Context, d *Directory, pth string) (_ FSNode, err error) {
+	defer rootOf(d.parent).recoverPanic(&err)
+
+	fsn, err := dirLookup(ctx, d, pth)
+	if err != nil {
+		return nil, pathError("lookup", gopath.Join(d.Path(), pth), err)
+	}
+	return fsn, nil
+}
+
+// dirLookup is `CtxDirLookup` without wrapping its errors in a
+// `*PathError`, for the internal lookups.
+func dirLookup(ctx context.Context, d *Directory, pth string) (FSNode, error) {
 	pth = strings.Trim(pth, "/")
 	parts := path.SplitList(pth)
 	if len(parts) == 1 && parts[0] == "" {
@@ -227,10 +704,11 @@ func DirLookup(d *Directory, pth string) (FSNode, error) {
 	for i, p := range parts {
 		chdir, ok := cur.(*Directory)
 		if !ok {
-			return nil, fmt.Errorf("cannot access %s: Not a directory", path.Join(parts[:i+1]))
+			notDir := gopath.Join(d.Path(), path.Join(parts[:i]))
+			return nil, &PathError{Path: notDir, Err: ErrNotDir}
 		}
 
-		child, err := chdir.Child(p)
+		child, err := chdir.CtxChild(ctx, p)
 		if err != nil {
 			return nil, err
 		}
@@ -243,18 +721,397 @@ func DirLookup(d *Directory, pth string) (FSNode, error) {
 // TODO: Document this function and link its functionality
 // with the republisher.
 //
+// A flush holds the locks of the directories of the subtree being stored,
+// then the lock of each of its ancestors in turn, only while its entry is
+// updated in it (never two ancestors at once).
+// Flushes of disjoint subtrees thus run in parallel and only wait for
+// each other in their common ancestors (and to persist the root, see
+// `Root.FlushState`).
+//
 // Deprecated: use github.com/ipfs/boxo/mfs.FlushPath
-func FlushPath(ctx context.Context, rt *Root, pth string) (ipld.Node, error) {
-	nd, err := Lookup(rt, pth)
+func FlushPath(ctx context.Context, rt *Root, pth string) (_ ipld.Node, err error) {
+	defer rt.recoverPanic(&err)
+
+	if err := rt.writeTombstones(ctx); err != nil {
+		return nil, pathError("flush", pth, err)
+	}
+	nd, err := dirLookup(ctx, rt.GetDirectory(), pth)
 	if err != nil {
-		return nil, err
+		return nil, pathError("flush", pth, err)
 	}
 
 	err = nd.Flush()
 	if err != nil {
-		return nil, err
+		return nil, pathError("flush", pth, err)
 	}
 
 	rt.repub.WaitPub(ctx)
 	return nd.GetNode()
 }
+
+// PathCid pairs an MFS path with the CID expected at it.
+type PathCid struct {
+	Path string
+	Cid  cid.Cid
+}
+
+// MissingPath is a `PathCid` manifest entry that doesn't match the tree.
+type MissingPath struct {
+	PathCid
+
+	// Actual is the CID found at the path, `cid.Undef` if absent.
+	Actual cid.Cid
+}
+
+// MissingPaths compares the manifest of expected path/CID pairs against
+// the tree and reports (in manifest order) the entries that differ or
+// are absent, to allow rsync-like delta detection. The comparison is done
+// against a snapshot of the tree taken at call start, and each directory
+// is loaded only once no matter how many manifest entries are under it.
+func MissingPaths(ctx context.Context, r *Root, manifest []PathCid) (_ []MissingPath, err error) {
+	defer r.recoverPanic(&err)
+
+	rootNd, err := r.GetDirectory().GetNode()
+	if err != nil {
+		return nil, err
+	}
+	dserv := r.GetDirectory().dagService
+
+	// Resolved directories by path (nil for the ones that don't exist
+	// or aren't directories).
+	dirs := make(map[string]uio.Directory)
+
+	var loadDir func(string) (uio.Directory, error)
+	loadDir = func(pth string) (uio.Directory, error) {
+		if dir, ok := dirs[pth]; ok {
+			return dir, nil
+		}
+
+		var nd ipld.Node
+		if pth == "/" {
+			nd = rootNd
+		} else {
+			parentPath, name := gopath.Split(pth)
+			parent, err := loadDir(gopath.Clean(parentPath))
+			if err != nil {
+				return nil, err
+			}
+			if parent != nil {
+				nd, err = parent.Find(ctx, name)
+				if err != nil && err != os.ErrNotExist {
+					return nil, err
+				}
+			}
+		}
+
+		var dir uio.Directory
+		if nd != nil {
+			dir, err = uio.NewDirectoryFromNode(dserv, nd)
+			if err != nil && err != uio.ErrNotADir {
+				return nil, err
+			}
+		}
+
+		dirs[pth] = dir
+		return dir, nil
+	}
+
+	var out []MissingPath
+	for _, pc := range manifest {
+		pth := gopath.Clean("/" + pc.Path)
+
+		actual := cid.Undef
+		if pth == "/" {
+			actual = rootNd.Cid()
+		} else {
+			parentPath, name := gopath.Split(pth)
+			parent, err := loadDir(gopath.Clean(parentPath))
+			if err != nil {
+				return nil, err
+			}
+			if parent != nil {
+				nd, err := parent.Find(ctx, name)
+				switch err {
+				case nil:
+					actual = nd.Cid()
+				case os.ErrNotExist:
+				default:
+					return nil, err
+				}
+			}
+		}
+
+		if !actual.Equals(pc.Cid) {
+			out = append(out, MissingPath{PathCid: pc, Actual: actual})
+		}
+	}
+
+	return out, nil
+}
+
+// TreeOpts is used by Tree
+type TreeOpts struct {
+	MaxDepth     int  // levels of directories expanded below the path, 0 for no limit
+	IncludeSizes bool // report the size of the files (which may need extra fetches)
+	SkipHidden   bool // leave out the hidden entries (see `WithHiddenFunc`)
+}
+
+// TreeEntry is a node of the nested listing returned by `Tree`.
+type TreeEntry struct {
+	NodeListing
+
+	// Entries of a directory, sorted by name. Directories beyond the
+	// `MaxDepth` have `Truncated` set instead.
+	Children  []*TreeEntry
+	Truncated bool
+}
+
+// Tree returns the subtree at 'pth' as a nested listing, in a single call
+// instead of one `Lookup` and `List` per directory. It's built out of a
+// snapshot of the tree taken at call start.
+func Tree(ctx context.Context, r *Root, pth string, opts TreeOpts) (_ *TreeEntry, err error) {
+	defer r.recoverPanic(&err)
+
+	fsn, err := dirLookup(ctx, r.GetDirectory(), pth)
+	if err != nil {
+		return nil, pathError("tree", pth, err)
+	}
+	nd, err := fsn.GetNode()
+	if err != nil {
+		return nil, pathError("tree", pth, err)
+	}
+
+	_, name := gopath.Split(gopath.Clean("/" + pth))
+	w := &treeWalk{dserv: r.GetDirectory().dagService, opts: opts}
+	if opts.SkipHidden {
+		w.hidden = hiddenFunc(r)
+	}
+	entry, err := w.entry(ctx, name, nd, 0)
+	if err != nil {
+		return nil, pathError("tree", pth, err)
+	}
+	return entry, nil
+}
+
+type treeWalk struct {
+	dserv  ipld.DAGService
+	opts   TreeOpts
+	hidden HiddenFunc // nil to keep the hidden entries
+}
+
+func (w *treeWalk) entry(ctx context.Context, name string, nd ipld.Node, depth int) (*TreeEntry, error) {
+	entry := &TreeEntry{
+		NodeListing: NodeListing{
+			Name: name,
+			Type: int(TFile),
+			Hash: nd.Cid().String(),
+		},
+	}
+
+	dir, err := uio.NewDirectoryFromNode(w.dserv, nd)
+	switch err {
+	case nil:
+	case uio.ErrNotADir:
+		if w.opts.IncludeSizes {
+			entry.Size, err = nodeSize(ctx, w.dserv, nd)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return entry, nil
+	default:
+		return nil, err
+	}
+
+	entry.Type = int(TDir)
+	if w.opts.MaxDepth > 0 && depth >= w.opts.MaxDepth {
+		entry.Truncated = true
+		return entry, nil
+	}
+
+	err = dir.ForEachLink(ctx, func(l *ipld.Link) error {
+		if w.hidden != nil && w.hidden(l.Name) {
+			return nil
+		}
+		child, err := l.GetNode(ctx, w.dserv)
+		if err != nil {
+			return err
+		}
+		ce, err := w.entry(ctx, l.Name, child, depth+1)
+		if err != nil {
+			return err
+		}
+		entry.Children = append(entry.Children, ce)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entry.Children, func(i, j int) bool {
+		return entry.Children[i].Name < entry.Children[j].Name
+	})
+	return entry, nil
+}
+
+// ReshardProgressInterval is the number of entries copied between calls
+// to the progress function of `Reshard`.
+const ReshardProgressInterval = 1000
+
+// Reshard rebuilds the directory at 'pth' as a HAMT with the given fanout
+// (a power of two, multiple of 8), or as a basic directory if the fanout
+// is 0. The new directory is built out of a snapshot without blocking
+// the tree, calling 'progress' (if not nil) with the number of entries
+// copied so far, and then swapped in if the directory didn't change in
+// the meantime. References to the old `Directory` become stale: it
+// refuses with `ErrInUse` to reshard a directory with open descriptors
+// below it, whose writes would be lost.
+func Reshard(ctx context.Context, r *Root, pth string, fanout int, progress func(copied int)) (err error) {
+	defer func() { err = pathError("reshard", pth, err) }()
+	defer r.recoverPanic(&err)
+
+	if fanout != 0 {
+		if err := validShardWidth(fanout); err != nil {
+			return err
+		}
+	}
+
+	pth = gopath.Clean("/" + pth)
+	if pth == "/" {
+		return fmt.Errorf("cannot reshard the root directory")
+	}
+	parentPath, name := gopath.Split(pth)
+
+	parent, err := lookupDir(r, parentPath)
+	if err != nil {
+		return err
+	}
+	dir, err := lookupDir(r, pth)
+	if err != nil {
+		return err
+	}
+	if inUse(dir) {
+		return ErrInUse
+	}
+
+	snapshot, err := dir.snapshot()
+	if err != nil {
+		return err
+	}
+	oldNd, err := snapshot.GetNode()
+	if err != nil {
+		return err
+	}
+
+	newNd, err := rebuildDir(ctx, dir.dagService, snapshot, fanout, dir.GetCidBuilder(), progress)
+	if err != nil {
+		return err
+	}
+
+	parent.lock.Lock()
+	defer parent.lock.Unlock()
+
+	current, err := parent.childUnsync(ctx, name)
+	if err != nil {
+		return err
+	}
+	curDir, ok := current.(*Directory)
+	if !ok {
+		return fmt.Errorf("%s: %w", pth, ErrNotDir)
+	}
+	curNd, err := curDir.GetNode()
+	if err != nil {
+		return err
+	}
+	if !curNd.Cid().Equals(oldNd.Cid()) {
+		return fmt.Errorf("directory %s changed while resharding", pth)
+	}
+	// Opened meanwhile.
+	if inUse(curDir) {
+		return ErrInUse
+	}
+
+	err = parent.dagService.Add(ctx, newNd)
+	if err != nil {
+		return err
+	}
+	err = parent.addUnixfsChild(ctx, name, newNd)
+	if err != nil {
+		return err
+	}
+
+	ndir, err := NewDirectory(parent.ctx, name, newNd, parent, parent.dagService)
+	if err != nil {
+		return err
+	}
+	detachEntry(curDir, false)
+	parent.cacheEntry(name, ndir, newNd.Cid())
+	parent.notifyChange()
+	return nil
+}
+
+// rebuildDir copies the entries of 'src' into a new HAMT with the given
+// fanout (or a basic directory if 0), all of its nodes built with
+// 'builder', and returns its node.
+func rebuildDir(ctx context.Context, dserv ipld.DAGService, src uio.Directory, fanout int, builder cid.Builder, progress func(int)) (*dag.ProtoNode, error) {
+	var add func(*ipld.Link) error
+	var getNode func() (ipld.Node, error)
+
+	if fanout == 0 {
+		nd := ft.EmptyDirNode()
+		nd.SetCidBuilder(builder)
+		add = func(l *ipld.Link) error {
+			return nd.AddRawLink(l.Name, &ipld.Link{Name: l.Name, Size: l.Size, Cid: l.Cid})
+		}
+		getNode = func() (ipld.Node, error) {
+			return nd, nil
+		}
+	} else {
+		shard, err := hamt.NewShard(dserv, fanout)
+		if err != nil {
+			return nil, err
+		}
+		// Inherited by the sub-shards it creates.
+		shard.SetCidBuilder(builder)
+		add = func(l *ipld.Link) error {
+			child, err := l.GetNode(ctx, dserv)
+			if err != nil {
+				return err
+			}
+			return shard.Set(ctx, l.Name, child)
+		}
+		getNode = shard.Node
+	}
+
+	var copied int
+	err := src.ForEachLink(ctx, func(l *ipld.Link) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := add(l); err != nil {
+			return err
+		}
+
+		copied++
+		if progress != nil && copied%ReshardProgressInterval == 0 {
+			progress(copied)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if progress != nil && copied%ReshardProgressInterval != 0 {
+		progress(copied)
+	}
+
+	nd, err := getNode()
+	if err != nil {
+		return nil, err
+	}
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return nil, dag.ErrNotProtobuf
+	}
+	return pbnd, nil
+}
@@ -1,8 +1,460 @@
 package mfs
 
+import (
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+)
+
 // Deprecated: use github.com/ipfs/boxo/mfs.Flags
 type Flags struct {
 	Read  bool
 	Write bool
 	Sync  bool
+
+	// Append moves the offset to the end of the file on open and before
+	// every write, like O_APPEND (`WriteAt` is refused then). It needs
+	// Write.
+	Append bool
+	// Create makes `Root.OpenPath` create the file if it doesn't exist,
+	// like O_CREATE.
+	Create bool
+	// Exclusive, with Create, fails the opening with `os.ErrExist` if
+	// the file already exists, like O_EXCL.
+	Exclusive bool
+	// Truncate empties the file on open, like O_TRUNC. It needs Write.
+	Truncate bool
+
+	// Chunker, if set, is the splitter of the data written through the
+	// descriptor (like "size-262144" or "rabin", see
+	// `chunker.FromString`), instead of the one of the root (see
+	// `WithChunker`). It should match how the file was imported so the
+	// appended data is chunked (and deduplicated) the same way.
+	Chunker string
+}
+
+// RootOption configures optional behavior of a `Root` on creation.
+type RootOption func(*rootOptions)
+
+type rootOptions struct {
+	keepAlive      time.Duration
+	publishGate    func(old, new cid.Cid) bool
+	publishOnStart bool
+
+	descHoldThreshold time.Duration
+
+	shardWidth int
+
+	overlay bool
+
+	stagingDir     string
+	stagingCleanup bool
+
+	modTimePolicy ModTimePolicy
+
+	bulkLoad bool
+
+	verifyWrites bool
+
+	persistHook PersistHook
+
+	onOrphan OrphanFunc
+
+	locker       Locker
+	lockKey      string
+	lockTakeover bool
+
+	publisher Publisher
+
+	graftLimits *GraftLimits
+
+	maxFileSize   int64
+	maxDirEntries int
+
+	listingCacheSize int
+	listingCacheSet  bool
+
+	reverseIndex bool
+
+	entryCacheLimit int
+	entrySpill      ds.Datastore
+
+	tombstones bool
+
+	repubOpts []RepublisherOption
+
+	unpublished []string
+
+	hidden HiddenFunc
+
+	chunker string
+
+	recoverPanics bool
+
+	unsupported UnsupportedPolicy
+
+	cidVersion    uint64
+	cidVersionSet bool
+	hashFunc      uint64
+	hashFuncSet   bool
+
+	signer     Signer
+	signerSeq  uint64
+	recordFunc RecordFunc
+
+	rootRecord *RootRecord
+	verifier   Verifier
+}
+
+// ModTimePolicy selects which changes update the modification time of
+// a `Directory`.
+type ModTimePolicy int
+
+const (
+	// ModTimeOnChange updates it on any change to the directory,
+	// including the contents of its entries being flushed.
+	ModTimeOnChange ModTimePolicy = iota
+	// ModTimeOnEntries only updates it when entries are added, removed
+	// or replaced, as POSIX filesystems do.
+	ModTimeOnEntries
+	// ModTimeNever leaves it at the time the directory was loaded.
+	ModTimeNever
+)
+
+// WithKeepAlive makes the root's republisher publish the current value
+// every 'interval' even if it didn't change, so records driven by the
+// `PubFunc` (like IPNS ones) don't expire while the MFS is idle.
+func WithKeepAlive(interval time.Duration) RootOption {
+	return func(o *rootOptions) {
+		o.keepAlive = interval
+	}
+}
+
+// WithPublishOnStart makes the root's republisher publish the root's
+// initial value as soon as it starts, rather than on the first change
+// (see `Republisher.PublishOnStart`). It only applies to the republisher
+// created for the `PubFunc`, not to one set with `WithPublisher`.
+func WithPublishOnStart() RootOption {
+	return func(o *rootOptions) {
+		o.publishOnStart = true
+	}
+}
+
+// WithPublishGate sets a predicate consulted before publishing a new
+// root value: returning false suppresses that publish (the changes are
+// still flushed locally). This lets embedders only publish complete
+// states or explicit checkpoints.
+func WithPublishGate(gate func(old, new cid.Cid) bool) RootOption {
+	return func(o *rootOptions) {
+		o.publishGate = gate
+	}
+}
+
+// WithRepublisherOptions configures the root's republisher (see
+// `WithRepublishIntervals`, `WithRepublishJitter` and
+// `WithRepublishBackoff`), which otherwise publishes after 300ms without
+// changes or 3s at most, retrying failed publishes every 3s.
+func WithRepublisherOptions(opts ...RepublisherOption) RootOption {
+	return func(o *rootOptions) {
+		o.repubOpts = append(o.repubOpts, opts...)
+	}
+}
+
+// WithUnpublishedPaths sets patterns of paths (like `/.cache/**`, see
+// `path.Match`, with `**` matching any number of segments) whose changes
+// are flushed locally but never published on their own: a root only
+// changed in them is not handed to the `PubFunc`, the next root with
+// other changes publishes them too. It applies before the
+// `WithPublishGate` predicate.
+func WithUnpublishedPaths(patterns ...string) RootOption {
+	return func(o *rootOptions) {
+		o.unpublished = append(o.unpublished, patterns...)
+	}
+}
+
+// WithHiddenFunc sets the predicate telling the hidden entries apart,
+// instead of `IsHidden`. The hidden entries are skipped by
+// `Directory.ListEntries` and `Tree` on request.
+func WithHiddenFunc(f HiddenFunc) RootOption {
+	return func(o *rootOptions) {
+		o.hidden = f
+	}
+}
+
+// WithChunker sets the splitter of the data written to the files of the
+// root (like "size-262144" or "rabin-16-32-64", see
+// `chunker.FromString`), instead of `chunker.DefaultSplitter`. Files can
+// override it when opened, see `Flags.Chunker`.
+func WithChunker(spec string) RootOption {
+	return func(o *rootOptions) {
+		o.chunker = spec
+	}
+}
+
+// WithUnsupportedPolicy sets how the root handles the entries of
+// unsupported UnixFS types, `UnsupportedReject` by default.
+func WithUnsupportedPolicy(p UnsupportedPolicy) RootOption {
+	return func(o *rootOptions) {
+		o.unsupported = p
+	}
+}
+
+// WithCidVersion sets the CID version of the nodes created by the root
+// (directories and their HAMT shards, files and the blocks written to
+// them, symlinks), instead of the one of the parent directory (so
+// ultimately of the root node). Existing nodes keep theirs until
+// rewritten, except the root node which is re-encoded on the next
+// flush. Files get raw leaves with CIDv1.
+func WithCidVersion(v uint64) RootOption {
+	return func(o *rootOptions) {
+		o.cidVersion = v
+		o.cidVersionSet = true
+	}
+}
+
+// WithHashFunction sets the multihash function (like `multihash.SHA2_512`,
+// or BLAKE3 once registered) of the nodes created by the root, like
+// `WithCidVersion`. CIDv0 only supports SHA2-256.
+func WithHashFunction(code uint64) RootOption {
+	return func(o *rootOptions) {
+		o.hashFunc = code
+		o.hashFuncSet = true
+	}
+}
+
+// WithPanicRecovery makes the entry points of the root (the operations
+// on paths, and the ones of its directories and file descriptors that
+// load or store nodes) recover from the panics raised under them, e.g.,
+// by a dependency on a malformed DAG, returning a `*PanicError` instead:
+// a single corrupt directory can't crash the whole process. The panics
+// in goroutines started by the dependencies (e.g., prefetching the
+// blocks of a file being read) can't be recovered.
+func WithPanicRecovery() RootOption {
+	return func(o *rootOptions) {
+		o.recoverPanics = true
+	}
+}
+
+// WithRootSigner makes the root sign a `RootRecord` of every value its
+// `PubFunc` published and hand it to 'emit' (a failure of which fails
+// the publish). The sequence numbers follow 'seq', which should be the
+// one of the last record emitted before (they follow the record given to
+// `WithRootRecord` if greater). It doesn't apply to a `WithPublisher` one.
+func WithRootSigner(s Signer, seq uint64, emit RecordFunc) RootOption {
+	return func(o *rootOptions) {
+		o.signer = s
+		o.signerSeq = seq
+		o.recordFunc = emit
+	}
+}
+
+// WithRootRecord makes `NewRoot` authenticate the root node with its
+// record: it fails with `ErrInvalidRootRecord` if the record doesn't
+// verify with 'v' or is of another root.
+func WithRootRecord(rec RootRecord, v Verifier) RootOption {
+	return func(o *rootOptions) {
+		o.rootRecord = &rec
+		o.verifier = v
+	}
+}
+
+// WithPublisher makes the root publish its values with 'p' instead of
+// a `Republisher` built from the `PubFunc` (which must then be nil), so
+// embedders can plug in their own publication engine. The root doesn't
+// start it but closes it in `Root.Close`. The republisher options (like
+// `WithKeepAlive`) don't apply to it.
+func WithPublisher(p Publisher) RootOption {
+	return func(o *rootOptions) {
+		o.publisher = p
+	}
+}
+
+// WithGraftValidation makes the root validate the DAGs grafted into it
+// from outside (by `PutNode` and `SyncFromCid`) before linking them:
+// they must be well-formed UnixFS within the given limits, or the
+// operation fails with `ErrInvalidGraft`. The whole DAG is fetched.
+func WithGraftValidation(limits GraftLimits) RootOption {
+	return func(o *rootOptions) {
+		o.graftLimits = &limits
+	}
+}
+
+// WithMaxFileSize sets the maximum size of the files: writes growing a
+// file past it fail with `ErrFileTooLarge`, as do the uploads and the
+// nodes linked (`PutNode`, `PutDAG`, `ImportCAR`, `File.SetNode`) of
+// larger files, or of directories holding some. The files of the tree
+// the `Root` was created over aren't affected until written to.
+func WithMaxFileSize(size int64) RootOption {
+	return func(o *rootOptions) {
+		o.maxFileSize = size
+	}
+}
+
+// WithMaxDirEntries sets the maximum number of entries of a directory:
+// adding more fails with `ErrTooManyEntries`.
+func WithMaxDirEntries(n int) RootOption {
+	return func(o *rootOptions) {
+		o.maxDirEntries = n
+	}
+}
+
+// WithDescriptorHoldThreshold sets the time a `FileDescriptor` can stay
+// open before `Root.HealthCheck` reports it as stuck.
+func WithDescriptorHoldThreshold(d time.Duration) RootOption {
+	return func(o *rootOptions) {
+		o.descHoldThreshold = d
+	}
+}
+
+// WithShardWidth sets the width of the HAMT shards used when directories
+// get sharded, instead of the go-unixfs global default (directories can
+// override it with `Directory.SetShardWidth`). It must be a power of two
+// and at least 8.
+func WithShardWidth(width int) RootOption {
+	return func(o *rootOptions) {
+		o.shardWidth = width
+	}
+}
+
+// WithOverlay makes the root accumulate its mutations in memory, layered
+// over the given DAG service, until `Root.Commit` copies the reachable
+// new blocks down to it. Abandoned intermediate nodes never reach the
+// DAG service, and only committed values are published.
+func WithOverlay() RootOption {
+	return func(o *rootOptions) {
+		o.overlay = true
+	}
+}
+
+// WithStagingDir sets the path of the directory reserved for staging
+// entries (see `Root.StagingDir`), instead of `DefaultStagingDir`.
+func WithStagingDir(pth string) RootOption {
+	return func(o *rootOptions) {
+		o.stagingDir = pth
+	}
+}
+
+// WithStagingCleanup removes the entries abandoned in the staging
+// directory (see `Root.StagingDir`) when the `Root` is created, like the
+// temporary files of the `WriteFileAtomic` calls interrupted by a crash.
+// The partial uploads are kept, for `ResumeUpload`. The removal changes
+// the tree (published on the next flush), so it's left to the `Root`s
+// writing to it.
+func WithStagingCleanup() RootOption {
+	return func(o *rootOptions) {
+		o.stagingCleanup = true
+	}
+}
+
+// WithModTimePolicy sets which changes update the modification time of
+// the directories, `ModTimeOnChange` by default.
+func WithModTimePolicy(p ModTimePolicy) RootOption {
+	return func(o *rootOptions) {
+		o.modTimePolicy = p
+	}
+}
+
+// WithBulkLoad creates the root in bulk-load mode, to be ended with
+// `Root.EndBulkLoad` once the initial import is done.
+func WithBulkLoad() RootOption {
+	return func(o *rootOptions) {
+		o.bulkLoad = true
+	}
+}
+
+// WithWriteVerification enables a paranoid mode reading back every node
+// right after it's added to the DAG service, to catch corrupted stores
+// or misconfigured services early (writes fail with `ErrVerifyFailed`).
+// It roughly doubles the cost of the writes, see `Root.VerifyStats` for
+// the results.
+func WithWriteVerification() RootOption {
+	return func(o *rootOptions) {
+		o.verifyWrites = true
+	}
+}
+
+// WithPersistHook sets a hook called with every new root once its whole
+// DAG is stored and before it's published (see `PersistHook`).
+func WithPersistHook(hook PersistHook) RootOption {
+	return func(o *rootOptions) {
+		o.persistHook = hook
+	}
+}
+
+// WithOnOrphan sets a function notified of the final node of a loaded
+// file once it has been unlinked from the tree and its last open
+// `FileDescriptor` has been closed.
+func WithOnOrphan(f OrphanFunc) RootOption {
+	return func(o *rootOptions) {
+		o.onOrphan = f
+	}
+}
+
+// WithLock makes the root hold the advisory lock 'key' of the locker
+// while open: `NewRoot` fails with `ErrRootLocked` if another owner holds
+// it, and a root that lost it (see `WithLockTakeover`) no longer
+// publishes. It's released by `Root.Close`.
+func WithLock(l Locker, key string) RootOption {
+	return func(o *rootOptions) {
+		o.locker = l
+		o.lockKey = key
+	}
+}
+
+// WithLockTakeover makes the root take the lock set with `WithLock`
+// even if another owner holds it (e.g., a crashed process).
+func WithLockTakeover() RootOption {
+	return func(o *rootOptions) {
+		o.lockTakeover = true
+	}
+}
+
+// WithListingCache sets the number of directory listings cached by the
+// root (`DefaultListingCacheSize` by default), 0 disables the cache.
+func WithListingCache(size int) RootOption {
+	return func(o *rootOptions) {
+		o.listingCacheSize = size
+		o.listingCacheSet = true
+	}
+}
+
+// WithReverseIndex makes the root keep an index of the paths of its
+// entries by CID, queried with `PathsForCid`.
+func WithReverseIndex() RootOption {
+	return func(o *rootOptions) {
+		o.reverseIndex = true
+	}
+}
+
+// WithEntryCacheLimit bounds the number of entries loaded in the
+// directories of the root, evicting the least recently used ones that are
+// flushed once over it (0, the default, keeps them all loaded until
+// uncached, see `Root.FlushMemFree`). Evicted entries are detached like
+// uncached ones: references to them fail with `ErrDetached`.
+func WithEntryCacheLimit(n int) RootOption {
+	return func(o *rootOptions) {
+		o.entryCacheLimit = n
+	}
+}
+
+// WithEntrySpill makes the entries evicted by `WithEntryCacheLimit` spill
+// their state (their node, and the modification time of the directories)
+// to the local datastore 'd' instead of dropping it: loading them again
+// restores it, without refetching their node from the DAG service. The
+// datastore is scratch space owned by the root, it's emptied by `NewRoot`
+// and `Root.Close`.
+func WithEntrySpill(d ds.Datastore) RootOption {
+	return func(o *rootOptions) {
+		o.entrySpill = d
+	}
+}
+
+// WithTombstones makes the root record the removals (and moves) of its
+// entries in `DefaultTombstoneDir`, see `Tombstones`. The records are
+// written on the next flush.
+func WithTombstones() RootOption {
+	return func(o *rootOptions) {
+		o.tombstones = true
+	}
 }
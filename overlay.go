@@ -0,0 +1,185 @@
+package mfs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// overlayDAG is a DAG service keeping the added nodes in memory, layered
+// over a persistent one which is only used to read the nodes not in
+// memory. Nodes are copied down to the persistent DAG service by `commit`.
+type overlayDAG struct {
+	base ipld.DAGService
+
+	lock sync.RWMutex
+	mem  map[cid.Cid]ipld.Node
+}
+
+var _ ipld.DAGService = (*overlayDAG)(nil)
+
+func newOverlayDAG(base ipld.DAGService) *overlayDAG {
+	return &overlayDAG{
+		base: base,
+		mem:  make(map[cid.Cid]ipld.Node),
+	}
+}
+
+func (o *overlayDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	o.lock.RLock()
+	nd, ok := o.mem[c]
+	o.lock.RUnlock()
+	if ok {
+		return nd, nil
+	}
+	return o.base.Get(ctx, c)
+}
+
+func (o *overlayDAG) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+
+	var missing []cid.Cid
+	o.lock.RLock()
+	for _, c := range cids {
+		if nd, ok := o.mem[c]; ok {
+			out <- &ipld.NodeOption{Node: nd}
+		} else {
+			missing = append(missing, c)
+		}
+	}
+	o.lock.RUnlock()
+
+	if len(missing) == 0 {
+		close(out)
+		return out
+	}
+
+	go func() {
+		defer close(out)
+		for opt := range o.base.GetMany(ctx, missing) {
+			select {
+			case out <- opt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (o *overlayDAG) Add(ctx context.Context, nd ipld.Node) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.mem[nd.Cid()] = nd
+	return nil
+}
+
+func (o *overlayDAG) AddMany(ctx context.Context, nds []ipld.Node) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, nd := range nds {
+		o.mem[nd.Cid()] = nd
+	}
+	return nil
+}
+
+// Remove only drops in-memory nodes, the persistent ones are untouched.
+func (o *overlayDAG) Remove(ctx context.Context, c cid.Cid) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	delete(o.mem, c)
+	return nil
+}
+
+func (o *overlayDAG) RemoveMany(ctx context.Context, cids []cid.Cid) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, c := range cids {
+		delete(o.mem, c)
+	}
+	return nil
+}
+
+// cids returns the CIDs of the nodes in memory.
+func (o *overlayDAG) cids() []cid.Cid {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	cids := make([]cid.Cid, 0, len(o.mem))
+	for c := range o.mem {
+		cids = append(cids, c)
+	}
+	return cids
+}
+
+// commit copies the in-memory nodes reachable from 'c' to the persistent
+// DAG service (children first, so it never holds a node with missing
+// descendants) and drops them from memory. The traversal stops at nodes
+// that aren't in memory, those are persisted along with their DAGs.
+func (o *overlayDAG) commit(ctx context.Context, c cid.Cid) error {
+	o.lock.RLock()
+	nd, ok := o.mem[c]
+	o.lock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	for _, l := range nd.Links() {
+		if err := o.commit(ctx, l.Cid); err != nil {
+			return err
+		}
+	}
+
+	if err := o.base.Add(ctx, nd); err != nil {
+		return err
+	}
+
+	o.lock.Lock()
+	delete(o.mem, c)
+	o.lock.Unlock()
+	return nil
+}
+
+// Commit copies the blocks of the current tree that only exist in memory
+// down to the persistent DAG service of an overlay `Root` (see
+// `WithOverlay`), and publishes the resulting value. The intermediate
+// nodes that aren't reachable from the tree are never persisted: they're
+// dropped from memory, unless descriptors are open (their writes not
+// flushed yet may have stored nodes meanwhile).
+func (kr *Root) Commit(ctx context.Context) (_ cid.Cid, err error) {
+	defer kr.recoverPanic(&err)
+
+	if kr.overlay == nil {
+		return cid.Undef, fmt.Errorf("root is not in overlay mode")
+	}
+
+	// The nodes stored so far are either in the DAG of the tree
+	// committed or in the ones of its earlier versions.
+	stored := kr.overlay.cids()
+	nd, err := kr.GetDirectory().GetNode()
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	if err := kr.overlay.commit(ctx, nd.Cid()); err != nil {
+		return cid.Undef, err
+	}
+
+	kr.descLock.Lock()
+	open := len(kr.openDescs) > 0
+	kr.descLock.Unlock()
+	if !open {
+		if err := kr.overlay.RemoveMany(ctx, stored); err != nil {
+			return cid.Undef, err
+		}
+	}
+
+	kr.persistLock.Lock()
+	defer kr.persistLock.Unlock()
+	if err := kr.rootPersisted(ctx, nd.Cid()); err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
@@ -0,0 +1,44 @@
+package mfs
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+// ErrPanic is wrapped by the `*PanicError`s.
+var ErrPanic = errors.New("internal panic")
+
+// PanicError is returned, with `WithPanicRecovery`, by the operations
+// that panicked (e.g., on a malformed DAG in a dependency) instead of
+// crashing the process.
+type PanicError struct {
+	Value interface{} // passed to `panic`
+	Stack []byte      // of the panicking goroutine
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%s: %v", ErrPanic, e.Value)
+}
+
+func (e *PanicError) Unwrap() error {
+	return ErrPanic
+}
+
+// recoverPanic, deferred by the entry points of the root (which may be
+// nil), turns a panic into a `*PanicError` returned through 'errp' if
+// the root recovers them. The locks taken with `defer` are released by
+// then, but the structures being changed may be left inconsistent: the
+// entry should be looked up again (or the root reloaded).
+func (kr *Root) recoverPanic(errp *error) {
+	if kr == nil || !kr.recoverPanics {
+		return
+	}
+	v := recover()
+	if v == nil {
+		return
+	}
+	pe := &PanicError{Value: v, Stack: debug.Stack()}
+	log.Errorf("recovered from %s\n%s", pe, pe.Stack)
+	*errp = pe
+}
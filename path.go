@@ -0,0 +1,102 @@
+package mfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	gopath "path"
+)
+
+// Path-based API of the `Root`: every call resolves its path again, so
+// callers only hold paths (and `FileDescriptor`s), never `*Directory` or
+// `*File` references that can go stale once their entry is unlinked or
+// moved. Open files can be handled by number as well, see `OpenFd`.
+
+// OpenPath opens the file at 'pth', creating it (empty) if missing with
+// `Flags.Create`.
+func (kr *Root) OpenPath(pth string, flags Flags) (_ FileDescriptor, err error) {
+	defer func() { err = pathError("open", pth, err) }()
+	defer kr.recoverPanic(&err)
+
+	fsn, err := dirLookup(kr.GetDirectory().ctx, kr.GetDirectory(), pth)
+	if flags.Create && errors.Is(err, os.ErrNotExist) {
+		fsn, err = kr.createFile(pth, flags.Exclusive)
+		// Created (or found, if not exclusive) meanwhile.
+		flags.Create, flags.Exclusive = false, false
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, ok := fsn.(*File)
+	if !ok {
+		return nil, ErrIsDirectory
+	}
+	return fi.Open(flags)
+}
+
+// createFile creates the empty file 'pth', or returns the entry created
+// there meanwhile unless 'exclusive'.
+func (kr *Root) createFile(pth string, exclusive bool) (FSNode, error) {
+	pdir, name, err := lookupParent(kr, pth)
+	if err != nil {
+		return nil, err
+	}
+	nd := NewEmptyFileNode(EmptyFileOpts{CidBuilder: pdir.newCidBuilder()})
+	err = pdir.AddChild(name, nd)
+	switch {
+	case errors.Is(err, ErrDirExists) && exclusive:
+		return nil, os.ErrExist
+	case err != nil && !errors.Is(err, ErrDirExists):
+		return nil, err
+	}
+	return pdir.Child(name)
+}
+
+// StatPath describes the entry at 'pth' (its `Name` is the last
+// component of the path, empty for the root).
+func (kr *Root) StatPath(ctx context.Context, pth string) (_ NodeListing, err error) {
+	defer func() { err = pathError("stat", pth, err) }()
+	defer kr.recoverPanic(&err)
+
+	fsn, err := dirLookup(ctx, kr.GetDirectory(), pth)
+	if err != nil {
+		return NodeListing{}, err
+	}
+	nd, err := fsn.GetNode()
+	if err != nil {
+		return NodeListing{}, err
+	}
+	_, name := gopath.Split(gopath.Clean("/" + pth))
+	nl, _, err := policyListing(ctx, kr.GetDirectory().dagService, name, nd, kr.unsupported)
+	return nl, err
+}
+
+// ListPath lists the entries of the directory at 'pth'.
+func (kr *Root) ListPath(ctx context.Context, pth string) (_ []NodeListing, err error) {
+	defer func() { err = pathError("ls", pth, err) }()
+	defer kr.recoverPanic(&err)
+
+	dir, err := lookupDir(kr, pth)
+	if err != nil {
+		return nil, err
+	}
+	return dir.List(ctx)
+}
+
+// WritePath writes 'data' to the file at 'pth', see `WriteFile`.
+func (kr *Root) WritePath(pth string, data io.Reader, opts WriteFileOpts) error {
+	return WriteFile(kr, pth, data, opts)
+}
+
+// RemovePath unlinks the entry at 'pth'.
+func (kr *Root) RemovePath(pth string) (err error) {
+	defer func() { err = pathError("rm", pth, err) }()
+	defer kr.recoverPanic(&err)
+
+	pdir, name, err := lookupParent(kr, pth)
+	if err != nil {
+		return err
+	}
+	return pdir.Unlink(name)
+}
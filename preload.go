@@ -0,0 +1,62 @@
+package mfs
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// Preload loads the entries at 'paths' into the cache, with the entries
+// below them up to 'depth' levels (0 for the entries themselves only, a
+// negative depth for their whole subtree), so that the first operations
+// on them don't pay for fetching the directories along the way. The
+// files below are cached as well, which fetches their root nodes (but not
+// their content). Entries stripped or of unsupported types (see
+// `WithUnsupportedPolicy`) are skipped. Preloaded entries are evicted like
+// the others if the cache is bounded (see `WithEntryCacheLimit`).
+func (kr *Root) Preload(ctx context.Context, paths []string, depth int) (err error) {
+	defer kr.recoverPanic(&err)
+
+	for _, pth := range paths {
+		fsn, err := CtxLookup(ctx, kr, pth)
+		if err != nil {
+			return pathError("preload", pth, err)
+		}
+		dir, ok := fsn.(*Directory)
+		if !ok || depth == 0 {
+			continue
+		}
+		if err := dir.preload(ctx, depth-1); err != nil {
+			return pathError("preload", pth, err)
+		}
+	}
+	return nil
+}
+
+// preload caches the entries of the directory, and the ones of its
+// subdirectories up to 'depth' levels below (all if negative).
+func (d *Directory) preload(ctx context.Context, depth int) error {
+	names, err := d.ListNames(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		child, err := d.CtxChild(ctx, name)
+		switch {
+		case errors.Is(err, os.ErrNotExist), errors.Is(err, ErrUnsupportedType):
+			// Stripped, or removed meanwhile.
+			continue
+		case err != nil:
+			return err
+		}
+		if cdir, ok := child.(*Directory); ok && depth != 0 {
+			if err := cdir.preload(ctx, depth-1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -2,6 +2,9 @@ package mfs
 
 import (
 	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	cid "github.com/ipfs/go-cid"
@@ -13,57 +16,261 @@ import (
 // Deprecated: use github.com/ipfs/boxo/mfs.PubFunc
 type PubFunc func(context.Context, cid.Cid) error
 
+// Publisher publishes the successive values of a `Root`. `Republisher`
+// is the default one, see `WithPublisher` to use another.
+type Publisher interface {
+	// Update sets the new value to publish, it must not block.
+	Update(cid.Cid)
+	// WaitPub waits for the last value set with `Update` to be
+	// published.
+	WaitPub(context.Context) error
+	// Close publishes the pending value (if any) and stops publishing.
+	Close() error
+}
+
+var _ Publisher = (*Republisher)(nil)
+
 // Republisher manages when to publish a given entry.
 //
 // Deprecated: use github.com/ipfs/boxo/mfs.Republisher
 type Republisher struct {
 	TimeoutLong  time.Duration
 	TimeoutShort time.Duration
-	RetryTimeout time.Duration
-	pubfunc      PubFunc
+	// RetryTimeout is the delay before retrying a failed publish. It
+	// doubles on each consecutive failure up to `MaxRetryTimeout`, if
+	// greater, and is reset on success.
+	RetryTimeout    time.Duration
+	MaxRetryTimeout time.Duration
+	// Jitter, if set, adds a random delay up to it to every timer (short,
+	// long, retry and keep-alive), so many republishers started together
+	// don't publish in lockstep.
+	Jitter time.Duration
+	// KeepAlive, if set, republishes the last published value after this
+	// long without a publish, even if it didn't change (so records driven
+	// by the `PubFunc` don't expire while the MFS is idle). It must be set
+	// before calling `Run`.
+	KeepAlive time.Duration
+	// PublishOnStart, if set, makes `Run` publish the initial value right
+	// away instead of waiting for a new one (e.g., to refresh the record
+	// of a root restored from a state store). Like the keep-alive
+	// republishes, it isn't gated. It must be set before calling `Run`.
+	PublishOnStart bool
+	// PublishGate, if set, is consulted before publishing a new value and
+	// can suppress it (e.g., to skip intermediate states) by returning
+	// false. The suppressed value is dropped, a later `Update` with the
+	// same value is evaluated again. It must be set before calling `Run`.
+	PublishGate func(old, new cid.Cid) bool
+	pubfunc     PubFunc
 
-	update           chan cid.Cid
-	immediatePublish chan chan struct{}
+	update           chan pubUpdate
+	immediatePublish chan struct{}
 
 	ctx    context.Context
 	cancel func()
+
+	// Set (atomically) when `Run` returns.
+	stopped int32
+
+	// State reported by `Status`, protected by `statusLock`.
+	statusLock  sync.Mutex
+	published   cid.Cid
+	publishedAt time.Time
+	pending     cid.Cid
+	lastErr     error
+	publishes   uint64
+	failures    uint64
+	retries     uint64
+
+	// Channels returned by `Subscribe`, protected by `subLock`.
+	subLock sync.Mutex
+	subs    map[chan PublishResult]struct{}
+
+	// `WaitPub` callers, protected by `waitLock`. Every `Update` gets a
+	// sequence number, a waiter is released once the value it observed
+	// (or a later one) is settled: published, or dropped because it was
+	// already published or suppressed by the `PublishGate`.
+	waitLock sync.Mutex
+	seq      uint64 // of the last `Update`
+	settled  uint64 // of the last settled value
+	waiters  map[*pubWaiter]struct{}
+	closed   bool // `Run` returned, no waiter will be settled anymore
+}
+
+// pubUpdate is a value passed to `Run` by `Update`.
+type pubUpdate struct {
+	value cid.Cid
+	seq   uint64
+}
+
+// pubWaiter is a `WaitPub` caller waiting for the value with sequence
+// number 'seq' to be settled.
+type pubWaiter struct {
+	seq  uint64
+	done chan error
+}
+
+// RepublisherStatus is returned by `Republisher.Status`.
+type RepublisherStatus struct {
+	Running     bool
+	Published   cid.Cid   // last published value (or the initial one)
+	PublishedAt time.Time // zero if nothing was published yet
+	Pending     cid.Cid   // value waiting to be published, if any
+	LastError   error     // error of the last failed publish attempt, until one succeeds
+
+	// Counters of the publish attempts: successful ones, failed ones,
+	// and the ones retrying a failed publish (whatever their outcome).
+	Publishes uint64
+	Failures  uint64
+	Retries   uint64
+}
+
+// PublishResult is the outcome of an attempt to publish a value,
+// delivered by `Republisher.Subscribe`.
+type PublishResult struct {
+	Cid      cid.Cid
+	Duration time.Duration // of the `PubFunc` call
+	Err      error
+	// Attempt is 1 for the first attempt to publish the value, and
+	// counts the retries after a failure.
+	Attempt int
+}
+
+// RepublisherOption configures a `Republisher` on creation.
+type RepublisherOption func(*Republisher)
+
+// WithRepublishIntervals sets the short and long intervals of the
+// republisher (see `Republisher.Run`), overriding the ones it's created
+// with.
+func WithRepublishIntervals(short, long time.Duration) RepublisherOption {
+	return func(rp *Republisher) {
+		rp.TimeoutShort = short
+		rp.TimeoutLong = long
+	}
+}
+
+// WithRepublishJitter adds a random delay up to 'd' to the timers of the
+// republisher.
+func WithRepublishJitter(d time.Duration) RepublisherOption {
+	return func(rp *Republisher) {
+		rp.Jitter = d
+	}
+}
+
+// WithRepublishBackoff retries failed publishes after 'initial', doubling
+// the delay on each consecutive failure up to 'max', instead of retrying
+// every long interval.
+func WithRepublishBackoff(initial, max time.Duration) RepublisherOption {
+	return func(rp *Republisher) {
+		rp.RetryTimeout = initial
+		rp.MaxRetryTimeout = max
+	}
 }
 
 // NewRepublisher creates a new Republisher object to republish the given root
 // using the given short and long time intervals.
 //
 // Deprecated: use github.com/ipfs/boxo/mfs.NewRepublisher
-func NewRepublisher(ctx context.Context, pf PubFunc, tshort, tlong time.Duration) *Republisher {
+func NewRepublisher(ctx context.Context, pf PubFunc, tshort, tlong time.Duration, opts ...RepublisherOption) *Republisher {
 	ctx, cancel := context.WithCancel(ctx)
-	return &Republisher{
+	rp := &Republisher{
 		TimeoutShort:     tshort,
 		TimeoutLong:      tlong,
 		RetryTimeout:     tlong,
-		update:           make(chan cid.Cid, 1),
+		update:           make(chan pubUpdate, 1),
 		pubfunc:          pf,
-		immediatePublish: make(chan chan struct{}),
+		immediatePublish: make(chan struct{}, 1),
+		waiters:          make(map[*pubWaiter]struct{}),
 		ctx:              ctx,
 		cancel:           cancel,
 	}
+	for _, opt := range opts {
+		opt(rp)
+	}
+	return rp
+}
+
+// jittered returns 'd' plus a random delay up to `Jitter`.
+func (rp *Republisher) jittered(d time.Duration) time.Duration {
+	if rp.Jitter <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(rp.Jitter)))
+}
+
+// nextRetry returns the delay before the retry following one after 'd'.
+func (rp *Republisher) nextRetry(d time.Duration) time.Duration {
+	if rp.MaxRetryTimeout <= d {
+		return d
+	}
+	d *= 2
+	if d > rp.MaxRetryTimeout {
+		d = rp.MaxRetryTimeout
+	}
+	return d
 }
 
 // WaitPub waits for the current value to be published (or returns early
-// if it already has).
+// if it already has), triggering an immediate publish. Any number of
+// callers can wait concurrently, each is released as soon as the value it
+// observed (or a later one) is published, regardless of failed attempts
+// in between. It fails if the republisher is closed first.
 func (rp *Republisher) WaitPub(ctx context.Context) error {
-	wait := make(chan struct{})
+	rp.waitLock.Lock()
+	if rp.seq <= rp.settled {
+		rp.waitLock.Unlock()
+		return nil
+	}
+	if rp.closed {
+		rp.waitLock.Unlock()
+		return rp.ctx.Err()
+	}
+	w := &pubWaiter{seq: rp.seq, done: make(chan error, 1)}
+	rp.waiters[w] = struct{}{}
+	rp.waitLock.Unlock()
+
+	// A single pending request is enough for all the waiters.
 	select {
-	case rp.immediatePublish <- wait:
-	case <-ctx.Done():
-		return ctx.Err()
+	case rp.immediatePublish <- struct{}{}:
+	default:
 	}
+
 	select {
-	case <-wait:
-		return nil
+	case err := <-w.done:
+		return err
 	case <-ctx.Done():
+		rp.waitLock.Lock()
+		delete(rp.waiters, w)
+		rp.waitLock.Unlock()
 		return ctx.Err()
 	}
 }
 
+// settle releases the waiters of the values up to 'seq'.
+func (rp *Republisher) settle(seq uint64) {
+	rp.waitLock.Lock()
+	defer rp.waitLock.Unlock()
+	if seq > rp.settled {
+		rp.settled = seq
+	}
+	for w := range rp.waiters {
+		if w.seq <= rp.settled {
+			w.done <- nil
+			delete(rp.waiters, w)
+		}
+	}
+}
+
+// releaseWaiters fails the remaining waiters once `Run` returns.
+func (rp *Republisher) releaseWaiters() {
+	rp.waitLock.Lock()
+	defer rp.waitLock.Unlock()
+	rp.closed = true
+	for w := range rp.waiters {
+		w.done <- rp.ctx.Err()
+		delete(rp.waiters, w)
+	}
+}
+
 func (rp *Republisher) Close() error {
 	// TODO(steb): Wait for `Run` to stop
 	err := rp.WaitPub(rp.ctx)
@@ -71,19 +278,120 @@ func (rp *Republisher) Close() error {
 	return err
 }
 
+// Status returns the current state of the republisher.
+func (rp *Republisher) Status() RepublisherStatus {
+	rp.statusLock.Lock()
+	defer rp.statusLock.Unlock()
+	return RepublisherStatus{
+		Running:     !rp.hasStopped(),
+		Published:   rp.published,
+		PublishedAt: rp.publishedAt,
+		Pending:     rp.pending,
+		LastError:   rp.lastErr,
+		Publishes:   rp.publishes,
+		Failures:    rp.failures,
+		Retries:     rp.retries,
+	}
+}
+
+// Subscribe returns a channel receiving the outcome of every publish
+// attempt, so operators can tell whether publishing keeps up. Up to
+// 'buffer' results are queued, the ones not received in time are
+// dropped (see the counters of `Status` for exact numbers). The channel
+// is closed by the returned function, or once the republisher stops.
+func (rp *Republisher) Subscribe(buffer int) (<-chan PublishResult, func()) {
+	ch := make(chan PublishResult, buffer)
+	rp.subLock.Lock()
+	defer rp.subLock.Unlock()
+	if rp.hasStopped() {
+		close(ch)
+		return ch, func() {}
+	}
+	if rp.subs == nil {
+		rp.subs = make(map[chan PublishResult]struct{})
+	}
+	rp.subs[ch] = struct{}{}
+	return ch, func() {
+		rp.subLock.Lock()
+		defer rp.subLock.Unlock()
+		if _, ok := rp.subs[ch]; ok {
+			delete(rp.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// sendResult delivers 'res' to the subscribers with room for it.
+func (rp *Republisher) sendResult(res PublishResult) {
+	rp.subLock.Lock()
+	defer rp.subLock.Unlock()
+	for ch := range rp.subs {
+		select {
+		case ch <- res:
+		default:
+		}
+	}
+}
+
+// closeSubs closes the subscribers' channels once `Run` returns.
+func (rp *Republisher) closeSubs() {
+	rp.subLock.Lock()
+	defer rp.subLock.Unlock()
+	atomic.StoreInt32(&rp.stopped, 1)
+	for ch := range rp.subs {
+		close(ch)
+	}
+	rp.subs = nil
+}
+
+func (rp *Republisher) setPending(c cid.Cid) {
+	rp.statusLock.Lock()
+	defer rp.statusLock.Unlock()
+	rp.pending = c
+}
+
+// setPublished records the outcome of an attempt to publish 'c'.
+func (rp *Republisher) setPublished(c cid.Cid, err error, retry bool) {
+	rp.statusLock.Lock()
+	defer rp.statusLock.Unlock()
+	rp.lastErr = err
+	if retry {
+		rp.retries++
+	}
+	if err != nil {
+		rp.failures++
+	} else {
+		rp.publishes++
+		rp.published = c
+		rp.publishedAt = time.Now()
+	}
+}
+
+// hasStopped reports whether the `Run` loop has returned.
+func (rp *Republisher) hasStopped() bool {
+	return atomic.LoadInt32(&rp.stopped) == 1
+}
+
 // Update the current value. The value will be published after a delay but each
 // consecutive call to Update may extend this delay up to TimeoutLong.
 func (rp *Republisher) Update(c cid.Cid) {
+	// Numbering and queuing the value together keeps the values in the
+	// channel in sequence order.
+	rp.waitLock.Lock()
+	defer rp.waitLock.Unlock()
+	rp.seq++
+	u := pubUpdate{value: c, seq: rp.seq}
+
 	select {
 	case <-rp.update:
 		select {
-		case rp.update <- c:
+		case rp.update <- u:
 		default:
 			// Don't try again. If we hit this case, there's a
 			// concurrent publish and we can safely let that
 			// concurrent publish win.
 		}
-	case rp.update <- c:
+	case rp.update <- u:
 	}
 }
 
@@ -102,8 +410,19 @@ func (rp *Republisher) Update(c cid.Cid) {
 // `TimeoutLong`. The `quick` timer allows us to publish sooner if
 // it looks like there are no more updates coming down the pipe.
 //
-// Note: If a publish fails, we retry repeatedly every TimeoutRetry.
+// Note: If a publish fails, we retry repeatedly after `RetryTimeout`,
+// backing off up to `MaxRetryTimeout`.
+//
+// If `KeepAlive` is set, a third timer republishes `lastPublished` when
+// nothing was published for that long.
 func (rp *Republisher) Run(lastPublished cid.Cid) {
+	defer rp.closeSubs()
+	defer rp.releaseWaiters()
+
+	rp.statusLock.Lock()
+	rp.published = lastPublished
+	rp.statusLock.Unlock()
+
 	quick := time.NewTimer(0)
 	if !quick.Stop() {
 		<-quick.C
@@ -113,14 +432,32 @@ func (rp *Republisher) Run(lastPublished cid.Cid) {
 		<-longer.C
 	}
 
+	var startC chan struct{}
+	if rp.PublishOnStart {
+		startC = make(chan struct{})
+		close(startC)
+	}
+
+	var keepAlive *time.Timer
+	var keepAliveC <-chan time.Time
+	if rp.KeepAlive > 0 {
+		keepAlive = time.NewTimer(rp.jittered(rp.KeepAlive))
+		defer keepAlive.Stop()
+		keepAliveC = keepAlive.C
+	}
+
 	var toPublish cid.Cid
+	// Sequence number of the last value received from `Update`.
+	var received uint64
 	for rp.ctx.Err() == nil {
-		var waiter chan struct{}
+		var keepAliveFired bool
 
 		select {
 		case <-rp.ctx.Done():
 			return
-		case newValue := <-rp.update:
+		case u := <-rp.update:
+			newValue := u.value
+			received = u.seq
 			// Skip already published values.
 			if lastPublished.Equals(newValue) {
 				// Break to the end of the switch to cleanup any
@@ -132,19 +469,22 @@ func (rp *Republisher) Run(lastPublished cid.Cid) {
 			// If we aren't already waiting to publish something,
 			// reset the long timeout.
 			if !toPublish.Defined() {
-				longer.Reset(rp.TimeoutLong)
+				longer.Reset(rp.jittered(rp.TimeoutLong))
 			}
 
 			// Always reset the short timeout.
-			quick.Reset(rp.TimeoutShort)
+			quick.Reset(rp.jittered(rp.TimeoutShort))
 
 			// Finally, set the new value to publish.
 			toPublish = newValue
+			rp.setPending(toPublish)
 			continue
-		case waiter = <-rp.immediatePublish:
+		case <-rp.immediatePublish:
 			// Make sure to grab the *latest* value to publish.
 			select {
-			case toPublish = <-rp.update:
+			case u := <-rp.update:
+				toPublish = u.value
+				received = u.seq
 			default:
 			}
 
@@ -154,6 +494,18 @@ func (rp *Republisher) Run(lastPublished cid.Cid) {
 			}
 		case <-quick.C:
 		case <-longer.C:
+		case <-startC:
+			startC = nil
+			// Publish the initial value unless a new one is pending.
+			if !toPublish.Defined() {
+				toPublish = lastPublished
+			}
+		case <-keepAliveC:
+			keepAliveFired = true
+			// Republish the current value unless a new one is pending.
+			if !toPublish.Defined() {
+				toPublish = lastPublished
+			}
 		}
 
 		// Cleanup, publish, and close waiters.
@@ -173,10 +525,25 @@ func (rp *Republisher) Run(lastPublished cid.Cid) {
 		default:
 		}
 
-		// 2. If we have a value to publish, publish it now.
-		if toPublish.Defined() {
-			for {
+		// 2. If we have a value to publish, publish it now (unless the
+		//    gate suppresses it, keep-alive republishing isn't gated).
+		if toPublish.Defined() && rp.PublishGate != nil &&
+			!lastPublished.Equals(toPublish) && !rp.PublishGate(lastPublished, toPublish) {
+			toPublish = cid.Undef
+		}
+		published := toPublish.Defined()
+		if published {
+			retry := rp.RetryTimeout
+			for attempt := 1; ; attempt++ {
+				start := time.Now()
 				err := rp.pubfunc(rp.ctx, toPublish)
+				rp.setPublished(toPublish, err, attempt > 1)
+				rp.sendResult(PublishResult{
+					Cid:      toPublish,
+					Duration: time.Since(start),
+					Err:      err,
+					Attempt:  attempt,
+				})
 				if err == nil {
 					break
 				}
@@ -186,18 +553,30 @@ func (rp *Republisher) Run(lastPublished cid.Cid) {
 				// complicates this code a bit). We'll pull off
 				// a new value on the next loop through.
 				select {
-				case <-time.After(rp.RetryTimeout):
+				case <-time.After(rp.jittered(retry)):
 				case <-rp.ctx.Done():
 					return
 				}
+				retry = rp.nextRetry(retry)
 			}
 			lastPublished = toPublish
 			toPublish = cid.Undef
 		}
+		rp.setPending(toPublish)
 
-		// 3. Trigger anything waiting in `WaitPub`.
-		if waiter != nil {
-			close(waiter)
+		// Restart the keep-alive period after any publish.
+		if keepAlive != nil && (published || keepAliveFired) {
+			if !keepAlive.Stop() {
+				select {
+				case <-keepAlive.C:
+				default:
+				}
+			}
+			keepAlive.Reset(rp.jittered(rp.KeepAlive))
 		}
+
+		// 3. Nothing is pending anymore, everything received is settled:
+		//    release the matching `WaitPub` callers.
+		rp.settle(received)
 	}
 }
@@ -2,6 +2,8 @@ package mfs
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"testing"
 	"time"
 
@@ -73,3 +75,346 @@ func TestRepublisher(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestRepublisherKeepAlive(t *testing.T) {
+	if ci.IsRunning() {
+		t.Skip("dont run timing tests in CI")
+	}
+
+	ctx := context.TODO()
+
+	pub := make(chan cid.Cid)
+
+	pf := func(ctx context.Context, c cid.Cid) error {
+		pub <- c
+		return nil
+	}
+
+	testCid1, _ := cid.Parse("QmeomffUNfmQy76CQGy9NdmqEnnHU9soCexBnGU3ezPHVH")
+
+	keepAlive := time.Millisecond * 100
+
+	rp := NewRepublisher(ctx, pf, time.Millisecond*10, time.Second)
+	rp.KeepAlive = keepAlive
+	go rp.Run(testCid1)
+
+	// The unchanged value should be republished every keep-alive period.
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-pub:
+			if !c.Equals(testCid1) {
+				t.Fatalf("republished unexpected value %s", c)
+			}
+		case <-time.After(keepAlive * 2):
+			t.Fatal("keep-alive publish didnt happen in time")
+		}
+	}
+
+	go func() {
+		for range pub {
+		}
+	}()
+
+	err := rp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepublisherPublishOnStart(t *testing.T) {
+	ctx := context.TODO()
+
+	pub := make(chan cid.Cid)
+
+	pf := func(ctx context.Context, c cid.Cid) error {
+		pub <- c
+		return nil
+	}
+
+	testCid1, _ := cid.Parse("QmeomffUNfmQy76CQGy9NdmqEnnHU9soCexBnGU3ezPHVH")
+
+	rp := NewRepublisher(ctx, pf, time.Second, time.Second*10)
+	rp.PublishOnStart = true
+	rp.PublishGate = func(old, new cid.Cid) bool {
+		return false
+	}
+	go rp.Run(testCid1)
+
+	// The initial value should be published right away, ungated.
+	select {
+	case c := <-pub:
+		if !c.Equals(testCid1) {
+			t.Fatalf("published unexpected value %s", c)
+		}
+	case <-time.After(time.Millisecond * 500):
+		t.Fatal("initial publish didnt happen in time")
+	}
+
+	go func() {
+		for range pub {
+		}
+	}()
+
+	err := rp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepublisherBackoff(t *testing.T) {
+	ctx := context.TODO()
+
+	var lock sync.Mutex
+	var attempts []time.Time
+	pub := make(chan struct{})
+	pf := func(ctx context.Context, c cid.Cid) error {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts = append(attempts, time.Now())
+		if len(attempts) < 4 {
+			return errors.New("publish failed")
+		}
+		close(pub)
+		return nil
+	}
+
+	rp := NewRepublisher(ctx, pf, time.Hour, time.Hour,
+		WithRepublishIntervals(time.Millisecond, time.Second),
+		WithRepublishBackoff(time.Millisecond*10, time.Millisecond*40),
+		WithRepublishJitter(time.Millisecond),
+	)
+	if rp.TimeoutShort != time.Millisecond || rp.TimeoutLong != time.Second {
+		t.Fatal("intervals option not applied")
+	}
+
+	// The retry delay doubles up to the maximum.
+	want := []time.Duration{20, 40, 40}
+	d := rp.RetryTimeout
+	for _, w := range want {
+		d = rp.nextRetry(d)
+		if d != w*time.Millisecond {
+			t.Fatalf("expected a retry delay of %dms, got %s", w, d)
+		}
+	}
+	if d := rp.jittered(time.Second); d < time.Second || d >= time.Second+time.Millisecond {
+		t.Fatalf("jittered delay out of range: %s", d)
+	}
+
+	go rp.Run(cid.Undef)
+	testCid, _ := cid.Parse("QmeomffUNfmQy76CQGy9NdmqEnnHU9soCexBnGU3ezPHVH")
+	rp.Update(testCid)
+
+	select {
+	case <-pub:
+	case <-time.After(time.Second * 5):
+		t.Fatal("publish was not retried")
+	}
+	if err := rp.WaitPub(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := rp.Status().LastError; err != nil {
+		t.Fatal(err)
+	}
+
+	if !ci.IsRunning() {
+		lock.Lock()
+		// 10ms, 20ms then 40ms between the attempts.
+		if total := attempts[3].Sub(attempts[0]); total < time.Millisecond*70 {
+			t.Fatalf("retries didnt back off: %s", total)
+		}
+		lock.Unlock()
+	}
+
+	if err := rp.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepublisherSubscribe(t *testing.T) {
+	ctx := context.TODO()
+
+	pubErr := errors.New("publish failed")
+	var calls int
+	pf := func(ctx context.Context, c cid.Cid) error {
+		calls++
+		if calls == 1 {
+			return pubErr
+		}
+		return nil
+	}
+
+	rp := NewRepublisher(ctx, pf, time.Millisecond, time.Millisecond,
+		WithRepublishBackoff(time.Millisecond, time.Millisecond))
+	results, _ := rp.Subscribe(4)
+	_, cancelSub := rp.Subscribe(0)
+	cancelSub()
+	cancelSub()
+	go rp.Run(cid.Undef)
+
+	testCid, _ := cid.Parse("QmeomffUNfmQy76CQGy9NdmqEnnHU9soCexBnGU3ezPHVH")
+	rp.Update(testCid)
+	if err := rp.WaitPub(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []error{pubErr, nil} {
+		res := <-results
+		if !res.Cid.Equals(testCid) || res.Attempt != i+1 || !errors.Is(res.Err, want) {
+			t.Fatalf("unexpected result %+v", res)
+		}
+	}
+	status := rp.Status()
+	if status.Publishes != 1 || status.Failures != 1 || status.Retries != 1 {
+		t.Fatalf("unexpected counters %+v", status)
+	}
+	if !status.Published.Equals(testCid) || status.PublishedAt.IsZero() {
+		t.Fatalf("unexpected last publish %+v", status)
+	}
+
+	if err := rp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-results:
+		if ok {
+			t.Fatal("unexpected result after close")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("results not closed with the republisher")
+	}
+}
+
+func TestRepublisherPublishGate(t *testing.T) {
+	ctx := context.TODO()
+
+	var published []cid.Cid
+	pf := func(ctx context.Context, c cid.Cid) error {
+		published = append(published, c)
+		return nil
+	}
+
+	testCid1, _ := cid.Parse("QmeomffUNfmQy76CQGy9NdmqEnnHU9soCexBnGU3ezPHVH")
+	testCid2, _ := cid.Parse("QmeomffUNfmQy76CQGy9NdmqEnnHU9soCexBnGU3ezPHVX")
+
+	rp := NewRepublisher(ctx, pf, time.Hour, time.Hour)
+	rp.PublishGate = func(old, new cid.Cid) bool {
+		return new.Equals(testCid2)
+	}
+	go rp.Run(cid.Undef)
+
+	rp.Update(testCid1)
+	if err := rp.WaitPub(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 0 {
+		t.Fatal("gated value shouldnt have been published")
+	}
+
+	rp.Update(testCid2)
+	if err := rp.WaitPub(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 1 || !published[0].Equals(testCid2) {
+		t.Fatalf("expected only %s to be published, got %v", testCid2, published)
+	}
+
+	err := rp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepublisherConcurrentWaiters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var lk sync.Mutex
+	var published []cid.Cid
+	failing := true
+	pf := func(ctx context.Context, c cid.Cid) error {
+		lk.Lock()
+		defer lk.Unlock()
+		if failing {
+			return errors.New("publish failed")
+		}
+		published = append(published, c)
+		return nil
+	}
+	setFailing := func(f bool) {
+		lk.Lock()
+		failing = f
+		lk.Unlock()
+	}
+
+	testCid1, _ := cid.Parse("QmeomffUNfmQy76CQGy9NdmqEnnHU9soCexBnGU3ezPHVH")
+	testCid2, _ := cid.Parse("QmeomffUNfmQy76CQGy9NdmqEnnHU9soCexBnGU3ezPHVX")
+
+	rp := NewRepublisher(ctx, pf, time.Hour, time.Hour)
+	rp.RetryTimeout = time.Millisecond
+	go rp.Run(cid.Undef)
+
+	rp.Update(testCid1)
+
+	const waiters = 20
+	results := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() {
+			results <- rp.WaitPub(ctx)
+		}()
+	}
+
+	// Waiters giving up don't affect the others.
+	cctx, ccancel := context.WithCancel(ctx)
+	canceled := make(chan error, 5)
+	for i := 0; i < cap(canceled); i++ {
+		go func() {
+			canceled <- rp.WaitPub(cctx)
+		}()
+	}
+	ccancel()
+	for i := 0; i < cap(canceled); i++ {
+		if err := <-canceled; !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected the canceled waiter to fail, got %v", err)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case err := <-results:
+		t.Fatalf("waiter released while publishing fails: %v", err)
+	default:
+	}
+
+	setFailing(false)
+	for i := 0; i < waiters; i++ {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+	lk.Lock()
+	if len(published) != 1 || !published[0].Equals(testCid1) {
+		t.Fatalf("expected only %s to be published, got %v", testCid1, published)
+	}
+	lk.Unlock()
+
+	// Nothing new to publish.
+	if err := rp.WaitPub(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Waiters are failed, not left hanging, when the republisher stops.
+	setFailing(true)
+	rp.Update(testCid2)
+	for i := 0; i < waiters; i++ {
+		go func() {
+			results <- rp.WaitPub(context.Background())
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	for i := 0; i < waiters; i++ {
+		if err := <-results; !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected the waiter to fail, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package mfs
+
+import (
+	"container/list"
+	"errors"
+	"os"
+	gopath "path"
+	"sync"
+)
+
+// DefaultResolverCacheSize is the number of paths cached by a `Resolver`
+// when `ResolverOpts.MaxEntries` isn't set.
+const DefaultResolverCacheSize = 1024
+
+// ResolverOpts is used by NewResolver
+type ResolverOpts struct {
+	// MaxEntries bounds the number of cached paths, the least recently
+	// used ones are evicted first.
+	MaxEntries int
+	// CacheMisses enables caching of paths that don't exist.
+	CacheMisses bool
+}
+
+// Resolver performs path lookups on a `Root` caching their results
+// (and optionally the misses) across calls, meant for read-heavy
+// workloads like gateways. Its cache is independent of the directories'
+// `entriesCache` and is dropped whenever the structure of the tree
+// changes (entries added, removed or uncached).
+type Resolver struct {
+	root *Root
+	opts ResolverOpts
+
+	lock sync.Mutex
+	// Root generation the cached entries correspond to.
+	generation uint64
+	entries    map[string]*list.Element
+	lru        *list.List
+}
+
+type resolverEntry struct {
+	path string
+	// nil for cached misses.
+	node FSNode
+}
+
+// NewResolver creates a new Resolver for the given root.
+func NewResolver(root *Root, opts ResolverOpts) *Resolver {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = DefaultResolverCacheSize
+	}
+	return &Resolver{
+		root:       root,
+		opts:       opts,
+		generation: root.generation(),
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Lookup behaves like the package level `Lookup` but serves repeated
+// queries for the same path from the cache.
+func (r *Resolver) Lookup(pth string) (FSNode, error) {
+	pth = gopath.Clean("/" + pth)
+	gen := r.root.generation()
+
+	r.lock.Lock()
+	if gen != r.generation {
+		r.resetUnsync(gen)
+	}
+	if e, ok := r.entries[pth]; ok {
+		r.lru.MoveToFront(e)
+		nd := e.Value.(*resolverEntry).node
+		r.lock.Unlock()
+
+		if nd == nil {
+			return nil, pathError("lookup", pth, os.ErrNotExist)
+		}
+		return nd, nil
+	}
+	r.lock.Unlock()
+
+	nd, err := Lookup(r.root, pth)
+	if err != nil && (!errors.Is(err, os.ErrNotExist) || !r.opts.CacheMisses) {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// Don't cache results of a lookup that raced with a change.
+	if r.generation == gen && r.root.generation() == gen {
+		r.addUnsync(pth, nd)
+	}
+	return nd, err
+}
+
+// Invalidate drops all the cached entries.
+func (r *Resolver) Invalidate() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.resetUnsync(r.root.generation())
+}
+
+func (r *Resolver) resetUnsync(gen uint64) {
+	r.generation = gen
+	r.entries = make(map[string]*list.Element)
+	r.lru.Init()
+}
+
+func (r *Resolver) addUnsync(pth string, nd FSNode) {
+	if _, ok := r.entries[pth]; ok {
+		return
+	}
+	r.entries[pth] = r.lru.PushFront(&resolverEntry{path: pth, node: nd})
+
+	for r.lru.Len() > r.opts.MaxEntries {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*resolverEntry).path)
+	}
+}
@@ -0,0 +1,172 @@
+package mfs
+
+import (
+	"context"
+	"errors"
+	gopath "path"
+	"sort"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// ErrNoReverseIndex is returned by `PathsForCid` on a root created
+// without `WithReverseIndex`.
+var ErrNoReverseIndex = errors.New("reverse index not enabled")
+
+// reverseIndex maps the CIDs of the entries of the tree to their paths.
+// It reflects the tree as of `root`, and is brought up to date with the
+// changes made since by diffing the two trees: the subtrees that didn't
+// change aren't visited.
+type reverseIndex struct {
+	lock sync.Mutex
+	root cid.Cid
+	// Paths by multihash, so a CID matches the entries of any version.
+	paths map[string]map[string]struct{}
+}
+
+func (ri *reverseIndex) add(c cid.Cid, pth string) {
+	key := string(c.Hash())
+	set, ok := ri.paths[key]
+	if !ok {
+		set = make(map[string]struct{})
+		ri.paths[key] = set
+	}
+	set[pth] = struct{}{}
+}
+
+func (ri *reverseIndex) remove(c cid.Cid, pth string) {
+	key := string(c.Hash())
+	delete(ri.paths[key], pth)
+	if len(ri.paths[key]) == 0 {
+		delete(ri.paths, key)
+	}
+}
+
+// update brings the index to the tree 'root'. If it fails the index is
+// dropped, to be rebuilt on next update.
+func (ri *reverseIndex) update(ctx context.Context, dserv ipld.DAGService, root cid.Cid) error {
+	if ri.root.Defined() && ri.root.Equals(root) {
+		return nil
+	}
+
+	var err error
+	if ri.root.Defined() {
+		err = ri.diff(ctx, dserv, ri.root, root, "/")
+	} else {
+		ri.paths = make(map[string]map[string]struct{})
+		err = ri.walk(ctx, dserv, root, "/", ri.add)
+	}
+	if err != nil {
+		ri.root = cid.Undef
+		ri.paths = nil
+		return err
+	}
+	ri.root = root
+	return nil
+}
+
+// walk calls 'f' for the entry 'c' at 'pth' and everything below it.
+func (ri *reverseIndex) walk(ctx context.Context, dserv ipld.DAGService, c cid.Cid, pth string, f func(cid.Cid, string)) error {
+	f(c, pth)
+
+	nt, err := linkType(ctx, dserv, c)
+	if err != nil || nt != TDir {
+		return err
+	}
+	links, err := entryLinks(ctx, dserv, c)
+	if err != nil {
+		return err
+	}
+	for name, lc := range links {
+		if err := ri.walk(ctx, dserv, lc, gopath.Join(pth, name), f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diff replaces the entry 'oc' at 'pth' with 'nc'.
+func (ri *reverseIndex) diff(ctx context.Context, dserv ipld.DAGService, oc, nc cid.Cid, pth string) error {
+	if oc.Equals(nc) {
+		return nil
+	}
+
+	oldType, err := linkType(ctx, dserv, oc)
+	if err != nil {
+		return err
+	}
+	newType, err := linkType(ctx, dserv, nc)
+	if err != nil {
+		return err
+	}
+	if oldType != TDir || newType != TDir {
+		if err := ri.walk(ctx, dserv, oc, pth, ri.remove); err != nil {
+			return err
+		}
+		return ri.walk(ctx, dserv, nc, pth, ri.add)
+	}
+
+	ri.remove(oc, pth)
+	ri.add(nc, pth)
+
+	oldLinks, err := entryLinks(ctx, dserv, oc)
+	if err != nil {
+		return err
+	}
+	newLinks, err := entryLinks(ctx, dserv, nc)
+	if err != nil {
+		return err
+	}
+	for name, olc := range oldLinks {
+		if _, ok := newLinks[name]; !ok {
+			if err := ri.walk(ctx, dserv, olc, gopath.Join(pth, name), ri.remove); err != nil {
+				return err
+			}
+		}
+	}
+	for name, nlc := range newLinks {
+		epth := gopath.Join(pth, name)
+		olc, ok := oldLinks[name]
+		if !ok {
+			err = ri.walk(ctx, dserv, nlc, epth, ri.add)
+		} else {
+			err = ri.diff(ctx, dserv, olc, nlc, epth)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PathsForCid returns the paths of the entries of the tree (files and
+// directories) with the CID 'c', in any CID version, sorted. Blocks
+// inside the DAG of a file aren't indexed. The root must have been
+// created `WithReverseIndex`: the tree is flushed and the index updated
+// with the subtrees changed since the last call.
+func PathsForCid(ctx context.Context, r *Root, c cid.Cid) ([]string, error) {
+	ri := r.revIndex
+	if ri == nil {
+		return nil, ErrNoReverseIndex
+	}
+	nd, err := r.GetDirectory().GetNode()
+	if err != nil {
+		return nil, err
+	}
+
+	ri.lock.Lock()
+	defer ri.lock.Unlock()
+
+	if err := ri.update(ctx, r.GetDirectory().dagService, nd.Cid()); err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for pth := range ri.paths[string(c.Hash())] {
+		paths = append(paths, pth)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
@@ -7,11 +7,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	gopath "path"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	dag "github.com/ipfs/go-merkledag"
 	ft "github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
 
+	cid "github.com/ipfs/go-cid"
 	ipld "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log"
 )
@@ -98,34 +103,283 @@ func IsFile(fsn FSNode) bool {
 	return fsn.Type() == TFile
 }
 
+// OrphanFunc is called with the DAG node of a file that is no longer
+// referenced by the MFS tree, so the embedder can account for (or
+// release) the space it uses. It must not call back into the MFS.
+type OrphanFunc func(ipld.Node)
+
 // Root represents the root of a filesystem tree.
 //
 // Deprecated: use github.com/ipfs/boxo/mfs.Root
 type Root struct {
+	// Counter of structural changes in the tree (entries added, removed
+	// or uncached), used to invalidate caches built on top of it. Kept
+	// first for 64-bit alignment, only accessed atomically.
+	changes uint64
 
 	// Root directory of the MFS layout.
 	dir *Directory
 
-	repub *Republisher
+	repub Publisher
+
+	// Notified of the orphaned files, see `WithOnOrphan`.
+	onOrphan OrphanFunc
+
+	// Registered `Watcher`s of the tree mutations.
+	watchers watchers
+
+	// Background goroutines, stopped by `Close`.
+	life *lifecycle
+
+	// Open `FileDescriptor`s and the time they were opened, checked
+	// against `descHoldThreshold` by `HealthCheck`.
+	descLock          sync.Mutex
+	openDescs         map[*fileDescriptor]time.Time
+	descHoldThreshold time.Duration
+
+	// Descriptors opened by number (see `OpenFd`).
+	fds fdTable
+
+	// Width of the HAMT shards inherited by the directories.
+	shardWidth int
+
+	// In-memory layer over the DAG service in overlay mode (nil otherwise),
+	// only committed values are published.
+	overlay *overlayDAG
+
+	// Progress of the `WriteFile`s by idempotency key, `writesOrder`
+	// keeps the keys in creation order to forget the oldest ones.
+	writesLock  sync.Mutex
+	writes      map[string]*writeRecord
+	writesOrder []string
+
+	// Path of the staging directory (see `StagingDir`).
+	stagingPath string
+
+	// Changes updating the directories' modification time.
+	modTimePolicy ModTimePolicy
+
+	// Ongoing write sessions (see `StartUpload`).
+	uploadsLock sync.Mutex
+	uploads     map[SessionID]*upload
+
+	// Set (atomically) in bulk-load mode, see `StartBulkLoad`.
+	bulkLoad int32
+
+	// Read-after-write checker of the DAG service (nil if disabled).
+	verifier *verifyingDAG
+
+	// Progress of the flushes and last persisted root (see
+	// `FlushState`), `persistLock` serializes their second phase.
+	persistLock sync.Mutex
+	flushLock   sync.Mutex
+	flushState  FlushState
+	persisted   cid.Cid
+	persistHook PersistHook
+
+	// Advisory lock held while open (nil if not requested).
+	lock *rootLock
+
+	// Limits of the grafted DAGs (nil if not validated).
+	graftLimits *GraftLimits
+
+	// Hard limits inherited by the directories.
+	limits limits
+
+	// Listings of the directory nodes (nil if disabled).
+	listings *listingCache
+
+	// Statistics of the directory nodes (see `TreeStats`).
+	treeStats treeStatsCache
+
+	// Paths of the entries by CID (nil if disabled).
+	revIndex *reverseIndex
+
+	// Loaded entries, bounded (nil if unbounded).
+	entries *entryCache
+
+	// Removals to record (nil if disabled, see `WithTombstones`).
+	tombstones *tombstones
+
+	// Predicate of the hidden entries (nil for `IsHidden`).
+	hidden HiddenFunc
+
+	// Splitter spec of the files (empty for the default one).
+	chunker string
+
+	// Whether the panics of the entry points are recovered.
+	recoverPanics bool
+
+	// CID prefix of the new nodes (nil to inherit the parent's).
+	cidPrefix *cid.Prefix
+
+	// Handling of the entries of unsupported UnixFS types.
+	unsupported UnsupportedPolicy
+
+	// State of the evicted entries, nil if dropped.
+	spill *entrySpill
 }
 
 // NewRoot creates a new Root and starts up a republisher routine for it.
 //
 // Deprecated: use github.com/ipfs/boxo/mfs.NewRoot
-func NewRoot(parent context.Context, ds ipld.DAGService, node *dag.ProtoNode, pf PubFunc) (*Root, error) {
+func NewRoot(parent context.Context, ds ipld.DAGService, node *dag.ProtoNode, pf PubFunc, opts ...RootOption) (_ *Root, _retErr error) {
+	var o rootOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.shardWidth != 0 {
+		if err := validShardWidth(o.shardWidth); err != nil {
+			return nil, err
+		}
+	}
+	stagingPath := DefaultStagingDir
+	if o.stagingDir != "" {
+		stagingPath = gopath.Clean("/" + o.stagingDir)
+	}
+	if stagingPath == "/" {
+		return nil, fmt.Errorf("the staging directory can't be the root")
+	}
+	rules, err := newPathRules(o.unpublished)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := splitterGen(o.chunker); err != nil {
+		return nil, err
+	}
+	cidPrefix, err := rootCidPrefix(&o, node.Cid())
+	if err != nil {
+		return nil, err
+	}
+	if o.publisher != nil && pf != nil {
+		return nil, fmt.Errorf("both a PubFunc and a Publisher were given")
+	}
+	if o.rootRecord != nil {
+		if err := o.rootRecord.Verify(o.verifier); err != nil {
+			return nil, err
+		}
+		if !o.rootRecord.Root.Equals(node.Cid()) {
+			return nil, fmt.Errorf("%w: record of %s, not of the root %s", ErrInvalidRootRecord, o.rootRecord.Root, node.Cid())
+		}
+	}
+	if o.signer != nil {
+		if pf == nil {
+			return nil, fmt.Errorf("a root signer needs a PubFunc")
+		}
+		rs := &recordSigner{signer: o.signer, emit: o.recordFunc}
+		rs.last.Seq = o.signerSeq
+		if o.rootRecord != nil && o.rootRecord.Seq > rs.last.Seq {
+			rs.last.Seq = o.rootRecord.Seq
+		}
+		pf = rs.pubFunc(pf)
+	}
+
+	var lock *rootLock
+	if o.locker != nil {
+		owner, err := newOwnerID()
+		if err != nil {
+			return nil, err
+		}
+		err = o.locker.Acquire(parent, o.lockKey, owner, o.lockTakeover)
+		if err != nil {
+			return nil, err
+		}
+		lock = &rootLock{locker: o.locker, key: o.lockKey, owner: owner}
+		defer func() {
+			if _retErr != nil {
+				_ = o.locker.Release(parent, o.lockKey, owner)
+			}
+		}()
+	}
+
+	var verifier *verifyingDAG
+	if o.verifyWrites {
+		verifier = newVerifyingDAG(ds)
+		ds = verifier
+	}
 
-	var repub *Republisher
+	var overlay *overlayDAG
+	if o.overlay {
+		overlay = newOverlayDAG(ds)
+		ds = overlay
+	}
+
+	var spill *entrySpill
+	if o.entrySpill != nil {
+		spill, err = newEntrySpill(parent, o.entrySpill)
+		if err != nil {
+			return nil, err
+		}
+		ds = &spillDAG{DAGService: ds, spill: spill}
+	}
+
+	life := newLifecycle(parent, o.recoverPanics)
+	defer func() {
+		if _retErr != nil {
+			life.stop()
+		}
+	}()
+
+	repub := o.publisher
 	if pf != nil {
-		repub = NewRepublisher(parent, pf, time.Millisecond*300, time.Second*3)
+		rp := NewRepublisher(life.ctx, pf, time.Millisecond*300, time.Second*3, o.repubOpts...)
+		rp.KeepAlive = o.keepAlive
+		rp.PublishOnStart = o.publishOnStart
+		rp.PublishGate = o.publishGate
+		if len(rules) > 0 {
+			rp.PublishGate = rules.publishGate(parent, ds, o.publishGate)
+		}
 
 		// No need to take the lock here since we just created
 		// the `Republisher` and no one has access to it yet.
 
-		go repub.Run(node.Cid())
+		life.Go("republisher", func(context.Context) error {
+			rp.Run(node.Cid())
+			return nil
+		})
+		repub = rp
 	}
 
 	root := &Root{
-		repub: repub,
+		repub:             repub,
+		life:              life,
+		descHoldThreshold: o.descHoldThreshold,
+		shardWidth:        o.shardWidth,
+		overlay:           overlay,
+		verifier:          verifier,
+		persisted:         node.Cid(),
+		flushState:        FlushState{Root: node.Cid()},
+		persistHook:       o.persistHook,
+		onOrphan:          o.onOrphan,
+		lock:              lock,
+		graftLimits:       o.graftLimits,
+		limits:            limits{maxFileSize: o.maxFileSize, maxDirEntries: o.maxDirEntries},
+		stagingPath:       stagingPath,
+		modTimePolicy:     o.modTimePolicy,
+		hidden:            o.hidden,
+		chunker:           o.chunker,
+		recoverPanics:     o.recoverPanics,
+		cidPrefix:         cidPrefix,
+		unsupported:       o.unsupported,
+		spill:             spill,
+	}
+	switch {
+	case !o.listingCacheSet:
+		root.listings = newListingCache(DefaultListingCacheSize)
+	case o.listingCacheSize > 0:
+		root.listings = newListingCache(o.listingCacheSize)
+	}
+	if o.reverseIndex {
+		root.revIndex = &reverseIndex{}
+	}
+	if o.tombstones {
+		root.tombstones = &tombstones{}
+	}
+	if o.entryCacheLimit > 0 {
+		root.entries = newEntryCache(o.entryCacheLimit, life)
+	}
+	if o.bulkLoad {
+		root.bulkLoad = 1
 	}
 
 	fsn, err := ft.FSNodeFromBytes(node.Data())
@@ -142,6 +396,9 @@ func NewRoot(parent context.Context, ds ipld.DAGService, node *dag.ProtoNode, pf
 			return nil, err
 		}
 
+		if cidPrefix != nil {
+			newDir.SetCidBuilder(*cidPrefix)
+		}
 		root.dir = newDir
 	case ft.TFile, ft.TMetadata, ft.TRaw:
 		return nil, fmt.Errorf("root can't be a file (unixfs type: %s)", fsn.Type())
@@ -150,39 +407,118 @@ func NewRoot(parent context.Context, ds ipld.DAGService, node *dag.ProtoNode, pf
 	default:
 		return nil, fmt.Errorf("unrecognized unixfs type: %s", fsn.Type())
 	}
+
+	if o.stagingCleanup {
+		if err := root.cleanStaging(parent); err != nil {
+			return nil, err
+		}
+	}
 	return root, nil
 }
 
+// NewRootFromCid is `NewRoot` over the directory 'c' (basic or HAMT
+// sharded), fetched from 'ds'. It fails with `ErrNotDir` if 'c' isn't a
+// UnixFS directory.
+func NewRootFromCid(parent context.Context, ds ipld.DAGService, c cid.Cid, pf PubFunc, opts ...RootOption) (*Root, error) {
+	nd, err := ds.Get(parent, c)
+	if err != nil {
+		return nil, err
+	}
+	switch err := checkDirNode(nd); {
+	case errors.Is(err, uio.ErrNotADir):
+		return nil, fmt.Errorf("%s: %w", c, ErrNotDir)
+	case err != nil:
+		return nil, fmt.Errorf("%s: %w", c, err)
+	}
+	return NewRoot(parent, ds, nd.(*dag.ProtoNode), pf, opts...)
+}
+
+// rootOf walks up the parents chain until reaching the `Root`
+// (nil if the chain isn't rooted).
+func rootOf(p parent) *Root {
+	for {
+		switch v := p.(type) {
+		case *Root:
+			return v
+		case *Directory:
+			p = v.parent
+		default:
+			return nil
+		}
+	}
+}
+
+// changed records a structural change in the tree.
+func (kr *Root) changed() {
+	atomic.AddUint64(&kr.changes, 1)
+}
+
+// generation returns the number of structural changes made so far.
+func (kr *Root) generation() uint64 {
+	return atomic.LoadUint64(&kr.changes)
+}
+
 // GetDirectory returns the root directory.
 func (kr *Root) GetDirectory() *Directory {
 	return kr.dir
 }
 
 // Flush signals that an update has occurred since the last publish,
-// and updates the Root republisher.
+// and updates the Root republisher (see `FlushState` for the phases).
 // TODO: We are definitely abusing the "flush" terminology here.
 func (kr *Root) Flush() error {
+	_, err := kr.FlushAndGetCid()
+	return err
+}
+
+// FlushAndGetCid is `Flush` returning the CID of the flushed root, the
+// one to pin or record (in overlay mode, the one `Commit` would persist).
+func (kr *Root) FlushAndGetCid() (cid.Cid, error) {
+	if err := kr.writeTombstones(context.TODO()); err != nil {
+		return cid.Undef, err
+	}
+	kr.setFlushPhase(FlushChildren, cid.Undef)
 	nd, err := kr.GetDirectory().GetNode()
 	if err != nil {
-		return err
+		return cid.Undef, kr.flushFailed(err)
 	}
 
-	if kr.repub != nil {
-		kr.repub.Update(nd.Cid())
+	c, err := kr.persistRoot(context.TODO(), nd)
+	if err != nil {
+		return cid.Undef, err
 	}
-	return nil
+	if kr.watched() {
+		kr.emit(Event{Name: "/", Op: Flush})
+	}
+	return c, nil
+}
+
+// StartBulkLoad enters the bulk-load mode: updates of the entries are
+// only recorded in their directory, without serializing it nor
+// propagating the change to its ancestors (nothing is published
+// either). This turns the O(n*depth) directory rewrites of a large
+// import into O(n + depth), the tree being sealed once in `EndBulkLoad`.
+// The nodes returned by `GetNode` still reflect all the changes.
+func (kr *Root) StartBulkLoad() {
+	atomic.StoreInt32(&kr.bulkLoad, 1)
 }
 
-// FlushMemFree flushes the root directory and then uncaches all of its links.
-// This has the effect of clearing out potentially stale references and allows
-// them to be garbage collected.
-// CAUTION: Take care not to ever call this while holding a reference to any
-// child directories. Those directories will be bad references and using them
-// may have unintended racy side effects.
-// A better implemented mfs system (one that does smarter internal caching and
-// refcounting) shouldnt need this method.
-// TODO: Review the motivation behind this method once the cache system is
-// refactored.
+// EndBulkLoad leaves the bulk-load mode, storing the new version of
+// every changed directory and publishing the resulting root.
+func (kr *Root) EndBulkLoad() error {
+	atomic.StoreInt32(&kr.bulkLoad, 0)
+	return kr.Flush()
+}
+
+// bulkLoading reports whether the root is in bulk-load mode.
+func (kr *Root) bulkLoading() bool {
+	return atomic.LoadInt32(&kr.bulkLoad) != 0
+}
+
+// FlushMemFree flushes the root directory and then uncaches all of its
+// entries (see `Directory.Uncache`), so the memory they hold can be
+// garbage collected. The references to the uncached entries become stale,
+// failing with `ErrDetached`.
 func (kr *Root) FlushMemFree(ctx context.Context) error {
 	dir := kr.GetDirectory()
 
@@ -194,10 +530,10 @@ func (kr *Root) FlushMemFree(ctx context.Context) error {
 	defer dir.lock.Unlock()
 
 	for name := range dir.entriesCache {
-		delete(dir.entriesCache, name)
+		if err := dir.uncacheUnsync(name); err != nil {
+			return err
+		}
 	}
-	// TODO: Can't we just create new maps?
-
 	return nil
 }
 
@@ -209,29 +545,40 @@ func (kr *Root) FlushMemFree(ctx context.Context) error {
 // the top), document it and maybe make it an anonymous variable (if
 // that's possible).
 func (kr *Root) updateChildEntry(c child) error {
-	err := kr.GetDirectory().dagService.Add(context.TODO(), c.Node)
-	if err != nil {
-		return err
-	}
-	// TODO: Why are we not using the inner directory lock nor
-	// applying the same procedure as `Directory.updateChildEntry`?
-
-	if kr.repub != nil {
-		kr.repub.Update(c.Node.Cid())
-	}
-	return nil
+	// The nodes below were stored while propagating the update.
+	_, err := kr.persistRoot(context.TODO(), c.Node)
+	return err
 }
 
-func (kr *Root) Close() error {
-	nd, err := kr.GetDirectory().GetNode()
-	if err != nil {
-		return err
+func (kr *Root) Close() (err error) {
+	// Whatever failed, the root is closed: its goroutines are stopped
+	// and its lock released. The first error is returned.
+	defer func() {
+		kr.life.stop()
+		if err := kr.spill.discard(context.TODO()); err != nil {
+			log.Errorf("failed to discard the spilled entries: %s", err)
+		}
+		if lerr := kr.releaseLock(context.TODO()); lerr != nil && err == nil {
+			err = lerr
+		}
+	}()
+
+	kr.closeWatchers()
+
+	err = kr.closeFds()
+	if err == nil {
+		err = kr.Flush()
+		if errors.Is(err, ErrRootLocked) {
+			// Taken over, the changes are lost: stop publishing anyway.
+			log.Errorf("closing root without publishing its last changes: %s", err)
+			err = nil
+		}
 	}
 
 	if kr.repub != nil {
-		kr.repub.Update(nd.Cid())
-		return kr.repub.Close()
+		if cerr := kr.repub.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
 	}
-
-	return nil
+	return err
 }
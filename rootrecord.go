@@ -0,0 +1,179 @@
+package mfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// ErrInvalidRootRecord is returned (wrapped) when a `RootRecord` fails to
+// decode or verify, or isn't for the expected root.
+var ErrInvalidRootRecord = errors.New("invalid root record")
+
+// rootRecordPrefix separates the signatures of root records from the
+// ones made with the same key for other purposes.
+const rootRecordPrefix = "mfs-root-record:"
+
+// RootRecord is a signed statement that `Root` is the `Seq`-th value
+// published by the holder of a key, so replicas can authenticate the
+// roots they're handed without relying solely on IPNS. See
+// `WithRootSigner` and `WithRootRecord`.
+type RootRecord struct {
+	Root      cid.Cid
+	Seq       uint64
+	Signature []byte
+}
+
+// Signer signs root records. A libp2p `crypto.PrivKey` is one.
+type Signer interface {
+	Sign(data []byte) ([]byte, error)
+}
+
+// Verifier verifies the signatures of root records. A libp2p
+// `crypto.PubKey` is one.
+type Verifier interface {
+	Verify(data, sig []byte) (bool, error)
+}
+
+// SignRootRecord returns the record of 'root' with the sequence number
+// 'seq', signed with 's'.
+func SignRootRecord(s Signer, root cid.Cid, seq uint64) (RootRecord, error) {
+	rec := RootRecord{Root: root, Seq: seq}
+	sig, err := s.Sign(rec.signedData())
+	if err != nil {
+		return RootRecord{}, err
+	}
+	rec.Signature = sig
+	return rec, nil
+}
+
+// Verify checks the signature of the record with 'v'.
+func (r RootRecord) Verify(v Verifier) error {
+	if !r.Root.Defined() {
+		return fmt.Errorf("%w: undefined root", ErrInvalidRootRecord)
+	}
+	ok, err := v.Verify(r.signedData(), r.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRootRecord, err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: bad signature", ErrInvalidRootRecord)
+	}
+	return nil
+}
+
+// signedData returns the bytes covered by the signature.
+func (r RootRecord) signedData() []byte {
+	buf := []byte(rootRecordPrefix)
+	buf = appendUvarint(buf, r.Seq)
+	return append(buf, r.Root.Bytes()...)
+}
+
+// MarshalBinary encodes the record as the varint-prefixed CID, the
+// varint sequence number and the varint-prefixed signature.
+func (r RootRecord) MarshalBinary() ([]byte, error) {
+	if !r.Root.Defined() {
+		return nil, fmt.Errorf("%w: undefined root", ErrInvalidRootRecord)
+	}
+	c := r.Root.Bytes()
+	buf := appendUvarint(nil, uint64(len(c)))
+	buf = append(buf, c...)
+	buf = appendUvarint(buf, r.Seq)
+	buf = appendUvarint(buf, uint64(len(r.Signature)))
+	return append(buf, r.Signature...), nil
+}
+
+// UnmarshalBinary decodes a record encoded by `MarshalBinary`, it
+// doesn't verify it.
+func (r *RootRecord) UnmarshalBinary(data []byte) error {
+	rd := bytes.NewReader(data)
+	readBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(rd)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(rd.Len()) {
+			return nil, fmt.Errorf("truncated")
+		}
+		b := make([]byte, n)
+		_, err = rd.Read(b)
+		return b, err
+	}
+
+	c, err := readBytes()
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRootRecord, err)
+	}
+	root, err := cid.Cast(c)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRootRecord, err)
+	}
+	seq, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRootRecord, err)
+	}
+	sig, err := readBytes()
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRootRecord, err)
+	}
+	if rd.Len() != 0 {
+		return fmt.Errorf("%w: trailing data", ErrInvalidRootRecord)
+	}
+	*r = RootRecord{Root: root, Seq: seq, Signature: sig}
+	return nil
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+// RecordFunc receives the signed record of every published root, to
+// store or distribute it next to the value published by the `PubFunc`.
+type RecordFunc func(context.Context, RootRecord) error
+
+// recordSigner signs the published roots with increasing sequence
+// numbers. A value published again (retried or kept alive) keeps its
+// record.
+type recordSigner struct {
+	signer Signer
+	emit   RecordFunc
+
+	lock sync.Mutex
+	last RootRecord
+}
+
+// pubFunc wraps 'pf' to emit the record of each value it published.
+func (s *recordSigner) pubFunc(pf PubFunc) PubFunc {
+	return func(ctx context.Context, c cid.Cid) error {
+		rec, err := s.sign(c)
+		if err != nil {
+			return err
+		}
+		if err := pf(ctx, c); err != nil {
+			return err
+		}
+		return s.emit(ctx, rec)
+	}
+}
+
+func (s *recordSigner) sign(c cid.Cid) (RootRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.last.Root.Equals(c) {
+		return s.last, nil
+	}
+	rec, err := SignRootRecord(s.signer, c, s.last.Seq+1)
+	if err != nil {
+		return RootRecord{}, err
+	}
+	s.last = rec
+	return rec, nil
+}
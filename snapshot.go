@@ -0,0 +1,137 @@
+package mfs
+
+import (
+	"context"
+	"time"
+
+	dag "github.com/ipfs/go-merkledag"
+	uio "github.com/ipfs/go-unixfs/io"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// Snapshot is an immutable view of the tree as of `Root.Snapshot`, that
+// the root can be rolled back to with `Root.Restore`.
+type Snapshot struct {
+	node  *dag.ProtoNode
+	dserv ipld.DAGService
+	taken time.Time
+}
+
+// Cid returns the CID of the root of the snapshot.
+func (s *Snapshot) Cid() cid.Cid {
+	return s.node.Cid()
+}
+
+// Time returns when the snapshot was taken.
+func (s *Snapshot) Time() time.Time {
+	return s.taken
+}
+
+// Open returns a new `Root` over the snapshot, to browse it. It doesn't
+// publish, and its changes don't affect the snapshot.
+func (s *Snapshot) Open(ctx context.Context) (*Root, error) {
+	return NewRoot(ctx, s.dserv, s.node.Copy().(*dag.ProtoNode), nil)
+}
+
+// Snapshot flushes the tree (without publishing it) and returns a
+// snapshot of it.
+func (kr *Root) Snapshot() (_ *Snapshot, err error) {
+	defer kr.recoverPanic(&err)
+
+	dir := kr.GetDirectory()
+	nd, err := dir.GetNode()
+	if err != nil {
+		return nil, err
+	}
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return nil, dag.ErrNotProtobuf
+	}
+	return &Snapshot{
+		node:  pbnd.Copy().(*dag.ProtoNode),
+		dserv: dir.dagService,
+		taken: time.Now(),
+	}, nil
+}
+
+// Restore rolls the tree back to the snapshot in a single update, which
+// is published. The `FSNode`s loaded before stop updating the tree, and
+// the watchers receive the events of the entries that changed.
+func (kr *Root) Restore(ctx context.Context, s *Snapshot) (err error) {
+	defer kr.recoverPanic(&err)
+
+	dir := kr.GetDirectory()
+	oldNd, err := dir.GetNode()
+	if err != nil {
+		return err
+	}
+	if oldNd.Cid().Equals(s.Cid()) {
+		return nil
+	}
+
+	nd := s.node.Copy()
+	if err := dir.reset(ctx, nd); err != nil {
+		return err
+	}
+	if err := kr.updateChildEntry(child{dir.name, nd}); err != nil {
+		return err
+	}
+
+	if kr.watched() {
+		return treeEvents(ctx, dir.dagService, oldNd.Cid(), nd.Cid(), "/", kr.emit)
+	}
+	return nil
+}
+
+// reset replaces the whole contents of the directory with the directory
+// 'nd', detaching the cached entries.
+func (d *Directory) reset(ctx context.Context, nd ipld.Node) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.resetUnsync(ctx, nd)
+}
+
+// swap is `reset` if the directory is still the node 'old', it reports
+// whether it was.
+func (d *Directory) swap(ctx context.Context, old cid.Cid, nd ipld.Node) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err := d.sync(); err != nil {
+		return false, err
+	}
+	cur, err := d.storeNode()
+	if err != nil {
+		return false, err
+	}
+	if !cur.Cid().Equals(old) {
+		return false, nil
+	}
+	return true, d.resetUnsync(ctx, nd)
+}
+
+func (d *Directory) resetUnsync(ctx context.Context, nd ipld.Node) error {
+	err := d.dagService.Add(ctx, nd)
+	if err != nil {
+		return err
+	}
+	db, err := uio.NewDirectoryFromNode(d.dagService, nd)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range d.entriesCache {
+		detachEntry(entry, true)
+	}
+	d.entriesCache = make(map[string]FSNode)
+	d.entryCids = make(map[string]cid.Cid)
+
+	d.setUnixfsDir(db)
+	d.storedNode = nd
+	d.entryCount = -1
+	d.touch(true)
+	d.notifyChange()
+	return nil
+}
@@ -0,0 +1,174 @@
+package mfs
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// entrySpill keeps the state of the entries evicted from the entry cache
+// in a local datastore (see `WithEntrySpill`), so loading them again
+// neither refetches their node from the DAG service nor loses what was
+// only kept in memory (like the modification time of the directories).
+// The nodes are kept under `/blocks/<cid>` and the rest of the state
+// under `/entries/<path>`, it's dropped once the entry is loaded again.
+type entrySpill struct {
+	ds ds.Datastore
+}
+
+// spilledEntry is the state of an evicted entry.
+type spilledEntry struct {
+	Cid     string    `json:"cid"`
+	ModTime time.Time `json:"modTime"`
+}
+
+var (
+	spillBlocks  = ds.NewKey("/blocks")
+	spillEntries = ds.NewKey("/entries")
+)
+
+// newEntrySpill returns a spill over 'd', discarding what was left in it
+// (by a previous `Root` not closed cleanly).
+func newEntrySpill(ctx context.Context, d ds.Datastore) (*entrySpill, error) {
+	res, err := d.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if err := d.Delete(ctx, ds.NewKey(e.Key)); err != nil {
+			return nil, err
+		}
+	}
+	return &entrySpill{ds: d}, nil
+}
+
+// spillState returns the state of the entry 'fsn' to spill, with its
+// node.
+func spillState(fsn FSNode) (ipld.Node, spilledEntry, error) {
+	nd, err := fsn.GetNode()
+	if err != nil {
+		return nil, spilledEntry{}, err
+	}
+	state := spilledEntry{Cid: nd.Cid().String()}
+	if dir, ok := fsn.(*Directory); ok {
+		state.ModTime = dir.ModTime()
+	}
+	return nd, state, nil
+}
+
+// spill stores the state of the entry at 'pth', evicted, and its node.
+func (s *entrySpill) spill(ctx context.Context, pth string, nd ipld.Node, state spilledEntry) error {
+	val, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := s.ds.Put(ctx, spillBlocks.ChildString(nd.Cid().String()), nd.RawData()); err != nil {
+		return err
+	}
+	return s.ds.Put(ctx, spillEntries.Child(ds.NewKey(pth)), val)
+}
+
+// reload restores the state spilled of the entry 'fsn' at 'pth', loaded
+// again from the node 'c', if it was spilled with the same node. The
+// spill may be nil (disabled).
+func (s *entrySpill) reload(ctx context.Context, pth string, c cid.Cid, fsn FSNode) error {
+	if s == nil {
+		return nil
+	}
+	key := spillEntries.Child(ds.NewKey(pth))
+	val, err := s.ds.Get(ctx, key)
+	switch err {
+	case nil:
+	case ds.ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+	var state spilledEntry
+	if err := json.Unmarshal(val, &state); err != nil {
+		return err
+	}
+	if err := s.ds.Delete(ctx, key); err != nil {
+		return err
+	}
+	// Nodes may be shared by several entries, or needed again after
+	// changes are rolled back: the blocks are only dropped with the whole
+	// spill, by `Root.Close`.
+
+	if c.String() != state.Cid {
+		// Replaced while evicted.
+		return nil
+	}
+	if dir, ok := fsn.(*Directory); ok && !state.ModTime.IsZero() {
+		dir.lock.Lock()
+		dir.modTime = state.ModTime
+		dir.lock.Unlock()
+	}
+	return nil
+}
+
+// get returns the node 'c' if spilled.
+func (s *entrySpill) get(ctx context.Context, c cid.Cid) (ipld.Node, bool, error) {
+	data, err := s.ds.Get(ctx, spillBlocks.ChildString(c.String()))
+	switch err {
+	case nil:
+	case ds.ErrNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, err
+	}
+	nd, err := decodeBlock(c, data)
+	if err != nil {
+		return nil, false, err
+	}
+	return nd, true, nil
+}
+
+// discard drops everything spilled.
+func (s *entrySpill) discard(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	_, err := newEntrySpill(ctx, s.ds)
+	return err
+}
+
+// spillDAG is a DAG service reading the nodes spilled before the
+// underlying one.
+type spillDAG struct {
+	ipld.DAGService
+	spill *entrySpill
+}
+
+var _ ipld.DAGService = (*spillDAG)(nil)
+
+func (s *spillDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	nd, ok, err := s.spill.get(ctx, c)
+	if err != nil {
+		// Fall back to the DAG service.
+		log.Warnf("failed to read spilled node %s: %s", c, err)
+	}
+	if ok {
+		return nd, nil
+	}
+	return s.DAGService.Get(ctx, c)
+}
+
+// spills returns the entry spill of the root of 'p' (nil if disabled or
+// detached from a root).
+func spills(p parent) *entrySpill {
+	if r := rootOf(p); r != nil {
+		return r.spill
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package mfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// DefaultStagingDir is the path of the staging directory of a `Root`,
+// unless changed with `WithStagingDir`.
+const DefaultStagingDir = "/.tmp"
+
+// StagingDir returns the directory reserved for staging entries (the
+// temporary files of `WriteFileAtomic`, partial uploads or the
+// application's own), creating it if needed. With `WithStagingCleanup`
+// its contents, but for the partial uploads, are removed when a `Root`
+// is created over the tree, so they must not be relied upon across
+// restarts.
+func (kr *Root) StagingDir() (*Directory, error) {
+	err := Mkdir(kr, kr.stagingPath, MkdirOpts{Mkparents: true})
+	if err != nil {
+		return nil, err
+	}
+	return lookupDir(kr, kr.stagingPath)
+}
+
+// cleanStaging removes the entries abandoned in the staging directory,
+// but for the partial uploads (which can be resumed after a restart).
+func (kr *Root) cleanStaging(ctx context.Context) error {
+	fsn, err := dirLookup(ctx, kr.GetDirectory(), kr.stagingPath)
+	if err == os.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	dir, ok := fsn.(*Directory)
+	if !ok {
+		return fmt.Errorf("staging path %s: %w", kr.stagingPath, ErrNotDir)
+	}
+
+	names, err := dir.ListNames(ctx)
+	if err != nil {
+		return err
+	}
+	var removed int
+	for _, name := range names {
+		if strings.HasPrefix(name, uploadPrefix) {
+			continue
+		}
+		if err := dir.Unlink(name); err != nil {
+			return err
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Infof("removed %d abandoned entries from the staging directory", removed)
+	}
+	return nil
+}
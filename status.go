@@ -0,0 +1,85 @@
+package mfs
+
+import (
+	"path"
+	"sort"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// PublishStatus is returned by `Root.PublishStatus`.
+type PublishStatus struct {
+	// State of the republisher, zero if the root has none (or uses
+	// another `Publisher`).
+	Republisher RepublisherStatus
+
+	// Current value of the root, and whether it's the last published one.
+	Current  cid.Cid
+	UpToDate bool
+
+	// Paths of the files with writes not yet flushed by their open
+	// `FileDescriptor`s, sorted.
+	DirtyPaths []string
+}
+
+// PublishStatus reports where the root stands with respect to its last
+// published value, for status commands of the embedders. Getting the
+// current value flushes the tree as `GetNode` does.
+func (kr *Root) PublishStatus() (PublishStatus, error) {
+	var status PublishStatus
+	if rp, ok := kr.repub.(*Republisher); ok {
+		status.Republisher = rp.Status()
+	}
+
+	nd, err := kr.GetDirectory().GetNode()
+	if err != nil {
+		return PublishStatus{}, err
+	}
+	status.Current = nd.Cid()
+	status.UpToDate = status.Current.Equals(status.Republisher.Published)
+
+	status.DirtyPaths = kr.dirtyPaths()
+	return status, nil
+}
+
+// dirtyPaths returns the paths of the files with unflushed writes.
+func (kr *Root) dirtyPaths() []string {
+	// The descriptors are locked after releasing `descLock`, closing
+	// them takes both locks the other way around.
+	kr.descLock.Lock()
+	fds := make([]*fileDescriptor, 0, len(kr.openDescs))
+	for fd := range kr.openDescs {
+		fds = append(fds, fd)
+	}
+	kr.descLock.Unlock()
+
+	var paths []string
+	for _, fd := range fds {
+		fd.lock.Lock()
+		dirty := fd.state == stateDirty
+		fd.lock.Unlock()
+		if !dirty {
+			continue
+		}
+
+		if pth, ok := fd.inode.path(); ok {
+			paths = append(paths, pth)
+		}
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+// path returns the path of the file in the tree, false if it was
+// unlinked.
+func (fi *File) path() (string, bool) {
+	fi.nodeLock.RLock()
+	defer fi.nodeLock.RUnlock()
+
+	dir, ok := fi.parent.(*Directory)
+	if !ok || fi.detached {
+		return "", false
+	}
+	return path.Join(dir.Path(), fi.name), true
+}
@@ -0,0 +1,166 @@
+package mfs
+
+import (
+	"errors"
+	gopath "path"
+	"strings"
+
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+)
+
+// MaxSymlinkDepth is the number of symlinks followed when resolving a
+// path before failing with `ErrTooManyLinks`.
+const MaxSymlinkDepth = 40
+
+// ErrTooManyLinks is returned when resolving a path follows more than
+// `MaxSymlinkDepth` symlinks (most likely a loop).
+var ErrTooManyLinks = errors.New("too many levels of symbolic links")
+
+// ErrNotSymlink is returned by `Readlink` for entries that aren't
+// symlinks.
+var ErrNotSymlink = errors.New("not a symlink")
+
+// Symlink creates a UnixFS symlink at 'pth' pointing to 'target'. The
+// target isn't checked, it may not exist (yet).
+func Symlink(r *Root, target, pth string) (err error) {
+	defer func() { err = pathError("symlink", pth, err) }()
+	defer r.recoverPanic(&err)
+
+	pdir, name, err := lookupParent(r, pth)
+	if err != nil {
+		return err
+	}
+
+	data, err := ft.SymlinkData(target)
+	if err != nil {
+		return err
+	}
+	nd := dag.NodeWithData(data)
+	nd.SetCidBuilder(pdir.newCidBuilder())
+	return pdir.AddChild(name, nd)
+}
+
+// Readlink returns the target of the symlink at 'pth' (which isn't
+// followed).
+func Readlink(r *Root, pth string) (_ string, err error) {
+	defer func() { err = pathError("readlink", pth, err) }()
+	defer r.recoverPanic(&err)
+
+	fsn, err := dirLookup(r.GetDirectory().ctx, r.GetDirectory(), pth)
+	if err != nil {
+		return "", err
+	}
+	target, ok, err := symlinkTarget(fsn)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrNotSymlink
+	}
+	return target, nil
+}
+
+// symlinkTarget returns the target of 'fsn' if it's a symlink.
+func symlinkTarget(fsn FSNode) (string, bool, error) {
+	if _, ok := fsn.(*File); !ok {
+		return "", false, nil
+	}
+	nd, err := fsn.GetNode()
+	if err != nil {
+		return "", false, err
+	}
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return "", false, nil
+	}
+	fsnd, err := ft.FSNodeFromBytes(pbnd.Data())
+	if err != nil {
+		return "", false, err
+	}
+	if fsnd.Type() != ft.TSymlink {
+		return "", false, nil
+	}
+	return string(fsnd.Data()), true, nil
+}
+
+// LookupOpts is used by LookupWithOpts
+type LookupOpts struct {
+	// FollowSymlinks resolves the symlinks found along the path,
+	// including its last component. Relative targets are resolved from
+	// the directory containing the symlink.
+	FollowSymlinks bool
+}
+
+// LookupWithOpts looks up the file or directory at 'pth' like `Lookup`,
+// optionally following symlinks.
+func LookupWithOpts(r *Root, pth string, opts LookupOpts) (FSNode, error) {
+	if !opts.FollowSymlinks {
+		return Lookup(r, pth)
+	}
+
+	root := r.GetDirectory()
+	dir, cur := root, "/"
+	var fsn FSNode = root
+	rest := splitPath(pth)
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+
+		if fsn != FSNode(dir) {
+			return nil, &PathError{Path: cur, Err: ErrNotDir}
+		}
+		switch name {
+		case ".":
+			continue
+		case "..":
+			cur = gopath.Dir(cur)
+			d, err := lookupDir(r, cur)
+			if err != nil {
+				return nil, err
+			}
+			dir, fsn = d, d
+			continue
+		}
+
+		child, err := dir.Child(name)
+		if err != nil {
+			return nil, err
+		}
+		target, ok, err := symlinkTarget(child)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			links++
+			if links > MaxSymlinkDepth {
+				return nil, &PathError{Path: gopath.Clean("/" + pth), Err: ErrTooManyLinks}
+			}
+			if strings.HasPrefix(target, "/") {
+				dir, cur = root, "/"
+			}
+			fsn = dir
+			rest = append(splitPath(target), rest...)
+			continue
+		}
+
+		cur = gopath.Join(cur, name)
+		fsn = child
+		if d, ok := child.(*Directory); ok {
+			dir = d
+		}
+	}
+	return fsn, nil
+}
+
+// splitPath returns the non-empty components of 'pth'.
+func splitPath(pth string) []string {
+	var parts []string
+	for _, p := range strings.Split(pth, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
@@ -0,0 +1,376 @@
+// Package sync replicates an MFS between devices. An `Engine` follows the
+// roots published by a remote device and merges each of them into the
+// local `mfs.Root`: it fetches the remote tree, diffs it and the local one
+// against their common base, merges them entry by entry (resolving the
+// conflicts with a `ConflictPolicy`) and publishes the result.
+package sync
+
+import (
+	"context"
+	"fmt"
+	gosync "sync"
+
+	dag "github.com/ipfs/go-merkledag"
+	mfs "github.com/ipfs/go-mfs"
+	ft "github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// ConflictPolicy decides which version of an entry changed on both sides
+// is kept.
+type ConflictPolicy int
+
+const (
+	// PreferLocal keeps the local version.
+	PreferLocal ConflictPolicy = iota
+	// PreferRemote keeps the remote version.
+	PreferRemote
+	// KeepBoth keeps the local version at the entry's path and the remote
+	// one next to it, under the name returned by `ConflictName`. When one
+	// side removed the entry the other side's version is kept.
+	KeepBoth
+)
+
+// Options is used by NewEngine
+type Options struct {
+	Policy ConflictPolicy
+
+	// OnConflict, if set, is called for every conflict once it's
+	// resolved.
+	OnConflict func(Conflict)
+}
+
+// Conflict is an entry changed differently on both sides since the base.
+// Removed sides have an undefined CID.
+type Conflict struct {
+	Path   string
+	Base   cid.Cid
+	Local  cid.Cid
+	Remote cid.Cid
+}
+
+// Report describes a merge.
+type Report struct {
+	// Merged is the root published after the merge.
+	Merged    cid.Cid
+	Conflicts []Conflict
+}
+
+// ConflictName returns the name given by `KeepBoth` to the remote
+// version 'c' of the entry 'name'. It's derived from the content so all
+// the devices merging the same trees agree on it.
+func ConflictName(name string, c cid.Cid) string {
+	s := c.String()
+	if len(s) > 8 {
+		s = s[len(s)-8:]
+	}
+	return fmt.Sprintf("%s.conflict-%s", name, s)
+}
+
+// Engine merges the roots of a remote device into a local `mfs.Root`.
+// The root must publish its updates (have a `PubFunc` or `Publisher`).
+//
+// Local mutations made while a merge is applied may be reverted by it,
+// so mutate the root from the same goroutine driving the engine (or
+// pause mutations during `Merge`).
+type Engine struct {
+	root  *mfs.Root
+	dserv ipld.DAGService
+	opts  Options
+
+	lock gosync.Mutex
+	base cid.Cid
+}
+
+// NewEngine creates an `Engine` merging into 'root'. 'base' is the last
+// remote root already merged (the common ancestor of the next merge),
+// undefined if the trees never synced: every entry present on both
+// sides with different contents is then a conflict.
+func NewEngine(root *mfs.Root, dserv ipld.DAGService, base cid.Cid, opts Options) *Engine {
+	return &Engine{
+		root:  root,
+		dserv: dserv,
+		opts:  opts,
+		base:  base,
+	}
+}
+
+// Base returns the last remote root merged.
+func (e *Engine) Base() cid.Cid {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.base
+}
+
+// Run merges every root received from 'remotes' until the channel is
+// closed or the context canceled. Only the latest of the roots received
+// while a merge is in progress is merged next.
+func (e *Engine) Run(ctx context.Context, remotes <-chan cid.Cid) error {
+	for {
+		var remote cid.Cid
+		select {
+		case c, ok := <-remotes:
+			if !ok {
+				return nil
+			}
+			remote = c
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	drain:
+		for {
+			select {
+			case c, ok := <-remotes:
+				if !ok {
+					break drain
+				}
+				remote = c
+			default:
+				break drain
+			}
+		}
+
+		if _, err := e.Merge(ctx, remote); err != nil {
+			return fmt.Errorf("merging %s: %w", remote, err)
+		}
+	}
+}
+
+// Merge merges the remote root 'remote' into the local root and
+// publishes the result.
+func (e *Engine) Merge(ctx context.Context, remote cid.Cid) (Report, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	// Fetch.
+	if _, err := e.dserv.Get(ctx, remote); err != nil {
+		return Report{}, err
+	}
+	local, err := e.root.GetDirectory().GetNode()
+	if err != nil {
+		return Report{}, err
+	}
+
+	// Diff and merge.
+	m := &merger{
+		dserv: e.dserv,
+		opts:  e.opts,
+	}
+	merged, err := m.mergeDir(ctx, "/", e.base, local.Cid(), remote)
+	if err != nil {
+		return Report{}, err
+	}
+
+	// Publish.
+	if !merged.Equals(local.Cid()) {
+		if _, err := mfs.SyncFromCid(ctx, e.root, merged, mfs.SyncOpts{}); err != nil {
+			return Report{}, err
+		}
+	}
+	nd, err := mfs.FlushPath(ctx, e.root, "/")
+	if err != nil {
+		return Report{}, err
+	}
+
+	e.base = remote
+	return Report{Merged: nd.Cid(), Conflicts: m.conflicts}, nil
+}
+
+// merger builds the three-way merge of two trees.
+type merger struct {
+	dserv     ipld.DAGService
+	opts      Options
+	conflicts []Conflict
+}
+
+// mergeDir returns the merge of the directories 'local' and 'remote' at
+// 'pth' against 'base' (undefined if the directory didn't exist). The
+// result is built from the local directory, fetching only the entries
+// that change.
+func (m *merger) mergeDir(ctx context.Context, pth string, base, local, remote cid.Cid) (cid.Cid, error) {
+	baseLinks := map[string]cid.Cid{}
+	if base.Defined() {
+		links, err := m.entryLinks(ctx, base)
+		if err != nil {
+			return cid.Undef, err
+		}
+		baseLinks = links
+	}
+	localLinks, err := m.entryLinks(ctx, local)
+	if err != nil {
+		return cid.Undef, err
+	}
+	remoteLinks, err := m.entryLinks(ctx, remote)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	localNd, err := m.dserv.Get(ctx, local)
+	if err != nil {
+		return cid.Undef, err
+	}
+	dir, err := uio.NewDirectoryFromNode(m.dserv, localNd)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	names := make(map[string]struct{})
+	for _, links := range []map[string]cid.Cid{baseLinks, localLinks, remoteLinks} {
+		for name := range links {
+			names[name] = struct{}{}
+		}
+	}
+
+	changed := false
+	set := func(name string, c cid.Cid) error {
+		if cur := localLinks[name]; cur.Equals(c) {
+			return nil
+		}
+		changed = true
+		if !c.Defined() {
+			return dir.RemoveChild(ctx, name)
+		}
+		nd, err := m.dserv.Get(ctx, c)
+		if err != nil {
+			return err
+		}
+		return dir.AddChild(ctx, name, nd)
+	}
+
+	for name := range names {
+		if err := ctx.Err(); err != nil {
+			return cid.Undef, err
+		}
+		b, l, r := baseLinks[name], localLinks[name], remoteLinks[name]
+		epth := pth + name
+
+		switch {
+		case l.Equals(r), b.Equals(r):
+			// Unchanged remotely (or changed the same way).
+			continue
+		case b.Equals(l):
+			// Only changed remotely.
+			if err := set(name, r); err != nil {
+				return cid.Undef, err
+			}
+			continue
+		}
+
+		if l.Defined() && r.Defined() {
+			ldir, err := m.isDir(ctx, l)
+			if err != nil {
+				return cid.Undef, err
+			}
+			rdir, err := m.isDir(ctx, r)
+			if err != nil {
+				return cid.Undef, err
+			}
+			if ldir && rdir {
+				bdir := cid.Undef
+				if b.Defined() {
+					isDir, err := m.isDir(ctx, b)
+					if err != nil {
+						return cid.Undef, err
+					}
+					if isDir {
+						bdir = b
+					}
+				}
+				mc, err := m.mergeDir(ctx, epth+"/", bdir, l, r)
+				if err != nil {
+					return cid.Undef, err
+				}
+				if err := set(name, mc); err != nil {
+					return cid.Undef, err
+				}
+				continue
+			}
+		}
+
+		if err := m.resolve(ctx, name, Conflict{Path: epth, Base: b, Local: l, Remote: r}, set); err != nil {
+			return cid.Undef, err
+		}
+	}
+
+	if !changed {
+		return local, nil
+	}
+	nd, err := dir.GetNode()
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err := m.dserv.Add(ctx, nd); err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+// resolve applies the conflict policy to the entry 'name'.
+func (m *merger) resolve(ctx context.Context, name string, c Conflict, set func(string, cid.Cid) error) error {
+	var err error
+	switch m.opts.Policy {
+	case PreferLocal:
+	case PreferRemote:
+		err = set(name, c.Remote)
+	case KeepBoth:
+		switch {
+		case !c.Local.Defined():
+			err = set(name, c.Remote)
+		case c.Remote.Defined():
+			err = set(ConflictName(name, c.Remote), c.Remote)
+		}
+	default:
+		return fmt.Errorf("unknown conflict policy %d", m.opts.Policy)
+	}
+	if err != nil {
+		return err
+	}
+
+	m.conflicts = append(m.conflicts, c)
+	if m.opts.OnConflict != nil {
+		m.opts.OnConflict(c)
+	}
+	return nil
+}
+
+// entryLinks returns the CIDs of the entries of the directory 'c'.
+func (m *merger) entryLinks(ctx context.Context, c cid.Cid) (map[string]cid.Cid, error) {
+	nd, err := m.dserv.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := uio.NewDirectoryFromNode(m.dserv, nd)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a directory: %w", c, err)
+	}
+
+	links := make(map[string]cid.Cid)
+	err = dir.ForEachLink(ctx, func(l *ipld.Link) error {
+		links[l.Name] = l.Cid
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// isDir reports whether the node 'c' is a UnixFS directory.
+func (m *merger) isDir(ctx context.Context, c cid.Cid) (bool, error) {
+	nd, err := m.dserv.Get(ctx, c)
+	if err != nil {
+		return false, err
+	}
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return false, nil
+	}
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	if err != nil {
+		return false, nil
+	}
+	return fsn.Type() == ft.TDirectory || fsn.Type() == ft.THAMTShard, nil
+}
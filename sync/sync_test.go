@@ -0,0 +1,213 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	mfs "github.com/ipfs/go-mfs"
+
+	bserv "github.com/ipfs/go-blockservice"
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+func getDagserv(t testing.TB) ipld.DAGService {
+	db := dssync.MutexWrap(ds.NewMapDatastore())
+	bs := bstore.NewBlockstore(db)
+	blockserv := bserv.New(bs, offline.Exchange(bs))
+	return dag.NewDAGService(blockserv)
+}
+
+func newRoot(ctx context.Context, t *testing.T, dserv ipld.DAGService, c cid.Cid) *mfs.Root {
+	nd := dag.NodeWithData(ft.FolderPBData())
+	if c.Defined() {
+		got, err := dserv.Get(ctx, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd = got.(*dag.ProtoNode)
+	}
+	rt, err := mfs.NewRoot(ctx, dserv, nd, func(ctx context.Context, c cid.Cid) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rt
+}
+
+func writeFile(t *testing.T, rt *mfs.Root, pth, data string) {
+	err := mfs.WriteFile(rt, pth, bytes.NewReader([]byte(data)), mfs.WriteFileOpts{Create: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func remove(t *testing.T, rt *mfs.Root, pth string) {
+	if err := rt.RemovePath(pth); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func rootCid(t *testing.T, rt *mfs.Root) cid.Cid {
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nd.Cid()
+}
+
+func readFile(t *testing.T, rt *mfs.Root, pth string) string {
+	t.Helper()
+	fd, err := rt.OpenPath(pth, mfs.Flags{Read: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	data, err := io.ReadAll(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestMerge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dserv := getDagserv(t)
+
+	base := newRoot(ctx, t, dserv, cid.Undef)
+	if err := mfs.Mkdir(base, "/d", mfs.MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, base, "/a", "base a")
+	writeFile(t, base, "/b", "base b")
+	writeFile(t, base, "/d/x", "base x")
+	baseCid := rootCid(t, base)
+
+	local := newRoot(ctx, t, dserv, baseCid)
+	writeFile(t, local, "/a", "local a")
+	writeFile(t, local, "/d/local", "local only")
+
+	remote := newRoot(ctx, t, dserv, baseCid)
+	writeFile(t, remote, "/a", "remote a")
+	writeFile(t, remote, "/b", "remote b")
+	remove(t, remote, "/d/x")
+	writeFile(t, remote, "/d/y", "remote y")
+	remoteCid := rootCid(t, remote)
+
+	var conflicts []Conflict
+	e := NewEngine(local, dserv, baseCid, Options{
+		Policy: KeepBoth,
+		OnConflict: func(c Conflict) {
+			conflicts = append(conflicts, c)
+		},
+	})
+	report, err := e.Merge(ctx, remoteCid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Conflicts) != 1 || report.Conflicts[0].Path != "/a" || len(conflicts) != 1 {
+		t.Fatalf("expected a conflict on /a, got %v", report.Conflicts)
+	}
+	if !report.Merged.Equals(rootCid(t, local)) {
+		t.Fatal("expected the merged root to be the local one")
+	}
+	if !e.Base().Equals(remoteCid) {
+		t.Fatal("expected the remote root to be the new base")
+	}
+
+	remoteA, err := mfs.Lookup(remote, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteANd, err := remoteA.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pth, expected := range map[string]string{
+		"/a":                                     "local a",
+		"/" + ConflictName("a", remoteANd.Cid()): "remote a",
+		"/b":                                     "remote b",
+		"/d/y":                                   "remote y",
+		"/d/local":                               "local only",
+	} {
+		if got := readFile(t, local, pth); got != expected {
+			t.Fatalf("expected %q at %s, got %q", expected, pth, got)
+		}
+	}
+	if _, err := mfs.Lookup(local, "/d/x"); err == nil {
+		t.Fatal("expected /d/x to be removed")
+	}
+
+	// Merging the same remote again changes nothing.
+	again, err := e.Merge(ctx, remoteCid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Merged.Equals(report.Merged) || len(again.Conflicts) != 0 {
+		t.Fatalf("expected a no-op merge, got %+v", again)
+	}
+}
+
+func TestMergePolicies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dserv := getDagserv(t)
+
+	for policy, expected := range map[ConflictPolicy]string{
+		PreferLocal:  "local",
+		PreferRemote: "remote",
+	} {
+		local := newRoot(ctx, t, dserv, cid.Undef)
+		writeFile(t, local, "/f", "local")
+		remote := newRoot(ctx, t, dserv, cid.Undef)
+		writeFile(t, remote, "/f", "remote")
+
+		// Without a base both versions conflict.
+		e := NewEngine(local, dserv, cid.Undef, Options{Policy: policy})
+		report, err := e.Merge(ctx, rootCid(t, remote))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Conflicts) != 1 {
+			t.Fatalf("expected a conflict, got %v", report.Conflicts)
+		}
+		if got := readFile(t, local, "/f"); got != expected {
+			t.Fatalf("policy %d: expected %q, got %q", policy, expected, got)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dserv := getDagserv(t)
+
+	local := newRoot(ctx, t, dserv, cid.Undef)
+	remote := newRoot(ctx, t, dserv, cid.Undef)
+
+	remotes := make(chan cid.Cid, 3)
+	for _, data := range []string{"1", "2", "3"} {
+		writeFile(t, remote, "/f", data)
+		remotes <- rootCid(t, remote)
+	}
+	close(remotes)
+
+	e := NewEngine(local, dserv, cid.Undef, Options{})
+	if err := e.Run(ctx, remotes); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, local, "/f"); got != "3" {
+		t.Fatalf("expected the latest remote, got %q", got)
+	}
+}
@@ -0,0 +1,170 @@
+package mfs
+
+import (
+	"context"
+	"fmt"
+
+	uio "github.com/ipfs/go-unixfs/io"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// SyncOpts is used by SyncFromCid
+type SyncOpts struct {
+	// Path of the directory to sync, the root by default.
+	Path string
+}
+
+// SyncReport counts the entries changed by `SyncFromCid`.
+type SyncReport struct {
+	Added    int
+	Removed  int
+	Modified int // files replaced (directories are synced recursively)
+}
+
+// SyncFromCid makes the directory at `SyncOpts.Path` match the directory
+// 'c' by applying their differences entry by entry, rather than swapping
+// the whole tree, so watchers observe (and caches keep) only what
+// actually changed. Subtrees with the same CID on both sides are skipped
+// without being fetched. The resulting node may still differ from 'c' if
+// the directories are encoded differently (CID builder, sharding).
+func SyncFromCid(ctx context.Context, r *Root, c cid.Cid, opts SyncOpts) (_ SyncReport, err error) {
+	defer func() { err = pathError("sync", opts.Path, err) }()
+	defer r.recoverPanic(&err)
+
+	dir, err := lookupDir(r, "/"+opts.Path)
+	if err != nil {
+		return SyncReport{}, err
+	}
+
+	if r.graftLimits != nil {
+		nd, err := dir.dagService.Get(ctx, c)
+		if err != nil {
+			return SyncReport{}, err
+		}
+		if err := r.validateGraft(ctx, nd); err != nil {
+			return SyncReport{}, err
+		}
+	}
+
+	var report SyncReport
+	err = syncDir(ctx, dir, c, &report)
+	return report, err
+}
+
+// syncDir applies to 'dir' the differences with the directory 'c'.
+func syncDir(ctx context.Context, dir *Directory, c cid.Cid, report *SyncReport) error {
+	target, err := entryLinks(ctx, dir.dagService, c)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := dir.snapshot()
+	if err != nil {
+		return err
+	}
+	current := make(map[string]cid.Cid)
+	err = snapshot.ForEachLink(ctx, func(l *ipld.Link) error {
+		current[l.Name] = l.Cid
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for name := range current {
+		if _, ok := target[name]; ok {
+			continue
+		}
+		if err := dir.Unlink(name); err != nil {
+			return err
+		}
+		report.Removed++
+	}
+
+	for name, tc := range target {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		cc, ok := current[name]
+		if ok && cc.Equals(tc) {
+			continue
+		}
+		nd, err := dir.dagService.Get(ctx, tc)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if err := dir.AddChild(name, nd); err != nil {
+				return err
+			}
+			report.Added++
+			continue
+		}
+
+		err = syncEntry(ctx, dir, name, nd, report)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncEntry replaces the entry 'name' of 'dir' with 'nd', recursing if
+// both are directories.
+func syncEntry(ctx context.Context, dir *Directory, name string, nd ipld.Node, report *SyncReport) error {
+	nt, err := nodeType(nd)
+	if err != nil {
+		return err
+	}
+	cur, err := dir.Child(name)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case nt == TDir && cur.Type() == TDir:
+		return syncDir(ctx, cur.(*Directory), nd.Cid(), report)
+	case nt == TFile && cur.Type() == TFile:
+		if err := dir.setFile(name, nd); err != nil {
+			return err
+		}
+		report.Modified++
+		return nil
+	default:
+		// The type changed.
+		if err := dir.Unlink(name); err != nil {
+			return err
+		}
+		if err := dir.AddChild(name, nd); err != nil {
+			return err
+		}
+		report.Removed++
+		report.Added++
+		return nil
+	}
+}
+
+// entryLinks returns the CIDs of the entries of the directory 'c'.
+func entryLinks(ctx context.Context, dserv ipld.DAGService, c cid.Cid) (map[string]cid.Cid, error) {
+	nd, err := dserv.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := uio.NewDirectoryFromNode(dserv, nd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c, err)
+	}
+
+	links := make(map[string]cid.Cid)
+	err = dir.ForEachLink(ctx, func(l *ipld.Link) error {
+		links[l.Name] = l.Cid
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
@@ -0,0 +1,223 @@
+package mfs
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	gopath "path"
+	"sort"
+	"strings"
+	"time"
+
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+	importer "github.com/ipfs/go-unixfs/importer"
+	uio "github.com/ipfs/go-unixfs/io"
+
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// tarModTime is the modification time of the archived entries: UnixFS 1.0
+// nodes don't record any.
+var tarModTime = time.Unix(0, 0)
+
+// WriteTar flushes the entry at 'pth' and writes it to 'w' as a tar
+// archive: the entries of a directory with their paths relative to it
+// (sorted, each directory before its entries), or a file under its own
+// name. The modes are the defaults of `FileInfo.Mode` as UnixFS 1.0
+// nodes carry neither modes nor modification times.
+func WriteTar(ctx context.Context, rt *Root, pth string, w io.Writer) (err error) {
+	defer func() { err = pathError("tar", pth, err) }()
+
+	fsn, err := dirLookup(ctx, rt.GetDirectory(), pth)
+	if err != nil {
+		return err
+	}
+	if err := fsn.Flush(); err != nil {
+		return err
+	}
+	nd, err := fsn.GetNode()
+	if err != nil {
+		return err
+	}
+
+	tw := &tarWriter{tw: tar.NewWriter(w), dserv: rt.GetDirectory().dagService, policy: rt.unsupported}
+	if fsn.Type() == TDir {
+		err = tw.writeDir(ctx, "", nd)
+	} else {
+		_, name := gopath.Split(gopath.Clean("/" + pth))
+		err = tw.writeEntry(ctx, name, nd)
+	}
+	if err != nil {
+		return err
+	}
+	return tw.tw.Close()
+}
+
+type tarWriter struct {
+	tw     *tar.Writer
+	dserv  ipld.DAGService
+	policy UnsupportedPolicy
+}
+
+// writeDir writes the entries of the directory 'nd' at 'pth'.
+func (t *tarWriter) writeDir(ctx context.Context, pth string, nd ipld.Node) error {
+	links, err := entryLinks(ctx, t.dserv, nd.Cid())
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(links))
+	for name := range links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child, err := t.dserv.Get(ctx, links[name])
+		if err != nil {
+			return err
+		}
+		if err := t.writeEntry(ctx, gopath.Join(pth, name), child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tarWriter) writeEntry(ctx context.Context, pth string, nd ipld.Node) error {
+	if err := checkSupported(nd); err != nil {
+		if t.policy == UnsupportedReject {
+			return fmt.Errorf("%s: %w", pth, err)
+		}
+		log.Debugf("skipping %s: %s", pth, err)
+		return nil
+	}
+	hdr := &tar.Header{Name: pth, ModTime: tarModTime}
+
+	if pbnd, ok := nd.(*dag.ProtoNode); ok {
+		fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+		if err != nil {
+			return err
+		}
+		switch fsn.Type() {
+		case ft.TDirectory, ft.THAMTShard:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			hdr.Mode = int64(DefaultDirPerm)
+			if err := t.tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			return t.writeDir(ctx, pth, nd)
+		case ft.TSymlink:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = string(fsn.Data())
+			hdr.Mode = int64(DefaultSymlinkPerm)
+			return t.tw.WriteHeader(hdr)
+		}
+	}
+
+	r, err := uio.NewDagReader(ctx, nd, t.dserv)
+	if err != nil {
+		return err
+	}
+	hdr.Typeflag = tar.TypeReg
+	hdr.Mode = int64(DefaultFilePerm)
+	hdr.Size = int64(r.Size())
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(t.tw, r)
+	return err
+}
+
+// ReadTar extracts the tar archive read from 'r' into the directory at
+// 'pth' (created if needed): directories are merged with the existing
+// ones, files and symlinks replace the existing entries. The modes and
+// modification times of the archive are dropped, and entries of other
+// types (hard links, devices...) are skipped. Paths escaping the
+// directory make it fail.
+func ReadTar(ctx context.Context, rt *Root, pth string, r io.Reader) (err error) {
+	defer func() { err = pathError("untar", pth, err) }()
+
+	pth = gopath.Clean("/" + pth)
+	if err := CtxMkdir(ctx, rt, pth, MkdirOpts{Mkparents: true}); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := gopath.Clean("/" + hdr.Name)
+		if strings.HasPrefix(hdr.Name, "/") || strings.Contains("/"+hdr.Name+"/", "/../") {
+			return fmt.Errorf("%s: path escapes the directory", hdr.Name)
+		}
+		if name == "/" {
+			continue
+		}
+		epth := gopath.Join(pth, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = CtxMkdir(ctx, rt, epth, MkdirOpts{Mkparents: true})
+		case tar.TypeReg:
+			err = extractFile(ctx, rt, epth, tr)
+		case tar.TypeSymlink:
+			err = extractSymlink(ctx, rt, epth, hdr.Linkname)
+		default:
+			log.Debugf("skipping %s of unsupported tar type %q", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// extractParent returns the parent directory of 'pth' (created if
+// needed), with the entry at 'pth' removed.
+func extractParent(ctx context.Context, rt *Root, pth string) (*Directory, error) {
+	dirp, name := gopath.Split(pth)
+	if err := CtxMkdir(ctx, rt, dirp, MkdirOpts{Mkparents: true}); err != nil {
+		return nil, err
+	}
+	pdir, err := ctxLookupDir(ctx, rt, dirp)
+	if err != nil {
+		return nil, err
+	}
+	if err := pdir.CtxUnlink(ctx, name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return pdir, nil
+}
+
+func extractFile(ctx context.Context, rt *Root, pth string, r io.Reader) error {
+	pdir, err := extractParent(ctx, rt, pth)
+	if err != nil {
+		return err
+	}
+	splitter, err := splitterGen(rt.chunker)
+	if err != nil {
+		return err
+	}
+	nd, err := importer.BuildDagFromReader(pdir.dagService, splitter(r))
+	if err != nil {
+		return err
+	}
+	return CtxPutNode(ctx, rt, pth, nd)
+}
+
+func extractSymlink(ctx context.Context, rt *Root, pth, target string) error {
+	if _, err := extractParent(ctx, rt, pth); err != nil {
+		return err
+	}
+	return Symlink(rt, target, pth)
+}
@@ -0,0 +1,229 @@
+package mfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	gopath "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// DefaultTombstoneDir is the path of the directory the removal records of
+// a `Root` created `WithTombstones` are kept in.
+const DefaultTombstoneDir = "/.tombstones"
+
+// ErrNoTombstones is returned by the tombstone operations on a root
+// created without `WithTombstones`.
+var ErrNoTombstones = errors.New("tombstones not enabled")
+
+// Tombstone records the removal of an entry, so merging trees of different
+// devices can tell an entry deleted on one side from one that never
+// existed there.
+type Tombstone struct {
+	Path string
+	Cid  cid.Cid // of the removed entry
+	Time time.Time
+}
+
+// tombstones queues the removals made under directory locks, to be
+// recorded in the tombstone directory on next flush.
+type tombstones struct {
+	lock    sync.Mutex
+	pending []Tombstone
+}
+
+// tombstonesOf returns the tombstones of the root of 'p' (nil if disabled
+// or detached from a root).
+func tombstonesOf(p parent) *tombstones {
+	if r := rootOf(p); r != nil {
+		return r.tombstones
+	}
+	return nil
+}
+
+// recordRemoval queues the tombstone of the entry 'name' being removed,
+// it must be called with the directory's lock taken. The removals in the
+// tombstone and staging directories aren't recorded.
+func (d *Directory) recordRemoval(ctx context.Context, name string) {
+	ts := tombstonesOf(d.parent)
+	if ts == nil {
+		return
+	}
+	pth := gopath.Join(d.Path(), name)
+	if inDir(pth, DefaultTombstoneDir) || inDir(pth, rootOf(d.parent).stagingPath) {
+		return
+	}
+
+	var nd ipld.Node
+	var err error
+	if entry, ok := d.entriesCache[name]; ok {
+		nd, err = entry.GetNode()
+	} else {
+		nd, err = d.childFromDag(ctx, name)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return // nothing is removed
+	}
+	if err != nil {
+		log.Errorf("failed to record the removal of %s: %s", pth, err)
+		return
+	}
+	c := nd.Cid()
+
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.pending = append(ts.pending, Tombstone{Path: pth, Cid: c, Time: time.Now()})
+}
+
+// inDir tells whether 'pth' is 'dir' or below it.
+func inDir(pth, dir string) bool {
+	return pth == dir || strings.HasPrefix(pth, dir+"/")
+}
+
+// writeTombstones records the queued removals in the tombstone directory,
+// replacing older records of the same paths.
+func (kr *Root) writeTombstones(ctx context.Context) error {
+	ts := kr.tombstones
+	if ts == nil {
+		return nil
+	}
+	ts.lock.Lock()
+	pending := ts.pending
+	ts.pending = nil
+	ts.lock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	dir, err := kr.tombstoneDir(ctx)
+	if err != nil {
+		return err
+	}
+	for _, t := range pending {
+		data, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		name := tombstoneName(t.Path)
+		if err := dir.CtxUnlink(ctx, name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		nd := dag.NodeWithData(ft.FilePBData(data, uint64(len(data))))
+		nd.SetCidBuilder(dir.newCidBuilder())
+		if err := dir.CtxAddChild(ctx, name, nd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kr *Root) tombstoneDir(ctx context.Context) (*Directory, error) {
+	err := CtxMkdir(ctx, kr, DefaultTombstoneDir, MkdirOpts{Mkparents: true})
+	if err != nil {
+		return nil, err
+	}
+	return ctxLookupDir(ctx, kr, DefaultTombstoneDir)
+}
+
+// tombstoneName is the name of the record of the removal of 'pth'.
+func tombstoneName(pth string) string {
+	sum := sha256.Sum256([]byte(pth))
+	return hex.EncodeToString(sum[:])
+}
+
+// Tombstones returns the removals recorded in the tree (the queued ones
+// are written first), sorted by path.
+func Tombstones(ctx context.Context, r *Root) ([]Tombstone, error) {
+	var out []Tombstone
+	err := forEachTombstone(ctx, r, func(_ string, t Tombstone) error {
+		out = append(out, t)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Path < out[j].Path
+	})
+	return out, nil
+}
+
+// PruneTombstones removes the records of the removals made before
+// 'before', returning how many were removed.
+func PruneTombstones(ctx context.Context, r *Root, before time.Time) (int, error) {
+	var old []string
+	err := forEachTombstone(ctx, r, func(name string, t Tombstone) error {
+		if t.Time.Before(before) {
+			old = append(old, name)
+		}
+		return nil
+	})
+	if err != nil || len(old) == 0 {
+		return 0, err
+	}
+
+	dir, err := ctxLookupDir(ctx, r, DefaultTombstoneDir)
+	if err != nil {
+		return 0, err
+	}
+	if err := dir.UnlinkMany(ctx, old); err != nil {
+		return 0, err
+	}
+	return len(old), nil
+}
+
+// forEachTombstone calls 'f' with the name and contents of each record.
+func forEachTombstone(ctx context.Context, r *Root, f func(string, Tombstone) error) error {
+	if r.tombstones == nil {
+		return ErrNoTombstones
+	}
+	if err := r.writeTombstones(ctx); err != nil {
+		return err
+	}
+
+	dir, err := ctxLookupDir(ctx, r, DefaultTombstoneDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	names, err := dir.ListNames(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		nd, err := dir.entryNode(ctx, name)
+		if err != nil {
+			return err
+		}
+		pbnd, ok := nd.(*dag.ProtoNode)
+		if !ok {
+			return dag.ErrNotProtobuf
+		}
+		fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+		if err != nil {
+			return err
+		}
+		var t Tombstone
+		if err := json.Unmarshal(fsn.Data(), &t); err != nil {
+			return err
+		}
+		if err := f(name, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
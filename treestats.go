@@ -0,0 +1,147 @@
+package mfs
+
+import (
+	"context"
+	gopath "path"
+	"sort"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// TreeStats characterizes the shape of the tree, see `Root.TreeStats`.
+type TreeStats struct {
+	Files       int // symlinks included
+	Directories int // the root excluded
+	// MaxDepth is the depth of the deepest entry, the entries of the root
+	// being at depth 1 (0 for an empty tree).
+	MaxDepth int
+
+	// Directory with the most entries and its number of entries (the
+	// root if there are no other directories).
+	LargestDir        string
+	LargestDirEntries int
+
+	// Largest file and its size (empty if there are no files).
+	LargestFile     string
+	LargestFileSize int64
+
+	// Ties between directories (or files) go to the first one of a
+	// depth-first walk of the tree visiting the entries in name order:
+	// a directory wins over its subdirectories.
+}
+
+// treeStatsCache keeps the statistics of the directory nodes by CID, with
+// their paths relative to the directory. As nodes are immutable only the
+// directories changed since the last call need to be walked again.
+type treeStatsCache struct {
+	lock  sync.Mutex
+	stats map[cid.Cid]TreeStats
+}
+
+// TreeStats walks the tree (flushing it first) to compute its statistics.
+// The statistics of the directories are cached by node, so walking an
+// unchanged subtree again is free.
+func (kr *Root) TreeStats(ctx context.Context) (TreeStats, error) {
+	nd, err := kr.GetDirectory().GetNode()
+	if err != nil {
+		return TreeStats{}, err
+	}
+
+	kr.treeStats.lock.Lock()
+	defer kr.treeStats.lock.Unlock()
+
+	w := &treeStatsWalk{
+		dserv: kr.GetDirectory().dagService,
+		old:   kr.treeStats.stats,
+		new:   make(map[cid.Cid]TreeStats),
+	}
+	stats, err := w.dirStats(ctx, nd)
+	if err != nil {
+		return TreeStats{}, err
+	}
+	// Only the directories of the current tree are kept.
+	kr.treeStats.stats = w.new
+
+	stats.LargestDir = "/" + stats.LargestDir
+	if stats.LargestFile != "" {
+		stats.LargestFile = "/" + stats.LargestFile
+	}
+	return stats, nil
+}
+
+type treeStatsWalk struct {
+	dserv    ipld.DAGService
+	old, new map[cid.Cid]TreeStats
+}
+
+// dirStats returns the statistics of the directory 'nd', with the paths
+// relative to it.
+func (w *treeStatsWalk) dirStats(ctx context.Context, nd ipld.Node) (TreeStats, error) {
+	if stats, ok := w.new[nd.Cid()]; ok {
+		return stats, nil
+	}
+	if stats, ok := w.old[nd.Cid()]; ok {
+		w.new[nd.Cid()] = stats
+		return stats, nil
+	}
+
+	links, err := entryLinks(ctx, w.dserv, nd.Cid())
+	if err != nil {
+		return TreeStats{}, err
+	}
+	names := make([]string, 0, len(links))
+	for name := range links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	stats := TreeStats{LargestDirEntries: len(links)}
+	if len(links) > 0 {
+		stats.MaxDepth = 1
+	}
+	for _, name := range names {
+		child, err := w.dserv.Get(ctx, links[name])
+		if err != nil {
+			return TreeStats{}, err
+		}
+		nt, err := nodeType(child)
+		if err != nil {
+			return TreeStats{}, err
+		}
+
+		if nt == TFile {
+			size, err := nodeSize(ctx, w.dserv, child)
+			if err != nil {
+				return TreeStats{}, err
+			}
+			stats.Files++
+			if stats.LargestFile == "" || size > stats.LargestFileSize {
+				stats.LargestFile, stats.LargestFileSize = name, size
+			}
+			continue
+		}
+
+		sub, err := w.dirStats(ctx, child)
+		if err != nil {
+			return TreeStats{}, err
+		}
+		stats.Files += sub.Files
+		stats.Directories += sub.Directories + 1
+		if sub.MaxDepth+1 > stats.MaxDepth {
+			stats.MaxDepth = sub.MaxDepth + 1
+		}
+		if sub.LargestDirEntries > stats.LargestDirEntries {
+			stats.LargestDir = gopath.Join(name, sub.LargestDir)
+			stats.LargestDirEntries = sub.LargestDirEntries
+		}
+		if sub.LargestFile != "" && (stats.LargestFile == "" || sub.LargestFileSize > stats.LargestFileSize) {
+			stats.LargestFile = gopath.Join(name, sub.LargestFile)
+			stats.LargestFileSize = sub.LargestFileSize
+		}
+	}
+
+	w.new[nd.Cid()] = stats
+	return stats, nil
+}
@@ -0,0 +1,81 @@
+package mfs
+
+import (
+	"fmt"
+	"io/fs"
+
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+	pb "github.com/ipfs/go-unixfs/pb"
+
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// Mapping between the MFS `NodeType`s, the UnixFS data types and the
+// type bits of `fs.FileMode`, for the adapters exposing the MFS through
+// other filesystem interfaces (FUSE, WebDAV, `io/fs`).
+
+// UnixFSNodeType returns the `NodeType` of the MFS entries of the given
+// UnixFS type. Symlinks are exposed as files.
+func UnixFSNodeType(t pb.Data_DataType) (NodeType, error) {
+	switch t {
+	case ft.TDirectory, ft.THAMTShard:
+		return TDir, nil
+	case ft.TFile, ft.TRaw, ft.TSymlink:
+		return TFile, nil
+	case ft.TMetadata:
+		return 0, ErrNotYetImplemented
+	default:
+		return 0, ErrInvalidChild
+	}
+}
+
+// nodeType returns the `NodeType` of the MFS entries pointing to 'nd'.
+func nodeType(nd ipld.Node) (NodeType, error) {
+	switch nd := nd.(type) {
+	case *dag.ProtoNode:
+		fsn, err := ft.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return 0, err
+		}
+		return UnixFSNodeType(fsn.Type())
+	case *dag.RawNode:
+		return TFile, nil
+	default:
+		return 0, ErrInvalidChild
+	}
+}
+
+// UnixFSFileMode returns the type bits of `fs.FileMode` matching the
+// given UnixFS type (0 for regular files).
+func UnixFSFileMode(t pb.Data_DataType) (fs.FileMode, error) {
+	if t == ft.TSymlink {
+		return fs.ModeSymlink, nil
+	}
+	nt, err := UnixFSNodeType(t)
+	if err != nil {
+		return 0, err
+	}
+	return nt.FileMode(), nil
+}
+
+// FileMode returns the type bits of `fs.FileMode` for the node type.
+func (t NodeType) FileMode() fs.FileMode {
+	if t == TDir {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+// NodeTypeFromFileMode returns the `NodeType` of the given mode, which
+// must be a directory or a regular file (symlinks are accepted as files).
+func NodeTypeFromFileMode(m fs.FileMode) (NodeType, error) {
+	switch {
+	case m.IsDir():
+		return TDir, nil
+	case m.IsRegular(), m.Type() == fs.ModeSymlink:
+		return TFile, nil
+	default:
+		return 0, fmt.Errorf("unsupported file mode type: %s", m.Type())
+	}
+}
@@ -0,0 +1,151 @@
+package mfs
+
+import (
+	"context"
+	"fmt"
+	gopath "path"
+	"strings"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// pathRules matches the paths of the tree against patterns in the syntax
+// of `path.Match`, applied segment by segment, where a `**` segment
+// matches any number of segments (including none): `/.cache/**` matches
+// `/.cache` and everything below it.
+type pathRules [][]string
+
+func newPathRules(patterns []string) (pathRules, error) {
+	rules := make(pathRules, 0, len(patterns))
+	for _, p := range patterns {
+		segs := splitPattern(p)
+		for _, seg := range segs {
+			if _, err := gopath.Match(seg, ""); err != nil {
+				return nil, fmt.Errorf("invalid path pattern %q: %w", p, err)
+			}
+		}
+		rules = append(rules, segs)
+	}
+	return rules, nil
+}
+
+func splitPattern(pth string) []string {
+	pth = strings.Trim(gopath.Clean("/"+pth), "/")
+	if pth == "" {
+		return nil
+	}
+	return strings.Split(pth, "/")
+}
+
+// match reports whether 'pth' or one of its ancestors matches a rule.
+func (pr pathRules) match(pth string) bool {
+	segs := splitPattern(pth)
+	for _, rule := range pr {
+		for i := 0; i <= len(segs); i++ {
+			if matchSegments(rule, segs[:i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchSegments(rule, segs []string) bool {
+	if len(rule) == 0 {
+		return len(segs) == 0
+	}
+	if rule[0] == "**" {
+		for i := 0; i <= len(segs); i++ {
+			if matchSegments(rule[1:], segs[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segs) == 0 {
+		return false
+	}
+	if ok, _ := gopath.Match(rule[0], segs[0]); !ok {
+		return false
+	}
+	return matchSegments(rule[1:], segs[1:])
+}
+
+// publishedChange reports whether the tree 'nc' differs from the tree
+// 'oc' outside of the unpublished paths. Only the subtrees that changed
+// are visited.
+func (pr pathRules) publishedChange(ctx context.Context, dserv ipld.DAGService, oc, nc cid.Cid, pth string) (bool, error) {
+	if oc.Equals(nc) || pr.match(pth) {
+		return false, nil
+	}
+
+	oldType, err := linkType(ctx, dserv, oc)
+	if err != nil {
+		return false, err
+	}
+	newType, err := linkType(ctx, dserv, nc)
+	if err != nil {
+		return false, err
+	}
+	if oldType != TDir || newType != TDir {
+		return true, nil
+	}
+
+	oldLinks, err := entryLinks(ctx, dserv, oc)
+	if err != nil {
+		return false, err
+	}
+	newLinks, err := entryLinks(ctx, dserv, nc)
+	if err != nil {
+		return false, err
+	}
+	// Entries changed in unpublished paths only.
+	var hidden bool
+	for name := range oldLinks {
+		if _, ok := newLinks[name]; !ok {
+			if !pr.match(gopath.Join(pth, name)) {
+				return true, nil
+			}
+			hidden = true
+		}
+	}
+	for name, nlc := range newLinks {
+		epth := gopath.Join(pth, name)
+		olc, ok := oldLinks[name]
+		if !ok {
+			if !pr.match(epth) {
+				return true, nil
+			}
+			hidden = true
+			continue
+		}
+		if olc.Equals(nlc) {
+			continue
+		}
+		changed, err := pr.publishedChange(ctx, dserv, olc, nlc, epth)
+		if err != nil || changed {
+			return changed, err
+		}
+		hidden = true
+	}
+	// Same entries in a different node (e.g., resharded).
+	return !hidden, nil
+}
+
+// publishGate returns the gate suppressing the publishes of the roots
+// only changed in the unpublished paths, followed by 'next' (if any).
+// The roots that can't be compared are published.
+func (pr pathRules) publishGate(ctx context.Context, dserv ipld.DAGService, next func(old, new cid.Cid) bool) func(old, new cid.Cid) bool {
+	return func(old, new cid.Cid) bool {
+		if old.Defined() {
+			changed, err := pr.publishedChange(ctx, dserv, old, new, "/")
+			if err != nil {
+				log.Errorf("failed to compare %s to the published root: %s", new, err)
+			} else if !changed {
+				return false
+			}
+		}
+		return next == nil || next(old, new)
+	}
+}
@@ -0,0 +1,99 @@
+package mfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+	pb "github.com/ipfs/go-unixfs/pb"
+
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// UnsupportedPolicy decides how a `Root` handles the entries of UnixFS
+// types it doesn't support (metadata nodes, or types unknown to
+// go-unixfs) found in its tree or in the DAGs grafted into it, see
+// `WithUnsupportedPolicy`.
+type UnsupportedPolicy int
+
+const (
+	// UnsupportedReject fails the operations on them (looking them up,
+	// listing their directory, copying and exporting them) with
+	// `ErrUnsupportedType`, as well as the validation of the grafted DAGs
+	// containing them (see `WithGraftValidation`).
+	UnsupportedReject UnsupportedPolicy = iota
+	// UnsupportedOpaque passes them through as opaque files: listed
+	// without a size, looked up as `File`s that can't be opened, copied
+	// and exported to CAR files as is. Tar archives, which can't
+	// represent them, skip them.
+	UnsupportedOpaque
+	// UnsupportedStrip treats them as absent: they aren't listed, looking
+	// them up fails with `os.ErrNotExist` and tar archives skip them. They
+	// stay linked in their directory (and so in its copies) until
+	// replaced or removed, which is why exporting them to CAR files fails
+	// with `ErrUnsupportedType` as with `UnsupportedReject`.
+	UnsupportedStrip
+)
+
+// ErrUnsupportedType is returned (wrapped) for the entries of unsupported
+// UnixFS types with `UnsupportedReject`.
+var ErrUnsupportedType = errors.New("unsupported UnixFS type")
+
+// unsupportedTypeError is the error of a node of the unsupported type
+// 't'. It also matches the error `UnixFSNodeType` returns for the type.
+type unsupportedTypeError struct {
+	t   pb.Data_DataType
+	err error
+}
+
+func (e *unsupportedTypeError) Error() string {
+	return fmt.Sprintf("%s %s", ErrUnsupportedType, e.t)
+}
+
+func (e *unsupportedTypeError) Is(target error) bool {
+	return target == ErrUnsupportedType || target == e.err
+}
+
+// checkSupported returns an `*unsupportedTypeError` if 'nd' is a UnixFS
+// node of an unsupported type. Malformed nodes are left to the callers.
+func checkSupported(nd ipld.Node) error {
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return nil
+	}
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	if err != nil {
+		return nil
+	}
+	if _, err := UnixFSNodeType(fsn.Type()); err != nil {
+		return &unsupportedTypeError{t: fsn.Type(), err: err}
+	}
+	return nil
+}
+
+// unsupportedPolicy returns the policy of the root of 'p'.
+func unsupportedPolicy(p parent) UnsupportedPolicy {
+	if r := rootOf(p); r != nil {
+		return r.unsupported
+	}
+	return UnsupportedReject
+}
+
+// policyListing is `nodeListing` applying the policy to the unsupported
+// nodes, it reports whether the entry is listed at all.
+func policyListing(ctx context.Context, dserv ipld.DAGService, name string, nd ipld.Node, policy UnsupportedPolicy) (NodeListing, bool, error) {
+	if err := checkSupported(nd); err != nil {
+		switch policy {
+		case UnsupportedOpaque:
+			return NodeListing{Name: name, Type: int(TFile), Hash: nd.Cid().String()}, true, nil
+		case UnsupportedStrip:
+			return NodeListing{}, false, nil
+		default:
+			return NodeListing{}, false, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	nl, err := nodeListing(ctx, dserv, name, nd)
+	return nl, err == nil, err
+}
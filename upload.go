@@ -0,0 +1,307 @@
+package mfs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	gopath "path"
+	"strings"
+	"sync"
+
+	mod "github.com/ipfs/go-unixfs/mod"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// ErrNoUpload is returned when referring to an unknown upload session.
+var ErrNoUpload = errors.New("no such upload session")
+
+// SessionID identifies an upload session of a `Root`.
+type SessionID string
+
+// uploadPrefix prefixes the names of the partial uploads in the staging
+// directory, followed by their `SessionID`.
+const uploadPrefix = "upload-"
+
+// upload is the state of a write session: the partial file DAG is
+// stored in the DAG service after every chunk (linked in the staging
+// directory so it's kept meanwhile), and only linked into its directory
+// on commit.
+type upload struct {
+	lock sync.Mutex
+
+	path      string
+	staged    string
+	node      ipld.Node
+	size      int64
+	rawLeaves bool
+}
+
+// StartUpload begins a write session of a new file to be placed at 'pth'
+// on `CommitUpload`. Large uploads can be sent in chunks with `AppendChunk`
+// and resumed after interruptions, see `UploadState` and `ResumeUpload`.
+// The sessions are only kept in memory: resuming after a restart relies
+// on the caller keeping the CID of the partial DAG reported by
+// `UploadState`.
+func StartUpload(r *Root, pth string) (_ SessionID, err error) {
+	defer r.recoverPanic(&err)
+
+	pdir, _, err := lookupParent(r, pth)
+	if err != nil {
+		return "", err
+	}
+
+	nd := NewEmptyFileNode(EmptyFileOpts{CidBuilder: pdir.newCidBuilder()})
+
+	return r.addUpload(gopath.Clean("/"+pth), nd, 0)
+}
+
+// ResumeUpload restores a write session of the file at 'pth' from the
+// CID of its partial DAG (as reported by `UploadState`), for example
+// after the process was restarted. The partial DAG staged by the
+// sessions gone with the restart is taken over by the new one.
+func ResumeUpload(ctx context.Context, r *Root, pth string, partial cid.Cid) (_ SessionID, err error) {
+	defer r.recoverPanic(&err)
+
+	pdir, _, err := lookupParent(r, pth)
+	if err != nil {
+		return "", err
+	}
+
+	nd, err := pdir.dagService.Get(ctx, partial)
+	if err != nil {
+		return "", err
+	}
+	size, err := nodeSize(ctx, pdir.dagService, nd)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := r.addUpload(gopath.Clean("/"+pth), nd, size)
+	if err != nil {
+		return "", err
+	}
+	if err := r.dropStaleUploads(ctx, partial); err != nil {
+		log.Errorf("failed to remove the stale staged uploads of %s: %s", partial, err)
+	}
+	return id, nil
+}
+
+// dropStaleUploads removes the partial uploads of 'c' staged by sessions
+// that no longer exist.
+func (kr *Root) dropStaleUploads(ctx context.Context, c cid.Cid) error {
+	staging, err := kr.StagingDir()
+	if err != nil {
+		return err
+	}
+	names, err := staging.ListNames(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, uploadPrefix) {
+			continue
+		}
+		if _, err := kr.getUpload(SessionID(strings.TrimPrefix(name, uploadPrefix))); err == nil {
+			continue
+		}
+		nd, err := staging.entryNode(ctx, name)
+		if err != nil {
+			return err
+		}
+		if !nd.Cid().Equals(c) {
+			continue
+		}
+		if err := staging.Unlink(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// AppendChunk adds the chunk at the end of the uploaded file, storing
+// the new partial DAG. The bytes already uploaded aren't rewritten.
+func AppendChunk(ctx context.Context, r *Root, id SessionID, chunk []byte) (err error) {
+	defer r.recoverPanic(&err)
+
+	up, err := r.getUpload(id)
+	if err != nil {
+		return err
+	}
+	dserv := r.GetDirectory().dagService
+
+	up.lock.Lock()
+	defer up.lock.Unlock()
+
+	if err := checkSize(up.path, up.size+int64(len(chunk)), r.limits.maxFileSize); err != nil {
+		return err
+	}
+
+	splitter, err := splitterGen(r.chunker)
+	if err != nil {
+		return err
+	}
+	dmod, err := mod.NewDagModifier(ctx, up.node, dserv, splitter)
+	if err != nil {
+		return err
+	}
+	dmod.RawLeaves = up.rawLeaves
+
+	if _, err := dmod.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err := dmod.Write(chunk); err != nil {
+		return err
+	}
+
+	nd, err := dmod.GetNode()
+	if err != nil {
+		return err
+	}
+	if err := dserv.Add(ctx, nd); err != nil {
+		return err
+	}
+
+	staging, err := r.StagingDir()
+	if err != nil {
+		return err
+	}
+	if err := staging.setFile(up.staged, nd); err != nil {
+		return err
+	}
+
+	up.node = nd
+	up.size += int64(len(chunk))
+	return nil
+}
+
+// UploadState returns the CID of the partial DAG of the upload and the
+// number of bytes it holds (where to resume sending data from).
+func UploadState(r *Root, id SessionID) (cid.Cid, int64, error) {
+	up, err := r.getUpload(id)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	return up.node.Cid(), up.size, nil
+}
+
+// CommitUpload links the uploaded file at its path (replacing any file
+// there) and then ends the session: if linking fails the session and its
+// staged DAG are kept, so the commit can be retried.
+func CommitUpload(r *Root, id SessionID) (err error) {
+	defer r.recoverPanic(&err)
+
+	up, err := r.getUpload(id)
+	if err != nil {
+		return err
+	}
+
+	up.lock.Lock()
+	defer up.lock.Unlock()
+
+	pdir, name, err := lookupParent(r, up.path)
+	if err != nil {
+		return err
+	}
+
+	fsn, err := pdir.Child(name)
+	switch {
+	case err == nil:
+		if _, ok := fsn.(*File); !ok {
+			return fmt.Errorf("%s is not a file: %w", up.path, ErrIsDirectory)
+		}
+	case err != os.ErrNotExist:
+		return err
+	}
+	// Resumed from a DAG of any size.
+	if err := pdir.checkNodeSize(context.TODO(), name, up.node); err != nil {
+		return err
+	}
+
+	// Replaced in a single update, counted against the entries limit
+	// only if new.
+	if err := pdir.setFile(name, up.node); err != nil {
+		return err
+	}
+
+	return r.removeUpload(id, up)
+}
+
+// AbortUpload ends the session without linking the file.
+func AbortUpload(r *Root, id SessionID) error {
+	up, err := r.getUpload(id)
+	if err != nil {
+		return err
+	}
+
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	return r.removeUpload(id, up)
+}
+
+func (kr *Root) addUpload(pth string, nd ipld.Node, size int64) (SessionID, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := SessionID(hex.EncodeToString(buf))
+	staged := uploadPrefix + string(id)
+
+	staging, err := kr.StagingDir()
+	if err != nil {
+		return "", err
+	}
+	if err := staging.setFile(staged, nd); err != nil {
+		return "", err
+	}
+
+	kr.uploadsLock.Lock()
+	defer kr.uploadsLock.Unlock()
+	if kr.uploads == nil {
+		kr.uploads = make(map[SessionID]*upload)
+	}
+	kr.uploads[id] = &upload{
+		path:      pth,
+		staged:    staged,
+		node:      nd,
+		size:      size,
+		rawLeaves: nd.Cid().Prefix().Version > 0,
+	}
+	return id, nil
+}
+
+func (kr *Root) getUpload(id SessionID) (*upload, error) {
+	kr.uploadsLock.Lock()
+	defer kr.uploadsLock.Unlock()
+	up, ok := kr.uploads[id]
+	if !ok {
+		return nil, ErrNoUpload
+	}
+	return up, nil
+}
+
+// removeUpload ends the session once its staged entry is removed (it's
+// kept, to be retried, otherwise). It must be called with its lock taken.
+func (kr *Root) removeUpload(id SessionID, up *upload) error {
+	staging, err := kr.StagingDir()
+	if err != nil {
+		return err
+	}
+	err = staging.Unlink(up.staged)
+	if err != nil && err != os.ErrNotExist {
+		return err
+	}
+
+	kr.uploadsLock.Lock()
+	delete(kr.uploads, id)
+	kr.uploadsLock.Unlock()
+	return nil
+}
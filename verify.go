@@ -0,0 +1,92 @@
+package mfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// ErrVerifyFailed is returned (wrapped) when a node read back right after
+// being added to the DAG service doesn't match what was written.
+var ErrVerifyFailed = errors.New("write verification failed")
+
+// VerifyStats are the aggregate results of the write verification, see
+// `WithWriteVerification`.
+type VerifyStats struct {
+	Verified uint64 // nodes read back successfully
+	Failed   uint64 // nodes missing or corrupted when read back
+}
+
+// verifyingDAG is a DAG service reading back every node added to the
+// underlying one to check it was stored correctly.
+type verifyingDAG struct {
+	ipld.DAGService
+
+	// Accessed atomically.
+	verified uint64
+	failed   uint64
+}
+
+var _ ipld.DAGService = (*verifyingDAG)(nil)
+
+func newVerifyingDAG(base ipld.DAGService) *verifyingDAG {
+	return &verifyingDAG{DAGService: base}
+}
+
+func (v *verifyingDAG) Add(ctx context.Context, nd ipld.Node) error {
+	if err := v.DAGService.Add(ctx, nd); err != nil {
+		return err
+	}
+	return v.verify(ctx, nd)
+}
+
+func (v *verifyingDAG) AddMany(ctx context.Context, nds []ipld.Node) error {
+	if err := v.DAGService.AddMany(ctx, nds); err != nil {
+		return err
+	}
+	for _, nd := range nds {
+		if err := v.verify(ctx, nd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify re-fetches the node and compares it with the one written.
+func (v *verifyingDAG) verify(ctx context.Context, nd ipld.Node) error {
+	stored, err := v.DAGService.Get(ctx, nd.Cid())
+	if err == nil && !bytes.Equal(stored.RawData(), nd.RawData()) {
+		err = fmt.Errorf("stored data differs")
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		atomic.AddUint64(&v.failed, 1)
+		log.Errorf("write verification of %s failed: %s", nd.Cid(), err)
+		return fmt.Errorf("%w for %s: %s", ErrVerifyFailed, nd.Cid(), err)
+	}
+
+	atomic.AddUint64(&v.verified, 1)
+	return nil
+}
+
+func (v *verifyingDAG) stats() VerifyStats {
+	return VerifyStats{
+		Verified: atomic.LoadUint64(&v.verified),
+		Failed:   atomic.LoadUint64(&v.failed),
+	}
+}
+
+// VerifyStats returns the aggregate results of the write verification
+// (zero if it isn't enabled).
+func (kr *Root) VerifyStats() VerifyStats {
+	if kr.verifier == nil {
+		return VerifyStats{}
+	}
+	return kr.verifier.stats()
+}
@@ -0,0 +1,233 @@
+package mfs
+
+import (
+	"context"
+	gopath "path"
+	"strings"
+	"sync"
+)
+
+// DefaultWatchBufferSize is the number of events buffered by a `Watcher`
+// when `WatchOpts.BufferSize` isn't set.
+const DefaultWatchBufferSize = 64
+
+// OverflowPolicy decides what happens when an event is emitted and
+// a `Watcher`'s buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDropOldest discards the oldest buffered events, the consumer
+	// receives an `Overflow` event before the ones that were kept.
+	OverflowDropOldest OverflowPolicy = iota
+	// OverflowBlock blocks the mutation emitting the event until the
+	// consumer catches up. The consumer must not mutate the MFS while
+	// handling events or it will deadlock.
+	OverflowBlock
+)
+
+// WatchOpts is used by Watch
+type WatchOpts struct {
+	// Path restricts the events to the ones of the entry at the path
+	// and its descendants, the whole tree by default.
+	Path string
+
+	BufferSize int
+	Overflow   OverflowPolicy
+}
+
+// Watcher delivers the events of the MFS mutations to a consumer.
+type Watcher struct {
+	set  *watchers
+	opts WatchOpts
+
+	out  chan Event
+	done chan struct{}
+
+	lock       sync.Mutex
+	cond       *sync.Cond
+	queue      []Event
+	overflowed bool
+	closed     bool
+}
+
+// Watch registers a new `Watcher` for the mutations of the tree. The
+// watchers of a closed root are closed.
+func (kr *Root) Watch(opts WatchOpts) *Watcher {
+	return kr.watchers.watch(opts, kr.life)
+}
+
+// watchers is a set of registered `Watcher`s.
+type watchers struct {
+	lock sync.Mutex
+	set  map[*Watcher]struct{}
+}
+
+// watch registers a new `Watcher` delivering its events in a goroutine
+// of 'life' (which may be nil).
+func (ws *watchers) watch(opts WatchOpts, life *lifecycle) *Watcher {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DefaultWatchBufferSize
+	}
+	opts.Path = gopath.Clean("/" + opts.Path)
+
+	w := &Watcher{
+		set:  ws,
+		opts: opts,
+		out:  make(chan Event),
+		done: make(chan struct{}),
+	}
+	w.cond = sync.NewCond(&w.lock)
+
+	ws.lock.Lock()
+	if ws.set == nil {
+		ws.set = make(map[*Watcher]struct{})
+	}
+	ws.set[w] = struct{}{}
+	ws.lock.Unlock()
+
+	started := life.Go("watcher", func(ctx context.Context) error {
+		// Closed along with the lifecycle.
+		go func() {
+			select {
+			case <-ctx.Done():
+				w.Close()
+			case <-w.done:
+			}
+		}()
+		w.run()
+		return nil
+	})
+	if !started {
+		w.Close()
+		close(w.out)
+	}
+	return w
+}
+
+// Events returns the channel the events are delivered on, it's closed
+// when the `Watcher` is.
+func (w *Watcher) Events() <-chan Event {
+	return w.out
+}
+
+// Close unregisters the `Watcher`, discarding the undelivered events.
+func (w *Watcher) Close() error {
+	w.set.lock.Lock()
+	delete(w.set.set, w)
+	w.set.lock.Unlock()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	w.closed = true
+	close(w.done)
+	w.cond.Broadcast()
+	return nil
+}
+
+// matches reports whether the event concerns the watched path.
+func (w *Watcher) matches(e Event) bool {
+	p := w.opts.Path
+	return p == "/" || e.Name == p || strings.HasPrefix(e.Name, p+"/")
+}
+
+// push queues the event applying the overflow policy if full.
+func (w *Watcher) push(e Event) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for len(w.queue) >= w.opts.BufferSize && !w.closed {
+		if w.opts.Overflow == OverflowBlock {
+			w.cond.Wait()
+			continue
+		}
+		w.queue = w.queue[1:]
+		w.overflowed = true
+	}
+	if w.closed {
+		return
+	}
+
+	w.queue = append(w.queue, e)
+	w.cond.Broadcast()
+}
+
+// run delivers the queued events until the `Watcher` is closed.
+func (w *Watcher) run() {
+	defer close(w.out)
+	for {
+		w.lock.Lock()
+		for len(w.queue) == 0 && !w.overflowed && !w.closed {
+			w.cond.Wait()
+		}
+		if w.closed {
+			w.lock.Unlock()
+			return
+		}
+
+		var e Event
+		if w.overflowed {
+			e = Event{Op: Overflow}
+			w.overflowed = false
+		} else {
+			e = w.queue[0]
+			w.queue = w.queue[1:]
+			// Wake up emitters blocked on a full queue.
+			w.cond.Broadcast()
+		}
+		w.lock.Unlock()
+
+		select {
+		case w.out <- e:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// watched reports whether there are watchers registered.
+func (kr *Root) watched() bool {
+	return kr.watchers.watched()
+}
+
+// emit delivers the event to all the registered watchers.
+func (kr *Root) emit(e Event) {
+	kr.watchers.emit(e)
+}
+
+// closeWatchers closes all the registered watchers.
+func (kr *Root) closeWatchers() {
+	kr.watchers.closeAll()
+}
+
+func (ws *watchers) watched() bool {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	return len(ws.set) > 0
+}
+
+func (ws *watchers) list() []*Watcher {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	list := make([]*Watcher, 0, len(ws.set))
+	for w := range ws.set {
+		list = append(list, w)
+	}
+	return list
+}
+
+func (ws *watchers) emit(e Event) {
+	for _, w := range ws.list() {
+		if w.matches(e) {
+			w.push(e)
+		}
+	}
+}
+
+func (ws *watchers) closeAll() {
+	for _, w := range ws.list() {
+		w.Close()
+	}
+}